@@ -2,7 +2,9 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,10 +25,13 @@ import (
 	"errors"
 
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/websocket"
+
+	"github.com/kittycash/teller/src/util/btcaddr"
 )
 
 const (
@@ -47,6 +52,9 @@ const (
 	serverIdleTimeout  = time.Second * 120
 )
 
+// btcParams are the chain params of the faked bitcoin network, set with the -network flag
+var btcParams = &chaincfg.MainNetParams
+
 // Deposit records information about a BTC deposit
 type Deposit struct {
 	Address string // deposit address
@@ -62,6 +70,14 @@ type BlockStore struct {
 	BestBlockHeight int32
 	BlockHashes     map[int64]string
 	HashBlocks      map[string]btcjson.GetBlockVerboseResult
+	// Mempool holds the unconfirmed transactions, they are included in the next block
+	Mempool map[string]MempoolTx
+}
+
+// MempoolTx is a transaction in the fake mempool
+type MempoolTx struct {
+	Tx   *btcutil.Tx
+	Time int64 // when the transaction was added to the mempool
 }
 
 var initialBlock = btcjson.GetBlockVerboseResult{
@@ -71,14 +87,19 @@ var initialBlock = btcjson.GetBlockVerboseResult{
 
 var defaultBlockStore *BlockStore
 
+var defaultNotifier *wsNotifier
+
 type commandHandler func(*rpcServer, interface{}, <-chan struct{}) (interface{}, error)
 
 var rpcHandlers = map[string]commandHandler{
-	"getblock":      handleGetBlock,
-	"getbestblock":  handleGetBestBlock,
-	"getblockhash":  handleGetBlockHash,
-	"getblockcount": handleGetBlockCount,
-	"nextdeposit":   handleNextDeposit, // for triggering a fake deposit
+	"getblock":           handleGetBlock,
+	"getbestblock":       handleGetBestBlock,
+	"getblockhash":       handleGetBlockHash,
+	"getblockcount":      handleGetBlockCount,
+	"getrawmempool":      handleGetRawMempool,
+	"getrawtransaction":  handleGetRawTransaction,
+	"nextdeposit":        handleNextDeposit,        // for triggering a fake deposit
+	"nextmempooldeposit": handleNextMempoolDeposit, // for triggering a fake unconfirmed deposit
 }
 
 type rpcServer struct {
@@ -129,13 +150,30 @@ func genCertPair(certFile, keyFile string) error {
 	return nil
 }
 
-func createNewBlock(previousHash string, previousHeight int64, deposits []Deposit) (*btcutil.Block, error) {
+func createNewBlock(previousHash string, previousHeight int64, txns []*wire.MsgTx) (*btcutil.Block, error) {
 	newHash, err := chainhash.NewHashFromStr(previousHash)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		return nil, err
 	}
 
+	msgBlock := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			PrevBlock: *newHash,
+			Timestamp: time.Now(),
+		},
+		Transactions: txns,
+	}
+
+	newBlock := btcutil.NewBlock(msgBlock)
+	height := previousHeight + 1
+	newBlock.SetHeight(int32(height))
+
+	return newBlock, nil
+}
+
+// createDepositTx creates a transaction with an output for each deposit
+func createDepositTx(deposits []Deposit) (*wire.MsgTx, error) {
 	txn := wire.NewMsgTx(1)
 
 	var n uint32
@@ -146,38 +184,25 @@ func createNewBlock(previousHash string, previousHeight int64, deposits []Deposi
 
 		satoshi := deposit.Value
 
-		//// Decode the provided address.
-		//addr, err := btcutil.DecodeAddress(deposit.Address, &chaincfg.MainNetParams)
-		//if err != nil {
-		//	fmt.Printf("Invalid address or key: %v, %v\n", deposit.Address, err)
-		//	return nil, err
-		//}
+		// Decode the provided address.
+		addr, err := btcaddr.Decode(deposit.Address, btcParams)
+		if err != nil {
+			fmt.Printf("Invalid address or key: %v, %v\n", deposit.Address, err)
+			return nil, err
+		}
 
 		// Create a new script which pays to the provided address.
-		pkScript := []byte(deposit.Address)
+		pkScript, err := btcaddr.PayToAddrScript(addr)
+		if err != nil {
+			return nil, err
+		}
 
 		txn.AddTxOut(wire.NewTxOut(satoshi, pkScript))
 
 		n = deposit.N + 1
 	}
 
-	txns := []*wire.MsgTx{
-		txn,
-	}
-
-	msgBlock := &wire.MsgBlock{
-		Header: wire.BlockHeader{
-			PrevBlock: *newHash,
-			Timestamp: time.Now(),
-		},
-		Transactions: txns,
-	}
-
-	newBlock := btcutil.NewBlock(msgBlock)
-	height := previousHeight + 1
-	newBlock.SetHeight(int32(height))
-
-	return newBlock, nil
+	return txn, nil
 }
 
 func createNewEmptyBlock(previousHash string, previousHeight int64) (*btcutil.Block, error) {
@@ -200,12 +225,22 @@ func createNewEmptyBlock(previousHash string, previousHeight int64) (*btcutil.Bl
 	return newBlock, nil
 }
 
-func createNewBlockWithTx(previousHash string, previousHeight int64, deposits []Deposit) (*btcutil.Block, error) {
-	if len(deposits) == 0 {
+// createNewBlockWithTx creates a block with the mempool transactions, followed by a transaction paying the deposits
+func createNewBlockWithTx(previousHash string, previousHeight int64, mempoolTxns []*wire.MsgTx, deposits []Deposit) (*btcutil.Block, error) {
+	txns := mempoolTxns
+	if len(deposits) != 0 {
+		txn, err := createDepositTx(deposits)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+
+	if len(txns) == 0 {
 		return createNewEmptyBlock(previousHash, previousHeight)
 	}
 
-	return createNewBlock(previousHash, previousHeight, deposits)
+	return createNewBlock(previousHash, previousHeight, txns)
 }
 
 func handleGetBestBlock(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
@@ -262,42 +297,8 @@ func convertBlockToGetBlockVerboseResult(block *btcutil.Block) *btcjson.GetBlock
 	var txRawResults []btcjson.TxRawResult
 
 	for _, tx := range block.Transactions() {
-		txRawResult := btcjson.TxRawResult{
-			Txid: tx.Hash().String(),
-		}
-
-		var vouts []btcjson.Vout
-		for i, txOut := range tx.MsgTx().TxOut {
-
-			pks := txOut.PkScript
-
-			//_, addrs, _, err := txscript.ExtractPkScriptAddrs(pks, &chaincfg.MainNetParams)
-			//
-			//if err != nil {
-			//	return nil
-			//}
-			//
-			//addresses := make([]string, len(addrs))
-			//for j := 0; j < len(addrs); j++ {
-			//	addresses[j] = addrs[j].String()
-			//}
-			address := string(pks)
-
-			vout := btcjson.Vout{
-				Value: btcutil.Amount(txOut.Value).ToBTC(),
-				N:     uint32(i),
-				ScriptPubKey: btcjson.ScriptPubKeyResult{
-					Addresses: []string{
-						address,
-					},
-				},
-			}
-
-			vouts = append(vouts, vout)
-		}
-
-		txRawResult.Vout = vouts
-
+		txRawResult := convertTxToTxRawResult(tx)
+		txRawResult.BlockHash = result.Hash
 		txRawResults = append(txRawResults, txRawResult)
 	}
 
@@ -310,25 +311,188 @@ func convertBlockToGetBlockVerboseResult(block *btcutil.Block) *btcjson.GetBlock
 	return &result
 }
 
+func convertTxToTxRawResult(tx *btcutil.Tx) btcjson.TxRawResult {
+	txRawResult := btcjson.TxRawResult{
+		Txid: tx.Hash().String(),
+	}
+
+	var vouts []btcjson.Vout
+	for i, txOut := range tx.MsgTx().TxOut {
+
+		pks := txOut.PkScript
+
+		var addresses []string
+		if address, err := btcaddr.ScriptAddress(pks, btcParams); err == nil && address != "" {
+			addresses = []string{address}
+		}
+
+		vout := btcjson.Vout{
+			Value: btcutil.Amount(txOut.Value).ToBTC(),
+			N:     uint32(i),
+			ScriptPubKey: btcjson.ScriptPubKeyResult{
+				Hex:       hex.EncodeToString(pks),
+				Type:      btcaddr.ScriptType(pks),
+				Addresses: addresses,
+			},
+		}
+
+		vouts = append(vouts, vout)
+	}
+
+	txRawResult.Vout = vouts
+
+	return txRawResult
+}
+
 func handleGetBlockCount(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	return int64(defaultBlockStore.BestBlockHeight), nil
 }
 
+func handleGetRawMempool(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetRawMempoolCmd)
+
+	defaultBlockStore.RLock()
+	defer defaultBlockStore.RUnlock()
+
+	if c.Verbose == nil || !*c.Verbose {
+		txids := make([]string, 0, len(defaultBlockStore.Mempool))
+		for txid := range defaultBlockStore.Mempool {
+			txids = append(txids, txid)
+		}
+		return txids, nil
+	}
+
+	result := make(map[string]btcjson.GetRawMempoolVerboseResult, len(defaultBlockStore.Mempool))
+	for txid, mtx := range defaultBlockStore.Mempool {
+		result[txid] = btcjson.GetRawMempoolVerboseResult{
+			Size:    int32(mtx.Tx.MsgTx().SerializeSize()),
+			Time:    mtx.Time,
+			Height:  int64(defaultBlockStore.BestBlockHeight),
+			Depends: []string{},
+		}
+	}
+
+	return result, nil
+}
+
+// handleGetRawTransaction returns a transaction in the mempool or in a block, only verbose results are supported
+func handleGetRawTransaction(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetRawTransactionCmd)
+
+	if c.Verbose == nil || *c.Verbose == 0 {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: "Only verbose results are supported",
+		}
+	}
+
+	defaultBlockStore.RLock()
+	defer defaultBlockStore.RUnlock()
+
+	if mtx, ok := defaultBlockStore.Mempool[c.Txid]; ok {
+		return convertTxToTxRawResult(mtx.Tx), nil
+	}
+
+	for _, block := range defaultBlockStore.HashBlocks {
+		for _, tx := range block.RawTx {
+			if tx.Txid == c.Txid {
+				tx.Confirmations = uint64(int64(defaultBlockStore.BestBlockHeight) - block.Height + 1)
+				return tx, nil
+			}
+		}
+	}
+
+	return nil, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCNoTxInfo,
+		Message: "No information available about transaction",
+	}
+}
+
+// addMempoolDeposits adds a transaction paying the deposits to the mempool
+func addMempoolDeposits(deposits []Deposit) (*btcjson.TxRawResult, error) {
+	if len(deposits) == 0 {
+		return nil, errors.New("No deposits")
+	}
+
+	txn, err := createDepositTx(deposits)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := btcutil.NewTx(txn)
+
+	defaultBlockStore.Lock()
+	defaultBlockStore.Mempool[tx.Hash().String()] = MempoolTx{
+		Tx:   tx,
+		Time: time.Now().Unix(),
+	}
+	defaultBlockStore.Unlock()
+
+	defaultNotifier.NotifyTx(tx, nil)
+
+	txRawResult := convertTxToTxRawResult(tx)
+	return &txRawResult, nil
+}
+
+func handleNextMempoolDeposit(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	var deposits []Deposit
+	if cmd != nil {
+		deposits = cmd.([]Deposit)
+		fmt.Printf("Got %v\n", deposits)
+	}
+
+	tx, err := addMempoolDeposits(deposits)
+	if err != nil {
+		fmt.Printf("addMempoolDeposits %v\n", err)
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: err.Error(),
+		}
+	}
+
+	return tx, nil
+}
+
+// processDeposits creates a new block with the mempool transactions and the deposits, empties the mempool
+// and notifies the websocket clients
 func processDeposits(deposits []Deposit) (*btcjson.GetBlockVerboseResult, error) {
+	block, gbvr, err := addBlock(deposits)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like btcd, the transactions are notified again with the block that includes them
+	defaultNotifier.NotifyBlockConnected(block)
+	for _, tx := range block.Transactions() {
+		defaultNotifier.NotifyTx(tx, block)
+	}
+
+	return gbvr, nil
+}
+
+// addBlock creates a new block with the mempool transactions and the deposits, and empties the mempool
+func addBlock(deposits []Deposit) (*btcutil.Block, *btcjson.GetBlockVerboseResult, error) {
 	defaultBlockStore.Lock()
 	defer defaultBlockStore.Unlock()
 
 	bestHeight := int64(defaultBlockStore.BestBlockHeight)
 	bestHash, ok := defaultBlockStore.BlockHashes[bestHeight]
 	if !ok {
-		return nil, errors.New("Block not found")
+		return nil, nil, errors.New("Block not found")
+	}
+
+	mempoolTxns := make([]*wire.MsgTx, 0, len(defaultBlockStore.Mempool))
+	for _, mtx := range defaultBlockStore.Mempool {
+		mempoolTxns = append(mempoolTxns, mtx.Tx.MsgTx())
 	}
 
-	block, err := createNewBlockWithTx(bestHash, bestHeight, deposits)
+	block, err := createNewBlockWithTx(bestHash, bestHeight, mempoolTxns, deposits)
 	if err != nil {
-		return nil, errors.New("createNewBlockWithTx failed")
+		return nil, nil, fmt.Errorf("createNewBlockWithTx failed: %v", err)
 	}
 
+	defaultBlockStore.Mempool = make(map[string]MempoolTx)
+
 	// Update NextHash of previous block
 	prevBlockHash := defaultBlockStore.BlockHashes[bestHeight]
 	prevBlock := defaultBlockStore.HashBlocks[prevBlockHash]
@@ -341,7 +505,7 @@ func processDeposits(deposits []Deposit) (*btcjson.GetBlockVerboseResult, error)
 	gbvr := convertBlockToGetBlockVerboseResult(block)
 	defaultBlockStore.HashBlocks[block.Hash().String()] = *gbvr
 
-	return gbvr, nil
+	return block, gbvr, nil
 }
 
 func handleNextDeposit(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
@@ -384,6 +548,7 @@ func (s *rpcServer) WebsocketHandler(conn *websocket.Conn, remoteAddr string) {
 	}
 	client.Start()
 	client.WaitForShutdown()
+	defaultNotifier.RemoveClient(client)
 	fmt.Printf("Disconnected websocket client %s\n", remoteAddr)
 }
 
@@ -499,7 +664,7 @@ func parseCmd(request *btcjson.Request) *parsedRPCCmd {
 	cmd, err := btcjson.UnmarshalCmd(request)
 
 	// Handle new commands except btcd cmds
-	if request.Method == "nextdeposit" {
+	if request.Method == "nextdeposit" || request.Method == "nextmempooldeposit" {
 		if len(request.Params) == 1 {
 			var deposit []Deposit
 			err := json.Unmarshal(request.Params[0], &deposit)
@@ -1127,6 +1292,171 @@ var wsHandlers map[string]wsCommandHandler
 
 // var wsHandlersBeforeInit = map[string]wsCommandHandler{}
 
+// handleNotifyBlocks implements the notifyblocks command extension for
+// websocket connections.
+func handleNotifyBlocks(wsc *wsClient, icmd interface{}) (interface{}, error) {
+	defaultNotifier.RegisterBlockUpdates(wsc)
+	return nil, nil
+}
+
+// handleStopNotifyBlocks implements the stopnotifyblocks command extension for
+// websocket connections.
+func handleStopNotifyBlocks(wsc *wsClient, icmd interface{}) (interface{}, error) {
+	defaultNotifier.UnregisterBlockUpdates(wsc)
+	return nil, nil
+}
+
+// handleNotifyReceived implements the notifyreceived command extension for
+// websocket connections.
+func handleNotifyReceived(wsc *wsClient, icmd interface{}) (interface{}, error) {
+	cmd, ok := icmd.(*btcjson.NotifyReceivedCmd)
+	if !ok {
+		return nil, btcjson.ErrRPCInternal
+	}
+
+	defaultNotifier.RegisterAddrRequests(wsc, cmd.Addresses)
+	return nil, nil
+}
+
+// handleStopNotifyReceived implements the stopnotifyreceived command extension
+// for websocket connections.
+func handleStopNotifyReceived(wsc *wsClient, icmd interface{}) (interface{}, error) {
+	cmd, ok := icmd.(*btcjson.StopNotifyReceivedCmd)
+	if !ok {
+		return nil, btcjson.ErrRPCInternal
+	}
+
+	defaultNotifier.UnregisterAddrRequests(wsc, cmd.Addresses)
+	return nil, nil
+}
+
+// wsNotifier keeps the websocket clients that requested notifications,
+// and sends them the blockconnected and recvtx notifications.
+type wsNotifier struct {
+	sync.Mutex
+	blockClients map[*wsClient]struct{}
+	addrClients  map[*wsClient]struct{}
+}
+
+func newWsNotifier() *wsNotifier {
+	return &wsNotifier{
+		blockClients: make(map[*wsClient]struct{}),
+		addrClients:  make(map[*wsClient]struct{}),
+	}
+}
+
+// RegisterBlockUpdates requests blockconnected notifications for the client
+func (n *wsNotifier) RegisterBlockUpdates(wsc *wsClient) {
+	n.Lock()
+	defer n.Unlock()
+	n.blockClients[wsc] = struct{}{}
+}
+
+// UnregisterBlockUpdates stops the blockconnected notifications of the client
+func (n *wsNotifier) UnregisterBlockUpdates(wsc *wsClient) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.blockClients, wsc)
+}
+
+// RegisterAddrRequests requests recvtx notifications for the transactions paying to addrs
+func (n *wsNotifier) RegisterAddrRequests(wsc *wsClient, addrs []string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, addr := range addrs {
+		wsc.addrRequests[addr] = struct{}{}
+	}
+	n.addrClients[wsc] = struct{}{}
+}
+
+// UnregisterAddrRequests stops the recvtx notifications of addrs
+func (n *wsNotifier) UnregisterAddrRequests(wsc *wsClient, addrs []string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, addr := range addrs {
+		delete(wsc.addrRequests, addr)
+	}
+	if len(wsc.addrRequests) == 0 {
+		delete(n.addrClients, wsc)
+	}
+}
+
+// RemoveClient removes all the notification requests of a disconnected client
+func (n *wsNotifier) RemoveClient(wsc *wsClient) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.blockClients, wsc)
+	delete(n.addrClients, wsc)
+	wsc.addrRequests = make(map[string]struct{})
+}
+
+// NotifyBlockConnected sends a blockconnected notification to the clients that requested block updates
+func (n *wsNotifier) NotifyBlockConnected(block *btcutil.Block) {
+	ntfn := btcjson.NewBlockConnectedNtfn(block.Hash().String(), block.Height(), block.MsgBlock().Header.Timestamp.Unix())
+	marshalledJSON, err := btcjson.MarshalCmd(nil, ntfn)
+	if err != nil {
+		fmt.Printf("Failed to marshal block connected notification: %v\n", err)
+		return
+	}
+
+	n.Lock()
+	clients := make([]*wsClient, 0, len(n.blockClients))
+	for wsc := range n.blockClients {
+		clients = append(clients, wsc)
+	}
+	n.Unlock()
+
+	for _, wsc := range clients {
+		wsc.SendMessage(marshalledJSON, nil)
+	}
+}
+
+// NotifyTx sends a recvtx notification to the clients that requested the addresses the transaction pays to.
+// block is nil for a mempool transaction.
+func (n *wsNotifier) NotifyTx(tx *btcutil.Tx, block *btcutil.Block) {
+	var buf bytes.Buffer
+	if err := tx.MsgTx().Serialize(&buf); err != nil {
+		fmt.Printf("Failed to serialize transaction: %v\n", err)
+		return
+	}
+
+	var details *btcjson.BlockDetails
+	if block != nil {
+		details = &btcjson.BlockDetails{
+			Height: block.Height(),
+			Hash:   block.Hash().String(),
+			Index:  tx.Index(),
+			Time:   block.MsgBlock().Header.Timestamp.Unix(),
+		}
+	}
+
+	marshalledJSON, err := btcjson.MarshalCmd(nil, btcjson.NewRecvTxNtfn(hex.EncodeToString(buf.Bytes()), details))
+	if err != nil {
+		fmt.Printf("Failed to marshal recvtx notification: %v\n", err)
+		return
+	}
+
+	n.Lock()
+	var clients []*wsClient
+	for wsc := range n.addrClients {
+		for _, txOut := range tx.MsgTx().TxOut {
+			address, err := btcaddr.ScriptAddress(txOut.PkScript, btcParams)
+			if err != nil || address == "" {
+				continue
+			}
+			if _, ok := wsc.addrRequests[address]; ok {
+				clients = append(clients, wsc)
+				break
+			}
+		}
+	}
+	n.Unlock()
+
+	for _, wsc := range clients {
+		wsc.SendMessage(marshalledJSON, nil)
+	}
+}
+
 // serviceRequest services a parsed RPC request by looking up and executing the
 // appropriate RPC handler.  The response is marshalled and sent to the
 // websocket client.
@@ -1279,9 +1609,54 @@ func httpHandleNextDeposit(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// httpHandleNextMempoolDeposit accept deposits and add a transaction paying them to the mempool,
+// returns the transaction. The transaction is included in the next block.
+// Method: POST
+// URI: /api/nextmempooldeposit
+// The request body is an array of deposits, like /api/nextdeposit
+func httpHandleNextMempoolDeposit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "close")
+	r.Close = true
+
+	if r.Method != http.MethodPost {
+		errCode := http.StatusMethodNotAllowed
+		http.Error(w, fmt.Sprintf("Accepts POST requests only"), errCode)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var deposits []Deposit
+	err := decoder.Decode(&deposits)
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			fmt.Println("Failed to close response body:", err)
+		}
+	}()
+
+	if err != nil {
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error reading JSON message: %v", errCode, err), errCode)
+		return
+	}
+
+	tx, err := addMempoolDeposits(deposits)
+	if err != nil {
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error processing data: %v", errCode, err), errCode)
+		return
+	}
+
+	if err := JSONResponse(w, tx); err != nil {
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error responding: %v", errCode, err), errCode)
+		return
+	}
+}
+
 func (server *httpAPIServer) start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/nextdeposit", httpHandleNextDeposit)
+	mux.HandleFunc("/api/nextmempooldeposit", httpHandleNextMempoolDeposit)
 
 	server.listen = &http.Server{
 		Addr:         server.address,
@@ -1317,9 +1692,17 @@ func run() error {
 	certFile := flag.String("cert", "rpc.cert", "btcd rpc cert")
 	address := flag.String("address", "127.0.0.1:8334", "btcd listening address")
 	httpAPIAddress := flag.String("api", "127.0.0.1:8834", "http api listening address")
+	network := flag.String("network", btcaddr.MainNet, "bitcoin network of the deposit addresses: mainnet, testnet3, regtest or simnet")
 
 	flag.Parse()
 
+	params, err := btcaddr.Params(*network)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	btcParams = params
+
 	// Get a channel that will be closed when a shutdown signal has been
 	// triggered either from an OS signal such as SIGINT (Ctrl+C) or from
 	// another subsystem such as the RPC server.
@@ -1376,10 +1759,21 @@ func init() {
 	defaultBlockStore = &BlockStore{
 		BlockHashes: make(map[int64]string),
 		HashBlocks:  make(map[string]btcjson.GetBlockVerboseResult),
+		Mempool:     make(map[string]MempoolTx),
+	}
+
+	defaultNotifier = newWsNotifier()
+
+	wsHandlers = map[string]wsCommandHandler{
+		"notifyblocks":       handleNotifyBlocks,
+		"stopnotifyblocks":   handleStopNotifyBlocks,
+		"notifyreceived":     handleNotifyReceived,
+		"stopnotifyreceived": handleStopNotifyReceived,
 	}
 
 	// Initialize a block with transactions, in order to pass the len(block.RawTx) != 0 check in teller
-	// when it begins scanning its first block
+	// when it begins scanning its first block.
+	// This runs before the -network flag is parsed, the P2PKH output script is the same on every network.
 	deposits := []Deposit{
 		{
 			Address: "14S31KagL5js1FWcz1CiEJWa776aYJjV3N",
@@ -1387,7 +1781,13 @@ func init() {
 			N:       0,
 		},
 	}
-	b, err := createNewBlock(initialBlock.Hash, initialBlock.Height, deposits)
+	txn, err := createDepositTx(deposits)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+
+	b, err := createNewBlock(initialBlock.Hash, initialBlock.Height, []*wire.MsgTx{txn})
 	if err != nil {
 		fmt.Println("ERROR:", err)
 		os.Exit(1)
@@ -60,7 +60,12 @@ func fixSkyAddrWhitespace(db *bolt.DB) error {
 		return err
 	}
 
-	return fixDepositInfoBkt(db)
+	if err := fixDepositInfoBkt(db); err != nil {
+		return err
+	}
+
+	// The deposit infos were changed without the exchange Store, so their indexes are stale
+	return exchange.BuildDepositIndexes(db)
 }
 
 func fixAddress(a string) (string, error) {
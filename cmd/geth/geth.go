@@ -0,0 +1,435 @@
+// a local fake geth that reports deposits to teller for testing
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
+	// The timeout configuration is necessary for public servers, or else
+	// connections will be used up
+	serverReadTimeout  = time.Second * 10
+	serverWriteTimeout = time.Second * 20
+	serverIdleTimeout  = time.Second * 120
+
+	// JSON-RPC error codes
+	errCodeParse          = -32700
+	errCodeMethodNotFound = -32601
+	errCodeInvalidParams  = -32602
+)
+
+// Deposit records information about an ETH deposit
+type Deposit struct {
+	Address string // deposit address
+	Value   int64  // deposit amount, measured in gwei
+}
+
+// Transaction is a transaction as returned by eth_getBlockByNumber
+type Transaction struct {
+	Hash        string `json:"hash"`
+	BlockHash   string `json:"blockHash"`
+	BlockNumber string `json:"blockNumber"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Value       string `json:"value"`
+}
+
+// Block is a block as returned by eth_getBlockByNumber
+type Block struct {
+	Number       string        `json:"number"`
+	Hash         string        `json:"hash"`
+	ParentHash   string        `json:"parentHash"`
+	Timestamp    string        `json:"timestamp"`
+	Transactions []Transaction `json:"transactions"`
+}
+
+// BlockStore holds fake block data
+type BlockStore struct {
+	sync.RWMutex
+	Blocks []Block // Blocks[i] is the block at height initialHeight+i
+}
+
+// initialHeight is the height of the first fake block,
+// matching the default eth_scanner.initial_scan_height
+const initialHeight = 4654259 - 1
+
+// fakeSender is the sender of all fake deposits
+const fakeSender = "0x0000000000000000000000000000000000000001"
+
+var defaultBlockStore *BlockStore
+
+func init() {
+	defaultBlockStore = &BlockStore{}
+	defaultBlockStore.addBlock(nil)
+}
+
+func fakeHash(data ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(data, ":")))
+	return "0x" + hex.EncodeToString(h[:])
+}
+
+func hexQuantity(n int64) string {
+	return fmt.Sprintf("0x%x", n)
+}
+
+// addBlock creates a new block containing one transaction per deposit
+func (bs *BlockStore) addBlock(deposits []Deposit) Block {
+	bs.Lock()
+	defer bs.Unlock()
+
+	height := int64(initialHeight + len(bs.Blocks))
+	parentHash := fakeHash("genesis")
+	if len(bs.Blocks) > 0 {
+		parentHash = bs.Blocks[len(bs.Blocks)-1].Hash
+	}
+
+	now := time.Now().Unix()
+	hash := fakeHash(parentHash, strconv.FormatInt(height, 10), strconv.FormatInt(now, 10))
+
+	block := Block{
+		Number:       hexQuantity(height),
+		Hash:         hash,
+		ParentHash:   parentHash,
+		Timestamp:    hexQuantity(now),
+		Transactions: make([]Transaction, 0, len(deposits)),
+	}
+
+	for i, d := range deposits {
+		wei := big.NewInt(0).Mul(big.NewInt(d.Value), big.NewInt(1e9))
+		block.Transactions = append(block.Transactions, Transaction{
+			Hash:        fakeHash(hash, strconv.Itoa(i)),
+			BlockHash:   hash,
+			BlockNumber: block.Number,
+			From:        fakeSender,
+			// geth returns addresses in lowercase
+			To:    strings.ToLower(d.Address),
+			Value: fmt.Sprintf("0x%s", wei.Text(16)),
+		})
+	}
+
+	bs.Blocks = append(bs.Blocks, block)
+
+	return block
+}
+
+// bestHeight returns the height of the latest block
+func (bs *BlockStore) bestHeight() int64 {
+	bs.RLock()
+	defer bs.RUnlock()
+	return int64(initialHeight + len(bs.Blocks) - 1)
+}
+
+// blockAtHeight returns the block at a height, or nil if there is no such block
+func (bs *BlockStore) blockAtHeight(height int64) *Block {
+	bs.RLock()
+	defer bs.RUnlock()
+
+	i := height - initialHeight
+	if i < 0 || i >= int64(len(bs.Blocks)) {
+		return nil
+	}
+
+	b := bs.Blocks[i]
+	return &b
+}
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type commandHandler func(params []json.RawMessage) (interface{}, *rpcError)
+
+var rpcHandlers = map[string]commandHandler{
+	"eth_blockNumber":      handleBlockNumber,
+	"eth_getBlockByNumber": handleGetBlockByNumber,
+	"nextdeposit":          handleNextDeposit, // for triggering a fake deposit
+}
+
+func handleBlockNumber(params []json.RawMessage) (interface{}, *rpcError) {
+	return hexQuantity(defaultBlockStore.bestHeight()), nil
+}
+
+// handleGetBlockByNumber returns a block with full transactions.
+// Like geth, the result is null if the block does not exist.
+func handleGetBlockByNumber(params []json.RawMessage) (interface{}, *rpcError) {
+	if len(params) == 0 {
+		return nil, &rpcError{Code: errCodeInvalidParams, Message: "missing block number"}
+	}
+
+	var number string
+	if err := json.Unmarshal(params[0], &number); err != nil {
+		return nil, &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+	}
+
+	var height int64
+	switch number {
+	case "latest", "pending":
+		height = defaultBlockStore.bestHeight()
+	case "earliest":
+		height = initialHeight
+	default:
+		if !strings.HasPrefix(number, "0x") {
+			return nil, &rpcError{Code: errCodeInvalidParams, Message: "invalid block number"}
+		}
+
+		var err error
+		height, err = strconv.ParseInt(number[2:], 16, 64)
+		if err != nil {
+			return nil, &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+		}
+	}
+
+	if b := defaultBlockStore.blockAtHeight(height); b != nil {
+		return b, nil
+	}
+
+	return nil, nil
+}
+
+// handleNextDeposit creates a new block with the deposits given as the first param
+func handleNextDeposit(params []json.RawMessage) (interface{}, *rpcError) {
+	var deposits []Deposit
+	if len(params) > 0 {
+		if err := json.Unmarshal(params[0], &deposits); err != nil {
+			return nil, &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+		}
+	}
+
+	block, err := processDeposits(deposits)
+	if err != nil {
+		return nil, &rpcError{Code: errCodeInvalidParams, Message: err.Error()}
+	}
+
+	return block, nil
+}
+
+func processDeposits(deposits []Deposit) (*Block, error) {
+	for _, d := range deposits {
+		if len(d.Address) != 42 || !strings.HasPrefix(d.Address, "0x") {
+			return nil, fmt.Errorf("invalid address %q", d.Address)
+		}
+		if _, err := hex.DecodeString(d.Address[2:]); err != nil {
+			return nil, fmt.Errorf("invalid address %q", d.Address)
+		}
+		if d.Value <= 0 {
+			return nil, errors.New("deposit value must be greater than zero")
+		}
+	}
+
+	block := defaultBlockStore.addBlock(deposits)
+	fmt.Printf("Created block %s at height %s with %d deposits\n", block.Hash, block.Number, len(deposits))
+
+	return &block, nil
+}
+
+// JSONResponse marshal data into json and write response
+func JSONResponse(w http.ResponseWriter, data interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	d, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(d)
+	return err
+}
+
+// rpcHandler serves geth's JSON-RPC API
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errCode := http.StatusMethodNotAllowed
+		http.Error(w, fmt.Sprintf("Accepts POST requests only"), errCode)
+		return
+	}
+
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			fmt.Println("Failed to close request body:", err)
+		}
+	}()
+
+	var req rpcRequest
+	resp := rpcResponse{
+		JSONRPC: "2.0",
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.Error = &rpcError{Code: errCodeParse, Message: err.Error()}
+	} else {
+		resp.ID = req.ID
+
+		handler, ok := rpcHandlers[req.Method]
+		if !ok {
+			resp.Error = &rpcError{
+				Code:    errCodeMethodNotFound,
+				Message: fmt.Sprintf("the method %s does not exist/is not available", req.Method),
+			}
+		} else {
+			resp.Result, resp.Error = handler(req.Params)
+		}
+	}
+
+	if err := JSONResponse(w, resp); err != nil {
+		fmt.Println("Write response failed:", err)
+	}
+}
+
+// httpHandleNextDeposit accept deposits and create a new block, returns the block.
+// Method: POST
+// URI: /api/nextdeposit
+// The request body is an array of deposits, Value is measured in gwei, for example:
+//  [{
+//     "Address": "0x77720eeb0be8b4060636e4f8e77b178ace343e11",
+//     "Value":   1000000000
+//  }]
+func httpHandleNextDeposit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errCode := http.StatusMethodNotAllowed
+		http.Error(w, fmt.Sprintf("Accepts POST requests only"), errCode)
+		return
+	}
+
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			fmt.Println("Failed to close request body:", err)
+		}
+	}()
+
+	var deposits []Deposit
+	if err := json.NewDecoder(r.Body).Decode(&deposits); err != nil {
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error reading JSON message: %v", errCode, err), errCode)
+		return
+	}
+
+	newBlock, err := processDeposits(deposits)
+	if err != nil {
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error processing data: %v", errCode, err), errCode)
+		return
+	}
+
+	if err := JSONResponse(w, newBlock); err != nil {
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error responding: %v", errCode, err), errCode)
+		return
+	}
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout:  serverIdleTimeout,
+	}
+}
+
+func run() error {
+	//flags
+	address := flag.String("address", "127.0.0.1:8545", "geth rpc listening address")
+	httpAPIAddress := flag.String("api", "127.0.0.1:8845", "http api listening address")
+	blockPeriod := flag.Duration("block-period", 0, "create an empty block every period, 0 disables")
+
+	flag.Parse()
+
+	rpcMux := http.NewServeMux()
+	rpcMux.HandleFunc("/", rpcHandler)
+	rpcServer := newServer(*address, rpcMux)
+
+	apiMux := http.NewServeMux()
+	apiMux.HandleFunc("/api/nextdeposit", httpHandleNextDeposit)
+	apiServer := newServer(*httpAPIAddress, apiMux)
+
+	errC := make(chan error, 2)
+	quit := make(chan struct{})
+
+	go func() {
+		fmt.Printf("geth rpc listening on %s\n", *address)
+		if err := rpcServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errC <- err
+		}
+	}()
+
+	go func() {
+		fmt.Printf("http api listening on %s\n", *httpAPIAddress)
+		if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errC <- err
+		}
+	}()
+
+	if *blockPeriod > 0 {
+		go func() {
+			t := time.NewTicker(*blockPeriod)
+			defer t.Stop()
+			for {
+				select {
+				case <-quit:
+					return
+				case <-t.C:
+					if _, err := processDeposits(nil); err != nil {
+						fmt.Println("Create empty block failed:", err)
+					}
+				}
+			}
+		}()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	var err error
+	select {
+	case <-interrupt:
+		fmt.Println("Received SIGINT, shutting down")
+	case err = <-errC:
+	}
+
+	close(quit)
+
+	if err := apiServer.Close(); err != nil {
+		fmt.Println("http api server shutdown failed:", err)
+	}
+	if err := rpcServer.Close(); err != nil {
+		fmt.Println("geth rpc server shutdown failed:", err)
+	}
+
+	return err
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/skycoin/skycoin/src/cipher"
 
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
 	btcrpcclient "github.com/btcsuite/btcd/rpcclient"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -31,6 +32,8 @@ import (
 	"github.com/kittycash/teller/src/sender"
 	"github.com/kittycash/teller/src/teller"
 	"github.com/kittycash/teller/src/util/logger"
+	"github.com/kittycash/teller/src/util/mathutil"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 func main() {
@@ -40,47 +43,149 @@ func main() {
 	}
 }
 
+func createRefunder(log logrus.FieldLogger, cfg config.Refund, btcParams *chaincfg.Params, store exchange.Storer) (*exchange.Refunder, error) {
+	senders := make(map[string]exchange.RefundSender)
+
+	if cfg.SkyWallet != "" {
+		log.Info("Sending SKY refunds from refund.sky_wallet")
+		senders[scanner.CoinTypeSKY] = sender.NewSkyRefundSender(cfg.SkyNodeAddr, cfg.SkyWallet)
+	}
+
+	if cfg.BtcWallet.Server != "" {
+		certs, err := ioutil.ReadFile(cfg.BtcWallet.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read cfg.Refund.BtcWallet.Cert %s: %v", cfg.BtcWallet.Cert, err)
+		}
+
+		btcwallet, err := btcrpcclient.New(&btcrpcclient.ConnConfig{
+			Host:         cfg.BtcWallet.Server,
+			User:         cfg.BtcWallet.User,
+			Pass:         cfg.BtcWallet.Pass,
+			Certificates: certs,
+			HTTPPostMode: true,
+		}, nil)
+		if err != nil {
+			log.WithError(err).Error("Create btcwallet client failed")
+			return nil, err
+		}
+
+		log.Info("Sending BTC refunds from refund.btc_wallet")
+		senders[scanner.CoinTypeBTC] = sender.NewBtcRefundSender(btcwallet, btcParams)
+	}
+
+	return exchange.NewRefunder(log, cfg, store, senders)
+}
+
 func createBtcScanner(log logrus.FieldLogger, cfg config.Config, scanStore *scanner.Store) (*scanner.BTCScanner, error) {
-	// create btc rpc client
-	certs, err := ioutil.ReadFile(cfg.BtcRPC.Cert)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read cfg.BtcRPC.Cert %s: %v", cfg.BtcRPC.Cert, err)
+	var btcrpc scanner.BtcRPCClient
+	var ntfns *scanner.BtcNotifications
+
+	switch cfg.BtcRPC.Backend {
+	case config.BtcBackendBitcoind:
+		log.Info("Using bitcoind")
+		btcrpc = scanner.NewBitcoindClient(scanner.BitcoindConfig{
+			Server:     cfg.BtcRPC.Server,
+			User:       cfg.BtcRPC.User,
+			Pass:       cfg.BtcRPC.Pass,
+			CookiePath: cfg.BtcRPC.Cookie,
+			Params:     cfg.BtcParams(),
+		})
+	default:
+		client, n, err := createBtcdClient(log, cfg)
+		if err != nil {
+			return nil, err
+		}
+		btcrpc = client
+		ntfns = n
 	}
 
-	log.Info("Connecting to btcd")
+	err := scanStore.AddSupportedCoin(scanner.CoinTypeBTC)
+	if err != nil {
+		log.WithError(err).Error("scanStore.AddSupportedCoin(scanner.CoinTypeBTC) failed")
+		return nil, err
+	}
 
-	btcrpc, err := btcrpcclient.New(&btcrpcclient.ConnConfig{
-		Endpoint:     "ws",
-		Host:         cfg.BtcRPC.Server,
-		User:         cfg.BtcRPC.User,
-		Pass:         cfg.BtcRPC.Pass,
-		Certificates: certs,
-	}, nil)
+	btcScanner, err := scanner.NewBTCScanner(log, scanStore, btcrpc, scanner.Config{
+		ScanPeriod:            cfg.BtcScanner.ScanPeriod,
+		ConfirmationsRequired: cfg.BtcScanner.ConfirmationsRequired,
+		InitialScanHeight:     cfg.BtcScanner.InitialScanHeight,
+		ScanMempool:           cfg.BtcScanner.ScanMempool,
+		NotifyScanPeriod:      cfg.BtcScanner.NotifyScanPeriod,
+		BtcParams:             cfg.BtcParams(),
+		CatchUpConcurrency:    cfg.BtcScanner.CatchUpConcurrency,
+	})
 	if err != nil {
-		log.WithError(err).Error("Connect btcd failed")
+		log.WithError(err).Error("Open scan service failed")
 		return nil, err
 	}
 
-	log.Info("Connect to btcd succeeded")
+	if ntfns != nil {
+		if err := btcScanner.EnableNotifications(ntfns); err != nil {
+			log.WithError(err).Error("btcScanner.EnableNotifications failed")
+			return nil, err
+		}
+	}
 
-	err = scanStore.AddSupportedCoin(scanner.CoinTypeBTC)
+	return btcScanner, nil
+}
+
+func createBtcEsploraScanner(log logrus.FieldLogger, cfg config.Config, scanStore *scanner.Store) (*scanner.BTCEsploraScanner, error) {
+	log.WithField("url", cfg.BtcRPC.Server).Info("Using the Esplora API")
+
+	err := scanStore.AddSupportedCoin(scanner.CoinTypeBTC)
 	if err != nil {
 		log.WithError(err).Error("scanStore.AddSupportedCoin(scanner.CoinTypeBTC) failed")
 		return nil, err
 	}
 
-	btcScanner, err := scanner.NewBTCScanner(log, scanStore, btcrpc, scanner.Config{
+	btcScanner, err := scanner.NewBTCEsploraScanner(log, scanStore, scanner.NewEsploraClient(cfg.BtcRPC.Server), scanner.Config{
 		ScanPeriod:            cfg.BtcScanner.ScanPeriod,
 		ConfirmationsRequired: cfg.BtcScanner.ConfirmationsRequired,
 		InitialScanHeight:     cfg.BtcScanner.InitialScanHeight,
+		ScanMempool:           cfg.BtcScanner.ScanMempool,
 	})
 	if err != nil {
 		log.WithError(err).Error("Open scan service failed")
 		return nil, err
 	}
+
 	return btcScanner, nil
 }
 
+// createBtcdClient connects to btcd, with notification handlers if btc_scanner.notifications is enabled
+func createBtcdClient(log logrus.FieldLogger, cfg config.Config) (*btcrpcclient.Client, *scanner.BtcNotifications, error) {
+	certs, err := ioutil.ReadFile(cfg.BtcRPC.Cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read cfg.BtcRPC.Cert %s: %v", cfg.BtcRPC.Cert, err)
+	}
+
+	log.Info("Connecting to btcd")
+
+	// btcd notifications are received over the websocket connection, which reconnects automatically
+	var ntfns *scanner.BtcNotifications
+	var ntfnHandlers *btcrpcclient.NotificationHandlers
+	if cfg.BtcScanner.Notifications {
+		ntfns = scanner.NewBtcNotifications()
+		ntfnHandlers = ntfns.Handlers()
+	}
+
+	btcrpc, err := btcrpcclient.New(&btcrpcclient.ConnConfig{
+		Endpoint:     "ws",
+		Host:         cfg.BtcRPC.Server,
+		User:         cfg.BtcRPC.User,
+		Pass:         cfg.BtcRPC.Pass,
+		Certificates: certs,
+	}, ntfnHandlers)
+	if err != nil {
+		log.WithError(err).Error("Connect btcd failed")
+		return nil, nil, err
+	}
+
+	log.Info("Connect to btcd succeeded")
+
+	return btcrpc, ntfns, nil
+}
+
 // createSkyScanner returns a new sky scanner instance
 func createSkyScanner(log logrus.FieldLogger, cfg config.Config, scanStore *scanner.Store) (*scanner.SKYScanner, error) {
 	skyrpc := scanner.NewSkyClient(cfg.SkyRPC.Address)
@@ -90,8 +195,10 @@ func createSkyScanner(log logrus.FieldLogger, cfg config.Config, scanStore *scan
 	}
 
 	skyScanner, err := scanner.NewSKYScanner(log, scanStore, skyrpc, scanner.Config{
-		ScanPeriod:        cfg.SkyScanner.ScanPeriod,
-		InitialScanHeight: cfg.SkyScanner.InitialScanHeight,
+		ScanPeriod:            cfg.SkyScanner.ScanPeriod,
+		ConfirmationsRequired: cfg.SkyScanner.ConfirmationsRequired,
+		InitialScanHeight:     cfg.SkyScanner.InitialScanHeight,
+		CatchUpConcurrency:    cfg.SkyScanner.CatchUpConcurrency,
 	})
 	if err != nil {
 		log.WithError(err).Error("Open skyscan service failed")
@@ -101,6 +208,29 @@ func createSkyScanner(log logrus.FieldLogger, cfg config.Config, scanStore *scan
 	return skyScanner, nil
 }
 
+// createEthScanner returns a new eth scanner instance
+func createEthScanner(log logrus.FieldLogger, cfg config.Config, scanStore *scanner.Store) (*scanner.ETHScanner, error) {
+	ethrpc := scanner.NewEthClient(cfg.EthRPC.Server, cfg.EthRPC.Port)
+	err := scanStore.AddSupportedCoin(scanner.CoinTypeETH)
+	if err != nil {
+		log.WithError(err).Error("scanStore.AddSupportedCoin(scanner.CoinTypeETH) failed")
+		return nil, err
+	}
+
+	ethScanner, err := scanner.NewETHScanner(log, scanStore, ethrpc, scanner.Config{
+		ScanPeriod:            cfg.EthScanner.ScanPeriod,
+		ConfirmationsRequired: cfg.EthScanner.ConfirmationsRequired,
+		InitialScanHeight:     cfg.EthScanner.InitialScanHeight,
+		CatchUpConcurrency:    cfg.EthScanner.CatchUpConcurrency,
+	})
+	if err != nil {
+		log.WithError(err).Error("Open ethscan service failed")
+		return nil, err
+	}
+
+	return ethScanner, nil
+}
+
 func run() error {
 	cur, err := user.Current()
 	if err != nil {
@@ -176,13 +306,17 @@ func run() error {
 	}
 
 	var btcScanner *scanner.BTCScanner
+	var btcEsploraScanner *scanner.BTCEsploraScanner
+	var btcScanAddrs monitor.ScanAddressGetter
 	var skyScanner *scanner.SKYScanner
+	var ethScanner *scanner.ETHScanner
 	var scanService scanner.Scanner
 	var scanSkyService scanner.Scanner
 	var sendService *sender.SendService
 	var sendAPI sender.Sender
-	var btcAddrMgr *addrs.Addrs
-	var skyAddrMgr *addrs.Addrs
+	var btcAddrMgr addrs.AddrGenerator
+	var skyAddrMgr addrs.AddrGenerator
+	var ethAddrMgr *addrs.Addrs
 
 	//create multiplexer to manage scanner
 	multiplexer := scanner.NewMultiplexer(log)
@@ -205,7 +339,17 @@ func run() error {
 		scanService.(*scanner.DummyScanner).BindHandlers(dummyMux)
 	} else {
 		// enable btc scanner
-		if cfg.BtcScanner.Enabled {
+		if cfg.BtcScanner.Enabled && cfg.BtcRPC.Backend == config.BtcBackendEsplora {
+			btcEsploraScanner, err = createBtcEsploraScanner(rusloggger, cfg, scanStore)
+			if err != nil {
+				log.WithError(err).Error("create btc esplora scanner failed")
+				return err
+			}
+			background("btcEsploraScanner.Run", errC, btcEsploraScanner.Run)
+
+			scanService = btcEsploraScanner
+			btcScanAddrs = btcEsploraScanner
+		} else if cfg.BtcScanner.Enabled {
 			btcScanner, err = createBtcScanner(rusloggger, cfg, scanStore)
 			if err != nil {
 				log.WithError(err).Error("create btc scanner failed")
@@ -214,6 +358,7 @@ func run() error {
 			background("btcScanner.Run", errC, btcScanner.Run)
 
 			scanService = btcScanner
+			btcScanAddrs = btcScanner
 		}
 
 		// create sky scanner if its enabled
@@ -233,6 +378,44 @@ func run() error {
 				return err
 			}
 		}
+
+		// create eth scanner if its enabled
+		if cfg.EthScanner.Enabled {
+			ethScanner, err = createEthScanner(rusloggger, cfg, scanStore)
+			if err != nil {
+				log.WithError(err).Error("create eth scanner failed")
+				return err
+			}
+
+			background("ethScanner.Run", errC, ethScanner.Run)
+
+			if err := multiplexer.AddScanner(ethScanner, scanner.CoinTypeETH); err != nil {
+				log.WithError(err).Errorf("multiplexer.AddScanner of %s failed", scanner.CoinTypeETH)
+				return err
+			}
+		}
+
+		// The scanners of disabled coin types can be registered at runtime with the admin API,
+		// the multiplexer runs and shuts them down
+		if !cfg.SkyScanner.Enabled {
+			multiplexer.SetScannerFactory(scanner.CoinTypeSKY, func() (scanner.ManagedScanner, error) {
+				scr, err := createSkyScanner(rusloggger, cfg, scanStore)
+				if err != nil {
+					return nil, err
+				}
+				return scr, nil
+			})
+		}
+
+		if !cfg.EthScanner.Enabled {
+			multiplexer.SetScannerFactory(scanner.CoinTypeETH, func() (scanner.ManagedScanner, error) {
+				scr, err := createEthScanner(rusloggger, cfg, scanStore)
+				if err != nil {
+					return nil, err
+				}
+				return scr, nil
+			})
+		}
 	}
 
 	if err := multiplexer.AddScanner(scanService, scanner.CoinTypeBTC); err != nil {
@@ -270,14 +453,35 @@ func run() error {
 		}()
 	}
 
+	// create the webhook outbox, events are only recorded if webhooks are enabled
+	webhookStore, err := webhook.NewStore(log, db)
+	if err != nil {
+		log.WithError(err).Error("webhook.NewStore failed")
+		return err
+	}
+
+	events := webhook.Discard
+	var notifier *webhook.Notifier
+	if cfg.Webhook.Enabled {
+		events = webhookStore
+
+		notifier, err = webhook.NewNotifier(log, cfg.Webhook, webhookStore)
+		if err != nil {
+			log.WithError(err).Error("webhook.NewNotifier failed")
+			return err
+		}
+
+		background("notifier.Run", errC, notifier.Run)
+	}
+
 	// create exchange service
-	exchangeStore, err := exchange.NewStore(log, db)
+	exchangeStore, err := exchange.NewStore(log, db, events)
 	if err != nil {
 		log.WithError(err).Error("exchange.NewStore failed")
 		return err
 	}
 
-	exchangeClient, err := exchange.NewExchange(log, cfg.BoxExchanger, exchangeStore, multiplexer, sendAPI)
+	exchangeClient, err := exchange.NewExchange(log, cfg.BoxExchanger, exchangeStore, multiplexer, sendAPI, cfg.BtcParams())
 	if err != nil {
 		log.WithError(err).Error("exchange.NewDirectExchange failed")
 		return err
@@ -285,12 +489,28 @@ func run() error {
 
 	background("exchangeClient.Run", errC, exchangeClient.Run)
 
+	var refunder *exchange.Refunder
+	if cfg.Refund.SendEnabled {
+		refunder, err = createRefunder(log, cfg.Refund, cfg.BtcParams(), exchangeStore)
+		if err != nil {
+			log.WithError(err).Error("createRefunder failed")
+			return err
+		}
+
+		background("refunder.Run", errC, refunder.Run)
+	}
+
 	//create AddrManager
 	addrManager := addrs.NewAddrManager()
 
 	if cfg.BtcScanner.Enabled {
 		// create bitcoin address manager
-		btcAddrMgr, err = addrs.NewBTCAddrs(log, db, cfg.BtcAddresses)
+		if cfg.BtcXPub != "" {
+			log.Info("Deriving BTC deposit addresses from btc_xpub")
+			btcAddrMgr, err = addrs.NewBTCHDAddrs(log, db, cfg.BtcXPub, cfg.BtcParams())
+		} else {
+			btcAddrMgr, err = addrs.NewBTCAddrs(log, db, cfg.BtcAddresses, cfg.BtcParams())
+		}
 		if err != nil {
 			log.WithError(err).Error("Create bitcoin deposit address manager failed")
 			return err
@@ -303,7 +523,12 @@ func run() error {
 
 	if cfg.SkyScanner.Enabled {
 		// create sky address manager
-		skyAddrMgr, err = addrs.NewSKYAddrs(log, db, cfg.SkyAddresses)
+		if cfg.SkyXPub != "" {
+			log.Info("Deriving SKY deposit addresses from sky_xpub")
+			skyAddrMgr, err = addrs.NewSKYHDAddrs(log, db, cfg.SkyXPub)
+		} else {
+			skyAddrMgr, err = addrs.NewSKYAddrs(log, db, cfg.SkyAddresses)
+		}
 		if err != nil {
 			log.WithError(err).Error("Create SKY deposit address manager failed")
 			return err
@@ -314,6 +539,19 @@ func run() error {
 		}
 	}
 
+	if cfg.EthScanner.Enabled {
+		// create ethereum address manager
+		ethAddrMgr, err = addrs.NewETHAddrs(log, db, cfg.EthAddresses)
+		if err != nil {
+			log.WithError(err).Error("Create ETH deposit address manager failed")
+			return err
+		}
+		if err := addrManager.PushGenerator(ethAddrMgr, scanner.CoinTypeETH); err != nil {
+			log.WithError(err).Error("Add ETH address manager failed")
+			return err
+		}
+	}
+
 	// create agent store
 	agentStore, err := kittyagent.NewStore(log, db)
 	if err != nil {
@@ -323,10 +561,28 @@ func run() error {
 
 	// create a new agent manager instance
 	agentCfg := kittyagent.Config{
-		KittyAPIAddress: cfg.KittyApi.Address,
-		VerifierEnabled: cfg.VerificationService.Enabled,
+		KittyAPIAddress:     cfg.KittyApi.Address,
+		VerifierEnabled:     cfg.VerificationService.Enabled,
+		ReservationTimeout:  cfg.Teller.ReservationTimeout,
+		MaxReservations:     cfg.Teller.MaxBoundAddresses,
+		CatalogueSyncPeriod: cfg.KittyApi.SyncPeriod,
+	}
+	if cfg.BoxExchanger.SkyETHExchangeRate != "" {
+		// the rate was validated when the config was loaded
+		agentCfg.SkyETHExchangeRate, err = mathutil.ParseRate(cfg.BoxExchanger.SkyETHExchangeRate)
+		if err != nil {
+			log.WithError(err).Error("Parse box_exchanger.sky_eth_exchange_rate failed")
+			return err
+		}
 	}
-	agentManager := kittyagent.New(log, agentCfg, agentStore)
+	agentManager, err := kittyagent.New(log, agentCfg, agentStore, exchangeStore, events)
+	if err != nil {
+		log.WithError(err).Error("agent.New failed")
+		return err
+	}
+
+	background("agentManager.Run", errC, agentManager.Run)
+
 	tellerServer := teller.New(log, exchangeClient, addrManager, agentManager, cfg, db)
 
 	// Run the service
@@ -336,7 +592,7 @@ func run() error {
 	monitorCfg := monitor.Config{
 		Addr: cfg.AdminPanel.Host,
 	}
-	monitorService := monitor.New(log, monitorCfg, btcAddrMgr, skyAddrMgr, exchangeClient, btcScanner)
+	monitorService := monitor.New(log, monitorCfg, btcAddrMgr, skyAddrMgr, exchangeClient, btcScanAddrs, exchangeClient, exchangeClient, exchangeClient, agentManager, webhookStore, multiplexer, scanStore)
 
 	background("monitorService.Run", errC, monitorService.Run)
 
@@ -360,15 +616,38 @@ func run() error {
 	log.Info("Shutting down tellerServer")
 	tellerServer.Shutdown()
 
+	log.Info("Shutting down agentManager")
+	agentManager.Shutdown()
+
 	log.Info("Shutting down the multiplexer")
 	multiplexer.Shutdown()
 
 	// close the scan service
+	if ethScanner != nil {
+		log.Info("Shutting down ethScanner")
+		ethScanner.Shutdown()
+	}
+
 	if btcScanner != nil {
 		log.Info("Shutting down btcScanner")
 		btcScanner.Shutdown()
 	}
 
+	if btcEsploraScanner != nil {
+		log.Info("Shutting down btcEsploraScanner")
+		btcEsploraScanner.Shutdown()
+	}
+
+	if refunder != nil {
+		log.Info("Shutting down refunder")
+		refunder.Shutdown()
+	}
+
+	if notifier != nil {
+		log.Info("Shutting down notifier")
+		notifier.Shutdown()
+	}
+
 	// close exchange service
 	log.Info("Shutting down exchangeClient")
 	exchangeClient.Shutdown()
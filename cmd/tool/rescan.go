@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
+	btcrpcclient "github.com/btcsuite/btcd/rpcclient"
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/config"
+	"github.com/kittycash/teller/src/scanner"
+)
+
+// rescanReportInterval is how many blocks are rescanned between progress reports
+const rescanReportInterval = 100
+
+// rpcConfig is the node or indexer that the rescan command gets blocks from
+type rpcConfig struct {
+	// Backend is the BTC node implementation, config.BtcBackendBtcd, config.BtcBackendBitcoind or config.BtcBackendEsplora
+	Backend string
+	// Server is the btcd or bitcoind host:port, the Esplora API URL, the skycoin node address or the eth host:port
+	Server string
+	User   string
+	Pass   string
+	// Cert is the btcd RPC certificate path
+	Cert string
+}
+
+// rescan scans the blocks of a height range again for deposits to some addresses, and adds the missed deposits to the db.
+// They are sent to the exchange when teller is started.
+// to_height must have at least confirmations confirmations.
+// args are coin_type from_height to_height address...
+func rescan(db *bolt.DB, params *chaincfg.Params, rpc rpcConfig, confirmations int64, args []string) error {
+	if len(args) < 4 {
+		return errors.New("Invalid arguments")
+	}
+
+	req := scanner.RescanRequest{
+		CoinType:  args[0],
+		Addresses: args[3:],
+	}
+
+	var err error
+	req.FromHeight, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid from height: %v", err)
+	}
+
+	req.ToHeight, err = strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid to height: %v", err)
+	}
+
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	if rpc.Server == "" {
+		return errors.New("-rpc is required")
+	}
+
+	if confirmations < 0 {
+		return errors.New("-confirmations must be >= 0")
+	}
+
+	log := logrus.New()
+	log.Level = logrus.WarnLevel
+
+	store, err := scanner.NewStore(log, db)
+	if err != nil {
+		return fmt.Errorf("Create scanner store failed: %v", err)
+	}
+
+	rs, shutdown, err := newRescanner(log, store, params, rpc, confirmations, req.CoinType)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	p, err := rs.Rescan(req, func(p scanner.RescanProgress) {
+		if p.Done {
+			return
+		}
+
+		if (p.Height-req.FromHeight+1)%rescanReportInterval == 0 || p.Height == req.ToHeight {
+			fmt.Printf("Rescanned height %d of %d, found %d deposits, added %d missed deposits\n",
+				p.Height, req.ToHeight, p.Found, len(p.Deposits))
+		}
+	})
+
+	for _, dv := range p.Deposits {
+		fmt.Printf("Added deposit: Height: %d Address: %s Value: %d Tx: %s\n", dv.Height, dv.Address, dv.Value, dv.ID())
+	}
+
+	if err != nil {
+		return fmt.Errorf("Rescan stopped after height %d: %v", p.Height, err)
+	}
+
+	fmt.Printf("Rescanned %s blocks %d to %d, found %d deposits, added %d missed deposits\n",
+		req.CoinType, req.FromHeight, req.ToHeight, p.Found, len(p.Deposits))
+	if len(p.Deposits) > 0 {
+		fmt.Println("The added deposits are sent to the exchange when teller is started")
+	}
+
+	return nil
+}
+
+// newRescanner creates the scanner of a coin type to rescan blocks with, and a function that closes its client.
+// The scanner is not run.
+func newRescanner(log logrus.FieldLogger, store scanner.Storer, params *chaincfg.Params, rpc rpcConfig, confirmations int64,
+	coinType string) (scanner.Rescanner, func(), error) {
+	cfg := scanner.Config{
+		ConfirmationsRequired: confirmations,
+	}
+
+	switch coinType {
+	case scanner.CoinTypeBTC:
+		switch rpc.Backend {
+		case config.BtcBackendBtcd:
+			certs, err := ioutil.ReadFile(rpc.Cert)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Read cert file failed: %v", err)
+			}
+
+			client, err := btcrpcclient.New(&btcrpcclient.ConnConfig{
+				Host:         rpc.Server,
+				Endpoint:     "ws",
+				User:         rpc.User,
+				Pass:         rpc.Pass,
+				Certificates: certs,
+			}, nil)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Connect btcd failed: %v", err)
+			}
+
+			cfg.BtcParams = params
+			s, err := scanner.NewBTCScanner(log, store, client, cfg)
+			return s, client.Shutdown, err
+		case config.BtcBackendBitcoind:
+			client := scanner.NewBitcoindClient(scanner.BitcoindConfig{
+				Server: rpc.Server,
+				User:   rpc.User,
+				Pass:   rpc.Pass,
+				Params: params,
+			})
+
+			cfg.BtcParams = params
+			s, err := scanner.NewBTCScanner(log, store, client, cfg)
+			return s, client.Shutdown, err
+		case config.BtcBackendEsplora:
+			s, err := scanner.NewBTCEsploraScanner(log, store, scanner.NewEsploraClient(rpc.Server), cfg)
+			return s, func() {}, err
+		default:
+			return nil, nil, fmt.Errorf("Invalid backend %q", rpc.Backend)
+		}
+	case scanner.CoinTypeSKY:
+		client := scanner.NewSkyClient(rpc.Server)
+		s, err := scanner.NewSKYScanner(log, store, client, cfg)
+		return s, client.Shutdown, err
+	case scanner.CoinTypeETH:
+		host, port, err := net.SplitHostPort(rpc.Server)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid eth server: %v", err)
+		}
+
+		client := scanner.NewEthClient(host, port)
+		s, err := scanner.NewETHScanner(log, store, client, cfg)
+		return s, client.Shutdown, err
+	default:
+		return nil, nil, fmt.Errorf("Unknown coin type %s", coinType)
+	}
+}
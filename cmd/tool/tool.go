@@ -20,12 +20,20 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	btcrpcclient "github.com/btcsuite/btcd/rpcclient"
+	"github.com/sirupsen/logrus"
 
 	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/kittycash/teller/src/config"
+	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/btcaddr"
 )
 
 const (
-	scanBlockCmdName = "scanblock"
+	scanBlockCmdName          = "scanblock"
+	getLastScanBlockCmdName   = "getlastscanblock"
+	resetLastScanBlockCmdName = "resetlastscanblock"
+	rescanCmdName             = "rescan"
 )
 
 // btc address json struct
@@ -43,6 +51,9 @@ The commands are:
     getbtcaddress       list all bitcoin deposit address in the pool
     newbtcaddress       generate bitcoin address
     scanblock           scan block from specific height to get all vout with interger value
+    getlastscanblock    show the last scanned block of a coin type
+    resetlastscanblock  reset the last scanned block of a coin type, scanning restarts from initial_scan_height
+    rescan              scan the blocks of a height range again for deposits to some addresses, and add the missed deposits
 `, filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
 
 func main() {
@@ -54,6 +65,15 @@ func main() {
 	dbFile := flag.String("db", filepath.Join(u.HomeDir, ".teller-kittycash/teller.db"), "db file path")
 	btcAddrFile := flag.String("btcfile", "../teller/btc_addresses.json", "btc addresses json file")
 	useJSON := flag.Bool("json", false, "Print newbtcaddress output as json")
+	network := flag.String("network", btcaddr.MainNet, "bitcoin network of the addresses: mainnet, testnet3, regtest or simnet")
+	addrType := flag.String("type", btcaddr.TypeP2PKH, "newbtcaddress address type: p2pkh, p2wpkh or p2sh-p2wpkh")
+	var rpc rpcConfig
+	flag.StringVar(&rpc.Backend, "backend", config.BtcBackendBtcd, "rescan BTC node implementation: btcd, bitcoind or esplora")
+	flag.StringVar(&rpc.Server, "rpc", "", "rescan block source: btcd or bitcoind host:port, esplora API URL, skycoin node address or eth host:port")
+	flag.StringVar(&rpc.User, "rpcuser", "", "rescan btcd or bitcoind rpc user")
+	flag.StringVar(&rpc.Pass, "rpcpass", "", "rescan btcd or bitcoind rpc password")
+	flag.StringVar(&rpc.Cert, "rpccert", "", "rescan btcd rpc cert path")
+	confirmations := flag.Int64("confirmations", 1, "rescan confirmations required for the last rescanned block")
 
 	flag.Parse()
 
@@ -66,9 +86,15 @@ func main() {
 
 	cmd := args[0]
 
+	btcParams, err := btcaddr.Params(*network)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	var db *bolt.DB
 	switch cmd {
-	case scanBlockCmdName:
+	case scanBlockCmdName, getLastScanBlockCmdName, resetLastScanBlockCmdName, rescanCmdName:
 		if _, err := os.Stat(*dbFile); os.IsNotExist(err) {
 			fmt.Println(*dbFile, "does not exist")
 			return
@@ -96,13 +122,19 @@ func main() {
 
 		switch args[1] {
 		case "addbtcaddress":
-			fmt.Println("usage: addbtcaddress btc_address")
+			fmt.Println("usage: [-network network] addbtcaddress btc_address")
 		case "getbtcaddress":
 			fmt.Println("usage: getbtcaddress")
 		case "newbtcaddress":
-			fmt.Println("usage: [-json] newbtcaddress seed num. -json will print as json.")
+			fmt.Println("usage: [-json] [-network network] [-type type] newbtcaddress seed num. -json will print as json, -type is p2pkh, p2wpkh or p2sh-p2wpkh.")
 		case scanBlockCmdName:
 			fmt.Println("usage: server user pass cert_path height")
+		case getLastScanBlockCmdName:
+			fmt.Println("usage: [-db db_path] getlastscanblock coin_type")
+		case resetLastScanBlockCmdName:
+			fmt.Println("usage: [-db db_path] resetlastscanblock coin_type")
+		case rescanCmdName:
+			fmt.Println("usage: [-db db_path] [-network network] [-backend backend] -rpc address [-rpcuser user] [-rpcpass pass] [-rpccert cert_path] [-confirmations n] rescan coin_type from_height to_height address [address...]. Stop teller first, the added deposits are sent to the exchange when it is started.")
 		case "newkeys":
 			fmt.Println("usage: newkeys")
 		}
@@ -135,6 +167,11 @@ func main() {
 			return
 		}
 
+		if err := btcaddr.Validate(args[1], btcParams); err != nil {
+			fmt.Println("Invalid bitcoin address:", err)
+			return
+		}
+
 		addrJSON.BtcAddresses = append(addrJSON.BtcAddresses, args[1])
 		v, err = json.MarshalIndent(addrJSON, "", "    ")
 		if err != nil {
@@ -170,8 +207,13 @@ func main() {
 
 		var addrs []string
 		for _, sec := range seckeys {
-			addr := cipher.BitcoinAddressFromPubkey(cipher.PubKeyFromSecKey(sec))
-			addrs = append(addrs, addr)
+			pubkey := cipher.PubKeyFromSecKey(sec)
+			addr, err := btcaddr.PubKeyAddress(pubkey[:], *addrType, btcParams)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			addrs = append(addrs, addr.EncodeAddress())
 		}
 
 		if *useJSON {
@@ -262,6 +304,58 @@ func main() {
 			}
 		}
 
+	case getLastScanBlockCmdName:
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments")
+			fmt.Println(usage)
+			return
+		}
+
+		store, err := scanner.NewStore(logrus.New(), db)
+		if err != nil {
+			fmt.Println("Create scanner store failed:", err)
+			return
+		}
+
+		lsb, err := store.GetLastScannedBlock(args[1])
+		if err != nil {
+			fmt.Println("Get last scanned block failed:", err)
+			return
+		}
+
+		if lsb == nil {
+			fmt.Printf("No %s block has been scanned\n", args[1])
+			return
+		}
+
+		fmt.Printf("Height: %d Hash: %s\n", lsb.Height, lsb.Hash)
+	case resetLastScanBlockCmdName:
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments")
+			fmt.Println(usage)
+			return
+		}
+
+		store, err := scanner.NewStore(logrus.New(), db)
+		if err != nil {
+			fmt.Println("Create scanner store failed:", err)
+			return
+		}
+
+		if err := store.ResetLastScannedBlock(args[1]); err != nil {
+			fmt.Println("Reset last scanned block failed:", err)
+			return
+		}
+
+		fmt.Printf("Reset the last scanned %s block\n", args[1])
+	case rescanCmdName:
+		if err := rescan(db, btcParams, rpc, *confirmations, args[1:]); err != nil {
+			fmt.Println(err)
+			if len(args) < 5 {
+				fmt.Println(usage)
+			}
+			return
+		}
 	default:
 		log.Printf("Unknown command: %s\n", cmd)
 	}
@@ -10,15 +10,17 @@ import (
 	"path/filepath"
 
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/sirupsen/logrus"
 
-	"github.com/skycoin/skycoin/src/cipher"
+	"github.com/kittycash/teller/src/util/btcaddr"
 )
 
 const btcBucketKey = "used_btc_address"
 
-// NewBTCAddrs returns an Addrs loaded with BTC addresses
-func NewBTCAddrs(log logrus.FieldLogger, db *bolt.DB, addrsFile string) (*Addrs, error) {
+// NewBTCAddrs returns an Addrs loaded with BTC addresses of the network of params.
+// P2PKH, P2SH and native segwit P2WPKH and P2WSH addresses are accepted.
+func NewBTCAddrs(log logrus.FieldLogger, db *bolt.DB, addrsFile string, params *chaincfg.Params) (*Addrs, error) {
 	f, err := ioutil.ReadFile(addrsFile)
 	if err != nil {
 		return nil, fmt.Errorf("Load deposit bitcoin address list failed: %v", err)
@@ -39,7 +41,7 @@ func NewBTCAddrs(log logrus.FieldLogger, db *bolt.DB, addrsFile string) (*Addrs,
 		return nil, err
 	}
 
-	if err := verifyBTCAddresses(addrs); err != nil {
+	if err := verifyBTCAddresses(addrs, params); err != nil {
 		return nil, err
 	}
 
@@ -58,7 +60,7 @@ func loadBTCAddressesJSON(addrsReader io.Reader) ([]string, error) {
 	return addrs.Addresses, nil
 }
 
-func verifyBTCAddresses(addrs []string) error {
+func verifyBTCAddresses(addrs []string, params *chaincfg.Params) error {
 	if len(addrs) == 0 {
 		return errors.New("No BTC addresses")
 	}
@@ -70,7 +72,7 @@ func verifyBTCAddresses(addrs []string) error {
 			return fmt.Errorf("Duplicate deposit address `%s`", addr)
 		}
 
-		if _, err := cipher.BitcoinDecodeBase58Address(addr); err != nil {
+		if err := btcaddr.Validate(addr, params); err != nil {
 			return fmt.Errorf("Invalid deposit address `%s`: %v", addr, err)
 		}
 
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/stretchr/testify/require"
 
 	"github.com/skycoin/teller/src/util/testutil"
@@ -29,7 +31,7 @@ func TestNewBTCAddrsNoFile(t *testing.T) {
 	log, _ := testutil.NewLogger(t)
 
 	name := "doesnotexist.txt"
-	_, err := NewBTCAddrs(log, db, name)
+	_, err := NewBTCAddrs(log, db, name, &chaincfg.MainNetParams)
 	require.Error(t, err)
 }
 
@@ -53,7 +55,7 @@ func TestNewBTCAddrsLoadText(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	btcAddrMgr, err := NewBTCAddrs(log, db, name)
+	btcAddrMgr, err := NewBTCAddrs(log, db, name, &chaincfg.MainNetParams)
 
 	require.NoError(t, err)
 	require.NotNil(t, btcAddrMgr)
@@ -93,7 +95,7 @@ func TestNewBTCAddrsAllValid(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json")
+	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json", &chaincfg.MainNetParams)
 
 	require.NoError(t, err)
 	require.NotNil(t, btcAddrMgr)
@@ -132,15 +134,83 @@ func TestNewBtcAddrsContainsInvalid(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	expectedErr := errors.New("Invalid deposit address `bad`: Invalid address length")
+	expectedErr := errors.New("Invalid deposit address `bad`: decoded address is of unknown format")
 
-	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json")
+	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json", &chaincfg.MainNetParams)
 
 	require.Error(t, err)
 	require.Equal(t, expectedErr, err)
 	require.Nil(t, btcAddrMgr)
 }
 
+func TestNewBTCAddrsNetwork(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	mainnetAddrs := []string{
+		"1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB",
+		"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy",
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3",
+	}
+	testnetAddrs := []string{
+		"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn",
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+	}
+
+	cases := []struct {
+		name   string
+		addrs  []string
+		params *chaincfg.Params
+		err    string
+	}{
+		{
+			name:   "mainnet",
+			addrs:  mainnetAddrs,
+			params: &chaincfg.MainNetParams,
+		},
+		{
+			name:   "testnet",
+			addrs:  testnetAddrs,
+			params: &chaincfg.TestNet3Params,
+		},
+		{
+			name:   "testnet addresses on mainnet",
+			addrs:  testnetAddrs[:1],
+			params: &chaincfg.MainNetParams,
+			err:    "Invalid deposit address `mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn`: Bitcoin address is for another network",
+		},
+		{
+			name:   "mainnet segwit address on testnet",
+			addrs:  mainnetAddrs[2:],
+			params: &chaincfg.TestNet3Params,
+			err:    "Invalid deposit address `bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4`: Bitcoin address is for another network",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			name := setupTempFile(t, strings.Join(tc.addrs, "\n"))
+			defer func() {
+				err := os.Remove(name)
+				require.NoError(t, err)
+			}()
+
+			btcAddrMgr, err := NewBTCAddrs(log, db, name, tc.params)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Equal(t, tc.err, err.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.addrs, btcAddrMgr.addresses)
+		})
+	}
+}
+
 func TestNewBtcAddrsContainsDuplicated(t *testing.T) {
 	db, shutdown := testutil.PrepareDB(t)
 	defer shutdown()
@@ -166,7 +236,7 @@ func TestNewBtcAddrsContainsDuplicated(t *testing.T) {
 
 	expectedErr := errors.New("Duplicate deposit address `14JwrdSxYXPxSi6crLKVwR4k2dbjfVZ3xj`")
 
-	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json")
+	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json", &chaincfg.MainNetParams)
 
 	require.Error(t, err)
 	require.Equal(t, expectedErr, err)
@@ -193,7 +263,7 @@ func TestNewBTCAddrsContainsNull(t *testing.T) {
 
 	expectedErr := errors.New("No BTC addresses")
 
-	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json")
+	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json", &chaincfg.MainNetParams)
 
 	require.Error(t, err)
 	require.Equal(t, expectedErr, err)
@@ -218,7 +288,7 @@ func TestNewBTCAddrsBadFormat(t *testing.T) {
 
 	expectedErr := errors.New("Decode loaded address json failed: EOF")
 
-	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json")
+	btcAddrMgr, err := NewBTCAddrs(log, db, name+".json", &chaincfg.MainNetParams)
 
 	require.Error(t, err)
 	require.Equal(t, expectedErr, err)
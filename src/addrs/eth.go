@@ -0,0 +1,92 @@
+package addrs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/util/ethutil"
+)
+
+const ethBucketKey = "used_eth_address"
+
+// NewETHAddrs returns an Addrs loaded with ETH addresses.
+// The addresses are converted to their EIP-55 checksum encoding,
+// which is the encoding used by the ETH scanner.
+func NewETHAddrs(log logrus.FieldLogger, db *bolt.DB, addrsFile string) (*Addrs, error) {
+	f, err := ioutil.ReadFile(addrsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Load deposit ethereum address list failed: %v", err)
+	}
+
+	ext := filepath.Ext(addrsFile)
+
+	var addrs []string
+
+	switch ext {
+	case jsonExtension:
+		addrs, err = loadETHAddressesJSON(bytes.NewReader(f))
+	default:
+		addrs, err = loadAddresses(bytes.NewReader(f))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err = verifyETHAddresses(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAddrs(log, db, addrs, ethBucketKey)
+}
+
+func loadETHAddressesJSON(addrsReader io.Reader) ([]string, error) {
+	var addrs struct {
+		Addresses []string `json:"eth_addresses"`
+	}
+
+	if err := json.NewDecoder(addrsReader).Decode(&addrs); err != nil {
+		return nil, fmt.Errorf("Decode loaded address json failed: %v", err)
+	}
+
+	return addrs.Addresses, nil
+}
+
+// verifyETHAddresses verifies the addresses and returns them in their checksum encoding
+func verifyETHAddresses(addrs []string) ([]string, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("No ETH addresses")
+	}
+
+	addrMap := make(map[string]struct{}, len(addrs))
+	checksummed := make([]string, 0, len(addrs))
+
+	for _, addr := range addrs {
+		if err := ethutil.ValidateAddress(addr); err != nil {
+			return nil, fmt.Errorf("Invalid deposit address `%s`: %v", addr, err)
+		}
+
+		cAddr, err := ethutil.ChecksumAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid deposit address `%s`: %v", addr, err)
+		}
+
+		if _, ok := addrMap[cAddr]; ok {
+			return nil, fmt.Errorf("Duplicate deposit address `%s`", addr)
+		}
+
+		addrMap[cAddr] = struct{}{}
+		checksummed = append(checksummed, cAddr)
+	}
+
+	return checksummed, nil
+}
@@ -0,0 +1,212 @@
+package addrs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+func TestNewETHAddrsNoFile(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	name := "doesnotexist.txt"
+	_, err := NewETHAddrs(log, db, name)
+	require.Error(t, err)
+}
+
+func TestNewETHAddrsLoadText(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	addressesText := `0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed
+0xfb6916095ca1df60bb79ce92ce3ea74c37c5d359
+# ignore
+0xDBF03B407C01E7CD3CBEA99509D93F8DDDC8C6FB
+`
+
+	name := setupTempFile(t, addressesText)
+	defer func() {
+		err := os.Remove(name)
+		require.NoError(t, err)
+	}()
+
+	ethAddrMgr, err := NewETHAddrs(log, db, name)
+
+	require.NoError(t, err)
+	require.NotNil(t, ethAddrMgr)
+
+	// Addresses are converted to their checksum encoding
+	expectedAddrs := []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+	}
+
+	require.Equal(t, expectedAddrs, ethAddrMgr.addresses)
+}
+
+func TestNewETHAddrsAllValid(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	addressesJSON := `{
+    "eth_addresses": [
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb"
+    ]
+}`
+
+	name := setupTempFile(t, addressesJSON)
+	err := os.Rename(name, name+".json")
+	require.NoError(t, err)
+	defer func() {
+		err := os.Remove(name + ".json")
+		require.NoError(t, err)
+	}()
+
+	ethAddrMgr, err := NewETHAddrs(log, db, name+".json")
+
+	require.NoError(t, err)
+	require.NotNil(t, ethAddrMgr)
+
+	expectedAddrs := []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	}
+
+	require.Equal(t, expectedAddrs, ethAddrMgr.addresses)
+}
+
+func TestNewETHAddrsContainsInvalid(t *testing.T) {
+	cases := []struct {
+		name        string
+		addr        string
+		expectedErr error
+	}{
+		{
+			"bad",
+			"bad",
+			errors.New("Invalid deposit address `bad`: Invalid ethereum address"),
+		},
+		{
+			"bad checksum",
+			"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD",
+			errors.New("Invalid deposit address `0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD`: Invalid ethereum address checksum: expected 0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, shutdown := testutil.PrepareDB(t)
+			defer shutdown()
+
+			log, _ := testutil.NewLogger(t)
+
+			addressesJSON := `{
+    "eth_addresses": [
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"` + tc.addr + `"
+    ]
+}`
+
+			name := setupTempFile(t, addressesJSON)
+			err := os.Rename(name, name+".json")
+			require.NoError(t, err)
+			defer func() {
+				err := os.Remove(name + ".json")
+				require.NoError(t, err)
+			}()
+
+			ethAddrMgr, err := NewETHAddrs(log, db, name+".json")
+
+			require.Error(t, err)
+			require.Equal(t, tc.expectedErr, err)
+			require.Nil(t, ethAddrMgr)
+		})
+	}
+}
+
+func TestNewETHAddrsContainsDuplicated(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	// The same address in a different case is a duplicate
+	addressesJSON := `{
+      "eth_addresses": [
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfb6916095ca1df60bb79ce92ce3ea74c37c5d359"
+    ]
+}`
+
+	name := setupTempFile(t, addressesJSON)
+	err := os.Rename(name, name+".json")
+	require.NoError(t, err)
+	defer func() {
+		err := os.Remove(name + ".json")
+		require.NoError(t, err)
+	}()
+
+	expectedErr := errors.New("Duplicate deposit address `0xfb6916095ca1df60bb79ce92ce3ea74c37c5d359`")
+
+	ethAddrMgr, err := NewETHAddrs(log, db, name+".json")
+
+	require.Error(t, err)
+	require.Equal(t, expectedErr, err)
+	require.Nil(t, ethAddrMgr)
+}
+
+func TestNewETHAddrsContainsNull(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	addressesJSON := `{
+      "eth_addresses": []
+}`
+
+	name := setupTempFile(t, addressesJSON)
+	err := os.Rename(name, name+".json")
+	require.NoError(t, err)
+	defer func() {
+		err := os.Remove(name + ".json")
+		require.NoError(t, err)
+	}()
+
+	expectedErr := errors.New("No ETH addresses")
+
+	ethAddrMgr, err := NewETHAddrs(log, db, name+".json")
+
+	require.Error(t, err)
+	require.Equal(t, expectedErr, err)
+	require.Nil(t, ethAddrMgr)
+}
+
+func TestNewETHAddrsExampleFile(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	ethAddrMgr, err := NewETHAddrs(log, db, "../../example_eth_addresses.json")
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(0), ethAddrMgr.Remaining())
+}
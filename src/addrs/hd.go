@@ -0,0 +1,225 @@
+package addrs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/sirupsen/logrus"
+
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/kittycash/teller/src/util/dbutil"
+)
+
+var (
+	// HDNextIndexBkt maps an extended public key to the index of the next address to derive from it
+	HDNextIndexBkt = []byte("hd_next_index")
+
+	// ErrInvalidXPubNetwork is returned when an extended public key is not for the expected network
+	ErrInvalidXPubNetwork = errors.New("Extended public key is not for the expected network")
+
+	// ErrNotXPub is returned when an extended private key is provided instead of an extended public key
+	ErrNotXPub = errors.New("Extended key is a private key, an extended public key is required")
+)
+
+// externalChain is the BIP44 chain used for receiving addresses.
+// Addresses are derived from <xpub>/0/<index>, where the xpub is
+// usually the account key m/44'/coin'/account'.
+const externalChain = 0
+
+// addressFromPubKey encodes a compressed secp256k1 public key as a deposit address
+type addressFromPubKey func(pubKey []byte) (string, error)
+
+// HDAddrs derives an unlimited supply of deposit addresses from a BIP32 extended public key.
+// The index of the next address is persisted, so no address is handed out twice.
+type HDAddrs struct {
+	sync.Mutex
+	log      logrus.FieldLogger
+	db       *bolt.DB
+	used     *Store // all used addresses
+	xpub     string
+	chain    *hdkeychain.ExtendedKey // the external chain key, <xpub>/0
+	encodeFn addressFromPubKey
+}
+
+// NewBTCHDAddrs returns an HDAddrs deriving P2PKH BTC addresses from an extended public key
+// of the network of params, e.g. an "xpub" key for mainnet or a "tpub" key for testnet
+func NewBTCHDAddrs(log logrus.FieldLogger, db *bolt.DB, xpub string, params *chaincfg.Params) (*HDAddrs, error) {
+	return newHDAddrs(log, db, xpub, params, btcBucketKey, func(pubKey []byte) (string, error) {
+		addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey), params)
+		if err != nil {
+			return "", err
+		}
+		return addr.EncodeAddress(), nil
+	})
+}
+
+// NewSKYHDAddrs returns an HDAddrs deriving SKY addresses from a BIP32 "xpub" key.
+// Skycoin uses secp256k1 keys like bitcoin, so a BIP32 public chain yields valid
+// SKY addresses, and the private keys of the deposit addresses never need to be on
+// the teller host. A Skycoin wallet seed derives its keys from a hash chain of the
+// secret seed instead, which has no public derivation.
+//
+// These addresses cannot be recovered from a Skycoin seed. The secret key of each
+// address is the private key of <xprv>/0/<index> of the BIP32 wallet the xpub was
+// exported from, so that wallet's seed must be backed up, see the README.
+func NewSKYHDAddrs(log logrus.FieldLogger, db *bolt.DB, xpub string) (*HDAddrs, error) {
+	return newHDAddrs(log, db, xpub, &chaincfg.MainNetParams, skyBucketKey, func(pubKey []byte) (string, error) {
+		pk := cipher.PubKey{}
+		if len(pubKey) != len(pk) {
+			return "", errors.New("Invalid public key length")
+		}
+		copy(pk[:], pubKey)
+
+		return cipher.AddressFromPubKey(pk).String(), nil
+	})
+}
+
+func newHDAddrs(log logrus.FieldLogger, db *bolt.DB, xpub string, params *chaincfg.Params, bucketKey string, encodeFn addressFromPubKey) (*HDAddrs, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid extended public key: %v", err)
+	}
+
+	if key.IsPrivate() {
+		return nil, ErrNotXPub
+	}
+
+	if !key.IsForNet(params) {
+		return nil, ErrInvalidXPubNetwork
+	}
+
+	chain, err := key.Child(externalChain)
+	if err != nil {
+		return nil, fmt.Errorf("Derive external chain key failed: %v", err)
+	}
+
+	used, err := NewStore(db, bucketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(HDNextIndexBkt)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &HDAddrs{
+		log:      log.WithField("prefix", "addrs.hd"),
+		db:       db,
+		used:     used,
+		xpub:     xpub,
+		chain:    chain,
+		encodeFn: encodeFn,
+	}, nil
+}
+
+// NewAddress returns a new deposit address
+func (a *HDAddrs) NewAddress() (string, error) {
+	var addr string
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		addr, err = a.NewAddressWithTx(tx)
+		return err
+	})
+
+	return addr, err
+}
+
+// NewAddressWithTx returns a new deposit address, saving the next index with a db tx.
+// The index is read from the tx, so if the tx is rolled back the address will be handed out again.
+func (a *HDAddrs) NewAddressWithTx(tx *bolt.Tx) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	index, err := a.getNextIndexTx(tx)
+	if err != nil {
+		return "", err
+	}
+
+	for ; index < hdkeychain.HardenedKeyStart; index++ {
+		child, err := a.chain.Child(index)
+		switch err {
+		case nil:
+		case hdkeychain.ErrInvalidChild:
+			a.log.WithField("index", index).Warn("Skipping invalid child key")
+			continue
+		default:
+			return "", err
+		}
+
+		pubKey, err := child.ECPubKey()
+		if err != nil {
+			return "", err
+		}
+
+		addr, err := a.encodeFn(pubKey.SerializeCompressed())
+		if err != nil {
+			return "", err
+		}
+
+		// Skip addresses that were already handed out, e.g. from a static address file
+		if used, err := dbutil.BucketHasKey(tx, a.used.BucketKey, addr); err != nil {
+			return "", err
+		} else if used {
+			continue
+		}
+
+		if err := a.used.PutWithTx(tx, addr); err != nil {
+			return "", fmt.Errorf("Put address in used pool failed: %v", err)
+		}
+
+		if err := dbutil.PutBucketValue(tx, HDNextIndexBkt, a.xpub, index+1); err != nil {
+			return "", err
+		}
+
+		a.log.WithFields(logrus.Fields{
+			"index": index,
+			"addr":  addr,
+		}).Info("Derived new deposit address")
+
+		return addr, nil
+	}
+
+	return "", ErrDepositAddressEmpty
+}
+
+// Remaining returns the number of addresses that can still be derived
+func (a *HDAddrs) Remaining() uint64 {
+	a.Lock()
+	defer a.Unlock()
+
+	var index uint32
+	if err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		index, err = a.getNextIndexTx(tx)
+		return err
+	}); err != nil {
+		a.log.WithError(err).Error("getNextIndexTx failed")
+		return 0
+	}
+
+	return uint64(hdkeychain.HardenedKeyStart - index)
+}
+
+// getNextIndexTx returns the index of the next address to derive
+func (a *HDAddrs) getNextIndexTx(tx *bolt.Tx) (uint32, error) {
+	var index uint32
+	if err := dbutil.GetBucketObject(tx, HDNextIndexBkt, a.xpub, &index); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	return index, nil
+}
@@ -0,0 +1,152 @@
+package addrs
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/stretchr/testify/require"
+
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+// BIP32 test vector 2 master keys
+const (
+	testXPub = "xpub661MyMwAqRbcFW31YEwpkMuc5THy2PSt5bDMsktWQcFF8syAmRUapSCGu8ED9W6oDMSgv6Zz8idoc4a6mr8BDzTJY47LJhkJ8UB7WEGuduB"
+	testXPrv = "xprv9s21ZrQH143K31xYSDQpPDxsXRTUcvj2iNHm5NUtrGiGG5e2DtALGdso3pGz6ssrdK4PFmM8NSpSBHNqPqm55Qn3LqFtT2emdEXVYsCzC2U"
+)
+
+func TestNewHDAddrsInvalidKey(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	_, err := NewBTCHDAddrs(log, db, testXPrv, &chaincfg.MainNetParams)
+	require.Equal(t, ErrNotXPub, err)
+
+	_, err = NewBTCHDAddrs(log, db, testXPub, &chaincfg.TestNet3Params)
+	require.Equal(t, ErrInvalidXPubNetwork, err)
+
+	_, err = NewSKYHDAddrs(log, db, "bad")
+	require.Error(t, err)
+
+	_, err = newHDAddrs(log, db, testXPub, &chaincfg.SimNetParams, btcBucketKey, nil)
+	require.Equal(t, ErrInvalidXPubNetwork, err)
+}
+
+func TestBTCHDAddrsNewAddress(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	a, err := NewBTCHDAddrs(log, db, testXPub, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	require.Equal(t, uint64(hdkeychain.HardenedKeyStart), a.Remaining())
+
+	seen := make(map[string]struct{})
+	for i := 0; i < 5; i++ {
+		addr, err := a.NewAddress()
+		require.NoError(t, err)
+
+		_, err = cipher.BitcoinDecodeBase58Address(addr)
+		require.NoError(t, err)
+
+		_, ok := seen[addr]
+		require.False(t, ok)
+		seen[addr] = struct{}{}
+
+		used, err := a.used.IsUsed(addr)
+		require.NoError(t, err)
+		require.True(t, used)
+	}
+
+	require.Equal(t, uint64(hdkeychain.HardenedKeyStart)-5, a.Remaining())
+
+	// The next index is persisted, so a restarted teller continues where it left off
+	a2, err := NewBTCHDAddrs(log, db, testXPub, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	require.Equal(t, a.Remaining(), a2.Remaining())
+
+	addr, err := a2.NewAddress()
+	require.NoError(t, err)
+	_, ok := seen[addr]
+	require.False(t, ok)
+}
+
+func TestSKYHDAddrsDeterministic(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+
+	derive := func(n int) []string {
+		db, shutdown := testutil.PrepareDB(t)
+		defer shutdown()
+
+		a, err := NewSKYHDAddrs(log, db, testXPub)
+		require.NoError(t, err)
+
+		var addrs []string
+		for i := 0; i < n; i++ {
+			addr, err := a.NewAddress()
+			require.NoError(t, err)
+
+			_, err = cipher.DecodeBase58Address(addr)
+			require.NoError(t, err)
+
+			addrs = append(addrs, addr)
+		}
+		return addrs
+	}
+
+	// Addresses derived from the same xpub in different databases are the same
+	require.Equal(t, derive(3), derive(3))
+}
+
+func TestHDAddrsSkipsUsedAddress(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	a, err := NewBTCHDAddrs(log, db, testXPub, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	// Find the first address, then reset the index
+	first, err := a.NewAddress()
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(HDNextIndexBkt).Delete([]byte(testXPub))
+	})
+	require.NoError(t, err)
+
+	// The used address is skipped
+	second, err := a.NewAddress()
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	require.Equal(t, uint64(hdkeychain.HardenedKeyStart)-2, a.Remaining())
+}
+
+func TestHDAddrsNewAddressWithTxRollback(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	a, err := NewBTCHDAddrs(log, db, testXPub, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	rolledBack, err := a.NewAddressWithTx(tx)
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	// The address of a rolled back tx is handed out again
+	addr, err := a.NewAddress()
+	require.NoError(t, err)
+	require.Equal(t, rolledBack, addr)
+}
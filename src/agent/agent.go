@@ -2,112 +2,175 @@
 package agent
 
 import (
-	"strconv"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/kittycash/kitty-api/src/rpc"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/util/droplet"
 
-	"github.com/kittycash/teller/src/util/dbutil"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 const (
-	// Max number of reservations a user can do
-	maxReservation = 1
+	// How often to check for expired reservations
+	expiryCheckPeriod = time.Minute
+	// How long to wait before retrying a failed release in the kitty api,
+	// doubled after each failed attempt up to maxReleaseRetryWait
+	releaseRetryWait    = time.Minute
+	maxReleaseRetryWait = time.Hour
 )
 
 // Config defines the agent config
 type Config struct {
 	KittyAPIAddress string
 	VerifierEnabled bool
+	// How long a reservation is held before it is released if not paid
+	ReservationTimeout time.Duration
+	// Max number of unpaid reservations a user can have, 0 means unlimited
+	MaxReservations int
+	// How often to sync the prices and status of the kitties from the kitty api
+	CatalogueSyncPeriod time.Duration
+	// SKY/ETH exchange rate used to price boxes in ETH.
+	// Boxes can't be paid for in ETH when it is zero.
+	SkyETHExchangeRate decimal.Decimal
 }
 
 // Manager provides APIs to interact with the agent service
 type Manager interface {
-	MakeReservation(tx *bolt.Tx, depositAddress, userAddress, kittyID, coinType, verificationCode string) error
+	MakeReservation(tx *bolt.Tx, depositAddress, userAddress, kittyID, coinType, verificationCode string) (*Reservation, error)
 	GetReservations(status string) ([]Reservation, error)
 	GetReservation(kittyID string) (*Reservation, error)
 	GetKittyDepositAddress(kittyID string) (string, error)
 }
 
+// PaymentTracker tracks the payments received for reservations.
+// It is implemented by the exchange store, which records the deposits.
+type PaymentTracker interface {
+	// IsPaidTx returns true if the reservation paid at depositAddr has received its full price
+	IsPaidTx(tx *bolt.Tx, depositAddr string) (bool, error)
+	// UnbindKittyTx removes the current deposit address of a kitty
+	UnbindKittyTx(tx *bolt.Tx, kittyID string) error
+}
+
 // Agent represents an agent object
 // handles kitty reservation requests
 // enforces limits, verifies verification codes
 type Agent struct {
 	log                logrus.FieldLogger
 	store              Storer
+	payments           PaymentTracker
+	events             webhook.Emitter
 	cfg                Config
 	ReservationManager *ReservationManager
 	UserManager        *UserManager
 	Verifier           *Verifier
 	KittyAPI           *KittyAPIClient
+	kittyCatalogue     KittyCatalogue
+	kittyReserver      KittyReserver
+	catalogue          catalogueSync
+	quit               chan struct{}
+	done               chan struct{}
 }
 
 // New creates a new agent service
-func New(log logrus.FieldLogger, cfg Config, store Storer) *Agent {
-	um := UserManager{
-		Users: make(map[string]*User),
+func New(log logrus.FieldLogger, cfg Config, store Storer, payments PaymentTracker, events webhook.Emitter) (*Agent, error) {
+	rm := ReservationManager{
+		Reservations: make(map[string]*Reservation),
 	}
-	var rm ReservationManager
-	verifier := NewVerifier(log, cfg.VerifierEnabled)
-	kittyAPICLient := NewKittyAPI(&rpc.ClientConfig{
-		Address: cfg.KittyAPIAddress,
-	}, log)
 
-	// get 100 kitties from the start
-	// no filters or sorters
-	entries, err := kittyAPICLient.c.Entries(&rpc.EntriesIn{
-		Offset:   0,
-		PageSize: 100,
-	})
-	//panic if we are not able to fetch kitties from kitty api
+	// the reservations saved by a previous run can be made before the catalogue is synced
+	reservations, err := store.GetReservations()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-
-	rm.Reservations = make(map[string]*Reservation, entries.TotalCount)
-	for _, entry := range entries.Results {
-		kittyID := strconv.Itoa(int(entry.ID))
-		// panic if we come across a faulty kittyid
-		if err != nil {
-			log.Panic(err)
-		}
-		// fetch reservation from database to see if its exists or not
-		r, err := store.GetReservationFromKittyID(kittyID)
-		switch err.(type) {
-		case dbutil.ObjectNotExistErr:
-			rm.Reservations[kittyID] = &Reservation{
-				KittyID:  kittyID,
-				Status:   entry.Reservation,
-				PriceBTC: entry.PriceBTC,
-				PriceSKY: entry.PriceSKY,
-			}
-			err := store.UpdateReservation(rm.Reservations[kittyID])
-			if err != nil {
-				log.Panic(err)
-			}
-		case nil:
-			// allow price to be controlled by the kitty api
-			r.PriceSKY = entry.PriceSKY
-			r.PriceBTC = entry.PriceBTC
-			rm.Reservations[kittyID] = r
-		default:
-			log.Panic(err)
-		}
+	for _, r := range reservations {
+		rm.SetReservation(r)
 	}
 
-	users, _ := store.GetUsers()
-	for _, u := range users {
-		um.Users[u.Address] = &u
-	}
+	verifier := NewVerifier(log, cfg.VerifierEnabled)
+	kittyAPICLient := NewKittyAPI(&rpc.ClientConfig{
+		Address: cfg.KittyAPIAddress,
+	}, log)
 
-	return &Agent{
+	a := &Agent{
 		log:                log.WithField("prefix", "teller.agent"),
 		cfg:                cfg,
 		store:              store,
+		payments:           payments,
+		events:             events,
 		ReservationManager: &rm,
-		UserManager:        &um,
+		UserManager:        NewUserManager(store, payments, cfg.MaxReservations),
 		Verifier:           verifier,
 		KittyAPI:           kittyAPICLient,
+		kittyCatalogue:     kittyAPICLient,
+		kittyReserver:      kittyAPICLient,
+		quit:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+
+	// a failed sync is retried by Run
+	if err := a.SyncCatalogue(); err != nil {
+		a.log.WithError(err).Error("Sync kitty catalogue failed")
 	}
+
+	return a, nil
+}
+
+// Run releases expired reservations, retries the failed releases in the kitty api and syncs the kitty catalogue periodically, until Shutdown is called
+func (a *Agent) Run() error {
+	log := a.log
+	log.Info("Start reservation expiry service...")
+	defer func() {
+		log.Info("Closed reservation expiry service")
+		close(a.done)
+	}()
+
+	ticker := time.NewTicker(expiryCheckPeriod)
+	defer ticker.Stop()
+
+	syncTimer := time.NewTimer(a.nextCatalogueSync())
+	defer syncTimer.Stop()
+
+	a.ExpireReservations()
+	a.RetryReleases()
+
+	for {
+		select {
+		case <-a.quit:
+			return nil
+		case <-ticker.C:
+			a.ExpireReservations()
+			a.RetryReleases()
+		case <-syncTimer.C:
+			if err := a.SyncCatalogue(); err != nil {
+				log.WithError(err).WithField("retryIn", a.nextCatalogueSync()).Error("Sync kitty catalogue failed")
+			}
+			syncTimer.Reset(a.nextCatalogueSync())
+		}
+	}
+}
+
+// Shutdown stops a previous call to Run
+func (a *Agent) Shutdown() {
+	a.log.Info("Shutting down agent")
+	close(a.quit)
+	a.log.Info("Waiting for run to finish")
+	<-a.done
+	a.log.Info("Shutdown complete")
+}
+
+// skyToETH converts a price in droplets to gwei with a SKY/ETH exchange rate.
+// Returns 0 if the exchange rate is not set.
+func skyToETH(droplets int64, skyETHRate decimal.Decimal) int64 {
+	if skyETHRate.Sign() <= 0 {
+		return 0
+	}
+
+	sky := decimal.New(droplets, -droplet.Exponent)
+	eth := sky.Div(skyETHRate)
+
+	// 1 ETH = 1e9 gwei
+	return eth.Mul(decimal.New(1, 9)).IntPart()
 }
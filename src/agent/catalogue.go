@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kittycash/kitty-api/src/rpc"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of entries to request from the kitty api at once
+	cataloguePageSize = 100
+	// How long to wait before retrying a failed catalogue sync, doubled after each failure
+	catalogueRetryWait = 5 * time.Second
+)
+
+// KittyCatalogue lists the kitty boxes for sale
+type KittyCatalogue interface {
+	Entries(in *rpc.EntriesIn) (*rpc.EntriesOut, error)
+}
+
+// CatalogueCounts counts the changes made by a catalogue sync
+type CatalogueCounts struct {
+	// Number of entries in the kitty api
+	Total int `json:"total"`
+	// Kitties that were not known before
+	Added int `json:"added"`
+	// Kitties whose prices or status changed
+	Updated int `json:"updated"`
+	// Kitties whose status or prices in the kitty api conflict with the reservation in teller, which was kept
+	Conflicts int `json:"conflicts"`
+}
+
+// CatalogueStatus is the status of the catalogue sync
+type CatalogueStatus struct {
+	CatalogueCounts
+	// Time of the last successful sync, in unix seconds
+	LastSync int64 `json:"last_sync"`
+	// Time of the last sync attempt, in unix seconds
+	LastAttempt int64 `json:"last_attempt"`
+	// Error of the last sync attempt, empty if it succeeded
+	LastError string `json:"last_error"`
+	// Number of sync attempts that failed in a row
+	Failures int `json:"failures"`
+}
+
+// catalogueSync tracks the status of the catalogue sync
+type catalogueSync struct {
+	sync.RWMutex
+	status CatalogueStatus
+}
+
+// mergeCatalogueEntry applies an entry from the kitty api to the reservation of its kitty.
+// The prices and status are only taken from the catalogue if the kitty is available in teller,
+// so that active reservations are never clobbered, and the price quoted to a buyer does not change.
+// Reservations are only made through teller, so a reserved status in the catalogue is never taken.
+// Returns the merged reservation, and whether the reservation was changed and conflicts with the entry.
+func mergeCatalogueEntry(r, entry Reservation) (merged Reservation, changed, conflict bool) {
+	merged = r
+	if merged.PriceBTC != entry.PriceBTC || merged.PriceSKY != entry.PriceSKY || merged.PriceETH != entry.PriceETH {
+		switch {
+		case merged.Status != Available:
+			conflict = true
+		default:
+			merged.PriceBTC = entry.PriceBTC
+			merged.PriceSKY = entry.PriceSKY
+			merged.PriceETH = entry.PriceETH
+			changed = true
+		}
+	}
+
+	if merged.Status != entry.Status {
+		switch {
+		case merged.Status != Available, entry.Status == Reserved:
+			conflict = true
+		default:
+			merged.Status = entry.Status
+			changed = true
+		}
+	}
+
+	return merged, changed, conflict
+}
+
+// SyncCatalogue pages through all entries of the kitty api, and saves their prices and status
+func (a *Agent) SyncCatalogue() error {
+	counts, err := a.syncCatalogue()
+
+	a.catalogue.Lock()
+	defer a.catalogue.Unlock()
+
+	now := time.Now().UTC().Unix()
+	a.catalogue.status.LastAttempt = now
+	if err != nil {
+		a.catalogue.status.LastError = err.Error()
+		a.catalogue.status.Failures++
+		return err
+	}
+
+	a.catalogue.status.CatalogueCounts = counts
+	a.catalogue.status.LastSync = now
+	a.catalogue.status.LastError = ""
+	a.catalogue.status.Failures = 0
+
+	return nil
+}
+
+func (a *Agent) syncCatalogue() (CatalogueCounts, error) {
+	var counts CatalogueCounts
+	for {
+		out, err := a.kittyCatalogue.Entries(&rpc.EntriesIn{
+			Offset:   counts.Total,
+			PageSize: cataloguePageSize,
+		})
+		if err != nil {
+			return counts, err
+		}
+
+		if out == nil {
+			return counts, errors.New("Kitty api returned no entries")
+		}
+
+		entries := make([]Reservation, 0, len(out.Results))
+		for _, entry := range out.Results {
+			entries = append(entries, Reservation{
+				KittyID:  strconv.FormatUint(uint64(entry.ID), 10),
+				Status:   entry.Reservation,
+				PriceBTC: entry.PriceBTC,
+				PriceSKY: entry.PriceSKY,
+				PriceETH: skyToETH(entry.PriceSKY, a.cfg.SkyETHExchangeRate),
+			})
+		}
+
+		merged, pageCounts, err := a.store.MergeCatalogue(entries, mergeCatalogueEntry)
+		if err != nil {
+			return counts, err
+		}
+
+		kittyIDs := make([]string, 0, len(merged))
+		for _, r := range merged {
+			kittyIDs = append(kittyIDs, r.KittyID)
+		}
+
+		// A reservation may have been made since the catalogue was merged
+		if err := a.ReservationManager.ReloadReservations(a.store, kittyIDs); err != nil {
+			return counts, err
+		}
+
+		counts.Total += len(out.Results)
+		counts.Added += pageCounts.Added
+		counts.Updated += pageCounts.Updated
+		counts.Conflicts += pageCounts.Conflicts
+
+		if len(out.Results) == 0 || counts.Total >= out.TotalCount {
+			break
+		}
+	}
+
+	a.log.WithFields(logrus.Fields{
+		"total":     counts.Total,
+		"added":     counts.Added,
+		"updated":   counts.Updated,
+		"conflicts": counts.Conflicts,
+	}).Info("Synced kitty catalogue")
+
+	return counts, nil
+}
+
+// CatalogueStatus returns the status of the catalogue sync
+func (a *Agent) CatalogueStatus() CatalogueStatus {
+	a.catalogue.RLock()
+	defer a.catalogue.RUnlock()
+	return a.catalogue.status
+}
+
+// nextCatalogueSync returns how long to wait until the next catalogue sync.
+// After a failure, the sync is retried with an exponential backoff.
+func (a *Agent) nextCatalogueSync() time.Duration {
+	a.catalogue.RLock()
+	failures := a.catalogue.status.Failures
+	a.catalogue.RUnlock()
+
+	if failures == 0 {
+		return a.cfg.CatalogueSyncPeriod
+	}
+
+	wait := catalogueRetryWait
+	for i := 1; i < failures && wait < a.cfg.CatalogueSyncPeriod; i++ {
+		wait *= 2
+	}
+
+	if wait > a.cfg.CatalogueSyncPeriod {
+		return a.cfg.CatalogueSyncPeriod
+	}
+
+	return wait
+}
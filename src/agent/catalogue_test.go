@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kittycash/kitty-api/src/rpc"
+	"github.com/kittycash/wallet/src/iko"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+// dummyCatalogue serves kitty api entries from memory
+type dummyCatalogue struct {
+	entries []*rpc.Entry
+	err     error
+	pages   int
+}
+
+func (dc *dummyCatalogue) Entries(in *rpc.EntriesIn) (*rpc.EntriesOut, error) {
+	if dc.err != nil {
+		return nil, dc.err
+	}
+
+	dc.pages++
+
+	end := in.Offset + in.PageSize
+	if end > len(dc.entries) {
+		end = len(dc.entries)
+	}
+
+	var results []*rpc.Entry
+	if in.Offset < end {
+		results = dc.entries[in.Offset:end]
+	}
+
+	return &rpc.EntriesOut{
+		TotalCount: len(dc.entries),
+		Results:    results,
+	}, nil
+}
+
+func newDummyCatalogue(n int) *dummyCatalogue {
+	dc := &dummyCatalogue{}
+	for i := 1; i <= n; i++ {
+		dc.entries = append(dc.entries, &rpc.Entry{
+			ID:          iko.KittyID(i),
+			Reservation: Available,
+			PriceBTC:    100000,
+			PriceSKY:    1e6,
+		})
+	}
+	return dc
+}
+
+func TestMergeCatalogueEntry(t *testing.T) {
+	entry := Reservation{
+		KittyID:  "1",
+		Status:   Available,
+		PriceBTC: 200,
+		PriceSKY: 300,
+	}
+
+	tt := []struct {
+		name     string
+		r        Reservation
+		entry    Reservation
+		expect   Reservation
+		changed  bool
+		conflict bool
+	}{
+		{
+			"unchanged",
+			entry,
+			entry,
+			entry,
+			false,
+			false,
+		},
+		{
+			"price changed",
+			Reservation{KittyID: "1", Status: Available, PriceBTC: 100, PriceSKY: 300},
+			entry,
+			entry,
+			true,
+			false,
+		},
+		{
+			"active reservation is kept",
+			Reservation{KittyID: "1", Status: Reserved, OwnerAddress: "a", DepositAddress: "b", Expire: 1, PriceBTC: 200, PriceSKY: 300},
+			entry,
+			Reservation{KittyID: "1", Status: Reserved, OwnerAddress: "a", DepositAddress: "b", Expire: 1, PriceBTC: 200, PriceSKY: 300},
+			false,
+			true,
+		},
+		{
+			"price of an active reservation is kept",
+			Reservation{KittyID: "1", Status: Reserved, OwnerAddress: "a", DepositAddress: "b", Expire: 1, PriceBTC: 100, PriceSKY: 300},
+			entry,
+			Reservation{KittyID: "1", Status: Reserved, OwnerAddress: "a", DepositAddress: "b", Expire: 1, PriceBTC: 100, PriceSKY: 300},
+			false,
+			true,
+		},
+		{
+			"reserved in the catalogue only",
+			Reservation{KittyID: "1", Status: Available, PriceBTC: 200, PriceSKY: 300},
+			Reservation{KittyID: "1", Status: Reserved, PriceBTC: 200, PriceSKY: 300},
+			Reservation{KittyID: "1", Status: Available, PriceBTC: 200, PriceSKY: 300},
+			false,
+			true,
+		},
+		{
+			"delivered in the catalogue",
+			Reservation{KittyID: "1", Status: Available, PriceBTC: 200, PriceSKY: 300},
+			Reservation{KittyID: "1", Status: Delivered, PriceBTC: 200, PriceSKY: 300},
+			Reservation{KittyID: "1", Status: Delivered, PriceBTC: 200, PriceSKY: 300},
+			true,
+			false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, changed, conflict := mergeCatalogueEntry(tc.r, tc.entry)
+			require.Equal(t, tc.expect, merged)
+			require.Equal(t, tc.changed, changed)
+			require.Equal(t, tc.conflict, conflict)
+		})
+	}
+}
+
+func TestSyncCatalogue(t *testing.T) {
+	a, shutdown := newTestAgent(t, 1, 0)
+	defer shutdown()
+
+	a.cfg.SkyETHExchangeRate = decimal.New(100, 0)
+
+	// More entries than fit in one page
+	dc := newDummyCatalogue(cataloguePageSize*2 + 50)
+	a.kittyCatalogue = dc
+
+	err := a.SyncCatalogue()
+	require.NoError(t, err)
+	require.Equal(t, 3, dc.pages)
+
+	status := a.CatalogueStatus()
+	require.Equal(t, CatalogueCounts{
+		Total: cataloguePageSize*2 + 50,
+		Added: cataloguePageSize*2 + 50,
+	}, status.CatalogueCounts)
+	require.NotZero(t, status.LastSync)
+	require.Empty(t, status.LastError)
+
+	reservations, err := a.store.GetReservations()
+	require.NoError(t, err)
+	require.Len(t, reservations, cataloguePageSize*2+50)
+	require.Len(t, a.ReservationManager.GetReservations(), cataloguePageSize*2+50)
+
+	// The last kitty can be reserved
+	lastKitty := fmt.Sprint(cataloguePageSize*2 + 50)
+	require.NoError(t, makeReservation(a, "d1", "u1", lastKitty))
+
+	reserved, err := a.store.GetReservationFromKittyID(lastKitty)
+	require.NoError(t, err)
+
+	// Prices change, and the catalogue has not seen the reservation yet
+	for _, e := range dc.entries {
+		e.PriceSKY = 2e6
+	}
+
+	err = a.SyncCatalogue()
+	require.NoError(t, err)
+
+	status = a.CatalogueStatus()
+	require.Equal(t, CatalogueCounts{
+		Total:     cataloguePageSize*2 + 50,
+		Updated:   cataloguePageSize*2 + 49,
+		Conflicts: 1,
+	}, status.CatalogueCounts)
+
+	// The price quoted to the buyer of the reserved kitty does not change
+	r, err := a.store.GetReservationFromKittyID(lastKitty)
+	require.NoError(t, err)
+	require.Equal(t, reserved, r)
+	require.NotEqual(t, int64(2e6), r.PriceSKY)
+
+	r, err = a.ReservationManager.GetReservationByKittyID(lastKitty)
+	require.NoError(t, err)
+	require.Equal(t, reserved, r)
+
+	r, err = a.ReservationManager.GetReservationByKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Available, r.Status)
+	require.Equal(t, int64(2e6), r.PriceSKY)
+	require.Equal(t, int64(2e7), r.PriceETH)
+
+	// A failed sync keeps the last successful counts
+	dc.err = errors.New("connection refused")
+	err = a.SyncCatalogue()
+	require.Equal(t, dc.err, err)
+
+	failed := a.CatalogueStatus()
+	require.Equal(t, status.CatalogueCounts, failed.CatalogueCounts)
+	require.Equal(t, status.LastSync, failed.LastSync)
+	require.Equal(t, "connection refused", failed.LastError)
+	require.Equal(t, 1, failed.Failures)
+}
+
+// reservingStore is a Store that runs reserve after a catalogue is merged
+type reservingStore struct {
+	*Store
+	reserve func()
+}
+
+func (s reservingStore) MergeCatalogue(entries []Reservation, merge func(r, entry Reservation) (Reservation, bool, bool)) ([]Reservation, CatalogueCounts, error) {
+	saved, counts, err := s.Store.MergeCatalogue(entries, merge)
+	s.reserve()
+	return saved, counts, err
+}
+
+func TestSyncCatalogueConcurrentReservation(t *testing.T) {
+	a, shutdown := newTestAgent(t, 1, 1)
+	defer shutdown()
+
+	dc := newDummyCatalogue(1)
+	dc.entries[0].PriceSKY = 2e6
+	a.kittyCatalogue = dc
+
+	// The kitty is reserved after the catalogue was merged, before the merged reservation is tracked
+	s := a.store.(*Store)
+	a.store = reservingStore{
+		Store: s,
+		reserve: func() {
+			a.store = s
+			require.NoError(t, makeReservation(a, "d1", "u1", "1"))
+		},
+	}
+
+	err := a.SyncCatalogue()
+	require.NoError(t, err)
+
+	r, err := a.ReservationManager.GetReservationByKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Reserved, r.Status)
+	require.Equal(t, "d1", r.DepositAddress)
+	require.Equal(t, int64(2e6), r.PriceSKY)
+	require.Len(t, a.ReservationManager.GetReservationsByStatus(Reserved), 1)
+}
+
+func TestNextCatalogueSync(t *testing.T) {
+	a, shutdown := newTestAgent(t, 1, 0)
+	defer shutdown()
+
+	a.cfg.CatalogueSyncPeriod = time.Minute
+
+	tt := []struct {
+		failures int
+		expect   time.Duration
+	}{
+		{0, time.Minute},
+		{1, catalogueRetryWait},
+		{2, catalogueRetryWait * 2},
+		{3, catalogueRetryWait * 4},
+		{4, catalogueRetryWait * 8},
+		{5, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tc := range tt {
+		t.Run(fmt.Sprint(tc.failures), func(t *testing.T) {
+			a.catalogue.status.Failures = tc.failures
+			require.Equal(t, tc.expect, a.nextCatalogueSync())
+		})
+	}
+}
@@ -20,6 +20,10 @@ func NewKittyAPI(config *rpc.ClientConfig, log logrus.FieldLogger) *KittyAPIClie
 	}
 }
 
+func (k *KittyAPIClient) Entries(in *rpc.EntriesIn) (*rpc.EntriesOut, error) {
+	return k.c.Entries(in)
+}
+
 func (k *KittyAPIClient) SetReservation(in *rpc.ReservationIn) (*rpc.ReservationOut, error) {
 	return k.c.SetReservation(in)
 }
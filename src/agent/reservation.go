@@ -3,9 +3,16 @@ package agent
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/go-errors/errors"
+	"github.com/kittycash/kitty-api/src/rpc"
+	"github.com/kittycash/wallet/src/iko"
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/util/dbutil"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 var (
@@ -21,6 +28,11 @@ var (
 	ErrInvalidReservationType = errors.New("Invalid reservation type")
 	// ErrDepositAddressNotFound deposit address not found for the reservation
 	ErrDepositAddressNotFound = errors.New("Deposit Address not found")
+	// ErrPriceNotSet represents that the box has no price in the requested cointype
+	ErrPriceNotSet = errors.New("Box has no price for this coin type")
+
+	// errReservationPaid is returned when trying to release a reservation that has been paid
+	errReservationPaid = errors.New("Reservation has been paid")
 )
 
 const (
@@ -29,12 +41,17 @@ const (
 	Available = "NONE"
 	// Reserved reservation
 	Reserved = "reserved"
-	// Delivered means the box of this reservation has been sent to a user
+	// Delivered means the box of this reservation has been paid for, and is sent to the user
 	Delivered = "delivered"
 	// All reservation boxes
 	All = "all"
 )
 
+// KittyReserver sets the reservation status of kitties in the kitty api
+type KittyReserver interface {
+	SetReservation(in *rpc.ReservationIn) (*rpc.ReservationOut, error)
+}
+
 // Reservation is a reservation instance for a kitty box
 type Reservation struct {
 	// DepositAddress is where the buyer should send the payment
@@ -49,6 +66,8 @@ type Reservation struct {
 	PriceBTC int64 `json:"price_btc,omitempty"`
 	// Amount to be paid in sly , stored in smallest unit i.e, droplet
 	PriceSKY int64 `json:"price_sky,omitempty"`
+	// Amount to be paid in eth, stored in gwei
+	PriceETH int64 `json:"price_eth,omitempty"`
 	// Payment currency
 	CoinType string `json:"coin_type,omitempty"`
 	// Expire defines after when a reservation expires
@@ -74,17 +93,44 @@ func (r *Reservation) MakeAvailable() {
 	r.OwnerAddress = ""
 }
 
-// GetReservationByKittyID returns reservation of the kittyID
+// GetReservationByKittyID returns a copy of the reservation of the kittyID
 func (rm *ReservationManager) GetReservationByKittyID(kittyID string) (*Reservation, error) {
 	rm.mux.RLock()
 	defer rm.mux.RUnlock()
 
 	// check if the reservation exists
-	if _, ok := rm.Reservations[kittyID]; !ok {
+	r, ok := rm.Reservations[kittyID]
+	if !ok {
 		return nil, ErrReservationNotFound
 	}
 
-	return rm.Reservations[kittyID], nil
+	reservation := *r
+	return &reservation, nil
+}
+
+// SetReservation replaces the reservation of a kitty
+func (rm *ReservationManager) SetReservation(reservation Reservation) {
+	rm.mux.Lock()
+	defer rm.mux.Unlock()
+	rm.Reservations[reservation.KittyID] = &reservation
+}
+
+// ReloadReservations replaces the reservations of kittyIDs with the ones saved in the store.
+// They are read under the lock, so that a reservation saved concurrently is not replaced by a stale copy.
+func (rm *ReservationManager) ReloadReservations(store Storer, kittyIDs []string) error {
+	rm.mux.Lock()
+	defer rm.mux.Unlock()
+
+	for _, kittyID := range kittyIDs {
+		r, err := store.GetReservationFromKittyID(kittyID)
+		if err != nil {
+			return err
+		}
+
+		rm.Reservations[kittyID] = r
+	}
+
+	return nil
 }
 
 // GetReservations returns all reservations currently being tracked by reservation manager
@@ -118,90 +164,116 @@ func (rm *ReservationManager) GetReservationsByStatus(status string) []Reservati
 func (rm *ReservationManager) ChangeReservationStatus(kittyID string, status string) {
 	rm.mux.Lock()
 	defer rm.mux.Unlock()
-	rm.Reservations[kittyID].Status = status
+	if r, ok := rm.Reservations[kittyID]; ok {
+		r.Status = status
+	}
 }
 
-// MakeReservation reserves a kitty box
+// MakeAvailable marks the reservation of kittyID as available
+func (rm *ReservationManager) MakeAvailable(kittyID string) {
+	rm.mux.Lock()
+	defer rm.mux.Unlock()
+	if r, ok := rm.Reservations[kittyID]; ok {
+		r.MakeAvailable()
+	}
+}
+
+// MakeReservation reserves a kitty box within a db tx, and returns the reservation.
+// The reservation is read and saved in the tx, so concurrent reservations are
+// serialized by the db. The reservation manager is only updated if the tx is committed.
 // Args:
 // userAddress: Address of the user reserving the box
 // kittyID: ID of kitty in the reservation box
 // cointype: payment cointype
-func (a *Agent) MakeReservation(tx *bolt.Tx, depositAddr, userAddr, kittyID, cointype, verificationCode string) error {
+func (a *Agent) MakeReservation(tx *bolt.Tx, depositAddr, userAddr, kittyID, cointype, verificationCode string) (*Reservation, error) {
 	// verify the verification code
 	err := a.Verifier.VerifyCode(verificationCode)
 	if err != nil {
 		a.log.WithError(err).Error("Verifier.VerifyCode failed")
-		return err
+		return nil, err
 	}
 
-	// get the reservation for the reservation map
-	reservation, err := a.ReservationManager.GetReservationByKittyID(kittyID)
+	// get the reservation from the store
+	reservation, err := a.store.GetReservationWithTx(tx, kittyID)
 	if err != nil {
-		a.log.WithError(err).Error("ReservationManager.GetReservation failed")
-		return err
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return nil, ErrReservationNotFound
+		default:
+			a.log.WithError(err).Error("Storer.GetReservationWithTx failed")
+			return nil, err
+		}
 	}
 
 	// check whether the kitty is available or not
 	switch reservation.Status {
 	case Reserved:
-		return ErrBoxAlreadyReserved
+		return nil, ErrBoxAlreadyReserved
 	case Available:
 		// set the payment cointype
+		var price int64
 		switch cointype {
 		case "SKY":
+			price = reservation.PriceSKY
 		case "BTC":
-			reservation.CoinType = cointype
+			price = reservation.PriceBTC
+		case "ETH":
+			price = reservation.PriceETH
 		default:
-			return ErrInvalidCoinType
+			return nil, ErrInvalidCoinType
+		}
+
+		// a box without a price can't be paid for in this cointype
+		if price <= 0 {
+			return nil, ErrPriceNotSet
 		}
+
+		reservation.CoinType = cointype
 	case Delivered:
 		fallthrough
 	default:
-		return ErrInvalidReservationType
+		return nil, ErrInvalidReservationType
 	}
 
-	// fetch user from user manager or create it if not found
-	var u *User
-	u, err = a.UserManager.GetUser(userAddr)
-	if err != nil {
-		if err == ErrUserNotFound {
-			u = &User{
-				Address:      userAddr,
-				Reservations: []Reservation{},
-			}
-			err = a.store.AddUserWithTx(tx, u)
-			if err != nil {
-				a.log.WithError(err).Error("Agent.Store.AddUser failed")
-				return err
-			}
+	// set the reservation as reserved
+	reservation.MakeReserved()
+	reservation.DepositAddress = depositAddr
+	reservation.OwnerAddress = userAddr
+	if a.cfg.ReservationTimeout > 0 {
+		reservation.Expire = time.Now().Add(a.cfg.ReservationTimeout).Unix()
+	}
 
-			a.UserManager.AddUser(u)
-		} else {
-			a.log.WithError(err).Error("UserManager.GetUser failed")
-			return err
+	// add the reservation to the user, the user is created if not found
+	if err := a.UserManager.AddReservationTx(tx, userAddr, *reservation); err != nil {
+		if err != ErrMaxReservationsExceeded {
+			a.log.WithError(err).Error("UserManager.AddReservationTx failed")
 		}
+		return nil, err
+	}
+
+	// the kitty api is updated with the new reservation, a pending release of the kitty must not undo it
+	if err := RemovePendingReleaseTx(tx, kittyID); err != nil {
+		a.log.WithError(err).Error("RemovePendingReleaseTx failed")
+		return nil, err
 	}
 
-	// set the reservation as reserved
-	a.ReservationManager.ChangeReservationStatus(kittyID, Reserved)
-	reservation.DepositAddress = depositAddr
-	reservation.OwnerAddress = userAddr
 	// update the reservation
 	if err := a.store.UpdateReservationWithTx(tx, reservation); err != nil {
-		a.log.WithError(err).Errorf("CancelReservation failed for %s", reservation.KittyID)
-		return err
+		a.log.WithError(err).Errorf("UpdateReservation failed for %s", reservation.KittyID)
+		return nil, err
 	}
 
-	// update the user
-	updatedUser := *u
-	updatedUser.Reservations = append(updatedUser.Reservations, *reservation)
-	err = a.store.UpdateUserWithTx(tx, &updatedUser)
-	if err != nil {
-		a.log.WithError(err).Error("Storer.UpdateUser failed")
-		return err
+	if err := a.events.EmitTx(tx, webhook.EventReservationCreated, reservation); err != nil {
+		a.log.WithError(err).Error("EmitTx failed")
+		return nil, err
 	}
 
-	return err
+	r := *reservation
+	tx.OnCommit(func() {
+		a.ReservationManager.SetReservation(r)
+	})
+
+	return reservation, nil
 }
 
 // GetReservations gets reversation based on the reservation status
@@ -243,15 +315,157 @@ func (a *Agent) GetKittyDepositAddress(kittyID string) (string, error) {
 	return reservation.DepositAddress, nil
 }
 
-//TODO (therealssj): implement reservation expiry
-//func (a *Agent) ExpireReservations() {
-//	for {
-//		for _, reservation := range a.ReservationManager.Reservations {
-//			if reservation.Expire > time.Now().UnixNano() {
-//				depositAddress := reservation.DepositAddress
-//				reservation.MakeAvailable()
-//				a.store.UpdateReservation(reservation)
-//			}
-//		}
-//	}
-//}
+// ExpireReservations releases the reservations that were not paid before they expired,
+// so that their kitties can be reserved again. The reservations that were paid are
+// marked as delivered, so that they are not checked again.
+func (a *Agent) ExpireReservations() {
+	now := time.Now().Unix()
+	for _, r := range a.ReservationManager.GetReservationsByStatus(Reserved) {
+		if r.Expire == 0 || r.Expire > now {
+			continue
+		}
+
+		log := a.log.WithFields(logrus.Fields{
+			"kittyID":     r.KittyID,
+			"depositAddr": r.DepositAddress,
+			"ownerAddr":   r.OwnerAddress,
+		})
+
+		if err := a.releaseReservation(r); err != nil {
+			switch err {
+			case errReservationPaid:
+				// The reservation was paid before the deposit was marked as delivered
+				if err := a.store.DeliverReservation(r.KittyID, r.DepositAddress); err != nil {
+					log.WithError(err).Error("DeliverReservation failed")
+					continue
+				}
+				log.Info("Expired reservation was paid, marked as delivered")
+			case ErrInvalidReservationType:
+				// The reservation was delivered or released since it was listed
+			default:
+				log.WithError(err).Error("releaseReservation failed")
+				continue
+			}
+
+			if err := a.ReservationManager.ReloadReservations(a.store, []string{r.KittyID}); err != nil {
+				log.WithError(err).Error("ReloadReservations failed")
+			}
+			continue
+		}
+
+		log.Info("Released expired reservation")
+	}
+}
+
+// releaseReservation cancels a reservation unless it has been paid, unbinds
+// its deposit address and makes the kitty available in the kitty api.
+// The release in the kitty api is recorded in the same tx as the cancellation,
+// so if it fails, it is retried by RetryReleases.
+func (a *Agent) releaseReservation(r Reservation) error {
+	if _, err := a.store.CancelReservation(r.KittyID, func(r Reservation, tx *bolt.Tx) error {
+		paid, err := a.payments.IsPaidTx(tx, r.DepositAddress)
+		if err != nil {
+			return err
+		}
+
+		if paid {
+			return errReservationPaid
+		}
+
+		if err := a.payments.UnbindKittyTx(tx, r.KittyID); err != nil {
+			return err
+		}
+
+		if err := a.events.EmitTx(tx, webhook.EventReservationExpired, r); err != nil {
+			return err
+		}
+
+		if err := AddPendingReleaseTx(tx, r.KittyID); err != nil {
+			return err
+		}
+
+		tx.OnCommit(func() {
+			a.ReservationManager.MakeAvailable(r.KittyID)
+		})
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return a.release(PendingRelease{
+		KittyID: r.KittyID,
+	})
+}
+
+// RetryReleases retries the releases in the kitty api that failed and are due
+func (a *Agent) RetryReleases() {
+	releases, err := a.store.GetPendingReleases()
+	if err != nil {
+		a.log.WithError(err).Error("GetPendingReleases failed")
+		return
+	}
+
+	now := time.Now().UTC().Unix()
+	for _, p := range releases {
+		if p.NextAttempt > now {
+			continue
+		}
+
+		log := a.log.WithFields(logrus.Fields{
+			"kittyID":  p.KittyID,
+			"attempts": p.Attempts,
+		})
+
+		if err := a.release(p); err != nil {
+			log.WithError(err).Error("Retry release failed")
+			continue
+		}
+
+		log.Info("Released kitty in the kitty api")
+	}
+}
+
+// release makes the kitty of a pending release available in the kitty api.
+// The pending release is removed once it succeeds, otherwise it is retried
+// with an exponential backoff.
+func (a *Agent) release(p PendingRelease) error {
+	kittyID, err := iko.KittyIDFromString(p.KittyID)
+	if err != nil {
+		// an invalid kitty id can never be released, don't retry it
+		if err := a.store.RemovePendingRelease(p.KittyID); err != nil {
+			a.log.WithError(err).Error("RemovePendingRelease failed")
+		}
+		return err
+	}
+
+	if _, err := a.kittyReserver.SetReservation(&rpc.ReservationIn{
+		KittyID:     kittyID,
+		Reservation: Available,
+	}); err != nil {
+		p.Attempts++
+		p.LastError = err.Error()
+		p.NextAttempt = time.Now().UTC().Add(releaseRetryDelay(p.Attempts)).Unix()
+		if err := a.store.UpdatePendingRelease(p); err != nil {
+			a.log.WithError(err).Error("UpdatePendingRelease failed")
+		}
+
+		return fmt.Errorf("KittyAPI.SetReservation failed: %v", err)
+	}
+
+	return a.store.RemovePendingRelease(p.KittyID)
+}
+
+// releaseRetryDelay returns how long to wait after a number of failed release attempts
+func releaseRetryDelay(attempts int) time.Duration {
+	wait := releaseRetryWait
+	for i := 1; i < attempts && wait < maxReleaseRetryWait; i++ {
+		wait *= 2
+	}
+
+	if wait > maxReleaseRetryWait {
+		return maxReleaseRetryWait
+	}
+
+	return wait
+}
@@ -0,0 +1,356 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/kittycash/kitty-api/src/rpc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/testutil"
+	"github.com/kittycash/teller/src/webhook"
+)
+
+// dummyReserver records the reservations set in the kitty api, failing the first fails calls
+type dummyReserver struct {
+	fails        int
+	reservations []rpc.ReservationIn
+}
+
+func (d *dummyReserver) SetReservation(in *rpc.ReservationIn) (*rpc.ReservationOut, error) {
+	if d.fails > 0 {
+		d.fails--
+		return nil, errors.New("kitty api unavailable")
+	}
+
+	d.reservations = append(d.reservations, *in)
+	return &rpc.ReservationOut{}, nil
+}
+
+func newTestAgent(t *testing.T, maxReservations, nKitties int) (*Agent, func()) {
+	s, shutdown := newTestStore(t)
+
+	log, _ := testutil.NewLogger(t)
+
+	rm := &ReservationManager{
+		Reservations: make(map[string]*Reservation),
+	}
+	for i := 1; i <= nKitties; i++ {
+		r := Reservation{
+			KittyID:  fmt.Sprint(i),
+			Status:   Available,
+			PriceBTC: 100000,
+			PriceSKY: 1e6,
+		}
+		require.NoError(t, s.UpdateReservation(&r))
+		rm.SetReservation(r)
+	}
+
+	events, err := webhook.NewStore(log, s.db)
+	require.NoError(t, err)
+
+	a := &Agent{
+		log:                log,
+		store:              s,
+		events:             events,
+		cfg:                Config{MaxReservations: maxReservations},
+		ReservationManager: rm,
+		payments:           dummyPayments{},
+		UserManager:        NewUserManager(s, dummyPayments{}, maxReservations),
+		Verifier:           NewVerifier(log, false),
+		kittyReserver:      &dummyReserver{},
+	}
+
+	return a, shutdown
+}
+
+func makeReservation(a *Agent, depositAddr, userAddr, kittyID string) error {
+	return a.store.(*Store).db.Update(func(tx *bolt.Tx) error {
+		_, err := a.MakeReservation(tx, depositAddr, userAddr, kittyID, "BTC", "code")
+		return err
+	})
+}
+
+func getEvents(t *testing.T, a *Agent) []webhook.Delivery {
+	ds, err := a.events.(*webhook.Store).GetDeliveries(func(webhook.Delivery) bool { return true })
+	require.NoError(t, err)
+	return ds
+}
+
+func TestMakeReservation(t *testing.T) {
+	a, shutdown := newTestAgent(t, 1, 2)
+	defer shutdown()
+
+	require.Equal(t, ErrInvalidCoinType, a.store.(*Store).db.Update(func(tx *bolt.Tx) error {
+		_, err := a.MakeReservation(tx, "d1", "u1", "1", "DOGE", "code")
+		return err
+	}))
+	require.Equal(t, ErrReservationNotFound, makeReservation(a, "d1", "u1", "3"))
+
+	require.NoError(t, makeReservation(a, "d1", "u1", "1"))
+
+	r, err := a.store.GetReservationFromKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Reserved, r.Status)
+	require.Equal(t, "d1", r.DepositAddress)
+	require.Equal(t, "u1", r.OwnerAddress)
+
+	r, err = a.ReservationManager.GetReservationByKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Reserved, r.Status)
+
+	u, err := a.UserManager.GetUser("u1")
+	require.NoError(t, err)
+	require.Len(t, u.Reservations, 1)
+
+	ds := getEvents(t, a)
+	require.Len(t, ds, 1)
+	require.Equal(t, webhook.EventReservationCreated, ds[0].Event.Type)
+	require.Equal(t, webhook.DeliveryPending, ds[0].Status)
+
+	require.Equal(t, ErrBoxAlreadyReserved, makeReservation(a, "d2", "u2", "1"))
+	require.Equal(t, ErrMaxReservationsExceeded, makeReservation(a, "d2", "u1", "2"))
+}
+
+func TestMakeReservationRollback(t *testing.T) {
+	a, shutdown := newTestAgent(t, 1, 1)
+	defer shutdown()
+
+	// The tx fails after the reservation is made, e.g. the kitty api is unreachable
+	errAbort := errors.New("abort")
+	err := a.store.(*Store).db.Update(func(tx *bolt.Tx) error {
+		if _, err := a.MakeReservation(tx, "d1", "u1", "1", "BTC", "code"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.Equal(t, errAbort, err)
+
+	r, err := a.ReservationManager.GetReservationByKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Available, r.Status)
+
+	_, err = a.UserManager.GetUser("u1")
+	require.Equal(t, ErrUserNotFound, err)
+	require.Empty(t, getEvents(t, a))
+
+	// Nothing was kept, so the user can still reserve the kitty
+	require.NoError(t, makeReservation(a, "d1", "u1", "1"))
+}
+
+func TestMakeReservationConcurrentSameUser(t *testing.T) {
+	maxReservations := 2
+	nKitties := 10
+	a, shutdown := newTestAgent(t, maxReservations, nKitties)
+	defer shutdown()
+
+	errs := make([]error, nKitties)
+	var wg sync.WaitGroup
+	for i := 0; i < nKitties; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			kittyID := fmt.Sprint(i + 1)
+			errs[i] = makeReservation(a, "d"+kittyID, "u1", kittyID)
+		}(i)
+	}
+	wg.Wait()
+
+	var nReserved int
+	for _, err := range errs {
+		switch err {
+		case nil:
+			nReserved++
+		case ErrMaxReservationsExceeded:
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	require.Equal(t, maxReservations, nReserved)
+
+	u, err := a.UserManager.GetUser("u1")
+	require.NoError(t, err)
+	require.Len(t, u.Reservations, maxReservations)
+
+	reserved, err := a.store.GetReservationsByStatus(Reserved)
+	require.NoError(t, err)
+	require.Len(t, reserved, maxReservations)
+	require.Len(t, a.ReservationManager.GetReservationsByStatus(Reserved), maxReservations)
+}
+
+func TestMakeReservationConcurrentSameKitty(t *testing.T) {
+	a, shutdown := newTestAgent(t, 1, 1)
+	defer shutdown()
+
+	nUsers := 10
+	errs := make([]error, nUsers)
+	var wg sync.WaitGroup
+	for i := 0; i < nUsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = makeReservation(a, fmt.Sprintf("d%d", i), fmt.Sprintf("u%d", i), "1")
+		}(i)
+	}
+	wg.Wait()
+
+	owner := -1
+	for i, err := range errs {
+		switch err {
+		case nil:
+			require.Equal(t, -1, owner, "kitty reserved twice")
+			owner = i
+		case ErrBoxAlreadyReserved:
+			_, err := a.UserManager.GetUser(fmt.Sprintf("u%d", i))
+			require.Equal(t, ErrUserNotFound, err)
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	require.NotEqual(t, -1, owner)
+
+	r, err := a.store.GetReservationFromKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("u%d", owner), r.OwnerAddress)
+
+	r, err = a.ReservationManager.GetReservationByKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("u%d", owner), r.OwnerAddress)
+}
+
+func TestExpireReservationsPaid(t *testing.T) {
+	a, shutdown := newTestAgent(t, 0, 2)
+	defer shutdown()
+
+	a.cfg.ReservationTimeout = time.Nanosecond
+	a.payments = dummyPayments{"d1": true}
+
+	require.NoError(t, makeReservation(a, "d1", "u1", "1"))
+	require.NoError(t, makeReservation(a, "d2", "u2", "2"))
+
+	// The exchange marked the payment of kitty 2 as delivered, the agent has not seen it yet
+	err := a.store.(*Store).db.Update(func(tx *bolt.Tx) error {
+		return DeliverReservationTx(tx, "2", "d2")
+	})
+	require.NoError(t, err)
+
+	a.ExpireReservations()
+
+	// The expired reservations that were paid are delivered, so they are not checked again
+	for _, kittyID := range []string{"1", "2"} {
+		r, err := a.store.GetReservationFromKittyID(kittyID)
+		require.NoError(t, err)
+		require.Equal(t, Delivered, r.Status)
+		require.Equal(t, "d"+kittyID, r.DepositAddress)
+
+		r, err = a.ReservationManager.GetReservationByKittyID(kittyID)
+		require.NoError(t, err)
+		require.Equal(t, Delivered, r.Status)
+	}
+
+	require.Empty(t, a.ReservationManager.GetReservationsByStatus(Reserved))
+
+	// A delivered reservation can't be reserved again
+	require.Equal(t, ErrInvalidReservationType, makeReservation(a, "d3", "u3", "1"))
+}
+
+func TestExpireReservationsRetryRelease(t *testing.T) {
+	a, shutdown := newTestAgent(t, 0, 2)
+	defer shutdown()
+
+	a.cfg.ReservationTimeout = time.Nanosecond
+	kittyAPI := &dummyReserver{fails: 1}
+	a.kittyReserver = kittyAPI
+
+	require.NoError(t, makeReservation(a, "d1", "u1", "1"))
+
+	// The kitty api is unavailable when the reservation expires
+	a.ExpireReservations()
+
+	r, err := a.store.GetReservationFromKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Available, r.Status)
+	require.Empty(t, kittyAPI.reservations)
+
+	// The failed release is recorded, and retried later
+	releases, err := a.store.GetPendingReleases()
+	require.NoError(t, err)
+	require.Len(t, releases, 1)
+	require.Equal(t, "1", releases[0].KittyID)
+	require.Equal(t, 1, releases[0].Attempts)
+	require.NotEmpty(t, releases[0].LastError)
+	require.True(t, releases[0].NextAttempt > time.Now().Unix())
+
+	// The release is not retried before it is due
+	a.RetryReleases()
+	require.Empty(t, kittyAPI.reservations)
+
+	releases[0].NextAttempt = time.Now().Unix()
+	require.NoError(t, a.store.UpdatePendingRelease(releases[0]))
+
+	a.RetryReleases()
+	require.Len(t, kittyAPI.reservations, 1)
+	require.Equal(t, Available, kittyAPI.reservations[0].Reservation)
+	require.Equal(t, "1", kittyAPI.reservations[0].KittyID.String())
+
+	releases, err = a.store.GetPendingReleases()
+	require.NoError(t, err)
+	require.Empty(t, releases)
+
+	// A kitty reserved again before its release is retried is not released
+	require.NoError(t, makeReservation(a, "d2", "u2", "2"))
+	kittyAPI.fails = 1
+	a.ExpireReservations()
+
+	releases, err = a.store.GetPendingReleases()
+	require.NoError(t, err)
+	require.Len(t, releases, 1)
+
+	require.NoError(t, makeReservation(a, "d3", "u3", "2"))
+
+	releases, err = a.store.GetPendingReleases()
+	require.NoError(t, err)
+	require.Empty(t, releases)
+}
+
+func TestReleaseRetryDelay(t *testing.T) {
+	require.Equal(t, releaseRetryWait, releaseRetryDelay(1))
+	require.Equal(t, releaseRetryWait*2, releaseRetryDelay(2))
+	require.Equal(t, releaseRetryWait*4, releaseRetryDelay(3))
+	require.Equal(t, maxReleaseRetryWait, releaseRetryDelay(100))
+}
+
+func TestDeliverReservationTx(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	err := s.UpdateReservation(&Reservation{
+		KittyID:        "1",
+		DepositAddress: "d1",
+		OwnerAddress:   "u1",
+		Status:         Reserved,
+	})
+	require.NoError(t, err)
+
+	// Not the deposit address of the reservation
+	err = s.DeliverReservation("1", "d2")
+	require.NoError(t, err)
+	r, err := s.GetReservationFromKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Reserved, r.Status)
+
+	err = s.DeliverReservation("1", "d1")
+	require.NoError(t, err)
+	r, err = s.GetReservationFromKittyID("1")
+	require.NoError(t, err)
+	require.Equal(t, Delivered, r.Status)
+	require.Equal(t, "u1", r.OwnerAddress)
+
+	// A delivered reservation can't be cancelled
+	_, err = s.CancelReservation("1", func(Reservation, *bolt.Tx) error { return nil })
+	require.Equal(t, ErrInvalidReservationType, err)
+}
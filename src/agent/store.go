@@ -3,6 +3,7 @@ package agent
 import (
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/sirupsen/logrus"
@@ -18,24 +19,43 @@ var (
 	UsersBkt = []byte("users")
 	// KittyOwnerBkt maps kitty id to the skycoin address of the user who has reserved it
 	KittyOwnerBkt = []byte("kitty_owner_idex")
+	// PendingReleasesBkt maps kitty id to a release of its reservation in the kitty api that has not succeeded yet
+	PendingReleasesBkt = []byte("pending_releases")
 )
 
+// PendingRelease records a kitty that must be made available in the kitty api.
+// It is saved in the tx that cancels the reservation, so the release is retried until it succeeds.
+type PendingRelease struct {
+	KittyID     string `json:"kitty_id"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
 // Storer interface handles database interactions
 type Storer interface {
 	GetReservations() ([]Reservation, error)
 	GetReservationsByStatus(status string) ([]Reservation, error)
 	GetReservationFromKittyID(kittyID string) (*Reservation, error)
+	GetReservationWithTx(tx *bolt.Tx, kittyID string) (*Reservation, error)
 	GetReservationUserFromKittyID(kittyID string) (*User, error)
 	AddUser(user *User) error
 	AddUserWithTx(tx *bolt.Tx, user *User) error
 	GetUsers() ([]User, error)
 	GetUser(userAddr string) (*User, error)
+	GetUserWithTx(tx *bolt.Tx, userAddr string) (*User, error)
 	GetUserReservations(userAddr string) ([]Reservation, error)
 	UpdateUser(user *User) error
 	UpdateUserWithTx(tx *bolt.Tx, user *User) error
 	UpdateReservation(reservation *Reservation) error
 	UpdateReservationWithTx(tx *bolt.Tx, reservation *Reservation) error
 	UpdateReservations(reservations []*Reservation) error
+	CancelReservation(kittyID string, callback func(Reservation, *bolt.Tx) error) (*Reservation, error)
+	DeliverReservation(kittyID, depositAddr string) error
+	MergeCatalogue(entries []Reservation, merge func(r, entry Reservation) (Reservation, bool, bool)) ([]Reservation, CatalogueCounts, error)
+	GetPendingReleases() ([]PendingRelease, error)
+	UpdatePendingRelease(release PendingRelease) error
+	RemovePendingRelease(kittyID string) error
 }
 
 // Store saves reservations and user data
@@ -66,6 +86,11 @@ func NewStore(log logrus.FieldLogger, db *bolt.DB) (*Store, error) {
 			return dbutil.NewCreateBucketFailedErr(KittyOwnerBkt, err)
 		}
 
+		// create pending releases bkt if not exist
+		if _, err := tx.CreateBucketIfNotExists(PendingReleasesBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(PendingReleasesBkt, err)
+		}
+
 		return nil
 	}); err != nil {
 		return nil, err
@@ -104,10 +129,12 @@ func (s *Store) GetReservations() ([]Reservation, error) {
 
 // GetReservationFromKittyID returns a reservation from the kittyID
 func (s *Store) GetReservationFromKittyID(kittyID string) (*Reservation, error) {
-	reservation := &Reservation{}
+	var reservation *Reservation
 
 	if err := s.db.View(func(tx *bolt.Tx) error {
-		return dbutil.GetBucketObject(tx, ReservationsKittyBkt, kittyID, reservation)
+		var err error
+		reservation, err = s.GetReservationWithTx(tx, kittyID)
+		return err
 	}); err != nil {
 		return nil, err
 	}
@@ -115,6 +142,17 @@ func (s *Store) GetReservationFromKittyID(kittyID string) (*Reservation, error)
 	return reservation, nil
 }
 
+// GetReservationWithTx returns a reservation from the kittyID within a transaction
+func (s *Store) GetReservationWithTx(tx *bolt.Tx, kittyID string) (*Reservation, error) {
+	reservation := &Reservation{}
+
+	if err := dbutil.GetBucketObject(tx, ReservationsKittyBkt, kittyID, reservation); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
 // GetReservationUserFromKittyID returns the user who has reserved the reservation for the given kittyID
 // Args:
 // kittyID: ID of a kitty reserved by the user
@@ -207,10 +245,24 @@ func (s *Store) GetUser(userAddr string) (*User, error) {
 	var user *User
 
 	if err := s.db.View(func(tx *bolt.Tx) error {
-		return dbutil.GetBucketObject(tx, UsersBkt, userAddr, user)
+		var err error
+		user, err = s.GetUserWithTx(tx, userAddr)
+		return err
 	}); err != nil {
 		return nil, err
 	}
+
+	return user, nil
+}
+
+// GetUserWithTx gets user info from the user address within a transaction
+func (s *Store) GetUserWithTx(tx *bolt.Tx, userAddr string) (*User, error) {
+	user := &User{}
+
+	if err := dbutil.GetBucketObject(tx, UsersBkt, userAddr, user); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
@@ -261,3 +313,194 @@ func (s *Store) UpdateReservations(reservations []*Reservation) error {
 		return err
 	})
 }
+
+// CancelReservation makes a reserved kitty available again and removes the reservation from its user.
+// The callback is called inside of the transaction with the reservation before it is cancelled.
+// If the callback returns an error, the cancellation is rolled back.
+func (s *Store) CancelReservation(kittyID string, callback func(Reservation, *bolt.Tx) error) (*Reservation, error) {
+	var reservation Reservation
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := dbutil.GetBucketObject(tx, ReservationsKittyBkt, kittyID, &reservation); err != nil {
+			return err
+		}
+
+		if reservation.Status != Reserved {
+			return ErrInvalidReservationType
+		}
+
+		if err := callback(reservation, tx); err != nil {
+			return err
+		}
+
+		userAddr := reservation.OwnerAddress
+		reservation.MakeAvailable()
+		if err := s.UpdateReservationWithTx(tx, &reservation); err != nil {
+			return err
+		}
+
+		var user User
+		if err := dbutil.GetBucketObject(tx, UsersBkt, userAddr, &user); err != nil {
+			switch err.(type) {
+			case dbutil.ObjectNotExistErr:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		user.Reservations = removeReservation(user.Reservations, kittyID)
+		return s.UpdateUserWithTx(tx, &user)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &reservation, nil
+}
+
+// DeliverReservation marks the reservation of a kitty paid at depositAddr as delivered
+func (s *Store) DeliverReservation(kittyID, depositAddr string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return DeliverReservationTx(tx, kittyID, depositAddr)
+	})
+}
+
+// DeliverReservationTx marks the reservation of a kitty paid at depositAddr as delivered in a bolt.Tx,
+// once its full price has been received. A delivered reservation does not expire.
+// It is a no-op if the kitty is not reserved to depositAddr.
+func DeliverReservationTx(tx *bolt.Tx, kittyID, depositAddr string) error {
+	var r Reservation
+	if err := dbutil.GetBucketObject(tx, ReservationsKittyBkt, kittyID, &r); err != nil {
+		return err
+	}
+
+	if r.Status != Reserved || r.DepositAddress != depositAddr {
+		return nil
+	}
+
+	r.Status = Delivered
+
+	return dbutil.PutBucketValue(tx, ReservationsKittyBkt, kittyID, r)
+}
+
+// AddPendingReleaseTx records in a bolt.Tx that a kitty must be made available in the kitty api.
+// The release is due immediately, a previous pending release of the kitty is replaced.
+func AddPendingReleaseTx(tx *bolt.Tx, kittyID string) error {
+	return dbutil.PutBucketValue(tx, PendingReleasesBkt, kittyID, PendingRelease{
+		KittyID:     kittyID,
+		NextAttempt: time.Now().UTC().Unix(),
+	})
+}
+
+// RemovePendingReleaseTx removes the pending release of a kitty in a bolt.Tx, if any
+func RemovePendingReleaseTx(tx *bolt.Tx, kittyID string) error {
+	bkt := tx.Bucket(PendingReleasesBkt)
+	if bkt == nil {
+		return dbutil.NewBucketNotExistErr(PendingReleasesBkt)
+	}
+
+	return bkt.Delete([]byte(kittyID))
+}
+
+// GetPendingReleases returns the pending releases, ordered by kitty id
+func (s *Store) GetPendingReleases() ([]PendingRelease, error) {
+	var releases []PendingRelease
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEach(tx, PendingReleasesBkt, func(k, v []byte) error {
+			var release PendingRelease
+			if err := json.Unmarshal(v, &release); err != nil {
+				return err
+			}
+
+			releases = append(releases, release)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// UpdatePendingRelease saves a failed attempt of a pending release.
+// It is a no-op if the release is no longer pending, e.g. the kitty was reserved again.
+func (s *Store) UpdatePendingRelease(release PendingRelease) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		exists, err := dbutil.BucketHasKey(tx, PendingReleasesBkt, release.KittyID)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return nil
+		}
+
+		return dbutil.PutBucketValue(tx, PendingReleasesBkt, release.KittyID, release)
+	})
+}
+
+// RemovePendingRelease removes the pending release of a kitty, once it has succeeded
+func (s *Store) RemovePendingRelease(kittyID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return RemovePendingReleaseTx(tx, kittyID)
+	})
+}
+
+// MergeCatalogue saves catalogue entries in one transaction. Entries of unknown kitties are added.
+// Otherwise merge returns the reservation merged with the entry, whether it changed, and whether they conflict.
+// Returns the reservations that were added or changed.
+func (s *Store) MergeCatalogue(entries []Reservation, merge func(r, entry Reservation) (Reservation, bool, bool)) ([]Reservation, CatalogueCounts, error) {
+	var saved []Reservation
+	var counts CatalogueCounts
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		saved = nil
+		counts = CatalogueCounts{}
+
+		for _, entry := range entries {
+			var r Reservation
+			if err := dbutil.GetBucketObject(tx, ReservationsKittyBkt, entry.KittyID, &r); err != nil {
+				switch err.(type) {
+				case dbutil.ObjectNotExistErr:
+				default:
+					return err
+				}
+
+				if err := s.UpdateReservationWithTx(tx, &entry); err != nil {
+					return err
+				}
+
+				saved = append(saved, entry)
+				counts.Added++
+				continue
+			}
+
+			merged, changed, conflict := merge(r, entry)
+			if conflict {
+				s.log.WithFields(logrus.Fields{
+					"reservation":    r,
+					"catalogueEntry": entry,
+				}).Warn("Kitty in the catalogue conflicts with the reservation, keeping the reservation")
+				counts.Conflicts++
+			}
+
+			if !changed {
+				continue
+			}
+
+			if err := s.UpdateReservationWithTx(tx, &merged); err != nil {
+				return err
+			}
+
+			saved = append(saved, merged)
+			counts.Updated++
+		}
+
+		return nil
+	}); err != nil {
+		return nil, CatalogueCounts{}, err
+	}
+
+	return saved, counts, nil
+}
@@ -3,6 +3,10 @@ package agent
 import (
 	"errors"
 	"sync"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/kittycash/teller/src/util/dbutil"
 )
 
 var (
@@ -12,49 +16,107 @@ var (
 
 // User represent a kitty cash user
 type User struct {
-	mux sync.Mutex `json:"-"`
 	// Users skycoin address
 	Address string `json:"address"`
-	// A user can have multiple reservations
-	// capped by maxReservation
+	// A user can have multiple reservations,
+	// the unpaid ones are capped by UserManager's maxReservations
 	Reservations []Reservation `json:"reservations"`
 }
 
-// CanReserve checks if the user can make any more reservations
-func (u *User) CanReserve() bool {
-	return len(u.Reservations) < maxReservation
+// UserManager keeps tracks of user reservations.
+// The users are saved in the store, which is the source of truth.
+type UserManager struct {
+	sync.Mutex
+	store    Storer
+	payments PaymentTracker
+	// Max number of unpaid reservations a user can have, 0 means unlimited
+	maxReservations int
 }
 
-// UserManager keeps tracks of user reservations
-type UserManager struct {
-	Users map[string]*User
+// NewUserManager creates a UserManager
+func NewUserManager(store Storer, payments PaymentTracker, maxReservations int) *UserManager {
+	return &UserManager{
+		store:           store,
+		payments:        payments,
+		maxReservations: maxReservations,
+	}
 }
 
-// GetUser returns a user from the usermanager
+// GetUser returns a user from the store
 func (um *UserManager) GetUser(userAddr string) (*User, error) {
-	u, ok := um.Users[userAddr]
-	if !ok {
-		return nil, ErrUserNotFound
+	u, err := um.store.GetUser(userAddr)
+	if err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return nil, ErrUserNotFound
+		default:
+			return nil, err
+		}
 	}
 
 	return u, nil
 }
 
-// GetUser returns a user from the usermanager
-func (um *UserManager) AddUser(user *User) {
-	um.Users[user.Address] = user
+// CanReserveTx checks if the user can make any more reservations within a db tx.
+// Paid reservations stay with the user, but they do not count towards the cap.
+func (um *UserManager) CanReserveTx(tx *bolt.Tx, u *User) (bool, error) {
+	if um.maxReservations == 0 {
+		return true, nil
+	}
+
+	unpaid := 0
+	for _, r := range u.Reservations {
+		paid, err := um.payments.IsPaidTx(tx, r.DepositAddress)
+		if err != nil {
+			return false, err
+		}
+
+		if !paid {
+			unpaid++
+		}
+	}
+
+	return unpaid < um.maxReservations, nil
 }
 
-// AddReservation adds reservation to a usermanager
-func (um *UserManager) AddReservation(u *User, reservation *Reservation) error {
-	u.mux.Lock()
-	defer u.mux.Unlock()
-	if !u.CanReserve() {
+// AddReservationTx adds a reservation to a user within a db tx, creating the user if it does not exist.
+// Returns ErrMaxReservationsExceeded if the user can't make any more reservations.
+func (um *UserManager) AddReservationTx(tx *bolt.Tx, userAddr string, reservation Reservation) error {
+	um.Lock()
+	defer um.Unlock()
+
+	u, err := um.store.GetUserWithTx(tx, userAddr)
+	if err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			u = &User{
+				Address:      userAddr,
+				Reservations: []Reservation{},
+			}
+		default:
+			return err
+		}
+	}
+
+	if ok, err := um.CanReserveTx(tx, u); err != nil {
+		return err
+	} else if !ok {
 		return ErrMaxReservationsExceeded
 	}
 
-	reservation.MakeReserved()
-	u.Reservations = append(u.Reservations, *reservation)
+	u.Reservations = append(removeReservation(u.Reservations, reservation.KittyID), reservation)
+
+	return um.store.UpdateUserWithTx(tx, u)
+}
+
+// removeReservation returns a copy of reservations without the reservation of kittyID
+func removeReservation(reservations []Reservation, kittyID string) []Reservation {
+	filtered := make([]Reservation, 0, len(reservations))
+	for _, r := range reservations {
+		if r.KittyID != kittyID {
+			filtered = append(filtered, r)
+		}
+	}
 
-	return nil
+	return filtered
 }
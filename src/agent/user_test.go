@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/dbutil"
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	db, shutdown := testutil.PrepareDB(t)
+
+	log, _ := testutil.NewLogger(t)
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+
+	return s, shutdown
+}
+
+// dummyPayments is a PaymentTracker of deposit addresses that are paid
+type dummyPayments map[string]bool
+
+func (p dummyPayments) IsPaidTx(tx *bolt.Tx, depositAddr string) (bool, error) {
+	return p[depositAddr], nil
+}
+
+func (p dummyPayments) UnbindKittyTx(tx *bolt.Tx, kittyID string) error {
+	return nil
+}
+
+func TestStoreGetUser(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	_, err := s.GetUser("a")
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+
+	u := &User{
+		Address: "a",
+		Reservations: []Reservation{
+			{
+				KittyID: "1",
+				Status:  Reserved,
+			},
+		},
+	}
+	err = s.AddUser(u)
+	require.NoError(t, err)
+
+	user, err := s.GetUser("a")
+	require.NoError(t, err)
+	require.Equal(t, u, user)
+
+	reservations, err := s.GetUserReservations("a")
+	require.NoError(t, err)
+	require.Equal(t, u.Reservations, reservations)
+}
+
+func TestUserManagerAddReservation(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	um := NewUserManager(s, dummyPayments{}, 2)
+
+	_, err := um.GetUser("a")
+	require.Equal(t, ErrUserNotFound, err)
+
+	addReservation := func(kittyID string) error {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return um.AddReservationTx(tx, "a", Reservation{
+				KittyID: kittyID,
+				Status:  Reserved,
+			})
+		})
+	}
+
+	require.NoError(t, addReservation("1"))
+	require.NoError(t, addReservation("2"))
+	require.Equal(t, ErrMaxReservationsExceeded, addReservation("3"))
+
+	u, err := um.GetUser("a")
+	require.NoError(t, err)
+	require.Len(t, u.Reservations, 2)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		ok, err := um.CanReserveTx(tx, u)
+		require.False(t, ok)
+		return err
+	})
+	require.NoError(t, err)
+
+	// A cancelled reservation frees a slot
+	err = s.UpdateReservation(&Reservation{
+		KittyID:      "1",
+		OwnerAddress: "a",
+		Status:       Reserved,
+	})
+	require.NoError(t, err)
+	_, err = s.CancelReservation("1", func(Reservation, *bolt.Tx) error { return nil })
+	require.NoError(t, err)
+
+	require.NoError(t, addReservation("3"))
+
+	u, err = um.GetUser("a")
+	require.NoError(t, err)
+	require.Equal(t, []Reservation{
+		{KittyID: "2", Status: Reserved},
+		{KittyID: "3", Status: Reserved},
+	}, u.Reservations)
+
+	// 0 means unlimited
+	um = NewUserManager(s, dummyPayments{}, 0)
+	require.NoError(t, addReservation("4"))
+}
+
+func TestUserManagerPaidReservations(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	payments := dummyPayments{}
+	um := NewUserManager(s, payments, 5)
+
+	addReservation := func(kittyID string) error {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return um.AddReservationTx(tx, "a", Reservation{
+				KittyID:        kittyID,
+				DepositAddress: "d" + kittyID,
+				Status:         Reserved,
+			})
+		})
+	}
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, addReservation(fmt.Sprint(i)))
+	}
+	require.Equal(t, ErrMaxReservationsExceeded, addReservation("6"))
+
+	// The paid reservations do not count towards the cap
+	for i := 1; i <= 5; i++ {
+		payments[fmt.Sprintf("d%d", i)] = true
+	}
+	require.NoError(t, addReservation("6"))
+
+	u, err := um.GetUser("a")
+	require.NoError(t, err)
+	require.Len(t, u.Reservations, 6)
+}
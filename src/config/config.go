@@ -6,13 +6,18 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/spf13/viper"
 
 	"github.com/skycoin/skycoin/src/visor"
+
+	"github.com/kittycash/teller/src/util/btcaddr"
+	"github.com/kittycash/teller/src/util/mathutil"
 )
 
 // Config represents the configuration root
@@ -26,22 +31,37 @@ type Config struct {
 	// Where database is saved, inside the ~/.teller-kittycash data directory
 	DBFilename string `mapstructure:"dbfile"`
 
+	// Bitcoin network of the BTC addresses and node: mainnet, testnet3, regtest or simnet
+	BtcNetwork string `mapstructure:"btc_network"`
 	// Path of BTC addresses JSON file
 	BtcAddresses string `mapstructure:"btc_addresses"`
 	// Path of SKY addresses JSON file
 	SkyAddresses string `mapstructure:"sky_addresses"`
+	// Path of ETH addresses JSON file
+	EthAddresses string `mapstructure:"eth_addresses"`
+	// BIP32 extended public key to derive BTC addresses from, instead of BtcAddresses
+	BtcXPub string `mapstructure:"btc_xpub"`
+	// BIP32 extended public key to derive SKY addresses from, instead of SkyAddresses.
+	// The addresses cannot be recovered from a skycoin wallet seed, only from the BIP32 wallet of the key
+	SkyXPub string `mapstructure:"sky_xpub"`
 
 	Teller Teller `mapstructure:"teller"`
 
 	SkyRPC SkyRPC `mapstructure:"sky_rpc"`
 	BtcRPC BtcRPC `mapstructure:"btc_rpc"`
+	EthRPC EthRPC `mapstructure:"eth_rpc"`
 
 	KittyClientAddr string `mapstructure:"kitty_client_addr"`
 
 	BtcScanner   BtcScanner   `mapstructure:"btc_scanner"`
 	SkyScanner   SkyScanner   `mapstructure:"sky_scanner"`
+	EthScanner   EthScanner   `mapstructure:"eth_scanner"`
 	BoxExchanger BoxExchanger `mapstructure:"box_exchanger"`
 
+	Refund Refund `mapstructure:"refund"`
+
+	Webhook Webhook `mapstructure:"webhook"`
+
 	Web Web `mapstructure:"web"`
 
 	AdminPanel AdminPanel `mapstructure:"admin_panel"`
@@ -57,10 +77,12 @@ type Config struct {
 
 // Teller config for teller
 type Teller struct {
-	// Max number of btc addresses a skycoin address can bind
+	// Max number of unpaid kitty reservations a skycoin address can have, each bound to its own deposit address. 0 means unlimited
 	MaxBoundAddresses int `mapstructure:"max_bound_addrs"`
 	// Allow address binding
 	BindEnabled bool `mapstructure:"bind_enabled"`
+	// How long a reservation is held before the kitty is released if it is not paid
+	ReservationTimeout time.Duration `mapstructure:"reservation_timeout"`
 }
 
 // SkyRPC config for Skycoin daemon node RPC
@@ -68,12 +90,31 @@ type SkyRPC struct {
 	Address string `mapstructure:"address"`
 }
 
+const (
+	// BtcBackendBtcd scans BTC with btcd over a TLS websocket connection
+	BtcBackendBtcd = "btcd"
+	// BtcBackendBitcoind scans BTC with bitcoind over HTTP
+	BtcBackendBitcoind = "bitcoind"
+	// BtcBackendEsplora scans the BTC deposit addresses with an Esplora-compatible REST API
+	BtcBackendEsplora = "esplora"
+)
+
 // BtcRPC config for btcrpc
 type BtcRPC struct {
+	// BTC node implementation, BtcBackendBtcd, BtcBackendBitcoind or BtcBackendEsplora
+	Backend string `mapstructure:"backend"`
+	Server  string `mapstructure:"server"`
+	User    string `mapstructure:"user"`
+	Pass    string `mapstructure:"pass"`
+	Cert    string `mapstructure:"cert"`
+	// Path of bitcoind's .cookie file, used instead of user and pass [bitcoind]
+	Cookie string `mapstructure:"cookie"`
+}
+
+// EthRPC config for geth RPC
+type EthRPC struct {
 	Server string `mapstructure:"server"`
-	User   string `mapstructure:"user"`
-	Pass   string `mapstructure:"pass"`
-	Cert   string `mapstructure:"cert"`
+	Port   string `mapstructure:"port"`
 }
 
 // BtcScanner config for BTC scanner
@@ -83,14 +124,36 @@ type BtcScanner struct {
 	InitialScanHeight     int64         `mapstructure:"initial_scan_height"`
 	ConfirmationsRequired int64         `mapstructure:"confirmations_required"`
 	Enabled               bool          `mapstructure:"enabled"`
+	// Show deposits in the mempool before they are confirmed
+	ScanMempool bool `mapstructure:"scan_mempool"`
+	// Scan new blocks as soon as btcd announces them over the websocket connection
+	Notifications bool `mapstructure:"notifications"`
+	// How often to try to scan for blocks while btcd announces them
+	NotifyScanPeriod time.Duration `mapstructure:"notify_scan_period"`
+	// How many blocks to fetch concurrently while catching up with the chain, e.g. after downtime
+	CatchUpConcurrency int `mapstructure:"catch_up_concurrency"`
 }
 
 // SkyScanner config for SKY Scanner
 type SkyScanner struct {
 	// How often to try to scan for blocks
-	ScanPeriod        time.Duration `mapstructure:"scan_period"`
-	InitialScanHeight int64         `mapstructure:"initial_scan_height"`
-	Enabled           bool          `mapstructure:"enabled"`
+	ScanPeriod            time.Duration `mapstructure:"scan_period"`
+	InitialScanHeight     int64         `mapstructure:"initial_scan_height"`
+	ConfirmationsRequired int64         `mapstructure:"confirmations_required"`
+	Enabled               bool          `mapstructure:"enabled"`
+	// How many blocks to fetch concurrently while catching up with the chain, e.g. after downtime
+	CatchUpConcurrency int `mapstructure:"catch_up_concurrency"`
+}
+
+// EthScanner config for ETH Scanner
+type EthScanner struct {
+	// How often to try to scan for blocks
+	ScanPeriod            time.Duration `mapstructure:"scan_period"`
+	InitialScanHeight     int64         `mapstructure:"initial_scan_height"`
+	ConfirmationsRequired int64         `mapstructure:"confirmations_required"`
+	Enabled               bool          `mapstructure:"enabled"`
+	// How many blocks to fetch concurrently while catching up with the chain, e.g. after downtime
+	CatchUpConcurrency int `mapstructure:"catch_up_concurrency"`
 }
 
 // BoxExchanger config for box sender
@@ -103,6 +166,14 @@ type BoxExchanger struct {
 	TxConfirmationCheckWait time.Duration `mapstructure:"tx_confirmation_check_wait"`
 	// Allow sending of boxes (deposits will still be received and recorded)
 	SendEnabled bool `mapstructure:"send_enabled"`
+	// SKY/ETH exchange rate used to price boxes in ETH, ETH payments are disabled if unset
+	SkyETHExchangeRate string `mapstructure:"sky_eth_exchange_rate"`
+	// How long to wait before retrying a deposit that failed to be processed, doubled after each failure
+	RetryWait time.Duration `mapstructure:"retry_wait"`
+	// Max time to wait before retrying a failed deposit
+	MaxRetryWait time.Duration `mapstructure:"max_retry_wait"`
+	// Number of attempts to process a deposit before it is moved to the dead letters
+	MaxRetryAttempts int `mapstructure:"max_retry_attempts"`
 }
 
 // Validate validates the BoxExchanger config
@@ -125,9 +196,71 @@ func (c BoxExchanger) validate() []error {
 		errs = append(errs, fmt.Errorf("sky_exchanger.max_decimals is larger than visor.MaxDropletPrecision=%d", visor.MaxDropletPrecision))
 	}
 
+	if c.SkyETHExchangeRate != "" {
+		if _, err := mathutil.ParseRate(c.SkyETHExchangeRate); err != nil {
+			errs = append(errs, fmt.Errorf("box_exchanger.sky_eth_exchange_rate invalid: %v", err))
+		}
+	}
+
+	if c.RetryWait < 0 {
+		errs = append(errs, errors.New("box_exchanger.retry_wait can't be negative"))
+	}
+
+	if c.MaxRetryWait != 0 && c.MaxRetryWait < c.RetryWait {
+		errs = append(errs, errors.New("box_exchanger.max_retry_wait must be >= box_exchanger.retry_wait"))
+	}
+
+	if c.MaxRetryAttempts < 0 {
+		errs = append(errs, errors.New("box_exchanger.max_retry_attempts can't be negative"))
+	}
+
 	return errs
 }
 
+// Refund config for paying back overpayments and payments to expired reservations
+type Refund struct {
+	// Send refunds automatically. Otherwise refunds are only recorded, to be paid by an operator
+	SendEnabled bool `mapstructure:"send_enabled"`
+	// How often to check for refunds to send
+	SendPeriod time.Duration `mapstructure:"send_period"`
+	// Address of the skycoin node web interface that holds the SKY refund wallet
+	SkyNodeAddr string `mapstructure:"sky_node_addr"`
+	// Wallet in the skycoin node to send SKY refunds from. SKY refunds are not sent if unset
+	SkyWallet string `mapstructure:"sky_wallet"`
+	// btcwallet RPC to send BTC refunds from. BTC refunds are not sent if the server is unset
+	BtcWallet BtcRPC `mapstructure:"btc_wallet"`
+}
+
+// Validate validates the Refund config
+func (c Refund) Validate() error {
+	if !c.SendEnabled {
+		return nil
+	}
+
+	if c.SendPeriod <= 0 {
+		return errors.New("refund.send_period must be > 0")
+	}
+
+	if c.SkyWallet == "" && c.BtcWallet.Server == "" {
+		return errors.New("refund.send_enabled requires refund.sky_wallet or refund.btc_wallet.server")
+	}
+
+	if c.SkyWallet != "" && c.SkyNodeAddr == "" {
+		return errors.New("refund.sky_node_addr missing")
+	}
+
+	if c.BtcWallet.Server != "" {
+		if c.BtcWallet.User == "" || c.BtcWallet.Pass == "" {
+			return errors.New("refund.btc_wallet.user and refund.btc_wallet.pass must be set")
+		}
+		if _, err := os.Stat(c.BtcWallet.Cert); os.IsNotExist(err) {
+			return errors.New("refund.btc_wallet.cert file does not exist")
+		}
+	}
+
+	return nil
+}
+
 // Web config for the teller HTTP interface
 type Web struct {
 	HTTPAddr         string        `mapstructure:"http_addr"`
@@ -180,12 +313,76 @@ type Dummy struct {
 
 type KittyApi struct {
 	Address string `mapstructure:"address"`
+	// How often to sync the prices and status of the kitties
+	SyncPeriod time.Duration `mapstructure:"sync_period"`
 }
 
 type VerificationService struct {
 	Enabled bool `mapstructure:"enabled"`
 }
 
+// Webhook config for the webhook notifications of reservation and deposit events
+type Webhook struct {
+	// Send webhooks
+	Enabled bool `mapstructure:"enabled"`
+	// URL to POST the events to
+	URL string `mapstructure:"url"`
+	// Secret to sign the events with, the HMAC-SHA256 of the X-Teller-Timestamp header and the body
+	// is sent in the X-Teller-Signature header
+	Secret string `mapstructure:"secret"`
+	// How often to check for events to send
+	SendPeriod time.Duration `mapstructure:"send_period"`
+	// Timeout of a webhook request
+	Timeout time.Duration `mapstructure:"timeout"`
+	// How long to wait before retrying a failed event, doubled after each failure
+	RetryWait time.Duration `mapstructure:"retry_wait"`
+	// Max time to wait before retrying a failed event
+	MaxRetryWait time.Duration `mapstructure:"max_retry_wait"`
+	// Number of attempts to send an event before giving up. It can be replayed from the admin panel
+	MaxAttempts int `mapstructure:"max_attempts"`
+}
+
+// Validate validates the Webhook config
+func (c Webhook) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("webhook.url is invalid: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook.url must be a http or https url")
+	}
+
+	if c.Secret == "" {
+		return errors.New("webhook.secret missing")
+	}
+
+	if c.SendPeriod <= 0 {
+		return errors.New("webhook.send_period must be > 0")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("webhook.timeout must be > 0")
+	}
+
+	if c.RetryWait <= 0 {
+		return errors.New("webhook.retry_wait must be > 0")
+	}
+
+	if c.MaxRetryWait != 0 && c.MaxRetryWait < c.RetryWait {
+		return errors.New("webhook.max_retry_wait must be >= webhook.retry_wait")
+	}
+
+	if c.MaxAttempts <= 0 {
+		return errors.New("webhook.max_attempts must be > 0")
+	}
+
+	return nil
+}
+
 // Redacted returns a copy of the config with sensitive information redacted
 func (c Config) Redacted() Config {
 	if c.BtcRPC.User != "" {
@@ -196,9 +393,31 @@ func (c Config) Redacted() Config {
 		c.BtcRPC.Pass = "<redacted>"
 	}
 
+	if c.Refund.BtcWallet.User != "" {
+		c.Refund.BtcWallet.User = "<redacted>"
+	}
+
+	if c.Refund.BtcWallet.Pass != "" {
+		c.Refund.BtcWallet.Pass = "<redacted>"
+	}
+
+	if c.Webhook.Secret != "" {
+		c.Webhook.Secret = "<redacted>"
+	}
+
 	return c
 }
 
+// BtcParams returns the chain params of BtcNetwork. Validate rejects an unknown network,
+// mainnet is returned if it is not set.
+func (c Config) BtcParams() *chaincfg.Params {
+	params, err := btcaddr.Params(c.BtcNetwork)
+	if err != nil {
+		return &chaincfg.MainNetParams
+	}
+	return params
+}
+
 // Validate validates the config
 func (c Config) Validate() error {
 	var errs []string
@@ -206,17 +425,33 @@ func (c Config) Validate() error {
 		errs = append(errs, err)
 	}
 
-	if c.BtcAddresses == "" {
-		oops("btc_addresses missing")
+	if _, err := btcaddr.Params(c.BtcNetwork); err != nil {
+		oops(fmt.Sprintf("btc_network invalid: %v", err))
 	}
-	if _, err := os.Stat(c.BtcAddresses); os.IsNotExist(err) {
-		oops("btc_addresses file does not exist")
+
+	if c.BtcXPub == "" {
+		if c.BtcAddresses == "" {
+			oops("btc_addresses missing")
+		}
+		if _, err := os.Stat(c.BtcAddresses); os.IsNotExist(err) {
+			oops("btc_addresses file does not exist")
+		}
 	}
-	if c.SkyAddresses == "" {
-		oops("sky_addresses missing")
+	if c.SkyXPub == "" {
+		if c.SkyAddresses == "" {
+			oops("sky_addresses missing")
+		}
+		if _, err := os.Stat(c.SkyAddresses); os.IsNotExist(err) {
+			oops("sky file does not exist")
+		}
 	}
-	if _, err := os.Stat(c.SkyAddresses); os.IsNotExist(err) {
-		oops("sky file does not exist")
+	if c.EthScanner.Enabled {
+		if c.EthAddresses == "" {
+			oops("eth_addresses missing")
+		}
+		if _, err := os.Stat(c.EthAddresses); os.IsNotExist(err) {
+			oops("eth_addresses file does not exist")
+		}
 	}
 
 	if !c.Dummy.Sender {
@@ -241,18 +476,46 @@ func (c Config) Validate() error {
 				oops("btc_rpc.server missing")
 			}
 
-			if c.BtcRPC.User == "" {
-				oops("btc_rpc.user missing")
-			}
-			if c.BtcRPC.Pass == "" {
-				oops("btc_rpc.pass missing")
-			}
-			if c.BtcRPC.Cert == "" {
-				oops("btc_rpc.cert missing")
+			switch c.BtcRPC.Backend {
+			case BtcBackendBtcd:
+				if c.BtcRPC.User == "" {
+					oops("btc_rpc.user missing")
+				}
+				if c.BtcRPC.Pass == "" {
+					oops("btc_rpc.pass missing")
+				}
+				if c.BtcRPC.Cert == "" {
+					oops("btc_rpc.cert missing")
+				}
+
+				if _, err := os.Stat(c.BtcRPC.Cert); os.IsNotExist(err) {
+					oops("btc_rpc.cert file does not exist")
+				}
+			case BtcBackendBitcoind:
+				if c.BtcRPC.Cookie == "" && (c.BtcRPC.User == "" || c.BtcRPC.Pass == "") {
+					oops("btc_rpc.cookie or btc_rpc.user and btc_rpc.pass are required for bitcoind")
+				}
+				if c.BtcScanner.Notifications {
+					oops("btc_scanner.notifications requires btc_rpc.backend = \"btcd\"")
+				}
+			case BtcBackendEsplora:
+				if !strings.HasPrefix(c.BtcRPC.Server, "http://") && !strings.HasPrefix(c.BtcRPC.Server, "https://") {
+					oops("btc_rpc.server must be the http:// or https:// URL of the Esplora API")
+				}
+				if c.BtcScanner.Notifications {
+					oops("btc_scanner.notifications requires btc_rpc.backend = \"btcd\"")
+				}
+			default:
+				oops(fmt.Sprintf("btc_rpc.backend must be %q, %q or %q", BtcBackendBtcd, BtcBackendBitcoind, BtcBackendEsplora))
 			}
+		}
 
-			if _, err := os.Stat(c.BtcRPC.Cert); os.IsNotExist(err) {
-				oops("btc_rpc.cert file does not exist")
+		if c.EthScanner.Enabled {
+			if c.EthRPC.Server == "" {
+				oops("eth_rpc.server missing")
+			}
+			if c.EthRPC.Port == "" {
+				oops("eth_rpc.port missing")
 			}
 		}
 	}
@@ -263,6 +526,43 @@ func (c Config) Validate() error {
 	if c.BtcScanner.InitialScanHeight < 0 {
 		oops("btc_scanner.initial_scan_height must be >= 0")
 	}
+	if c.BtcScanner.Notifications && c.BtcScanner.NotifyScanPeriod <= 0 {
+		oops("btc_scanner.notify_scan_period must be > 0")
+	}
+	if c.BtcScanner.CatchUpConcurrency <= 0 {
+		oops("btc_scanner.catch_up_concurrency must be > 0")
+	}
+
+	if c.SkyScanner.ConfirmationsRequired < 0 {
+		oops("sky_scanner.confirmations_required must be >= 0")
+	}
+	if c.SkyScanner.InitialScanHeight < 0 {
+		oops("sky_scanner.initial_scan_height must be >= 0")
+	}
+	if c.SkyScanner.CatchUpConcurrency <= 0 {
+		oops("sky_scanner.catch_up_concurrency must be > 0")
+	}
+
+	if c.EthScanner.ConfirmationsRequired < 0 {
+		oops("eth_scanner.confirmations_required must be >= 0")
+	}
+	if c.EthScanner.InitialScanHeight < 0 {
+		oops("eth_scanner.initial_scan_height must be >= 0")
+	}
+	if c.EthScanner.CatchUpConcurrency <= 0 {
+		oops("eth_scanner.catch_up_concurrency must be > 0")
+	}
+
+	if c.Teller.ReservationTimeout <= 0 {
+		oops("teller.reservation_timeout must be > 0")
+	}
+	if c.Teller.MaxBoundAddresses < 0 {
+		oops("teller.max_bound_addrs must be >= 0")
+	}
+
+	if c.KittyApi.SyncPeriod <= 0 {
+		oops("kitty_api.sync_period must be > 0")
+	}
 
 	exchangeErrs := c.BoxExchanger.validate()
 	for _, err := range exchangeErrs {
@@ -276,6 +576,14 @@ func (c Config) Validate() error {
 	//	}
 	//}
 
+	if err := c.Refund.Validate(); err != nil {
+		oops(err.Error())
+	}
+
+	if err := c.Webhook.Validate(); err != nil {
+		oops(err.Error())
+	}
+
 	if err := c.Web.Validate(); err != nil {
 		oops(err.Error())
 	}
@@ -293,35 +601,70 @@ func setDefaults() {
 	viper.SetDefault("debug", true)
 	viper.SetDefault("logfile", "./kittyteller.log")
 	viper.SetDefault("dbfile", "kittyteller.db")
+	viper.SetDefault("btc_network", btcaddr.MainNet)
 
 	// Teller
-	viper.SetDefault("teller.max_bound_btc_addrs", 5)
+	viper.SetDefault("teller.max_bound_addrs", 5)
 	viper.SetDefault("teller.bind_enabled", true)
+	viper.SetDefault("teller.reservation_timeout", time.Hour*24)
 
 	// SkyRPC
 	viper.SetDefault("sky_rpc.address", "127.0.0.1:6430")
 
 	// BtcRPC
+	viper.SetDefault("btc_rpc.backend", BtcBackendBtcd)
 	viper.SetDefault("btc_rpc.server", "127.0.0.1:8334")
 
+	// EthRPC
+	viper.SetDefault("eth_rpc.server", "127.0.0.1")
+	viper.SetDefault("eth_rpc.port", "8545")
+
 	// BtcScanner
 	viper.SetDefault("btc_scanner.enabled", true)
 	viper.SetDefault("btc_scanner.scan_period", time.Second*20)
 	viper.SetDefault("btc_scanner.initial_scan_height", int64(492478))
 	viper.SetDefault("btc_scanner.confirmations_required", int64(1))
+	viper.SetDefault("btc_scanner.scan_mempool", true)
+	viper.SetDefault("btc_scanner.notifications", false)
+	viper.SetDefault("btc_scanner.notify_scan_period", time.Minute*5)
+	viper.SetDefault("btc_scanner.catch_up_concurrency", 4)
 
 	// SkyScanner
 	viper.SetDefault("sky_scanner.enabled", true)
 	viper.SetDefault("sky_scanner.scan_period", time.Second*5)
 	viper.SetDefault("sky_scanner.initial_scan_height", int64(17000))
 	viper.SetDefault("sky_scanner.confirmations_required", int64(0))
+	viper.SetDefault("sky_scanner.catch_up_concurrency", 4)
+
+	// EthScanner
+	viper.SetDefault("eth_scanner.enabled", false)
+	viper.SetDefault("eth_scanner.scan_period", time.Second*5)
+	viper.SetDefault("eth_scanner.initial_scan_height", int64(4654259))
+	viper.SetDefault("eth_scanner.confirmations_required", int64(1))
+	viper.SetDefault("eth_scanner.catch_up_concurrency", 4)
 
 	// SkyExchanger
 	viper.SetDefault("sky_exchanger.tx_confirmation_check_wait", time.Second*5)
 	viper.SetDefault("sky_exchanger.max_decimals", 3)
+	viper.SetDefault("box_exchanger.retry_wait", time.Second*10)
+	viper.SetDefault("box_exchanger.max_retry_wait", time.Minute*10)
+	viper.SetDefault("box_exchanger.max_retry_attempts", 10)
 	viper.SetDefault("web.bind_enabled", true)
 	viper.SetDefault("web.send_enabled", true)
 
+	// Refund
+	viper.SetDefault("refund.send_enabled", false)
+	viper.SetDefault("refund.send_period", time.Minute)
+	viper.SetDefault("refund.sky_node_addr", "127.0.0.1:6420")
+
+	// Webhook
+	viper.SetDefault("webhook.enabled", false)
+	viper.SetDefault("webhook.send_period", time.Second*5)
+	viper.SetDefault("webhook.timeout", time.Second*10)
+	viper.SetDefault("webhook.retry_wait", time.Second*10)
+	viper.SetDefault("webhook.max_retry_wait", time.Hour)
+	viper.SetDefault("webhook.max_attempts", 20)
+
 	// Web
 	viper.SetDefault("web.http_addr", "127.0.0.1:7071")
 	viper.SetDefault("web.throttle_max", int64(60))
@@ -337,6 +680,7 @@ func setDefaults() {
 
 	// KittyAPI RPC
 	viper.SetDefault("kitty_api.address", "127.0.0.1:7000")
+	viper.SetDefault("kitty_api.sync_period", time.Minute*5)
 
 	// Verification service
 	viper.SetDefault("verification_service.enabled", false)
@@ -1,6 +1,7 @@
 package exchange
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -8,9 +9,11 @@ import (
 	"github.com/boltdb/bolt"
 
 	"github.com/kittycash/teller/src/config"
-	"github.com/kittycash/teller/src/util/dbutil"
 )
 
+// errDepositProcessed is returned when updating the status of a deposit that was already processed
+var errDepositProcessed = errors.New("Deposit was already processed")
+
 // Processor is a component that processes deposits from a Receiver and sends them to a Sender
 type Processor interface {
 	Deposits() <-chan DepositInfo
@@ -20,6 +23,8 @@ type Processor interface {
 type ProcessRunner interface {
 	Runner
 	Processor
+	// Decided queues a deposit that an operator decided on to be processed again
+	Decided(DepositInfo)
 }
 
 // Buy implements a Processor. All deposits are sent directly to the sender for processing.
@@ -28,13 +33,15 @@ type Buy struct {
 	cfg      config.BoxExchanger
 	receiver Receiver
 	store    Storer
+	retrier  *Retrier
 	deposits chan DepositInfo
+	decided  chan DepositInfo
 	quit     chan struct{}
 	done     chan struct{}
 }
 
 // NewBuy creates DirectBuy
-func NewBuy(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, receiver Receiver) (*Buy, error) {
+func NewBuy(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, receiver Receiver, retrier *Retrier) (*Buy, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
@@ -44,7 +51,9 @@ func NewBuy(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, recei
 		cfg:      cfg,
 		store:    store,
 		receiver: receiver,
+		retrier:  retrier,
 		deposits: make(chan DepositInfo, 100),
+		decided:  make(chan DepositInfo, 100),
 		quit:     make(chan struct{}),
 		done:     make(chan struct{}),
 	}, nil
@@ -72,29 +81,74 @@ func (p *Buy) Run() error {
 	return nil
 }
 
-// runUpdateStatus reads deposits from the Receiver and changes their status to StatusWaitSend
+// runUpdateStatus reads deposits from the Receiver, the deposits that are due to be retried
+// and the deposits that an operator decided on, and changes their status to StatusWaitSend
 func (p *Buy) runUpdateStatus() {
 	log := p.log.WithField("goroutine", "runUpdateStatus")
 	for {
+		var d DepositInfo
 		select {
 		case <-p.quit:
 			log.Info("quit")
 			return
-		case d := <-p.receiver.Deposits():
-			updatedDeposit, err := p.updateStatus(d)
-			if err != nil {
-				msg := "runUpdateStatus failed. This deposit will not be reprocessed until teller is restarted."
-				log.WithField("depositInfo", d).WithError(err).Error(msg)
-				continue
-			}
+		case rt := <-p.retrier.Due(RetryStageProcess):
+			p.retryDeposit(rt)
+			continue
+		case d = <-p.decided:
+		case d = <-p.receiver.Deposits():
+		}
 
-			if updatedDeposit.Status == StatusWaitSend {
-				p.deposits <- updatedDeposit
+		updatedDeposit, err := p.updateStatus(d)
+		switch err {
+		case nil:
+		case errDepositProcessed:
+			log.WithField("depositInfo", d).Info("Deposit was already processed")
+			continue
+		default:
+			log.WithField("depositInfo", d).WithError(err).Error("runUpdateStatus failed")
+			if _, err := p.retrier.Schedule(RetryStageProcess, d.DepositID, nil, err); err != nil {
+				log.WithField("depositInfo", d).WithError(err).Error("Schedule retry failed. This deposit will not be reprocessed until teller is restarted.")
 			}
+			continue
+		}
+
+		switch updatedDeposit.Status {
+		case StatusWaitSend:
+			p.deposits <- updatedDeposit
+		case StatusWaitDecide:
+			log.WithField("depositInfo", updatedDeposit).Warn("Deposit is held for an operator's decision")
 		}
 	}
 }
 
+// retryDeposit updates the status of a deposit that failed to be updated again
+func (p *Buy) retryDeposit(rt DepositRetry) {
+	log := p.log.WithField("retry", rt)
+
+	di, err := p.store.getDepositInfo(rt.DepositID)
+	if err == nil {
+		di, err = p.updateStatus(di)
+	}
+
+	switch err {
+	case nil:
+	case errDepositProcessed:
+		log.Info("Deposit was processed in the meantime")
+	default:
+		log.WithError(err).Error("Retry failed")
+		if _, err := p.retrier.Schedule(RetryStageProcess, rt.DepositID, nil, err); err != nil {
+			log.WithError(err).Error("Schedule retry failed")
+		}
+		return
+	}
+
+	p.retrier.Complete(rt.DepositID)
+
+	if err == nil && di.Status == StatusWaitSend {
+		p.deposits <- di
+	}
+}
+
 // Shutdown stops a previous call to Run
 func (p *Buy) Shutdown() {
 	p.log.Info("Shutting down DirectBuy")
@@ -104,30 +158,106 @@ func (p *Buy) Shutdown() {
 	p.log.Info("Shutdown complete")
 }
 
+// Decided queues a deposit that an operator decided on to be processed again
+func (p *Buy) Decided(di DepositInfo) {
+	select {
+	case <-p.quit:
+	case p.decided <- di:
+	}
+}
+
 // Deposits returns a channel of processed deposits
 func (p *Buy) Deposits() <-chan DepositInfo {
 	return p.deposits
 }
 
-// updateStatus sets the deposit's status to StatusWaitPartial.
+// updateStatus sets the deposit's status to StatusWaitPartial, or to
+// StatusWaitSend once the full amount for the kitty box has been deposited.
+// Any amount that is not needed to pay for the kitty is recorded as a refund,
+// and deposits that are refunded entirely are set to StatusWaitRefund.
+// Suspicious deposits are held in StatusWaitDecide with a HoldReason, without being counted,
+// until an operator decides on them.
+// A deposit is only counted once, errDepositProcessed is returned if it is not in StatusWaitDecide
+// or if it is waiting for a decision.
 func (p *Buy) updateStatus(di DepositInfo) (DepositInfo, error) {
+	status := StatusWaitPartial
+	var prev DepositInfo
+	var held string
 	updatedDi, err := p.store.UpdateDepositInfoCallback(di.DepositID, func(di DepositInfo) DepositInfo {
+		prev = di
 		di.Status = StatusWaitPartial
 		return di
 	}, func(info DepositInfo, tx *bolt.Tx) error {
-		dt, err := p.store.getDepositTrackTx(tx, di.DepositAddress)
+		// rolls back the update, the deposit was counted already or is waiting for a decision
+		if prev.Status != StatusWaitDecide || prev.AwaitingDecision() {
+			return errDepositProcessed
+		}
+
+		dt, err := p.store.getDepositTrackTx(tx, info.DepositAddress)
+		if err != nil {
+			return err
+		}
+
+		// A late deposit to the address of an expired reservation must not
+		// deliver the kitty, which may have been reserved by someone else
+		reserved, err := p.store.isKittyReservedToTx(tx, info.KittyID, info.DepositAddress)
 		if err != nil {
 			return err
 		}
 
-		dt.AmountDeposited += di.DepositValue
-		if err := p.store.updateDepositTrackTx(tx, di.DepositAddress, dt); err != nil {
+		paidBefore := dt.AmountDeposited >= dt.AmountRequired
+		dt.AmountDeposited += info.DepositValue
+
+		// A deposit that an operator decided on is not held again
+		if info.Decision == "" {
+			r, err := p.store.getReservationTx(tx, info.KittyID)
+			if err != nil {
+				return err
+			}
+
+			if held = holdReason(info, dt, r, reserved, paidBefore); held != "" {
+				status = StatusWaitDecide
+				info.Status = StatusWaitDecide
+				info.HoldReason = held
+				return p.store.putDepositInfoTx(tx, info)
+			}
+		}
+
+		var reason string
+		switch {
+		case !reserved:
+			p.log.WithField("depositInfo", info).Warn("Reservation expired before the deposit was received, not sending the kitty")
+			status = StatusWaitRefund
+			reason = RefundReasonExpired
+		case paidBefore:
+			status = StatusWaitRefund
+			reason = RefundReasonAlreadyPaid
+		case dt.AmountDeposited >= dt.AmountRequired:
+			status = StatusWaitSend
+			reason = RefundReasonOverpaid
+		}
+
+		if refund := dt.Refundable(reserved); refund > 0 {
+			if _, err := p.store.createRefundTx(tx, info, refund, reason); err != nil {
+				return err
+			}
+			dt.AmountRefunded += refund
+		}
+
+		if err := p.store.updateDepositTrackTx(tx, info.DepositAddress, dt); err != nil {
 			return err
 		}
 
-		if dt.AmountDeposited >= dt.AmountRequired {
-			di.Status = StatusWaitSend
-			if err := dbutil.PutBucketValue(tx, DepositInfoBkt, di.Txid, di); err != nil {
+		// The kitty is paid for, its reservation no longer expires
+		if status == StatusWaitSend {
+			if err := p.store.deliverReservationTx(tx, info.KittyID, info.DepositAddress); err != nil {
+				return err
+			}
+		}
+
+		if status != StatusWaitPartial {
+			info.Status = status
+			if err := p.store.putDepositInfoTx(tx, info); err != nil {
 				return err
 			}
 		}
@@ -135,9 +265,16 @@ func (p *Buy) updateStatus(di DepositInfo) (DepositInfo, error) {
 		return nil
 	})
 	if err != nil {
-		p.log.WithError(err).Error("UpdateDepositInfo set StatusWaitPartial failed")
+		if err != errDepositProcessed {
+			p.log.WithError(err).Error("UpdateDepositInfo set StatusWaitPartial failed")
+		}
 		return di, err
 	}
 
+	updatedDi.Status = status
+	if held != "" {
+		updatedDi.HoldReason = held
+	}
+
 	return updatedDi, nil
 }
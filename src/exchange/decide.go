@@ -0,0 +1,92 @@
+package exchange
+
+import (
+	"errors"
+
+	"github.com/kittycash/teller/src/agent"
+)
+
+var (
+	// ErrDepositNotHeld is returned when deciding on a deposit that is not waiting for a decision
+	ErrDepositNotHeld = errors.New("Deposit is not waiting for a decision")
+	// ErrKittyNotReserved is returned when a deposit can't pay for a kitty, because the kitty is not reserved to the deposit address
+	ErrKittyNotReserved = errors.New("Kitty is not reserved to the deposit address")
+	// ErrReassignCoinType is returned when reassigning a deposit to a kitty reserved with another coin type
+	ErrReassignCoinType = errors.New("Kitty is reserved with another coin type")
+	// ErrInvalidDecision is returned for an unknown decision
+	ErrInvalidDecision = errors.New("Invalid decision")
+	// ErrNoOperator is returned when a decision is made without the operator's identity
+	ErrNoOperator = errors.New("Operator is required")
+)
+
+const (
+	// HoldReasonWrongAmount the deposit paid more than the amount left to pay for the kitty
+	HoldReasonWrongAmount = "wrong_amount"
+	// HoldReasonExpired the reservation expired or was released before the deposit was received
+	HoldReasonExpired = "reservation_expired"
+	// HoldReasonCoinType the deposit's coin type is not the one the kitty was reserved with
+	HoldReasonCoinType = "coin_type_mismatch"
+)
+
+// Decision is an operator's decision on a deposit waiting in StatusWaitDecide
+type Decision string
+
+const (
+	// DecisionApprove the deposit is processed as if it was not suspicious
+	DecisionApprove Decision = "approve"
+	// DecisionReject the whole deposit is refunded
+	DecisionReject Decision = "reject"
+	// DecisionReassign the deposit pays for another reserved kitty
+	DecisionReassign Decision = "reassign"
+)
+
+// DepositDecision is an operator's decision on a deposit
+type DepositDecision struct {
+	Decision Decision
+	Operator string
+	// KittyID is the kitty to reassign the deposit to, only for DecisionReassign
+	KittyID string
+}
+
+// holdReason returns why a deposit must wait for an operator's decision, or "" if it can be processed.
+// dt is the deposit track of the deposit address, including the deposit.
+func holdReason(di DepositInfo, dt DepositTrack, r agent.Reservation, reserved, paidBefore bool) string {
+	switch {
+	case r.CoinType != "" && r.CoinType != di.CoinType:
+		return HoldReasonCoinType
+	case !reserved:
+		return HoldReasonExpired
+	case paidBefore, dt.AmountDeposited > dt.AmountRequired:
+		return HoldReasonWrongAmount
+	default:
+		return ""
+	}
+}
+
+// GetDepositsAwaitingDecision returns the suspicious deposits that wait for an operator's decision
+func (e *Exchange) GetDepositsAwaitingDecision() ([]DepositInfo, error) {
+	return e.store.GetDepositInfoByStatus(StatusWaitDecide, func(di DepositInfo) bool {
+		return di.AwaitingDecision()
+	})
+}
+
+// DecideDeposit records an operator's decision on a deposit waiting for a decision.
+// Approved and reassigned deposits are processed again, rejected deposits are refunded.
+func (e *Exchange) DecideDeposit(depositID string, d DepositDecision) (DepositInfo, error) {
+	if d.Operator == "" {
+		return DepositInfo{}, ErrNoOperator
+	}
+
+	di, err := e.store.DecideDeposit(depositID, d)
+	if err != nil {
+		return di, err
+	}
+
+	e.log.WithField("depositInfo", di).Info("Deposit decided")
+
+	if di.Status == StatusWaitDecide {
+		e.Processor.Decided(di)
+	}
+
+	return di, nil
+}
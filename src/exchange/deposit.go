@@ -25,8 +25,12 @@ const (
 	StatusDone
 	// StatusUnknown fallback value
 	StatusUnknown
-	// StatusWaitDecide initial deposit receive state
+	// StatusWaitDecide initial deposit receive state, suspicious deposits wait in it for an operator's decision
 	StatusWaitDecide
+	// StatusOrphaned deposit's block was orphaned by a chain reorganization, needs operator action
+	StatusOrphaned
+	// StatusWaitRefund deposit was not needed to pay for a kitty and is waiting to be refunded
+	StatusWaitRefund
 )
 
 var statusString = []string{
@@ -37,6 +41,8 @@ var statusString = []string{
 	StatusDone:        "done",
 	StatusUnknown:     "unknown",
 	StatusWaitDecide:  "waiting_decide",
+	StatusOrphaned:    "orphaned",
+	StatusWaitRefund:  "waiting_refund",
 }
 
 func (s Status) String() string {
@@ -58,6 +64,10 @@ func NewStatusFromStr(st string) Status {
 		return StatusDone
 	case statusString[StatusWaitDecide]:
 		return StatusWaitDecide
+	case statusString[StatusOrphaned]:
+		return StatusOrphaned
+	case statusString[StatusWaitRefund]:
+		return StatusWaitRefund
 	default:
 		return StatusUnknown
 	}
@@ -68,6 +78,8 @@ type BoundAddress struct {
 	KittyID  string
 	Address  string
 	CoinType string
+	// RefundAddress is where deposits that can't pay for the kitty are refunded to, optional
+	RefundAddress string
 }
 
 // DepositInfo records the deposit info
@@ -84,12 +96,23 @@ type DepositInfo struct {
 	Txid         string // txhash
 	DepositValue int64  // Deposit amount. Should be measured in the smallest unit possible (e.g. satoshis for BTC or droplets for skycoin)
 	Error        string // An error that occurred during processing
+	// HoldReason is why a suspicious deposit waits in StatusWaitDecide for an operator's decision
+	HoldReason string
+	// The operator's decision on a held deposit, who made it and when
+	Decision  Decision
+	DecidedBy string
+	DecidedAt int64
 	// The original Deposit is saved for the records, in case there is a mistake.
 	// Do not use this data directly.  All necessary data is copied to the top level
 	// of DepositInfo (e.g. DepositID, DepositAddress, DepositValue, CoinType).
 	Deposit scanner.Deposit
 }
 
+// AwaitingDecision returns true if the deposit is held until an operator decides on it
+func (di DepositInfo) AwaitingDecision() bool {
+	return di.Status == StatusWaitDecide && di.HoldReason != "" && di.Decision == ""
+}
+
 // DepositTrack keeps track of payments towards a kitty reservation
 type DepositTrack struct {
 	// AmountDeposited is the amount deposited so far
@@ -98,12 +121,31 @@ type DepositTrack struct {
 	KittyID string
 	// AmountRequired is the total amount to be deposited
 	AmountRequired int64
+	// AmountRefunded is the amount deposited that is owed back to the buyer
+	AmountRefunded int64
+}
+
+// Refundable returns the amount deposited that is not needed to pay for the kitty
+// and that is not owed back yet. If the reservation is no longer paid with this
+// deposit address, e.g. because it expired, all of the amount deposited is refundable.
+func (dt DepositTrack) Refundable(reserved bool) int64 {
+	var kept int64
+	if reserved {
+		kept = dt.AmountRequired
+	}
+
+	if n := dt.AmountDeposited - kept - dt.AmountRefunded; n > 0 {
+		return n
+	}
+
+	return 0
 }
 
 // DepositStats records overall statistics about deposits
 type DepositStats struct {
 	TotalBTCReceived int64 `json:"total_btc_received"`
 	TotalSKYReceived int64 `json:"total_sky_received"`
+	TotalETHReceived int64 `json:"total_eth_received"`
 	TotalBoxesSent   int64 `json:"total_boxes_sent"`
 }
 
@@ -160,6 +202,12 @@ func (di DepositInfo) ValidateForStatus() error {
 	case StatusWaitDecide:
 		return checkWaitSend()
 
+	case StatusOrphaned:
+		return checkWaitSend()
+
+	case StatusWaitRefund:
+		return checkWaitSend()
+
 	case StatusWaitDeposit, StatusUnknown:
 		fallthrough
 	default:
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/sirupsen/logrus"
 
 	"github.com/kittycash/teller/src/config"
@@ -29,6 +30,10 @@ var (
 	ErrDepositStatusInvalid = errors.New("Deposit status cannot be handled")
 	// ErrNoBoundAddress is returned if no skycoin address is bound to a deposit's address
 	ErrNoBoundAddress = errors.New("Deposit has no bound skycoin address")
+	// ErrNoOwnerAddress is returned if a deposit has no owner address to send the kitty to
+	ErrNoOwnerAddress = errors.New("Deposit has no owner address")
+	// ErrDepositOrphaned is recorded on a deposit whose block was orphaned by a chain reorganization
+	ErrDepositOrphaned = errors.New("Deposit was orphaned by a chain reorganization")
 )
 
 // DepositFilter filters deposits
@@ -43,8 +48,9 @@ type Runner interface {
 // Exchanger provides APIs to interact with the exchange service
 type Exchanger interface {
 	BindAddress(kittyID, depositAddr, coinType string) (*BoundAddress, error)
-	BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error)
+	BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error)
 	GetDepositStatuses(kittyID string) ([]DepositStatus, error)
+	GetKittyStatusesOfOwner(ownerAddr string) ([]KittyStatus, error)
 	GetDepositStatusDetail(flt DepositFilter) ([]DepositStatusDetail, error)
 	IsBound(kittyAddr string) bool
 	GetDepositStats() (*DepositStats, error)
@@ -59,29 +65,38 @@ type Exchange struct {
 	cfg   config.BoxExchanger
 	quit  chan struct{}
 	done  chan struct{}
+	// btcParams are the chain params of the bitcoin network, to validate BTC refund addresses
+	btcParams *chaincfg.Params
 
 	Receiver  ReceiveRunner
 	Processor ProcessRunner
 	Sender    SendRunner
+	Retrier   *Retrier
 }
 
-// NewExchange creates an Exchange which performs handles payments and forwards to sender once the payment is confirmed
-func NewExchange(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, multiplexer *scanner.Multiplexer, boxSender sender.Sender) (*Exchange, error) {
+// NewExchange creates an Exchange which performs handles payments and forwards to sender once the payment is confirmed.
+// btcParams are the chain params of the bitcoin network of the BTC deposits and refunds.
+func NewExchange(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, multiplexer *scanner.Multiplexer, boxSender sender.Sender, btcParams *chaincfg.Params) (*Exchange, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
 
-	receiver, err := NewReceive(log, cfg, store, multiplexer)
+	retrier, err := NewRetrier(log, cfg, store)
 	if err != nil {
 		return nil, err
 	}
 
-	processor, err := NewBuy(log, cfg, store, receiver)
+	receiver, err := NewReceive(log, cfg, store, multiplexer, retrier)
 	if err != nil {
 		return nil, err
 	}
 
-	sender, err := NewSend(log, cfg, store, boxSender, processor)
+	processor, err := NewBuy(log, cfg, store, receiver, retrier)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := NewSend(log, cfg, store, boxSender, processor, retrier)
 	if err != nil {
 		return nil, err
 	}
@@ -92,9 +107,11 @@ func NewExchange(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer,
 		cfg:       cfg,
 		quit:      make(chan struct{}),
 		done:      make(chan struct{}),
+		btcParams: btcParams,
 		Receiver:  receiver,
 		Processor: processor,
 		Sender:    sender,
+		Retrier:   retrier,
 	}, nil
 }
 
@@ -110,7 +127,7 @@ func (e *Exchange) Run() error {
 	// Create channels for linking two components, initialize the components with the channels
 	// Close them to teardown
 
-	errC := make(chan error, 3)
+	errC := make(chan error, 4)
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -140,6 +157,15 @@ func (e *Exchange) Run() error {
 		}
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := e.Retrier.Run(); err != nil {
+			e.log.WithError(err).Error("Retrier.Run failed")
+			errC <- err
+		}
+	}()
+
 	var err error
 	select {
 	case <-e.quit:
@@ -158,6 +184,7 @@ func (e *Exchange) Shutdown() {
 	close(e.quit)
 
 	e.log.Info("Shutting down Exchange subcomponents")
+	e.Retrier.Shutdown()
 	e.Receiver.Shutdown()
 	e.Processor.Shutdown()
 	e.Sender.Shutdown()
@@ -173,8 +200,31 @@ type DepositStatus struct {
 	UpdatedAt int64  `json:"updated_at"`
 	Status    string `json:"status"`
 	CoinType  string `json:"coin_type"`
+	Amount    int64  `json:"amount"`
+	Txid      string `json:"txid,omitempty"` // the transaction sending the kitty
+}
+
+// KittyStatus is the payment progress of a kitty reserved by a skycoin address.
+// A kitty reserved more than once by the address has a KittyStatus per deposit address.
+type KittyStatus struct {
+	KittyID        string `json:"kitty_id"`
+	CoinType       string `json:"coin_type"`
+	DepositAddress string `json:"deposit_address"`
+	// Reserved is true while the kitty is reserved to the address, to be paid at DepositAddress
+	Reserved          bool            `json:"reserved"`
+	Expire            int64           `json:"expire,omitempty"`
+	AmountRequired    int64           `json:"amount_required"`
+	AmountPaid        int64           `json:"amount_paid"` // deposited towards the price, refunds excluded
+	AmountRefunded    int64           `json:"amount_refunded"`
+	AmountUnconfirmed int64           `json:"amount_unconfirmed"` // seen in the mempool, not part of AmountPaid
+	Txid              string          `json:"txid,omitempty"`     // the transaction sending the kitty
+	Deposits          []DepositStatus `json:"deposits"`
 }
 
+// DepositStatusUnconfirmed is the status of a deposit seen by the scanner in the mempool,
+// it changes to a deposit status once the deposit is confirmed
+const DepositStatusUnconfirmed = "unconfirmed"
+
 // DepositStatusDetail deposit status detail info
 type DepositStatusDetail struct {
 	Seq            uint64 `json:"seq"`
@@ -201,11 +251,18 @@ func (e *Exchange) GetDepositStatuses(kittyID string) ([]DepositStatus, error) {
 			UpdatedAt: di.UpdatedAt,
 			Status:    di.Status.String(),
 			CoinType:  di.CoinType,
+			Amount:    di.DepositValue,
+			Txid:      di.Txid,
 		})
 	}
 	return dss, nil
 }
 
+// GetKittyStatusesOfOwner returns the payment progress of the kitties reserved by a skycoin address
+func (e *Exchange) GetKittyStatusesOfOwner(ownerAddr string) ([]KittyStatus, error) {
+	return e.store.GetKittyStatusesOfOwner(ownerAddr)
+}
+
 // GetDepositStatusDetail returns deposit status details
 func (e *Exchange) GetDepositStatusDetail(flt DepositFilter) ([]DepositStatusDetail, error) {
 	dis, err := e.store.GetDepositInfoArray(flt)
@@ -213,6 +270,20 @@ func (e *Exchange) GetDepositStatusDetail(flt DepositFilter) ([]DepositStatusDet
 		return nil, err
 	}
 
+	return newDepositStatusDetails(dis), nil
+}
+
+// GetDepositStatusDetailByStatus returns the deposit status details of the deposits with a status
+func (e *Exchange) GetDepositStatusDetailByStatus(status Status) ([]DepositStatusDetail, error) {
+	dis, err := e.store.GetDepositInfoByStatus(status, func(DepositInfo) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	return newDepositStatusDetails(dis), nil
+}
+
+func newDepositStatusDetails(dis []DepositInfo) []DepositStatusDetail {
 	dss := make([]DepositStatusDetail, 0, len(dis))
 	for _, di := range dis {
 		dss = append(dss, DepositStatusDetail{
@@ -226,7 +297,7 @@ func (e *Exchange) GetDepositStatusDetail(flt DepositFilter) ([]DepositStatusDet
 			OwnerAddress:   di.OwnerAddress,
 		})
 	}
-	return dss, nil
+	return dss
 }
 
 // IsBound returns whether the kitty is already bound to a deposit address or not
@@ -238,7 +309,7 @@ func (e *Exchange) IsBound(kittyID string) bool {
 
 // GetDepositStats returns deposit status
 func (e *Exchange) GetDepositStats() (*DepositStats, error) {
-	tbr, tsr, tbs, err := e.store.GetDepositStats()
+	tbr, tsr, ter, tbs, err := e.store.GetDepositStats()
 	if err != nil {
 		return nil, err
 	}
@@ -246,6 +317,7 @@ func (e *Exchange) GetDepositStats() (*DepositStats, error) {
 	return &DepositStats{
 		TotalBTCReceived: tbr,
 		TotalSKYReceived: tsr,
+		TotalETHReceived: ter,
 		TotalBoxesSent:   tbs,
 	}, nil
 }
@@ -267,6 +339,6 @@ func (e *Exchange) BindAddress(kittyID, depositAddr, coinType string) (*BoundAdd
 	return e.Receiver.BindAddress(kittyID, depositAddr, coinType)
 }
 
-func (e *Exchange) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error) {
-	return e.Receiver.BindAddressWithTx(tx, kittyID, depositAddr, coinType)
+func (e *Exchange) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error) {
+	return e.Receiver.BindAddressWithTx(tx, kittyID, depositAddr, coinType, refundAddr)
 }
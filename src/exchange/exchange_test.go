@@ -1,22 +1,27 @@
 package exchange
 
 import (
+	"errors"
 	"sync"
 	"testing"
 
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/sirupsen/logrus"
 	logrus_test "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 
 	"github.com/kittycash/wallet/src/iko"
 
+	"github.com/kittycash/teller/src/agent"
 	"github.com/kittycash/teller/src/config"
 	"github.com/kittycash/teller/src/scanner"
 	"github.com/kittycash/teller/src/sender"
+	"github.com/kittycash/teller/src/util/dbutil"
 	"github.com/kittycash/teller/src/util/testutil"
+	"github.com/kittycash/teller/src/webhook"
 
 	"github.com/skycoin/skycoin/src/cipher"
 )
@@ -119,7 +124,7 @@ func newDummyScanner() *dummyScanner {
 	}
 }
 
-func (scan *dummyScanner) AddScanAddress(btcAddr, coinType string) error {
+func (scan *dummyScanner) AddScanAddress(btcAddr, coinType, kittyID string) error {
 	scan.addrs = append(scan.addrs, btcAddr)
 	return nil
 }
@@ -159,7 +164,7 @@ var (
 )
 
 func newTestExchange(t *testing.T, log *logrus.Logger, db *bolt.DB) *Exchange {
-	store, err := NewStore(log, db)
+	store, err := NewStore(log, db, webhook.Discard)
 	require.NoError(t, err)
 
 	bscr := newDummyScanner()
@@ -172,7 +177,7 @@ func newTestExchange(t *testing.T, log *logrus.Logger, db *bolt.DB) *Exchange {
 
 	go testutil.CheckError(t, multiplexer.Multiplex)
 
-	e, err := NewExchange(log, defaultCfg, store, multiplexer, newDummySender())
+	e, err := NewExchange(log, defaultCfg, store, multiplexer, newDummySender(), &chaincfg.MainNetParams)
 	require.NoError(t, err)
 	return e
 }
@@ -225,7 +230,7 @@ func runExchangeMockStore(t *testing.T) (*Exchange, func(), *logrus_test.Hook) {
 
 	go testutil.CheckError(t, multiplexer.Multiplex)
 
-	e, err := NewExchange(log, defaultCfg, store, multiplexer, newDummySender())
+	e, err := NewExchange(log, defaultCfg, store, multiplexer, newDummySender(), &chaincfg.MainNetParams)
 	require.NoError(t, err)
 
 	done := make(chan struct{})
@@ -289,3 +294,907 @@ func TestExchangeRunScannerClosed(t *testing.T) {
 }
 
 //@TODO (therealssj): add tests
+
+func requireDepositAccepted(t *testing.T, dn scanner.DepositNote) {
+	select {
+	case update := <-dn.UpdateC:
+		require.Equal(t, scanner.DepositStatusUpdate{Status: scanner.DepositAccepted}, update)
+	case err := <-dn.ErrC:
+		t.Fatalf("Deposit was not accepted: %v", err)
+	case <-time.After(statusCheckTimeout):
+		t.Fatal("Timed out waiting for the deposit to be accepted")
+	}
+}
+
+func waitForDepositStatus(t *testing.T, s Storer, depositID string, status Status) DepositInfo {
+	timeout := time.After(statusCheckTimeout)
+	for {
+		dis, err := s.GetDepositInfoArray(func(di DepositInfo) bool {
+			return di.DepositID == depositID
+		})
+		require.NoError(t, err)
+
+		if len(dis) == 1 && dis[0].Status == status {
+			return dis[0]
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("Timed out waiting for deposit %s to reach status %s", depositID, status)
+		case <-time.After(statusCheckInterval):
+		}
+	}
+}
+
+func waitForHeldDeposit(t *testing.T, s Storer, depositID string) DepositInfo {
+	timeout := time.After(statusCheckTimeout)
+	for {
+		dis, err := s.GetDepositInfoArray(func(di DepositInfo) bool {
+			return di.DepositID == depositID
+		})
+		require.NoError(t, err)
+
+		if len(dis) == 1 && dis[0].AwaitingDecision() {
+			return dis[0]
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("Timed out waiting for deposit %s to be held", depositID)
+		case <-time.After(statusCheckInterval):
+		}
+	}
+}
+
+func TestExchangeSendDeposit(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, e.store.(*Store).db)
+	require.NoError(t, err)
+
+	kittyID := "1"
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        kittyID,
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       100000,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	_, err = e.BindAddress(kittyID, depositAddr, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	dn := scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    100000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	})
+
+	mp := e.Receiver.(*Receive).multiplexer
+	mp.GetScanner(scanner.CoinTypeBTC).(*dummyScanner).addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	ds := e.Sender.(*Send).sender.(*dummySender)
+	txid := ds.predictTxid(t, testSkyAddr, iko.KittyID(1))
+
+	di := waitForDepositStatus(t, e.store, dn.Deposit.ID(), StatusWaitConfirm)
+	require.Equal(t, txid, di.Txid)
+	require.Equal(t, testSkyAddr, di.OwnerAddress)
+	require.Equal(t, kittyID, di.KittyID)
+
+	// The paid reservation no longer expires
+	r, err := agentStore.GetReservationFromKittyID(kittyID)
+	require.NoError(t, err)
+	require.Equal(t, agent.Delivered, r.Status)
+	require.Equal(t, depositAddr, r.DepositAddress)
+
+	ds.setTxConfirmed(txid)
+
+	di = waitForDepositStatus(t, e.store, dn.Deposit.ID(), StatusDone)
+	require.Equal(t, txid, di.Txid)
+	checkExchangerStatus(t, e, nil)
+}
+
+func TestVerifyCreatedTransaction(t *testing.T) {
+	s := newDummySender()
+
+	di := DepositInfo{
+		KittyID:      "1",
+		OwnerAddress: testSkyAddr,
+	}
+
+	tx, err := s.CreateTransaction(testSkyAddr, iko.KittyID(1))
+	require.NoError(t, err)
+	require.NoError(t, verifyCreatedTransaction(tx, di))
+
+	// Wrong kitty
+	tx, err = s.CreateTransaction(testSkyAddr, iko.KittyID(2))
+	require.NoError(t, err)
+	require.Error(t, verifyCreatedTransaction(tx, di))
+
+	// Wrong recipient
+	tx, err = s.CreateTransaction(testSkyAddr2, iko.KittyID(1))
+	require.NoError(t, err)
+	require.Error(t, verifyCreatedTransaction(tx, di))
+
+	require.Error(t, verifyCreatedTransaction(nil, di))
+}
+
+func TestExchangeOrphanedDeposit(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, e.store.(*Store).db)
+	require.NoError(t, err)
+
+	kittyID := "1"
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        kittyID,
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       200000,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	_, err = e.BindAddress(kittyID, depositAddr, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	dv := scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    100000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	}
+	dn := scanner.NewDepositNote(dv)
+
+	ds := e.Receiver.(*Receive).multiplexer.GetScanner(scanner.CoinTypeBTC).(*dummyScanner)
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	waitForDepositStatus(t, e.store, dv.ID(), StatusWaitPartial)
+
+	dt, err := e.store.getDepositTrack(depositAddr)
+	require.NoError(t, err)
+	require.Equal(t, int64(100000), dt.AmountDeposited)
+
+	// The deposit's block is orphaned by a chain reorganization
+	dv.Status = scanner.DepositInvalidated
+	dn = scanner.NewDepositNote(dv)
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	di := waitForDepositStatus(t, e.store, dv.ID(), StatusOrphaned)
+	require.Equal(t, ErrDepositOrphaned.Error(), di.Error)
+
+	dt, err = e.store.getDepositTrack(depositAddr)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), dt.AmountDeposited)
+
+	// The transaction is included in a block of the new chain, the deposit is counted again
+	dv.Status = scanner.DepositNotProcessed
+	dv.Height = 21
+	dn = scanner.NewDepositNote(dv)
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	di = waitForDepositStatus(t, e.store, dv.ID(), StatusWaitPartial)
+	require.Empty(t, di.Error)
+	require.Equal(t, dv, di.Deposit)
+
+	dt, err = e.store.getDepositTrack(depositAddr)
+	require.NoError(t, err)
+	require.Equal(t, int64(100000), dt.AmountDeposited)
+
+	// An invalidated deposit that was never received is ignored
+	dn = scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    100000,
+		Height:   21,
+		Tx:       "bar-tx",
+		N:        0,
+		Status:   scanner.DepositInvalidated,
+	})
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	dis, err := e.store.GetDepositInfoArray(func(di DepositInfo) bool {
+		return di.DepositID == dn.Deposit.ID()
+	})
+	require.NoError(t, err)
+	require.Empty(t, dis)
+}
+
+func TestExchangeDepositToExpiredReservation(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, e.store.(*Store).db)
+	require.NoError(t, err)
+
+	kittyID := "1"
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+	r := &agent.Reservation{
+		KittyID:        kittyID,
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       100000,
+		CoinType:       scanner.CoinTypeBTC,
+	}
+	err = agentStore.UpdateReservation(r)
+	require.NoError(t, err)
+
+	_, err = e.BindAddress(kittyID, depositAddr, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	// The reservation expires and the kitty is reserved by someone else
+	r.MakeAvailable()
+	r.MakeReserved()
+	r.DepositAddress = "1FeDtFhARLxjKUPPkQqEBL78tisenc9znS"
+	r.OwnerAddress = testSkyAddr2
+	err = agentStore.UpdateReservation(r)
+	require.NoError(t, err)
+
+	dn := scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    100000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	})
+
+	mp := e.Receiver.(*Receive).multiplexer
+	mp.GetScanner(scanner.CoinTypeBTC).(*dummyScanner).addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	// The deposit is recorded but the kitty is not sent, it waits for a decision
+	di := waitForHeldDeposit(t, e.store, dn.Deposit.ID())
+	require.Equal(t, HoldReasonExpired, di.HoldReason)
+
+	dis, err := e.GetDepositsAwaitingDecision()
+	require.NoError(t, err)
+	require.Len(t, dis, 1)
+	require.Equal(t, dn.Deposit.ID(), dis[0].DepositID)
+
+	dt, err := e.store.getDepositTrack(depositAddr)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), dt.AmountDeposited)
+
+	// The kitty can't be sent for the deposit
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionApprove,
+		Operator: "alice",
+	})
+	require.Equal(t, ErrKittyNotReserved, err)
+
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionReject,
+	})
+	require.Equal(t, ErrNoOperator, err)
+
+	di, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionReject,
+		Operator: "alice",
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusWaitRefund, di.Status)
+	require.Equal(t, DecisionReject, di.Decision)
+	require.Equal(t, "alice", di.DecidedBy)
+	require.NotZero(t, di.DecidedAt)
+
+	refunds, err := e.GetRefunds(func(r Refund) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, dn.Deposit.ID(), refunds[0].DepositID)
+	require.Equal(t, int64(100000), refunds[0].Amount)
+	require.Equal(t, RefundReasonRejected, refunds[0].Reason)
+	require.Equal(t, RefundStatusWaitAddress, refunds[0].Status)
+
+	// A deposit is only decided once
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionReject,
+		Operator: "alice",
+	})
+	require.Equal(t, ErrDepositNotHeld, err)
+
+	dis, err = e.GetDepositsAwaitingDecision()
+	require.NoError(t, err)
+	require.Empty(t, dis)
+}
+
+func TestExchangeOverpaidDeposit(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, e.store.(*Store).db)
+	require.NoError(t, err)
+
+	kittyID := "1"
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+	refundAddr := "1FeDtFhARLxjKUPPkQqEBL78tisenc9znS"
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        kittyID,
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       100000,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	err = e.store.(*Store).db.Update(func(tx *bolt.Tx) error {
+		_, err := e.BindAddressWithTx(tx, kittyID, depositAddr, scanner.CoinTypeBTC, refundAddr)
+		return err
+	})
+	require.NoError(t, err)
+
+	dn := scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    150000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	})
+
+	ds := e.Receiver.(*Receive).multiplexer.GetScanner(scanner.CoinTypeBTC).(*dummyScanner)
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	// The deposit pays more than the price, it waits for a decision
+	di := waitForHeldDeposit(t, e.store, dn.Deposit.ID())
+	require.Equal(t, HoldReasonWrongAmount, di.HoldReason)
+
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionApprove,
+		Operator: "alice",
+	})
+	require.NoError(t, err)
+
+	// The kitty is sent and the excess is refunded
+	di = waitForDepositStatus(t, e.store, dn.Deposit.ID(), StatusWaitConfirm)
+	require.Equal(t, DecisionApprove, di.Decision)
+	require.Equal(t, HoldReasonWrongAmount, di.HoldReason)
+
+	refunds, err := e.GetRefunds(func(r Refund) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, int64(50000), refunds[0].Amount)
+	require.Equal(t, RefundReasonOverpaid, refunds[0].Reason)
+	require.Equal(t, refundAddr, refunds[0].RefundAddress)
+	require.Equal(t, RefundStatusWaitSend, refunds[0].Status)
+
+	// A deposit after the kitty was paid is held, and refunded in full once approved
+	dn = scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    20000,
+		Height:   21,
+		Tx:       "bar-tx",
+		N:        0,
+	})
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	di = waitForHeldDeposit(t, e.store, dn.Deposit.ID())
+	require.Equal(t, HoldReasonWrongAmount, di.HoldReason)
+
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionApprove,
+		Operator: "alice",
+	})
+	require.NoError(t, err)
+
+	waitForDepositStatus(t, e.store, dn.Deposit.ID(), StatusWaitRefund)
+
+	refunds, err = e.GetRefunds(func(r Refund) bool { return r.DepositID == dn.Deposit.ID() })
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, int64(20000), refunds[0].Amount)
+	require.Equal(t, RefundReasonAlreadyPaid, refunds[0].Reason)
+
+	dt, err := e.store.getDepositTrack(depositAddr)
+	require.NoError(t, err)
+	require.Equal(t, int64(170000), dt.AmountDeposited)
+	require.Equal(t, int64(70000), dt.AmountRefunded)
+}
+
+func TestExchangeReassignDeposit(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, e.store.(*Store).db)
+	require.NoError(t, err)
+
+	// The kitty was reserved to be paid in SKY, but its deposit address receives BTC
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        "1",
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       100000,
+		CoinType:       scanner.CoinTypeSKY,
+	})
+	require.NoError(t, err)
+
+	_, err = e.BindAddress("1", depositAddr, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	depositAddr2 := "1FeDtFhARLxjKUPPkQqEBL78tisenc9znS"
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        "2",
+		DepositAddress: depositAddr2,
+		OwnerAddress:   testSkyAddr2,
+		Status:         agent.Reserved,
+		PriceBTC:       100000,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	_, err = e.BindAddress("2", depositAddr2, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	dn := scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    100000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	})
+
+	ds := e.Receiver.(*Receive).multiplexer.GetScanner(scanner.CoinTypeBTC).(*dummyScanner)
+	ds.addDeposit(dn)
+	requireDepositAccepted(t, dn)
+
+	di := waitForHeldDeposit(t, e.store, dn.Deposit.ID())
+	require.Equal(t, HoldReasonCoinType, di.HoldReason)
+
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionReassign,
+		Operator: "bob",
+		KittyID:  "3",
+	})
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionReassign,
+		Operator: "bob",
+		KittyID:  "1",
+	})
+	require.Equal(t, ErrReassignCoinType, err)
+
+	_, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: "foo",
+		Operator: "bob",
+	})
+	require.Equal(t, ErrInvalidDecision, err)
+
+	di, err = e.DecideDeposit(dn.Deposit.ID(), DepositDecision{
+		Decision: DecisionReassign,
+		Operator: "bob",
+		KittyID:  "2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "2", di.KittyID)
+	require.Equal(t, depositAddr2, di.DepositAddress)
+	require.Equal(t, testSkyAddr2, di.OwnerAddress)
+	require.Equal(t, depositAddr, di.Deposit.Address)
+
+	// The deposit pays for the other kitty
+	di = waitForDepositStatus(t, e.store, dn.Deposit.ID(), StatusWaitConfirm)
+	require.Equal(t, DecisionReassign, di.Decision)
+	require.Equal(t, "bob", di.DecidedBy)
+
+	dt, err := e.store.getDepositTrack(depositAddr2)
+	require.NoError(t, err)
+	require.Equal(t, int64(100000), dt.AmountDeposited)
+
+	dt, err = e.store.getDepositTrack(depositAddr)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), dt.AmountDeposited)
+
+	dis, err := e.store.GetDepositInfoOfKittyID("2")
+	require.NoError(t, err)
+	require.Len(t, dis, 1)
+	require.Equal(t, dn.Deposit.ID(), dis[0].DepositID)
+}
+
+type dummyRefundSender struct {
+	sync.Mutex
+	err  error
+	sent map[string]int64
+}
+
+func (s *dummyRefundSender) SendRefund(addr string, amount int64) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return "", s.err
+	}
+
+	if s.sent == nil {
+		s.sent = make(map[string]int64)
+	}
+	s.sent[addr] += amount
+
+	return "refund-tx-" + addr, nil
+}
+
+func TestDepositTrackRefundable(t *testing.T) {
+	tt := []struct {
+		name     string
+		dt       DepositTrack
+		reserved bool
+		expect   int64
+	}{
+		{"partial payment", DepositTrack{AmountDeposited: 40, AmountRequired: 100}, true, 0},
+		{"exact payment", DepositTrack{AmountDeposited: 100, AmountRequired: 100}, true, 0},
+		{"overpayment", DepositTrack{AmountDeposited: 150, AmountRequired: 100}, true, 50},
+		{"overpayment partly refunded", DepositTrack{AmountDeposited: 150, AmountRequired: 100, AmountRefunded: 20}, true, 30},
+		{"not reserved", DepositTrack{AmountDeposited: 40, AmountRequired: 100}, false, 40},
+		{"not reserved and refunded", DepositTrack{AmountDeposited: 40, AmountRequired: 100, AmountRefunded: 40}, false, 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, tc.dt.Refundable(tc.reserved))
+		})
+	}
+}
+
+func TestExchangeRefunds(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	e := newTestExchange(t, log, db)
+	s := e.store.(*Store)
+
+	agentStore, err := agent.NewStore(log, db)
+	require.NoError(t, err)
+
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+	refundAddr := "1FeDtFhARLxjKUPPkQqEBL78tisenc9znS"
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        "1",
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       1000,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	_, err = e.BindAddress("1", depositAddr, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	var depositIDs []string
+	for i := 0; i < 3; i++ {
+		di, err := s.GetOrCreateDepositInfo(scanner.Deposit{
+			CoinType: scanner.CoinTypeBTC,
+			Address:  depositAddr,
+			Value:    1000,
+			Tx:       "foo-tx",
+			N:        uint32(i),
+		})
+		require.NoError(t, err)
+
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			_, err := s.createRefundTx(tx, di, 1000, RefundReasonAlreadyPaid)
+			return err
+		})
+		require.NoError(t, err)
+
+		depositIDs = append(depositIDs, di.DepositID)
+	}
+
+	_, err = e.SetRefundAddress(depositIDs[0], "invalid")
+	require.Equal(t, ErrInvalidRefundAddress, err)
+
+	r, err := e.SetRefundAddress(depositIDs[0], refundAddr)
+	require.NoError(t, err)
+	require.Equal(t, RefundStatusWaitSend, r.Status)
+
+	r, err = e.CompleteRefund(depositIDs[1], "manual-tx")
+	require.NoError(t, err)
+	require.Equal(t, RefundStatusSent, r.Status)
+	require.Equal(t, "manual-tx", r.Txid)
+
+	_, err = e.CancelRefund(depositIDs[1])
+	require.Equal(t, ErrRefundStatusInvalid, err)
+
+	_, err = e.SetRefundAddress(depositIDs[1], refundAddr)
+	require.Equal(t, ErrRefundStatusInvalid, err)
+
+	// Refunds without an address are not sent
+	refundCfg := config.Refund{
+		SendEnabled: true,
+		SendPeriod:  time.Millisecond * 10,
+		SkyNodeAddr: "127.0.0.1:6420",
+		SkyWallet:   "test.wlt",
+	}
+	rs := &dummyRefundSender{err: errors.New("wallet is locked")}
+	refunder, err := NewRefunder(log, refundCfg, s, map[string]RefundSender{
+		scanner.CoinTypeBTC: rs,
+	})
+	require.NoError(t, err)
+
+	// A failed send is retried later
+	refunder.sendRefunds()
+	refunds, err := e.GetRefunds(func(r Refund) bool { return r.DepositID == depositIDs[0] })
+	require.NoError(t, err)
+	require.Equal(t, RefundStatusWaitSend, refunds[0].Status)
+	require.Equal(t, "wallet is locked", refunds[0].Error)
+
+	rs.err = nil
+	refunder.sendRefunds()
+	refunds, err = e.GetRefunds(func(r Refund) bool { return r.DepositID == depositIDs[0] })
+	require.NoError(t, err)
+	require.Equal(t, RefundStatusSent, refunds[0].Status)
+	require.Equal(t, "refund-tx-"+refundAddr, refunds[0].Txid)
+	require.Empty(t, refunds[0].Error)
+	require.Equal(t, map[string]int64{refundAddr: 1000}, rs.sent)
+
+	// Nothing is sent twice
+	refunder.sendRefunds()
+	require.Equal(t, map[string]int64{refundAddr: 1000}, rs.sent)
+
+	r, err = e.CancelRefund(depositIDs[2])
+	require.NoError(t, err)
+	require.Equal(t, RefundStatusCancelled, r.Status)
+
+	refunds, err = e.GetRefunds(func(r Refund) bool { return r.Status == RefundStatusWaitAddress })
+	require.NoError(t, err)
+	require.Empty(t, refunds)
+}
+
+func TestRetrierSchedule(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	cfg := defaultCfg
+	cfg.RetryWait = time.Minute
+	cfg.MaxRetryWait = time.Minute * 3
+	cfg.MaxRetryAttempts = 3
+	r, err := NewRetrier(log, cfg, s)
+	require.NoError(t, err)
+
+	require.Equal(t, time.Minute, r.retryWait(1))
+	require.Equal(t, time.Minute*2, r.retryWait(2))
+	require.Equal(t, time.Minute*3, r.retryWait(3))
+	require.Equal(t, time.Minute*3, r.retryWait(10))
+
+	errFail := errors.New("fail")
+	dv := scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  "b",
+		Value:    100,
+		Tx:       "t1",
+		N:        0,
+	}
+
+	rt, err := r.Schedule(RetryStageReceive, dv.ID(), &dv, errFail)
+	require.NoError(t, err)
+	require.Equal(t, 1, rt.Attempts)
+	require.Equal(t, RetryStageReceive, rt.Stage)
+	require.Equal(t, &dv, rt.Deposit)
+	require.Equal(t, "fail", rt.LastError)
+	require.False(t, rt.Dead)
+	require.True(t, rt.NextAttempt > time.Now().Unix())
+
+	// A retry is not dispatched before its next attempt
+	r.dispatch()
+	require.Len(t, r.Due(RetryStageReceive), 0)
+
+	// A failure in another stage starts over
+	rt, err = r.Schedule(RetryStageProcess, dv.ID(), nil, errFail)
+	require.NoError(t, err)
+	require.Equal(t, 1, rt.Attempts)
+	require.Equal(t, RetryStageProcess, rt.Stage)
+
+	for i := 0; i < 2; i++ {
+		rt, err = r.Schedule(RetryStageProcess, dv.ID(), nil, errFail)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, rt.Attempts)
+	require.True(t, rt.Dead)
+
+	// The dead letter is moved out of the retries
+	err = s.db.View(func(tx *bolt.Tx) error {
+		hasKey, err := dbutil.BucketHasKey(tx, RetryBkt, dv.ID())
+		require.NoError(t, err)
+		require.False(t, hasKey)
+
+		hasKey, err = dbutil.BucketHasKey(tx, DeadLetterBkt, dv.ID())
+		require.NoError(t, err)
+		require.True(t, hasKey)
+		return nil
+	})
+	require.NoError(t, err)
+
+	retries, err := s.GetRetries(func(rt DepositRetry) bool { return rt.Dead })
+	require.NoError(t, err)
+	require.Len(t, retries, 1)
+
+	// Dead letters are not retried until they are requeued
+	_, err = s.UpdateRetry(dv.ID(), func(rt DepositRetry) (DepositRetry, error) {
+		rt.NextAttempt = 0
+		return rt, nil
+	})
+	require.NoError(t, err)
+	r.dispatch()
+	require.Len(t, r.Due(RetryStageProcess), 0)
+
+	_, err = s.RequeueDeadLetter("unknown", 0)
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+
+	rt, err = s.RequeueDeadLetter(dv.ID(), time.Now().Unix())
+	require.NoError(t, err)
+	require.False(t, rt.Dead)
+	require.Equal(t, 0, rt.Attempts)
+
+	r.dispatch()
+	require.Len(t, r.Due(RetryStageProcess), 1)
+	rt = <-r.Due(RetryStageProcess)
+	require.Equal(t, dv.ID(), rt.DepositID)
+
+	// The claimed retry is not dispatched twice
+	r.dispatch()
+	require.Len(t, r.Due(RetryStageProcess), 0)
+
+	require.NoError(t, s.DeleteRetry(dv.ID()))
+	retries, err = s.GetRetries(func(DepositRetry) bool { return true })
+	require.NoError(t, err)
+	require.Empty(t, retries)
+}
+
+func TestExchangeRetryDeposit(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	kittyID := "1"
+	depositAddr := "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB"
+
+	err := e.store.(*Store).db.Update(func(tx *bolt.Tx) error {
+		_, err := e.BindAddressWithTx(tx, kittyID, depositAddr, scanner.CoinTypeBTC, "")
+		return err
+	})
+	require.NoError(t, err)
+
+	// The deposit is received before the kitty's reservation is saved, so it can't be saved
+	dn := scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  depositAddr,
+		Value:    100000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	})
+
+	ds := e.Receiver.(*Receive).multiplexer.GetScanner(scanner.CoinTypeBTC).(*dummyScanner)
+	ds.addDeposit(dn)
+	receiveErr := <-dn.ErrC
+	require.Error(t, receiveErr)
+
+	retries, err := e.GetRetries(func(DepositRetry) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, retries, 1)
+	require.Equal(t, dn.Deposit.ID(), retries[0].DepositID)
+	require.Equal(t, RetryStageReceive, retries[0].Stage)
+	require.Equal(t, 1, retries[0].Attempts)
+	require.Equal(t, receiveErr.Error(), retries[0].LastError)
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, e.store.(*Store).db)
+	require.NoError(t, err)
+
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        kittyID,
+		DepositAddress: depositAddr,
+		OwnerAddress:   testSkyAddr,
+		Status:         agent.Reserved,
+		PriceBTC:       100000,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	// Once the cause is fixed, the retry processes the deposit
+	_, err = e.store.UpdateRetry(dn.Deposit.ID(), func(rt DepositRetry) (DepositRetry, error) {
+		rt.NextAttempt = 0
+		return rt, nil
+	})
+	require.NoError(t, err)
+	e.Retrier.dispatch()
+
+	waitForDepositStatus(t, e.store, dn.Deposit.ID(), StatusWaitConfirm)
+
+	timeout := time.After(statusCheckTimeout)
+	for {
+		retries, err = e.GetRetries(func(DepositRetry) bool { return true })
+		require.NoError(t, err)
+		if len(retries) == 0 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for the retry to complete")
+		case <-time.After(statusCheckInterval):
+		}
+	}
+}
+
+func TestExchangeRejectDeposit(t *testing.T) {
+	e, shutdown, _ := runExchange(t)
+	defer shutdown()
+	defer e.Shutdown()
+	defer closeMultiplexer(e)
+
+	// The deposit's address is not bound to a kitty, so it is rejected instead of retried
+	dn := scanner.NewDepositNote(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  "1PZ63K3G4gZP6A6E2TTbBwxT5bFQGL2TLB",
+		Value:    100000,
+		Height:   20,
+		Tx:       "foo-tx",
+		N:        2,
+	})
+
+	ds := e.Receiver.(*Receive).multiplexer.GetScanner(scanner.CoinTypeBTC).(*dummyScanner)
+	ds.addDeposit(dn)
+
+	select {
+	case update := <-dn.UpdateC:
+		require.Equal(t, scanner.DepositStatusUpdate{
+			Status: scanner.DepositRejected,
+			Err:    ErrNoBoundAddress,
+		}, update)
+	case err := <-dn.ErrC:
+		t.Fatalf("Deposit was not rejected: %v", err)
+	case <-time.After(statusCheckTimeout):
+		t.Fatal("Timed out waiting for the deposit to be rejected")
+	}
+
+	retries, err := e.GetRetries(func(DepositRetry) bool { return true })
+	require.NoError(t, err)
+	require.Empty(t, retries)
+
+	dis, err := e.store.GetDepositInfoArray(func(DepositInfo) bool { return true })
+	require.NoError(t, err)
+	require.Empty(t, dis)
+}
@@ -0,0 +1,282 @@
+package exchange
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/dbutil"
+)
+
+// depositIndexVersion is increased when the indexes change, so that they are rebuilt when a Store is opened
+const depositIndexVersion = 1
+
+const (
+	depositIndexVersionKey = "index_version"
+	depositCountersKey     = "counters"
+)
+
+// depositIndex is a secondary index of DepositInfoBkt. Its keys are the indexed value
+// and the deposit ID separated by a "/", with empty values, so the deposit infos
+// with a value are found with a prefix scan, in the order of their deposit IDs.
+type depositIndex struct {
+	bkt   []byte
+	value func(di DepositInfo) string
+}
+
+var depositIndexes = []depositIndex{
+	{
+		bkt:   DepositStatusIndexBkt,
+		value: func(di DepositInfo) string { return di.Status.String() },
+	},
+	{
+		bkt:   DepositCoinTypeIndexBkt,
+		value: func(di DepositInfo) string { return di.CoinType },
+	},
+	{
+		bkt:   DepositOwnerIndexBkt,
+		value: func(di DepositInfo) string { return di.OwnerAddress },
+	},
+}
+
+func depositIndexPrefix(value string) []byte {
+	return []byte(value + "/")
+}
+
+func depositIndexKey(value, depositID string) []byte {
+	return append(depositIndexPrefix(value), depositID...)
+}
+
+// depositCounters are running totals of the deposit infos, updated with the indexes
+type depositCounters struct {
+	// Received is the deposit value received by coin type
+	Received map[string]int64 `json:"received"`
+	// Statuses is the number of deposits by status
+	Statuses map[string]int64 `json:"statuses"`
+}
+
+// add adds the deposit to the counters n times, use -1 to remove it
+func (c *depositCounters) add(di DepositInfo, n int64) {
+	c.Received[di.CoinType] += n * di.DepositValue
+	c.Statuses[di.Status.String()] += n
+}
+
+func getDepositCountersTx(tx *bolt.Tx) (depositCounters, error) {
+	c := depositCounters{
+		Received: make(map[string]int64),
+		Statuses: make(map[string]int64),
+	}
+
+	if err := dbutil.GetBucketObject(tx, DepositInfoMetaBkt, depositCountersKey, &c); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+		default:
+			return c, err
+		}
+	}
+
+	if c.Received == nil {
+		c.Received = make(map[string]int64)
+	}
+
+	if c.Statuses == nil {
+		c.Statuses = make(map[string]int64)
+	}
+
+	return c, nil
+}
+
+func indexDepositInfoTx(tx *bolt.Tx, di DepositInfo, c *depositCounters) error {
+	for _, idx := range depositIndexes {
+		v := idx.value(di)
+		if v == "" {
+			continue
+		}
+
+		if err := tx.Bucket(idx.bkt).Put(depositIndexKey(v, di.DepositID), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	c.add(di, 1)
+
+	return nil
+}
+
+func unindexDepositInfoTx(tx *bolt.Tx, di DepositInfo, c *depositCounters) error {
+	for _, idx := range depositIndexes {
+		v := idx.value(di)
+		if v == "" {
+			continue
+		}
+
+		if err := tx.Bucket(idx.bkt).Delete(depositIndexKey(v, di.DepositID)); err != nil {
+			return err
+		}
+	}
+
+	c.add(di, -1)
+
+	return nil
+}
+
+// putDepositInfoTx saves a DepositInfo, and updates the indexes and counters.
+// All writes to DepositInfoBkt must go through it.
+func (s *Store) putDepositInfoTx(tx *bolt.Tx, di DepositInfo) error {
+	c, err := getDepositCountersTx(tx)
+	if err != nil {
+		return err
+	}
+
+	var prev DepositInfo
+	if err := dbutil.GetBucketObject(tx, DepositInfoBkt, di.DepositID, &prev); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+		default:
+			return err
+		}
+	} else if err := unindexDepositInfoTx(tx, prev, &c); err != nil {
+		return err
+	}
+
+	if err := dbutil.PutBucketValue(tx, DepositInfoBkt, di.DepositID, di); err != nil {
+		return err
+	}
+
+	if err := indexDepositInfoTx(tx, di, &c); err != nil {
+		return err
+	}
+
+	return dbutil.PutBucketValue(tx, DepositInfoMetaBkt, depositCountersKey, c)
+}
+
+// BuildDepositIndexes rebuilds the deposit info indexes and counters from DepositInfoBkt.
+// A Store does it once when it opens a db saved before the indexes existed.
+// It must be run after changing DepositInfoBkt without a Store, e.g. with cmd/dbfix.
+func BuildDepositIndexes(db *bolt.DB) error {
+	return db.Update(buildDepositIndexesTx)
+}
+
+func buildDepositIndexesTx(tx *bolt.Tx) error {
+	for _, bkt := range [][]byte{DepositStatusIndexBkt, DepositCoinTypeIndexBkt, DepositOwnerIndexBkt} {
+		if tx.Bucket(bkt) != nil {
+			if err := tx.DeleteBucket(bkt); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.CreateBucket(bkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(bkt, err)
+		}
+	}
+
+	if _, err := tx.CreateBucketIfNotExists(DepositInfoMetaBkt); err != nil {
+		return dbutil.NewCreateBucketFailedErr(DepositInfoMetaBkt, err)
+	}
+
+	c := depositCounters{
+		Received: make(map[string]int64),
+		Statuses: make(map[string]int64),
+	}
+
+	if tx.Bucket(DepositInfoBkt) != nil {
+		if err := dbutil.ForEach(tx, DepositInfoBkt, func(k, v []byte) error {
+			var di DepositInfo
+			if err := json.Unmarshal(v, &di); err != nil {
+				return err
+			}
+
+			return indexDepositInfoTx(tx, di, &c)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := dbutil.PutBucketValue(tx, DepositInfoMetaBkt, depositCountersKey, c); err != nil {
+		return err
+	}
+
+	return dbutil.PutBucketValue(tx, DepositInfoMetaBkt, depositIndexVersionKey, depositIndexVersion)
+}
+
+// depositIndexesBuiltTx returns true if the indexes are up to date
+func depositIndexesBuiltTx(tx *bolt.Tx) (bool, error) {
+	var version int
+	if err := dbutil.GetBucketObject(tx, DepositInfoMetaBkt, depositIndexVersionKey, &version); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return version == depositIndexVersion, nil
+}
+
+// getDepositInfoByIndex returns the deposit infos with a value in an index that match the filter
+func (s *Store) getDepositInfoByIndex(bkt []byte, value string, flt DepositFilter) ([]DepositInfo, error) {
+	var dpis []DepositInfo
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		dpis, err = s.getDepositInfoByIndexTx(tx, bkt, value, flt)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return dpis, nil
+}
+
+func (s *Store) getDepositInfoByIndexTx(tx *bolt.Tx, bkt []byte, value string, flt DepositFilter) ([]DepositInfo, error) {
+	var dpis []DepositInfo
+
+	prefix := depositIndexPrefix(value)
+	c := tx.Bucket(bkt).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		dpi, err := s.getDepositInfoTx(tx, string(k[len(prefix):]))
+		if err != nil {
+			return nil, err
+		}
+
+		if flt(dpi) {
+			dpis = append(dpis, dpi)
+		}
+	}
+
+	return dpis, nil
+}
+
+// GetDepositInfoByStatus returns the deposit infos with a status that match the filter
+func (s *Store) GetDepositInfoByStatus(status Status, flt DepositFilter) ([]DepositInfo, error) {
+	return s.getDepositInfoByIndex(DepositStatusIndexBkt, status.String(), flt)
+}
+
+// GetDepositInfoByCoinType returns the deposit infos of a coin type that match the filter
+func (s *Store) GetDepositInfoByCoinType(coinType string, flt DepositFilter) ([]DepositInfo, error) {
+	return s.getDepositInfoByIndex(DepositCoinTypeIndexBkt, coinType, flt)
+}
+
+// GetDepositInfoByOwner returns the deposit infos that pay for kitties reserved by an owner address, that match the filter
+func (s *Store) GetDepositInfoByOwner(ownerAddr string, flt DepositFilter) ([]DepositInfo, error) {
+	return s.getDepositInfoByIndex(DepositOwnerIndexBkt, ownerAddr, flt)
+}
+
+// GetDepositStats returns BTC, SKY and ETH received and boxes sent
+func (s *Store) GetDepositStats() (int64, int64, int64, int64, error) {
+	var c depositCounters
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		c, err = getDepositCountersTx(tx)
+		return err
+	}); err != nil {
+		return -1, -1, -1, -1, err
+	}
+
+	// TotalBoxesSent = no. of deposits with status == done
+	return c.Received[scanner.CoinTypeBTC], c.Received[scanner.CoinTypeSKY], c.Received[scanner.CoinTypeETH], c.Statuses[StatusDone.String()], nil
+}
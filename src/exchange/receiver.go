@@ -9,6 +9,7 @@ import (
 
 	"github.com/kittycash/teller/src/config"
 	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/dbutil"
 )
 
 //func init() {
@@ -19,7 +20,7 @@ import (
 type Receiver interface {
 	Deposits() <-chan DepositInfo
 	BindAddress(kittyID, depositAddr, coinType string) (*BoundAddress, error)
-	BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error)
+	BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error)
 }
 
 // ReceiveRunner is a Receiver than can be run
@@ -35,13 +36,14 @@ type Receive struct {
 	cfg         config.BoxExchanger
 	multiplexer *scanner.Multiplexer
 	store       Storer
+	retrier     *Retrier
 	deposits    chan DepositInfo
 	quit        chan struct{}
 	done        chan struct{}
 }
 
 // NewReceive creates a Receive
-func NewReceive(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, multiplexer *scanner.Multiplexer) (*Receive, error) {
+func NewReceive(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, multiplexer *scanner.Multiplexer, retrier *Retrier) (*Receive, error) {
 	// TODO -- split up config into relevant parts?
 	// The Receive component needs exchange rates
 	if err := cfg.Validate(); err != nil {
@@ -53,6 +55,7 @@ func NewReceive(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, m
 		cfg:         cfg,
 		store:       store,
 		multiplexer: multiplexer,
+		retrier:     retrier,
 		deposits:    make(chan DepositInfo, 100),
 		quit:        make(chan struct{}),
 		done:        make(chan struct{}),
@@ -68,13 +71,13 @@ func (r *Receive) Run() error {
 		r.done <- struct{}{}
 	}()
 
-	// Load StatusWaitDecide deposits for resubmission
-	waitDecideDeposits, err := r.store.GetDepositInfoArray(func(di DepositInfo) bool {
-		return di.Status == StatusWaitDecide
+	// Load StatusWaitDecide deposits for resubmission, except those held for an operator's decision
+	waitDecideDeposits, err := r.store.GetDepositInfoByStatus(StatusWaitDecide, func(di DepositInfo) bool {
+		return !di.AwaitingDecision()
 	})
 
 	if err != nil {
-		err = fmt.Errorf("GetDepositInfoArray failed: %v", err)
+		err = fmt.Errorf("GetDepositInfoByStatus failed: %v", err)
 		log.WithError(err).Error(err)
 		return err
 	}
@@ -101,7 +104,7 @@ func (r *Receive) Run() error {
 	return nil
 }
 
-// runReadMultiplexer reads deposits from the multiplexer
+// runReadMultiplexer reads deposits from the multiplexer, and the deposits that are due to be retried
 func (r *Receive) runReadMultiplexer() {
 	log := r.log.WithField("goroutine", "readMultiplexer")
 	for {
@@ -111,6 +114,9 @@ func (r *Receive) runReadMultiplexer() {
 		case <-r.quit:
 			log.Info("quit")
 			return
+		case rt := <-r.retrier.Due(RetryStageReceive):
+			r.retryDeposit(rt)
+			continue
 		case dv, ok = <-r.multiplexer.GetDeposit():
 			if !ok {
 				log.Warn("Scan service closed, watch deposits loop quit")
@@ -118,23 +124,97 @@ func (r *Receive) runReadMultiplexer() {
 			}
 
 		}
-		log := log.WithField("deposit", dv.Deposit)
-
-		// Save a new DepositInfo based upon the scanner.Deposit.
-		// If the save fails, report it to the scanner.
-		// The scanner will mark the deposit as "processed" if no error
-		// occurred.  Any unprocessed deposits held by the scanner
-		// will be resent to the exchange when teller is started.
-		if d, err := r.saveIncomingDeposit(dv.Deposit); err != nil {
-			log.WithError(err).Error("saveIncomingDeposit failed. This deposit will not be reprocessed until teller is restarted.")
+
+		// Report the result to the scanner.
+		// The scanner will mark the deposit as "processed" if it is accepted,
+		// or as "rejected" if it can never be received, e.g. because its
+		// address is not bound to a kitty. Any unprocessed deposits held by
+		// the scanner will be resent to the exchange when teller is started.
+		// A failed deposit is also scheduled to be retried, so it does not
+		// have to wait for a restart.
+		d, err := r.receiveDeposit(dv.Deposit)
+		switch {
+		case err == nil:
+			dv.Accept()
+		case isRejectedDepositErr(err):
+			log.WithField("deposit", dv.Deposit).WithError(err).Warn("Deposit rejected")
+			dv.Reject(err)
+		default:
+			dep := dv.Deposit
+			if _, schedErr := r.retrier.Schedule(RetryStageReceive, dep.ID(), &dep, err); schedErr != nil {
+				log.WithField("deposit", dep).WithError(schedErr).Error("Schedule retry failed. This deposit will not be reprocessed until teller is restarted.")
+			}
 			dv.ErrC <- err
-		} else {
-			dv.ErrC <- nil
-			r.deposits <- d
+		}
+
+		if d != nil {
+			r.deposits <- *d
 		}
 	}
 }
 
+// receiveDeposit saves a deposit received from the scanner, and returns the DepositInfo
+// to pass on for processing. A deposit invalidated by a chain reorganization is marked
+// as orphaned, and is not passed on for processing. An orphaned deposit that is received
+// again was included in the new chain, it is restored and processed again.
+func (r *Receive) receiveDeposit(dv scanner.Deposit) (*DepositInfo, error) {
+	log := r.log.WithField("deposit", dv)
+
+	if dv.Status == scanner.DepositInvalidated {
+		if err := r.orphanDeposit(dv); err != nil {
+			log.WithError(err).Error("orphanDeposit failed")
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	// Save a new DepositInfo based upon the scanner.Deposit.
+	d, err := r.saveIncomingDeposit(dv)
+	if err != nil {
+		log.WithError(err).Error("saveIncomingDeposit failed")
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// isRejectedDepositErr returns true if receiveDeposit failed because the deposit can never be received,
+// so that it is rejected instead of retried
+func isRejectedDepositErr(err error) bool {
+	return err == ErrNoBoundAddress
+}
+
+// retryDeposit receives a deposit that failed to be saved again
+func (r *Receive) retryDeposit(rt DepositRetry) {
+	log := r.log.WithField("retry", rt)
+
+	if rt.Deposit == nil {
+		log.Error("Retry has no deposit, it can't be received again")
+		return
+	}
+
+	d, err := r.receiveDeposit(*rt.Deposit)
+	if err != nil {
+		if isRejectedDepositErr(err) {
+			// The scanner records the rejection when the deposit is sent again after a restart
+			log.WithError(err).Warn("Deposit rejected, it is not retried")
+			r.retrier.Complete(rt.DepositID)
+			return
+		}
+
+		if _, err := r.retrier.Schedule(RetryStageReceive, rt.DepositID, nil, err); err != nil {
+			log.WithError(err).Error("Schedule retry failed")
+		}
+		return
+	}
+
+	r.retrier.Complete(rt.DepositID)
+
+	if d != nil {
+		r.deposits <- *d
+	}
+}
+
 // Shutdown stops a previous call to run
 func (r *Receive) Shutdown() {
 	r.log.Info("Shutting down Receive")
@@ -165,6 +245,27 @@ func (r *Receive) saveIncomingDeposit(dv scanner.Deposit) (DepositInfo, error) {
 	return di, err
 }
 
+// orphanDeposit is called when receiving a deposit invalidated by a chain reorganization from the scanner
+func (r *Receive) orphanDeposit(dv scanner.Deposit) error {
+	log := r.log.WithField("deposit", dv)
+
+	di, err := r.store.OrphanDepositInfo(dv)
+	if err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			log.Info("No DepositInfo for the invalidated deposit")
+			return nil
+		default:
+			log.WithError(err).Error("OrphanDepositInfo failed")
+			return err
+		}
+	}
+
+	log.WithField("depositInfo", di).Warn("DepositInfo set to StatusOrphaned")
+
+	return nil
+}
+
 // BindAddress binds deposit address with kitty id, and
 // add the btc/sky address to scan service, when a deposit is detected
 // to the btc/sky address, will send specific kitty box to the user who owns the box
@@ -178,24 +279,24 @@ func (r *Receive) BindAddress(kittyID, depositAddr, coinType string) (*BoundAddr
 		return nil, err
 	}
 
-	if err := r.multiplexer.AddScanAddress(depositAddr, coinType); err != nil {
+	if err := r.multiplexer.AddScanAddress(depositAddr, coinType, kittyID); err != nil {
 		return nil, err
 	}
 
 	return boundAddr, nil
 }
 
-func (r *Receive) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error) {
+func (r *Receive) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error) {
 	if err := r.multiplexer.ValidateCoinType(coinType); err != nil {
 		return nil, err
 	}
 
-	boundAddr, err := r.store.BindAddressWithTx(tx, kittyID, depositAddr, coinType)
+	boundAddr, err := r.store.BindAddressWithTx(tx, kittyID, depositAddr, coinType, refundAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := r.multiplexer.AddScanAddress(depositAddr, coinType); err != nil {
+	if err := r.multiplexer.AddScanAddress(depositAddr, coinType, kittyID); err != nil {
 		return nil, err
 	}
 
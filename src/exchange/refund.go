@@ -0,0 +1,276 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/kittycash/teller/src/config"
+	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/btcaddr"
+	"github.com/kittycash/teller/src/util/ethutil"
+)
+
+var (
+	// ErrRefundStatusInvalid is returned when a refund can't be changed in its current status
+	ErrRefundStatusInvalid = errors.New("Refund status does not allow this change")
+	// ErrRefundExists is returned when a deposit already has a refund
+	ErrRefundExists = errors.New("Deposit already has a refund")
+	// ErrInvalidRefundAddress is returned when a refund address is not valid for the refund's coin type
+	ErrInvalidRefundAddress = errors.New("Invalid refund address")
+)
+
+// RefundStatus refund status
+type RefundStatus string
+
+const (
+	// RefundStatusWaitAddress the buyer gave no refund address, an operator has to set one
+	RefundStatusWaitAddress RefundStatus = "waiting_address"
+	// RefundStatusWaitSend the refund is ready to be sent
+	RefundStatusWaitSend RefundStatus = "waiting_send"
+	// RefundStatusSending the refund is being sent. If it stays in this status,
+	// teller was stopped while sending and an operator has to check the refund wallet
+	RefundStatusSending RefundStatus = "sending"
+	// RefundStatusSent the refund has been sent
+	RefundStatusSent RefundStatus = "sent"
+	// RefundStatusCancelled the refund was cancelled, e.g. the deposit was orphaned
+	RefundStatusCancelled RefundStatus = "cancelled"
+)
+
+const (
+	// RefundReasonOverpaid the deposit paid more than the price of the kitty
+	RefundReasonOverpaid = "overpaid"
+	// RefundReasonAlreadyPaid the deposit was received after the kitty was paid in full
+	RefundReasonAlreadyPaid = "already_paid"
+	// RefundReasonExpired the reservation expired before it was paid in full
+	RefundReasonExpired = "reservation_expired"
+	// RefundReasonRejected an operator rejected the deposit
+	RefundReasonRejected = "rejected"
+)
+
+// Refund records an amount owed back to a buyer.
+// There is at most one refund per deposit, saved under the deposit's ID.
+type Refund struct {
+	DepositID      string       `json:"deposit_id"`
+	DepositAddress string       `json:"deposit_address"`
+	KittyID        string       `json:"kitty_id"`
+	CoinType       string       `json:"coin_type"`
+	Amount         int64        `json:"amount"` // in the smallest unit of the coin type
+	Reason         string       `json:"reason"`
+	RefundAddress  string       `json:"refund_address"`
+	Status         RefundStatus `json:"status"`
+	Txid           string       `json:"txid"`
+	Error          string       `json:"error"` // the last error that occurred while sending
+	CreatedAt      int64        `json:"created_at"`
+	UpdatedAt      int64        `json:"updated_at"`
+}
+
+// RefundFilter filters refunds
+type RefundFilter func(r Refund) bool
+
+// ValidateRefundAddress returns an error if addr can't receive refunds of coinType.
+// BTC addresses must be for the network of btcParams.
+func ValidateRefundAddress(coinType, addr string, btcParams *chaincfg.Params) error {
+	switch coinType {
+	case scanner.CoinTypeBTC:
+		return btcaddr.Validate(addr, btcParams)
+	case scanner.CoinTypeSKY:
+		_, err := cipher.DecodeBase58Address(addr)
+		return err
+	case scanner.CoinTypeETH:
+		return ethutil.ValidateAddress(addr)
+	default:
+		return scanner.ErrUnsupportedCoinType
+	}
+}
+
+// RefundSender sends refunds of one coin type
+type RefundSender interface {
+	// SendRefund sends amount, in the smallest unit of the coin, to addr and returns the txid
+	SendRefund(addr string, amount int64) (string, error)
+}
+
+// Refunder sends the refunds that are waiting to be sent
+type Refunder struct {
+	log     logrus.FieldLogger
+	cfg     config.Refund
+	store   Storer
+	senders map[string]RefundSender // senders by coin type, refunds of other coin types are not sent
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewRefunder creates a Refunder
+func NewRefunder(log logrus.FieldLogger, cfg config.Refund, store Storer, senders map[string]RefundSender) (*Refunder, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Refunder{
+		log:     log.WithField("prefix", "teller.exchange.refunder"),
+		cfg:     cfg,
+		store:   store,
+		senders: senders,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Run sends the refunds that are waiting to be sent every SendPeriod
+func (r *Refunder) Run() error {
+	log := r.log
+	log.Info("Start refund service...")
+	defer func() {
+		log.Info("Closed refund service")
+		close(r.done)
+	}()
+
+	ticker := time.NewTicker(r.cfg.SendPeriod)
+	defer ticker.Stop()
+
+	for {
+		r.sendRefunds()
+
+		select {
+		case <-r.quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops a previous call to Run
+func (r *Refunder) Shutdown() {
+	r.log.Info("Shutting down Refunder")
+	close(r.quit)
+	r.log.Info("Waiting for run to finish")
+	<-r.done
+	r.log.Info("Shutdown complete")
+}
+
+// sendRefunds sends all refunds with RefundStatusWaitSend
+func (r *Refunder) sendRefunds() {
+	refunds, err := r.store.GetRefunds(func(rf Refund) bool {
+		return rf.Status == RefundStatusWaitSend
+	})
+	if err != nil {
+		r.log.WithError(err).Error("GetRefunds failed")
+		return
+	}
+
+	for _, rf := range refunds {
+		select {
+		case <-r.quit:
+			return
+		default:
+		}
+
+		sender, ok := r.senders[rf.CoinType]
+		if !ok {
+			continue
+		}
+
+		log := r.log.WithField("refund", rf)
+		rf, err := r.send(rf, sender)
+		if err != nil {
+			log.WithError(err).Error("Send refund failed")
+			continue
+		}
+
+		log.WithField("txid", rf.Txid).Info("Refund sent")
+	}
+}
+
+// send sends a refund and records its txid
+func (r *Refunder) send(rf Refund, sender RefundSender) (Refund, error) {
+	// The refund is marked as sending before it is broadcast, so that it is never sent twice
+	rf, err := r.store.UpdateRefund(rf.DepositID, func(rf Refund) (Refund, error) {
+		if rf.Status != RefundStatusWaitSend {
+			return rf, ErrRefundStatusInvalid
+		}
+		rf.Status = RefundStatusSending
+		return rf, nil
+	})
+	if err != nil {
+		return rf, err
+	}
+
+	txid, sendErr := sender.SendRefund(rf.RefundAddress, rf.Amount)
+
+	rf, err = r.store.UpdateRefund(rf.DepositID, func(rf Refund) (Refund, error) {
+		if sendErr != nil {
+			// retried on the next run
+			rf.Status = RefundStatusWaitSend
+			rf.Error = sendErr.Error()
+			return rf, nil
+		}
+
+		rf.Status = RefundStatusSent
+		rf.Txid = txid
+		rf.Error = ""
+		return rf, nil
+	})
+	if err != nil {
+		return rf, fmt.Errorf("UpdateRefund failed after sending refund: %v", err)
+	}
+
+	return rf, sendErr
+}
+
+// GetRefunds returns the refunds that match the filter
+func (e *Exchange) GetRefunds(flt RefundFilter) ([]Refund, error) {
+	return e.store.GetRefunds(flt)
+}
+
+// SetRefundAddress sets the address a refund is sent to, e.g. when the buyer gave none
+func (e *Exchange) SetRefundAddress(depositID, addr string) (Refund, error) {
+	return e.store.UpdateRefund(depositID, func(r Refund) (Refund, error) {
+		switch r.Status {
+		case RefundStatusWaitAddress, RefundStatusWaitSend:
+		default:
+			return r, ErrRefundStatusInvalid
+		}
+
+		if err := ValidateRefundAddress(r.CoinType, addr, e.btcParams); err != nil {
+			return r, ErrInvalidRefundAddress
+		}
+
+		r.RefundAddress = addr
+		r.Status = RefundStatusWaitSend
+		return r, nil
+	})
+}
+
+// CompleteRefund records a refund that an operator has sent manually
+func (e *Exchange) CompleteRefund(depositID, txid string) (Refund, error) {
+	return e.store.UpdateRefund(depositID, func(r Refund) (Refund, error) {
+		switch r.Status {
+		case RefundStatusWaitAddress, RefundStatusWaitSend, RefundStatusSending:
+		default:
+			return r, ErrRefundStatusInvalid
+		}
+
+		r.Status = RefundStatusSent
+		r.Txid = txid
+		r.Error = ""
+		return r, nil
+	})
+}
+
+// CancelRefund cancels a refund that has not been sent
+func (e *Exchange) CancelRefund(depositID string) (Refund, error) {
+	return e.store.UpdateRefund(depositID, func(r Refund) (Refund, error) {
+		switch r.Status {
+		case RefundStatusWaitAddress, RefundStatusWaitSend, RefundStatusSending:
+		default:
+			return r, ErrRefundStatusInvalid
+		}
+
+		r.Status = RefundStatusCancelled
+		return r, nil
+	})
+}
@@ -0,0 +1,269 @@
+package exchange
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/config"
+	"github.com/kittycash/teller/src/scanner"
+)
+
+const (
+	// How often to check for deposits that are due to be retried
+	retryCheckPeriod = time.Second * 5
+	// Defaults used when the config leaves the retry settings unset
+	defaultRetryWait        = time.Second * 10
+	defaultMaxRetryWait     = time.Minute * 10
+	defaultMaxRetryAttempts = 10
+)
+
+var (
+	// errRetryNotScheduled is returned when claiming a retry that was completed or claimed in the meantime
+	errRetryNotScheduled = errors.New("Retry is not scheduled")
+)
+
+// RetryStage is the stage of the deposit pipeline that failed
+type RetryStage string
+
+const (
+	// RetryStageReceive saving a deposit received from the scanner failed
+	RetryStageReceive RetryStage = "receive"
+	// RetryStageProcess updating the status of a deposit failed
+	RetryStageProcess RetryStage = "process"
+	// RetryStageSend sending the kitty of a paid deposit failed
+	RetryStageSend RetryStage = "send"
+)
+
+// DepositRetry records a deposit that failed to be processed.
+// There is at most one retry per deposit, saved under the deposit's ID.
+type DepositRetry struct {
+	DepositID string     `json:"deposit_id"`
+	Stage     RetryStage `json:"stage"`
+	// The deposit received from the scanner, only set for RetryStageReceive,
+	// since its DepositInfo may not have been saved
+	Deposit     *scanner.Deposit `json:"deposit,omitempty"`
+	Attempts    int              `json:"attempts"`
+	NextAttempt int64            `json:"next_attempt"`
+	LastError   string           `json:"last_error"`
+	// The retry was given up after the max number of attempts, an operator has to requeue it
+	Dead      bool  `json:"dead"`
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// RetryFilter filters retries
+type RetryFilter func(r DepositRetry) bool
+
+// Retrier schedules the deposits that failed in a stage of the pipeline to be processed again.
+// Failed deposits are retried with an exponential backoff, and are moved to the dead letters
+// after MaxRetryAttempts. The retries are saved, so they survive a restart.
+type Retrier struct {
+	log   logrus.FieldLogger
+	cfg   config.BoxExchanger
+	store Storer
+	due   map[RetryStage]chan DepositRetry
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// NewRetrier creates a Retrier
+func NewRetrier(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer) (*Retrier, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.RetryWait == 0 {
+		cfg.RetryWait = defaultRetryWait
+	}
+
+	if cfg.MaxRetryWait == 0 {
+		cfg.MaxRetryWait = defaultMaxRetryWait
+	}
+
+	if cfg.MaxRetryWait < cfg.RetryWait {
+		cfg.MaxRetryWait = cfg.RetryWait
+	}
+
+	if cfg.MaxRetryAttempts == 0 {
+		cfg.MaxRetryAttempts = defaultMaxRetryAttempts
+	}
+
+	return &Retrier{
+		log:   log.WithField("prefix", "teller.exchange.retrier"),
+		cfg:   cfg,
+		store: store,
+		due: map[RetryStage]chan DepositRetry{
+			RetryStageReceive: make(chan DepositRetry, 100),
+			RetryStageProcess: make(chan DepositRetry, 100),
+			RetryStageSend:    make(chan DepositRetry, 100),
+		},
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Run sends the retries that are due to the stage that failed, until Shutdown is called
+func (r *Retrier) Run() error {
+	log := r.log
+	log.Info("Start retry service...")
+	defer func() {
+		log.Info("Closed retry service")
+		close(r.done)
+	}()
+
+	ticker := time.NewTicker(retryCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		r.dispatch()
+
+		select {
+		case <-r.quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops a previous call to Run
+func (r *Retrier) Shutdown() {
+	r.log.Info("Shutting down Retrier")
+	close(r.quit)
+	r.log.Info("Waiting for run to finish")
+	<-r.done
+	r.log.Info("Shutdown complete")
+}
+
+// Due returns a channel of the retries of a stage that are due
+func (r *Retrier) Due(stage RetryStage) <-chan DepositRetry {
+	return r.due[stage]
+}
+
+// dispatch sends the retries that are due to their stage
+func (r *Retrier) dispatch() {
+	now := time.Now().UTC()
+	retries, err := r.store.GetRetries(func(rt DepositRetry) bool {
+		return !rt.Dead && rt.NextAttempt <= now.Unix()
+	})
+	if err != nil {
+		r.log.WithError(err).Error("GetRetries failed")
+		return
+	}
+
+	for _, rt := range retries {
+		log := r.log.WithField("retry", rt)
+
+		due, ok := r.due[rt.Stage]
+		if !ok {
+			log.Error("Retry has an unknown stage")
+			continue
+		}
+
+		// The next attempt is pushed back before the retry is handed over, so that it is not
+		// dispatched twice. If the stage never reports back, it is dispatched again after the wait.
+		rt, err := r.store.UpdateRetry(rt.DepositID, func(rt DepositRetry) (DepositRetry, error) {
+			if rt.DepositID == "" || rt.Dead || rt.NextAttempt > now.Unix() {
+				return rt, errRetryNotScheduled
+			}
+			rt.NextAttempt = now.Add(r.retryWait(rt.Attempts + 1)).Unix()
+			return rt, nil
+		})
+		if err != nil {
+			if err != errRetryNotScheduled {
+				log.WithError(err).Error("UpdateRetry failed")
+			}
+			continue
+		}
+
+		select {
+		case <-r.quit:
+			return
+		case due <- rt:
+			log.Info("Retrying deposit")
+		}
+	}
+}
+
+// Schedule records that processing a deposit failed in a stage.
+// dv is the deposit received from the scanner, which is only needed for RetryStageReceive.
+func (r *Retrier) Schedule(stage RetryStage, depositID string, dv *scanner.Deposit, cause error) (DepositRetry, error) {
+	now := time.Now().UTC()
+	rt, err := r.store.UpdateRetry(depositID, func(rt DepositRetry) (DepositRetry, error) {
+		if rt.DepositID == "" || rt.Stage != stage {
+			rt = DepositRetry{
+				DepositID: depositID,
+				Stage:     stage,
+				CreatedAt: now.Unix(),
+			}
+		}
+
+		if dv != nil {
+			rt.Deposit = dv
+		}
+
+		rt.Attempts++
+		rt.LastError = cause.Error()
+		rt.UpdatedAt = now.Unix()
+
+		if rt.Attempts >= r.cfg.MaxRetryAttempts {
+			rt.Dead = true
+			return rt, nil
+		}
+
+		rt.NextAttempt = now.Add(r.retryWait(rt.Attempts)).Unix()
+		return rt, nil
+	})
+	if err != nil {
+		return rt, err
+	}
+
+	log := r.log.WithField("retry", rt)
+	if rt.Dead {
+		log.Error("Deposit failed too many times, moved to the dead letters. Requeue it from the admin panel once the cause is fixed.")
+	} else {
+		log.Warn("Deposit scheduled for retry")
+	}
+
+	return rt, nil
+}
+
+// Complete removes the retry of a deposit that was processed
+func (r *Retrier) Complete(depositID string) {
+	if err := r.store.DeleteRetry(depositID); err != nil {
+		r.log.WithError(err).WithField("depositID", depositID).Error("DeleteRetry failed")
+	}
+}
+
+// retryWait returns how long to wait after a number of failed attempts
+func (r *Retrier) retryWait(attempts int) time.Duration {
+	wait := r.cfg.RetryWait
+	for i := 1; i < attempts && wait < r.cfg.MaxRetryWait; i++ {
+		wait *= 2
+	}
+
+	if wait > r.cfg.MaxRetryWait {
+		return r.cfg.MaxRetryWait
+	}
+
+	return wait
+}
+
+// GetRetries returns the scheduled retries and dead letters that match the filter
+func (e *Exchange) GetRetries(flt RetryFilter) ([]DepositRetry, error) {
+	return e.store.GetRetries(flt)
+}
+
+// RequeueDeadLetter schedules a dead letter to be retried immediately, with its attempts reset.
+// Returns dbutil.ObjectNotExistErr if the deposit has no dead letter.
+func (e *Exchange) RequeueDeadLetter(depositID string) (DepositRetry, error) {
+	rt, err := e.store.RequeueDeadLetter(depositID, time.Now().UTC().Unix())
+	if err != nil {
+		return rt, err
+	}
+
+	e.log.WithField("retry", rt).Info("Requeued dead letter")
+
+	return rt, nil
+}
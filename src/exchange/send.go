@@ -1,14 +1,18 @@
 package exchange
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/sirupsen/logrus"
 
 	"github.com/kittycash/wallet/src/iko"
 
+	"github.com/skycoin/skycoin/src/cipher"
+
 	"github.com/kittycash/teller/src/config"
 	"github.com/kittycash/teller/src/sender"
 )
@@ -32,6 +36,7 @@ type Send struct {
 	processor   Processor
 	sender      sender.Sender // sender provides APIs for sending boxes
 	store       Storer        // deposit info storage
+	retrier     *Retrier
 	quit        chan struct{}
 	done        chan struct{}
 	depositChan chan DepositInfo
@@ -40,7 +45,7 @@ type Send struct {
 }
 
 // NewSend creates exchange service
-func NewSend(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, sender sender.Sender, processor Processor) (*Send, error) {
+func NewSend(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, sender sender.Sender, processor Processor, retrier *Retrier) (*Send, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
@@ -55,6 +60,7 @@ func NewSend(log logrus.FieldLogger, cfg config.BoxExchanger, store Storer, send
 		processor:   processor,
 		sender:      sender,
 		store:       store,
+		retrier:     retrier,
 		quit:        make(chan struct{}),
 		done:        make(chan struct{}, 1),
 		depositChan: make(chan DepositInfo, 100),
@@ -74,23 +80,23 @@ func (s *Send) Run() error {
 
 	if s.cfg.SendEnabled {
 		// Load StatusWaitSend deposits for processing later
-		waitSendDeposits, err := s.store.GetDepositInfoArray(func(di DepositInfo) bool {
-			return di.Status == StatusWaitSend
+		waitSendDeposits, err := s.store.GetDepositInfoByStatus(StatusWaitSend, func(di DepositInfo) bool {
+			return true
 		})
 
 		if err != nil {
-			err = fmt.Errorf("GetDepositInfoArray failed: %v", err)
+			err = fmt.Errorf("GetDepositInfoByStatus failed: %v", err)
 			log.WithError(err).Error(err)
 			return err
 		}
 
 		// Load StatusWaitConfirm deposits for processing later
-		waitConfirmDeposits, err := s.store.GetDepositInfoArray(func(di DepositInfo) bool {
-			return di.Status == StatusWaitConfirm
+		waitConfirmDeposits, err := s.store.GetDepositInfoByStatus(StatusWaitConfirm, func(di DepositInfo) bool {
+			return true
 		})
 
 		if err != nil {
-			err = fmt.Errorf("GetDepositInfoArray failed: %v", err)
+			err = fmt.Errorf("GetDepositInfoByStatus failed: %v", err)
 			log.WithError(err).Error(err)
 			return err
 		}
@@ -140,15 +146,60 @@ func (s *Send) runSend() {
 		case <-s.quit:
 			log.Info("quit")
 			return
+		case rt := <-s.retrier.Due(RetryStageSend):
+			s.retryDeposit(rt)
 		case d := <-s.depositChan:
 			log := log.WithField("depositInfo", d)
 			if err := s.processWaitSendDeposit(d); err != nil {
-				log.WithError(err).Error("processWaitSendDeposit failed. This deposit will not be reprocessed until teller is restarted.")
+				log.WithError(err).Error("processWaitSendDeposit failed")
+				if _, err := s.retrier.Schedule(RetryStageSend, d.DepositID, nil, err); err != nil {
+					log.WithError(err).Error("Schedule retry failed. This deposit will not be reprocessed until teller is restarted.")
+				}
 			}
 		}
 	}
 }
 
+// retryDeposit sends the kitty of a deposit that failed to be sent again.
+// The DepositInfo is reloaded, since its status may have changed since it failed.
+func (s *Send) retryDeposit(rt DepositRetry) {
+	log := s.log.WithField("retry", rt)
+
+	di, err := s.store.getDepositInfo(rt.DepositID)
+	if err != nil {
+		log.WithError(err).Error("getDepositInfo failed")
+		if _, err := s.retrier.Schedule(RetryStageSend, rt.DepositID, nil, err); err != nil {
+			log.WithError(err).Error("Schedule retry failed")
+		}
+		return
+	}
+
+	switch di.Status {
+	case StatusWaitSend, StatusWaitConfirm:
+	default:
+		log.WithField("depositInfo", di).Info("Deposit no longer needs to be sent")
+		s.retrier.Complete(rt.DepositID)
+		return
+	}
+
+	if err := s.processWaitSendDeposit(di); err != nil {
+		log.WithError(err).Error("processWaitSendDeposit failed")
+		if _, err := s.retrier.Schedule(RetryStageSend, rt.DepositID, nil, err); err != nil {
+			log.WithError(err).Error("Schedule retry failed")
+		}
+		return
+	}
+
+	// processWaitSendDeposit also returns when quitting, the retry is dispatched again after a restart
+	select {
+	case <-s.quit:
+		return
+	default:
+	}
+
+	s.retrier.Complete(rt.DepositID)
+}
+
 func (s *Send) runNoSend() {
 	// Flush the deposit channel so that it doesn't fill up
 	log := s.log.WithField("goroutine", "runNoSend")
@@ -160,6 +211,9 @@ func (s *Send) runNoSend() {
 		case d := <-s.depositChan:
 			log := log.WithField("depositInfo", d)
 			log.Warning("Received depositInfo, but sending is disabled")
+		case rt := <-s.retrier.Due(RetryStageSend):
+			log := log.WithField("retry", rt)
+			log.Warning("Retry is due, but sending is disabled")
 		}
 	}
 }
@@ -258,7 +312,41 @@ func (s *Send) handleDepositInfoState(di DepositInfo) (DepositInfo, error) {
 
 	switch di.Status {
 	case StatusWaitSend:
-		//@TODO (therealssj): implement
+		// Prepare transaction
+		tx, err := s.createTransaction(di)
+		if err != nil {
+			log.WithError(err).Error("createTransaction failed")
+			return di, err
+		}
+
+		log = log.WithField("txid", tx.Hash().Hex())
+
+		// Update the status and txid before broadcasting, to avoid double-sends.
+		// If the broadcast fails, the update is rolled back.
+		di, err = s.store.UpdateDepositInfoCallback(di.DepositID, func(di DepositInfo) DepositInfo {
+			di.Txid = tx.Hash().Hex()
+			di.Status = StatusWaitConfirm
+			return di
+		}, func(di DepositInfo, _ *bolt.Tx) error {
+			// NOTE: broadcastTransaction retries indefinitely on error.
+			// If the kitty node is not reachable, this will block,
+			// which will also block the database since it's in a transaction
+			rsp, err := s.broadcastTransaction(tx)
+			if err != nil {
+				log.WithError(err).Error("broadcastTransaction failed")
+				return err
+			}
+
+			log.WithField("sendRsp", rsp).Info("Sent kitty")
+
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Error("UpdateDepositInfoCallback set StatusWaitConfirm failed")
+			return di, err
+		}
+
+		log.Info("DepositInfo status set to StatusWaitConfirm")
 
 		return di, nil
 
@@ -325,13 +413,19 @@ func (s *Send) createTransaction(di DepositInfo) (*iko.Transaction, error) {
 		return nil, err
 	}
 
+	// The owner address is copied from the reservation when the DepositInfo
+	// is created, we cannot send the kitty anywhere without it
+	if di.OwnerAddress == "" {
+		err := ErrNoOwnerAddress
+		log.WithError(err).Error(err)
+		return nil, err
+	}
+
 	log = log.WithField("depositAddress", di.DepositAddress)
 	log = log.WithField("ownerAddress", di.OwnerAddress)
 	log = log.WithField("kittyID", di.KittyID)
 	log = log.WithField("depositAmt", di.DepositValue)
 
-	//@TODO (therealssj): verify deposit amount here
-
 	log.Info("Creating kitty cash transaction")
 
 	kittyID, err := iko.KittyIDFromString(di.KittyID)
@@ -346,16 +440,38 @@ func (s *Send) createTransaction(di DepositInfo) (*iko.Transaction, error) {
 		return nil, err
 	}
 
-	//@TODO (therealssj): do transaction verification here
+	if err := verifyCreatedTransaction(tx, di); err != nil {
+		log.WithError(err).Error("verifyCreatedTransaction failed")
+		return nil, err
+	}
 
 	return tx, nil
 }
 
 func verifyCreatedTransaction(tx *iko.Transaction, di DepositInfo) error {
 	// Check invariant assertions:
-	// The transaction should contain one output to the destination address.
-	// It may or may not have a change output.
-	//@TODO (therealssj): implement
+	// The transaction should transfer the reserved kitty to the owner address.
+	if tx == nil {
+		return errors.New("Created transaction is nil")
+	}
+
+	kittyID, err := iko.KittyIDFromString(di.KittyID)
+	if err != nil {
+		return err
+	}
+
+	if tx.KittyID != kittyID {
+		return fmt.Errorf("Transaction kitty ID %d does not match deposit kitty ID %s", tx.KittyID, di.KittyID)
+	}
+
+	ownerAddr, err := cipher.DecodeBase58Address(di.OwnerAddress)
+	if err != nil {
+		return err
+	}
+
+	if tx.Out != ownerAddr {
+		return fmt.Errorf("Transaction output address %s does not match deposit owner address %s", tx.Out.String(), di.OwnerAddress)
+	}
 
 	return nil
 }
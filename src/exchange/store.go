@@ -13,12 +13,25 @@ import (
 	"github.com/kittycash/teller/src/agent"
 	"github.com/kittycash/teller/src/scanner"
 	"github.com/kittycash/teller/src/util/dbutil"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 var (
 	// DepositInfoBkt maps a deposit transaction to a DepositInfo
 	DepositInfoBkt = []byte("deposit_info")
 
+	// DepositStatusIndexBkt indexes the deposit infos by status, see depositIndex
+	DepositStatusIndexBkt = []byte("deposit_info_status_index")
+
+	// DepositCoinTypeIndexBkt indexes the deposit infos by coin type, see depositIndex
+	DepositCoinTypeIndexBkt = []byte("deposit_info_coin_type_index")
+
+	// DepositOwnerIndexBkt indexes the deposit infos by owner address, see depositIndex
+	DepositOwnerIndexBkt = []byte("deposit_info_owner_index")
+
+	// DepositInfoMetaBkt saves the version of the deposit info indexes, and the deposit counters
+	DepositInfoMetaBkt = []byte("deposit_info_meta")
+
 	// TxsBkt maps a deposit transaction to a DepositInfo
 	TxsBkt = []byte("deposit_txs")
 
@@ -28,6 +41,15 @@ var (
 	//DepositTrackBkt keeps track of amount paid for a reservation box
 	DepositTrackBkt = []byte("deposit_track")
 
+	// RefundBkt maps a deposit ID to the Refund of the deposit
+	RefundBkt = []byte("refunds")
+
+	// RetryBkt maps a deposit ID to the DepositRetry of a deposit that failed to be processed
+	RetryBkt = []byte("deposit_retries")
+
+	// DeadLetterBkt maps a deposit ID to the DepositRetry of a deposit that failed too many times
+	DeadLetterBkt = []byte("deposit_dead_letters")
+
 	// ErrAddressAlreadyBound is returned if a payment address has already been bound to a kittyID
 	ErrAddressAlreadyBound = errors.New("Address already bound to a kitty ID")
 )
@@ -42,6 +64,8 @@ func GetBindAddressBkt(coinType string) ([]byte, error) {
 		suffix = "btc"
 	case scanner.CoinTypeSKY:
 		suffix = "sky"
+	case scanner.CoinTypeETH:
+		suffix = "eth"
 	default:
 		return nil, scanner.ErrUnsupportedCoinType
 	}
@@ -75,29 +99,48 @@ func init() {
 type Storer interface {
 	GetBindAddress(depositAddr, coinType string) (*BoundAddress, error)
 	BindAddress(kittyID, depositAddr, coinType string) (*BoundAddress, error)
-	BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error)
+	BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error)
 	GetOrCreateDepositInfo(scanner.Deposit) (DepositInfo, error)
+	OrphanDepositInfo(scanner.Deposit) (DepositInfo, error)
 	GetDepositInfoArray(DepositFilter) ([]DepositInfo, error)
+	GetDepositInfoByStatus(Status, DepositFilter) ([]DepositInfo, error)
+	GetDepositInfoByCoinType(string, DepositFilter) ([]DepositInfo, error)
+	GetDepositInfoByOwner(string, DepositFilter) ([]DepositInfo, error)
 	GetDepositInfoOfKittyID(string) ([]DepositInfo, error)
+	GetKittyStatusesOfOwner(string) ([]KittyStatus, error)
 	UpdateDepositInfo(string, func(DepositInfo) DepositInfo) (DepositInfo, error)
 	UpdateDepositInfoCallback(string, func(DepositInfo) DepositInfo, func(DepositInfo, *bolt.Tx) error) (DepositInfo, error)
 	GetKittyBindAddress(string) (*BoundAddress, error)
-	GetDepositStats() (int64, int64, int64, error)
+	GetDepositStats() (int64, int64, int64, int64, error)
+	GetRefunds(RefundFilter) ([]Refund, error)
+	UpdateRefund(string, func(Refund) (Refund, error)) (Refund, error)
+	GetRetries(RetryFilter) ([]DepositRetry, error)
+	UpdateRetry(string, func(DepositRetry) (DepositRetry, error)) (DepositRetry, error)
+	DeleteRetry(string) error
+	RequeueDeadLetter(depositID string, nextAttempt int64) (DepositRetry, error)
+	DecideDeposit(depositID string, d DepositDecision) (DepositInfo, error)
 	//TODO (therealssj): these need to be refactored
+	getDepositInfo(depositID string) (DepositInfo, error)
+	putDepositInfoTx(tx *bolt.Tx, di DepositInfo) error
 	getDepositTrack(depositAddr string) (DepositTrack, error)
 	getDepositTrackTx(tx *bolt.Tx, depositAddr string) (DepositTrack, error)
 	updateDepositTrack(depositAddr string, dt DepositTrack) error
 	updateDepositTrackTx(tx *bolt.Tx, depositAddr string, dt DepositTrack) error
+	isKittyReservedToTx(tx *bolt.Tx, kittyID, depositAddr string) (bool, error)
+	getReservationTx(tx *bolt.Tx, kittyID string) (agent.Reservation, error)
+	deliverReservationTx(tx *bolt.Tx, kittyID, depositAddr string) error
+	createRefundTx(tx *bolt.Tx, di DepositInfo, amount int64, reason string) (Refund, error)
 }
 
 // Store storage for exchange
 type Store struct {
-	db  *bolt.DB
-	log logrus.FieldLogger
+	db     *bolt.DB
+	log    logrus.FieldLogger
+	events webhook.Emitter
 }
 
-// NewStore creates a Store instance
-func NewStore(log logrus.FieldLogger, db *bolt.DB) (*Store, error) {
+// NewStore creates a Store instance. The events of deposit status changes are emitted to events.
+func NewStore(log logrus.FieldLogger, db *bolt.DB, events webhook.Emitter) (*Store, error) {
 	if db == nil {
 		return nil, errors.New("new exchange Store failed, db is nil")
 	}
@@ -129,14 +172,42 @@ func NewStore(log logrus.FieldLogger, db *bolt.DB) (*Store, error) {
 			return dbutil.NewCreateBucketFailedErr(DepositTrackBkt, err)
 		}
 
+		if _, err := tx.CreateBucketIfNotExists(RefundBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(RefundBkt, err)
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(RetryBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(RetryBkt, err)
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(DeadLetterBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(DeadLetterBkt, err)
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(DepositInfoMetaBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(DepositInfoMetaBkt, err)
+		}
+
+		// build the deposit info indexes of a db saved before they existed
+		built, err := depositIndexesBuiltTx(tx)
+		if err != nil {
+			return err
+		}
+
+		if !built {
+			log.Info("Building the deposit info indexes")
+			return buildDepositIndexesTx(tx)
+		}
+
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
 	return &Store{
-		db:  db,
-		log: log.WithField("prefix", "exchange.Store"),
+		db:     db,
+		log:    log.WithField("prefix", "exchange.Store"),
+		events: events,
 	}, nil
 }
 
@@ -203,7 +274,11 @@ func (s *Store) BindAddress(kittyID, depositAddr, coinType string) (*BoundAddres
 			return err
 		}
 
-		return dbutil.PutBucketValue(tx, bindBktFullName, depositAddr, boundAddr)
+		if err := dbutil.PutBucketValue(tx, bindBktFullName, depositAddr, boundAddr); err != nil {
+			return err
+		}
+
+		return dbutil.PutBucketValue(tx, KittyDepositSeqsIndexBkt, kittyID, boundAddr)
 	}); err != nil {
 		return nil, err
 	}
@@ -211,7 +286,9 @@ func (s *Store) BindAddress(kittyID, depositAddr, coinType string) (*BoundAddres
 	return &boundAddr, nil
 }
 
-func (s *Store) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error) {
+// BindAddressWithTx binds a deposit address to bound info with a db tx.
+// refundAddr is where deposits that can't pay for the kitty are refunded to, it can be empty.
+func (s *Store) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error) {
 	log := s.log.WithField("kittyID", kittyID)
 	log = log.WithField("depositAddr", depositAddr)
 	log = log.WithField("coinType", coinType)
@@ -222,9 +299,10 @@ func (s *Store) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType st
 	}
 
 	boundAddr := BoundAddress{
-		KittyID:  kittyID,
-		Address:  depositAddr,
-		CoinType: coinType,
+		KittyID:       kittyID,
+		Address:       depositAddr,
+		CoinType:      coinType,
+		RefundAddress: refundAddr,
 	}
 
 	existingKittyID, err := s.getBindAddressTx(tx, depositAddr, coinType)
@@ -238,9 +316,115 @@ func (s *Store) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType st
 		return nil, err
 	}
 
-	err = dbutil.PutBucketValue(tx, bindBktFullName, depositAddr, boundAddr)
+	if err := dbutil.PutBucketValue(tx, bindBktFullName, depositAddr, boundAddr); err != nil {
+		return nil, err
+	}
+
+	if err := dbutil.PutBucketValue(tx, KittyDepositSeqsIndexBkt, kittyID, boundAddr); err != nil {
+		return nil, err
+	}
+
+	return &boundAddr, nil
+}
+
+// UnbindKittyTx removes the current deposit address of a kitty, e.g. when its reservation expires.
+// The deposit address stays bound to the kitty, so that late deposits to it are still recorded.
+// The deposits received so far at the address are refunded.
+// The scanner deactivates the address, it stops watching it after a grace period for late deposits.
+func (s *Store) UnbindKittyTx(tx *bolt.Tx, kittyID string) error {
+	var r agent.Reservation
+	if err := dbutil.GetBucketObject(tx, agent.ReservationsKittyBkt, kittyID, &r); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr, dbutil.BucketNotExistErr:
+			// Never reserved, so there is nothing to refund
+		default:
+			return err
+		}
+	}
+
+	if r.DepositAddress != "" {
+		if err := s.refundPartialDepositsTx(tx, r.DepositAddress); err != nil {
+			return err
+		}
+	}
+
+	var boundAddr BoundAddress
+	if err := dbutil.GetBucketObject(tx, KittyDepositSeqsIndexBkt, kittyID, &boundAddr); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if err := scanner.DeactivateScanAddressTx(tx, boundAddr.Address, boundAddr.CoinType); err != nil {
+		return err
+	}
+
+	return tx.Bucket(KittyDepositSeqsIndexBkt).Delete([]byte(kittyID))
+}
+
+// refundPartialDepositsTx refunds the deposits at a deposit address that only paid part of the kitty
+func (s *Store) refundPartialDepositsTx(tx *bolt.Tx, depositAddr string) error {
+	var txns []string
+	if err := dbutil.GetBucketObject(tx, TxsBkt, depositAddr, &txns); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	dt, err := s.getDepositTrackTx(tx, depositAddr)
+	if err != nil {
+		return err
+	}
+
+	for _, txn := range txns {
+		di, err := s.getDepositInfoTx(tx, txn)
+		if err != nil {
+			return err
+		}
+
+		if di.Status != StatusWaitPartial {
+			continue
+		}
+
+		if _, err := s.createRefundTx(tx, di, di.DepositValue, RefundReasonExpired); err != nil {
+			return err
+		}
+
+		dt.AmountRefunded += di.DepositValue
+
+		di.Status = StatusWaitRefund
+		di.UpdatedAt = time.Now().UTC().Unix()
+		if err := s.putDepositInfoTx(tx, di); err != nil {
+			return err
+		}
+
+		if err := s.emitStatusEventTx(tx, StatusWaitPartial, di); err != nil {
+			return err
+		}
+	}
 
-	return &boundAddr, err
+	return s.updateDepositTrackTx(tx, depositAddr, dt)
+}
+
+// IsPaidTx returns true if the full price of the kitty bound to a deposit address has been received
+func (s *Store) IsPaidTx(tx *bolt.Tx, depositAddr string) (bool, error) {
+	dt, err := s.getDepositTrackTx(tx, depositAddr)
+	switch err.(type) {
+	case nil:
+	case dbutil.ObjectNotExistErr:
+		// no deposit has been received yet
+		return false, nil
+	default:
+		return false, err
+	}
+
+	return dt.AmountRequired > 0 && dt.AmountDeposited >= dt.AmountRequired, nil
 }
 
 // GetOrCreateDepositInfo creates a DepositInfo unless one exists with the DepositInfo.DepositID key,
@@ -253,6 +437,15 @@ func (s *Store) GetOrCreateDepositInfo(dv scanner.Deposit) (DepositInfo, error)
 		di, err := s.getDepositInfoTx(tx, dv.ID())
 		switch err.(type) {
 		case nil:
+			if di.Status == StatusOrphaned {
+				di, err = s.restoreOrphanedDepositInfoTx(tx, di, dv)
+				if err != nil {
+					err = fmt.Errorf("restoreOrphanedDepositInfoTx failed: %v", err)
+					log.WithError(err).Error(err)
+					return err
+				}
+			}
+
 			finalDepositInfo = di
 			return nil
 
@@ -287,11 +480,18 @@ func (s *Store) GetOrCreateDepositInfo(dv scanner.Deposit) (DepositInfo, error)
 				return err
 			}
 
-			//TODO (therealssj): add owner address?
+			ownerAddr, err := s.getKittyOwnerTx(tx, boundAddr.KittyID)
+			if err != nil {
+				err = fmt.Errorf("getKittyOwnerTx failed: %v", err)
+				log.WithError(err).Error(err)
+				return err
+			}
+
 			di := DepositInfo{
 				CoinType:       dv.CoinType,
 				DepositAddress: dv.Address,
 				KittyID:        boundAddr.KittyID,
+				OwnerAddress:   ownerAddr,
 				DepositID:      dv.ID(),
 				Status:         StatusWaitDecide,
 				DepositValue:   dv.Value,
@@ -324,6 +524,146 @@ func (s *Store) GetOrCreateDepositInfo(dv scanner.Deposit) (DepositInfo, error)
 
 }
 
+// OrphanDepositInfo sets the DepositInfo of a deposit invalidated by a chain reorganization
+// to StatusOrphaned. If the deposit value was already counted towards the kitty's
+// DepositTrack, it is subtracted again. Returns dbutil.ObjectNotExistErr if no
+// DepositInfo exists for the deposit.
+func (s *Store) OrphanDepositInfo(dv scanner.Deposit) (DepositInfo, error) {
+	log := s.log.WithField("deposit", dv)
+
+	var di DepositInfo
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		di, err = s.getDepositInfoTx(tx, dv.ID())
+		if err != nil {
+			return err
+		}
+
+		if di.Status == StatusOrphaned {
+			return nil
+		}
+
+		log = log.WithField("depositInfo", di)
+
+		switch di.Status {
+		case StatusWaitPartial, StatusWaitSend, StatusWaitConfirm, StatusDone, StatusWaitRefund:
+			dt, err := s.getDepositTrackTx(tx, di.DepositAddress)
+			if err != nil {
+				err = fmt.Errorf("getDepositTrackTx failed: %v", err)
+				log.WithError(err).Error(err)
+				return err
+			}
+
+			refunded, err := s.cancelRefundTx(tx, di.DepositID)
+			if err != nil {
+				err = fmt.Errorf("cancelRefundTx failed: %v", err)
+				log.WithError(err).Error(err)
+				return err
+			}
+
+			dt.AmountDeposited -= di.DepositValue
+			dt.AmountRefunded -= refunded
+			if err := s.updateDepositTrackTx(tx, di.DepositAddress, dt); err != nil {
+				err = fmt.Errorf("updateDepositTrackTx failed: %v", err)
+				log.WithError(err).Error(err)
+				return err
+			}
+		}
+
+		if di.Txid != "" {
+			log.Error("Deposit was orphaned after the kitty was sent")
+		}
+
+		prevStatus := di.Status
+		di.Status = StatusOrphaned
+		di.Error = ErrDepositOrphaned.Error()
+		di.UpdatedAt = time.Now().UTC().Unix()
+
+		if err := s.putDepositInfoTx(tx, di); err != nil {
+			return err
+		}
+
+		return s.emitStatusEventTx(tx, prevStatus, di)
+	}); err != nil {
+		return DepositInfo{}, err
+	}
+
+	return di, nil
+}
+
+// restoreOrphanedDepositInfoTx restores the DepositInfo of an orphaned deposit that was included in
+// the chain again after a chain reorganization. It is set back to StatusWaitDecide, so that its amount
+// is counted again. If the kitty was sent before the deposit was orphaned, its amount is counted again
+// here and it is set to StatusWaitConfirm instead, so that the kitty is not sent twice.
+func (s *Store) restoreOrphanedDepositInfoTx(tx *bolt.Tx, di DepositInfo, dv scanner.Deposit) (DepositInfo, error) {
+	log := s.log.WithField("depositInfo", di)
+
+	var r Refund
+	hasRefund := true
+	if err := dbutil.GetBucketObject(tx, RefundBkt, di.DepositID, &r); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			hasRefund = false
+		default:
+			return DepositInfo{}, err
+		}
+	}
+
+	// The refund that was cancelled when the deposit was orphaned
+	cancelled := hasRefund && r.Status == RefundStatusCancelled && r.Error == ErrDepositOrphaned.Error()
+
+	prevStatus := di.Status
+	di.Status = StatusWaitDecide
+	di.Error = ""
+	di.Deposit = dv
+	di.UpdatedAt = time.Now().UTC().Unix()
+
+	if di.Txid == "" {
+		// The refund is recorded again when the deposit is counted
+		if cancelled {
+			if err := tx.Bucket(RefundBkt).Delete([]byte(di.DepositID)); err != nil {
+				return DepositInfo{}, err
+			}
+		}
+	} else {
+		dt, err := s.getDepositTrackTx(tx, di.DepositAddress)
+		if err != nil {
+			return DepositInfo{}, err
+		}
+
+		dt.AmountDeposited += di.DepositValue
+
+		if cancelled {
+			r.Status = RefundStatusWaitAddress
+			if r.RefundAddress != "" {
+				r.Status = RefundStatusWaitSend
+			}
+			r.Error = ""
+			r.UpdatedAt = di.UpdatedAt
+
+			if err := dbutil.PutBucketValue(tx, RefundBkt, r.DepositID, r); err != nil {
+				return DepositInfo{}, err
+			}
+
+			dt.AmountRefunded += r.Amount
+		}
+
+		if err := s.updateDepositTrackTx(tx, di.DepositAddress, dt); err != nil {
+			return DepositInfo{}, err
+		}
+
+		di.Status = StatusWaitConfirm
+	}
+
+	if err := s.putDepositInfoTx(tx, di); err != nil {
+		return DepositInfo{}, err
+	}
+
+	log.WithField("status", di.Status).Warn("Orphaned deposit was included in the chain again, DepositInfo restored")
+
+	return di, s.emitStatusEventTx(tx, prevStatus, di)
+}
+
 // addDepositInfo adds deposit info into storage, return seq or error
 func (s *Store) addDepositInfo(di DepositInfo) (DepositInfo, error) {
 	var updatedDi DepositInfo
@@ -363,7 +703,7 @@ func (s *Store) addDepositInfoTx(tx *bolt.Tx, di DepositInfo) (DepositInfo, erro
 		return di, err
 	}
 
-	if err := dbutil.PutBucketValue(tx, DepositInfoBkt, updatedDi.DepositID, updatedDi); err != nil {
+	if err := s.putDepositInfoTx(tx, updatedDi); err != nil {
 		return di, err
 	}
 
@@ -382,6 +722,10 @@ func (s *Store) addDepositInfoTx(tx *bolt.Tx, di DepositInfo) (DepositInfo, erro
 		return di, err
 	}
 
+	if err := s.events.EmitTx(tx, webhook.EventDepositSeen, updatedDi); err != nil {
+		return di, err
+	}
+
 	return updatedDi, nil
 }
 
@@ -548,6 +892,148 @@ func (s *Store) GetDepositInfoOfKittyID(kittyID string) ([]DepositInfo, error) {
 	return dpis, nil
 }
 
+// GetKittyStatusesOfOwner returns the payment progress of the kitties reserved by an owner address.
+// They include the kitties it has reserved, and the kitties its deposits were received for,
+// e.g. after the kitty was sent or the reservation expired.
+func (s *Store) GetKittyStatusesOfOwner(ownerAddr string) ([]KittyStatus, error) {
+	var kss []KittyStatus
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		// the kitty statuses by deposit address
+		statuses := make(map[string]*KittyStatus)
+		getStatus := func(kittyID, depositAddr, coinType string) *KittyStatus {
+			ks, ok := statuses[depositAddr]
+			if !ok {
+				ks = &KittyStatus{
+					KittyID:        kittyID,
+					CoinType:       coinType,
+					DepositAddress: depositAddr,
+					Deposits:       []DepositStatus{},
+				}
+				statuses[depositAddr] = ks
+			}
+			return ks
+		}
+
+		var user agent.User
+		if err := dbutil.GetBucketObject(tx, agent.UsersBkt, ownerAddr, &user); err != nil {
+			switch err.(type) {
+			case dbutil.ObjectNotExistErr:
+			default:
+				return err
+			}
+		}
+
+		for _, ur := range user.Reservations {
+			r, err := s.getReservationTx(tx, ur.KittyID)
+			if err != nil {
+				switch err.(type) {
+				case dbutil.ObjectNotExistErr:
+					continue
+				default:
+					return err
+				}
+			}
+
+			if r.Status != agent.Reserved || r.OwnerAddress != ownerAddr || r.DepositAddress == "" {
+				continue
+			}
+
+			ks := getStatus(r.KittyID, r.DepositAddress, r.CoinType)
+			ks.Reserved = true
+			ks.Expire = r.Expire
+
+			// the price is known before the first deposit creates the deposit track
+			if price, err := s.getKittyPriceTx(tx, r.KittyID, r.CoinType); err == nil {
+				ks.AmountRequired = price
+			}
+		}
+
+		dis, err := s.getDepositInfoByIndexTx(tx, DepositOwnerIndexBkt, ownerAddr, func(DepositInfo) bool {
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, di := range dis {
+			ks := getStatus(di.KittyID, di.DepositAddress, di.CoinType)
+			ks.Deposits = append(ks.Deposits, DepositStatus{
+				Seq:       di.Seq,
+				UpdatedAt: di.UpdatedAt,
+				Status:    di.Status.String(),
+				CoinType:  di.CoinType,
+				Amount:    di.DepositValue,
+				Txid:      di.Txid,
+			})
+
+			if di.Txid != "" {
+				ks.Txid = di.Txid
+			}
+		}
+
+		// Deposits seen in the mempool are shown after the confirmed deposits,
+		// they are not counted as paid until they are confirmed
+		udvs, err := scanner.GetUnconfirmedDepositsTx(tx, func(dv scanner.UnconfirmedDeposit) bool {
+			ks, ok := statuses[dv.Address]
+			return ok && ks.CoinType == dv.CoinType
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(udvs, func(i, j int) bool {
+			return udvs[i].SeenAt < udvs[j].SeenAt
+		})
+
+		for _, ks := range statuses {
+			dt, err := s.getDepositTrackTx(tx, ks.DepositAddress)
+			switch err.(type) {
+			case nil:
+				ks.AmountRequired = dt.AmountRequired
+				ks.AmountPaid = dt.AmountDeposited - dt.AmountRefunded
+				ks.AmountRefunded = dt.AmountRefunded
+			case dbutil.ObjectNotExistErr:
+			default:
+				return err
+			}
+
+			sort.Slice(ks.Deposits, func(i, j int) bool {
+				return ks.Deposits[i].Seq < ks.Deposits[j].Seq
+			})
+
+			for _, dv := range udvs {
+				if dv.Address != ks.DepositAddress {
+					continue
+				}
+
+				ks.AmountUnconfirmed += dv.Value
+				ks.Deposits = append(ks.Deposits, DepositStatus{
+					UpdatedAt: dv.SeenAt,
+					Status:    DepositStatusUnconfirmed,
+					CoinType:  dv.CoinType,
+					Amount:    dv.Value,
+				})
+			}
+
+			kss = append(kss, *ks)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(kss, func(i, j int) bool {
+		if kss[i].KittyID != kss[j].KittyID {
+			return kss[i].KittyID < kss[j].KittyID
+		}
+		return kss[i].DepositAddress < kss[j].DepositAddress
+	})
+
+	return kss, nil
+}
+
 // UpdateDepositInfo updates deposit info. The update func takes a DepositInfo
 // and returns a modified copy of it.
 func (s *Store) UpdateDepositInfo(Tx string, update func(DepositInfo) DepositInfo) (DepositInfo, error) {
@@ -557,7 +1043,8 @@ func (s *Store) UpdateDepositInfo(Tx string, update func(DepositInfo) DepositInf
 // UpdateDepositInfoCallback updates deposit info. The update func takes a DepositInfo
 // and returns a modified copy of it.  After updating the DepositInfo, it calls callback,
 // inside of the transaction.  If the callback returns an error, the DepositInfo update
-// is rolled back.
+// is rolled back. If the status changed, the event of the final status is emitted,
+// including any change made by the callback.
 func (s *Store) UpdateDepositInfoCallback(Txid string, update func(DepositInfo) DepositInfo, callback func(DepositInfo, *bolt.Tx) error) (DepositInfo, error) {
 	log := s.log.WithField("Txid:", Txid)
 
@@ -575,15 +1062,26 @@ func (s *Store) UpdateDepositInfoCallback(Txid string, update func(DepositInfo)
 			return err
 		}
 
+		prevStatus := dpi.Status
 		dpi = update(dpi)
 
 		dpi.UpdatedAt = time.Now().UTC().Unix()
 
-		if err := dbutil.PutBucketValue(tx, DepositInfoBkt, Txid, dpi); err != nil {
+		if err := s.putDepositInfoTx(tx, dpi); err != nil {
 			return err
 		}
 
-		return callback(dpi, tx)
+		if err := callback(dpi, tx); err != nil {
+			return err
+		}
+
+		// the callback may have saved the DepositInfo again
+		final, err := s.getDepositInfoTx(tx, Txid)
+		if err != nil {
+			return err
+		}
+
+		return s.emitStatusEventTx(tx, prevStatus, final)
 
 	}); err != nil {
 		return DepositInfo{}, err
@@ -592,6 +1090,33 @@ func (s *Store) UpdateDepositInfoCallback(Txid string, update func(DepositInfo)
 	return dpi, nil
 }
 
+// emitStatusEventTx emits the event of a DepositInfo's status, if it changed from prevStatus
+func (s *Store) emitStatusEventTx(tx *bolt.Tx, prevStatus Status, di DepositInfo) error {
+	if di.Status == prevStatus {
+		return nil
+	}
+
+	var eventType webhook.EventType
+	switch di.Status {
+	case StatusWaitPartial:
+		eventType = webhook.EventDepositPartial
+	case StatusWaitSend:
+		eventType = webhook.EventDepositPaid
+	case StatusWaitConfirm:
+		eventType = webhook.EventKittySent
+	case StatusDone:
+		eventType = webhook.EventKittyConfirmed
+	case StatusWaitRefund:
+		eventType = webhook.EventDepositRefund
+	case StatusOrphaned:
+		eventType = webhook.EventDepositOrphaned
+	default:
+		return nil
+	}
+
+	return s.events.EmitTx(tx, eventType, di)
+}
+
 // GetKittyBindAddress returns the current bound address for a given kitty ID
 func (s *Store) GetKittyBindAddress(kittyID string) (*BoundAddress, error) {
 	// @TODO: improve this
@@ -613,46 +1138,436 @@ func (s *Store) getKittyPriceTx(tx *bolt.Tx, kittyID string, coinType string) (i
 		return 0, err
 	}
 
-	if coinType == "SKY" {
+	switch coinType {
+	case scanner.CoinTypeSKY:
 		return r.PriceSKY, nil
-	} else if coinType == "BTC" {
+	case scanner.CoinTypeBTC:
 		return r.PriceBTC, nil
+	case scanner.CoinTypeETH:
+		return r.PriceETH, nil
 	}
 
 	return 0, agent.ErrInvalidCoinType
 }
 
-// GetDepositStats returns BTC and SKY received and boxes sent
-func (s *Store) GetDepositStats() (int64, int64, int64, error) {
-	var totalBTCReceived int64
-	var totalSKYReceived int64
-	var totalBoxesSent int64
+// getKittyOwnerTx returns the address of the user who reserved the kitty
+func (s *Store) getKittyOwnerTx(tx *bolt.Tx, kittyID string) (string, error) {
+	var r agent.Reservation
+	if err := dbutil.GetBucketObject(tx, agent.ReservationsKittyBkt, kittyID, &r); err != nil {
+		return "", err
+	}
 
-	if err := s.db.View(func(tx *bolt.Tx) error {
-		return dbutil.ForEach(tx, DepositInfoBkt, func(k, v []byte) error {
-			var dpi DepositInfo
-			if err := json.Unmarshal(v, &dpi); err != nil {
+	return r.OwnerAddress, nil
+}
+
+// isKittyReservedToTx returns true if the kitty's reservation is still paid at the deposit address.
+// It is false once the reservation has expired, even if the kitty has been reserved again.
+func (s *Store) isKittyReservedToTx(tx *bolt.Tx, kittyID, depositAddr string) (bool, error) {
+	var r agent.Reservation
+	if err := dbutil.GetBucketObject(tx, agent.ReservationsKittyBkt, kittyID, &r); err != nil {
+		return false, err
+	}
+
+	return r.DepositAddress == depositAddr, nil
+}
+
+// getReservationTx returns the reservation of a kitty
+func (s *Store) getReservationTx(tx *bolt.Tx, kittyID string) (agent.Reservation, error) {
+	var r agent.Reservation
+	if err := dbutil.GetBucketObject(tx, agent.ReservationsKittyBkt, kittyID, &r); err != nil {
+		return agent.Reservation{}, err
+	}
+
+	return r, nil
+}
+
+// deliverReservationTx marks the reservation of a kitty paid at depositAddr as delivered,
+// so that it does not expire
+func (s *Store) deliverReservationTx(tx *bolt.Tx, kittyID, depositAddr string) error {
+	return agent.DeliverReservationTx(tx, kittyID, depositAddr)
+}
+
+// DecideDeposit records an operator's decision on a deposit waiting for a decision.
+// A rejected deposit is refunded entirely. An approved or reassigned deposit stays in
+// StatusWaitDecide, to be processed again without being held.
+// Returns dbutil.ObjectNotExistErr if the deposit does not exist.
+func (s *Store) DecideDeposit(depositID string, d DepositDecision) (DepositInfo, error) {
+	var di DepositInfo
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		di, err = s.getDepositInfoTx(tx, depositID)
+		if err != nil {
+			return err
+		}
+
+		if !di.AwaitingDecision() {
+			return ErrDepositNotHeld
+		}
+
+		prevStatus := di.Status
+
+		switch d.Decision {
+		case DecisionApprove:
+			reserved, err := s.isKittyReservedToTx(tx, di.KittyID, di.DepositAddress)
+			if err != nil {
 				return err
 			}
 
-			if dpi.CoinType == scanner.CoinTypeBTC {
-				totalBTCReceived += dpi.DepositValue
+			if !reserved {
+				return ErrKittyNotReserved
 			}
 
-			if dpi.CoinType == scanner.CoinTypeSKY {
-				totalSKYReceived += dpi.DepositValue
+		case DecisionReject:
+			if _, err := s.createRefundTx(tx, di, di.DepositValue, RefundReasonRejected); err != nil {
+				return err
+			}
+			di.Status = StatusWaitRefund
+
+		case DecisionReassign:
+			di, err = s.reassignDepositTx(tx, di, d.KittyID)
+			if err != nil {
+				return err
+			}
+
+		default:
+			return ErrInvalidDecision
+		}
+
+		now := time.Now().UTC().Unix()
+		di.Decision = d.Decision
+		di.DecidedBy = d.Operator
+		di.DecidedAt = now
+		di.UpdatedAt = now
+
+		if err := s.putDepositInfoTx(tx, di); err != nil {
+			return err
+		}
+
+		return s.emitStatusEventTx(tx, prevStatus, di)
+	}); err != nil {
+		return DepositInfo{}, err
+	}
+
+	return di, nil
+}
+
+// reassignDepositTx moves a deposit to the deposit address of another reserved kitty.
+// The original address stays recorded in DepositInfo.Deposit.
+func (s *Store) reassignDepositTx(tx *bolt.Tx, di DepositInfo, kittyID string) (DepositInfo, error) {
+	r, err := s.getReservationTx(tx, kittyID)
+	if err != nil {
+		return di, err
+	}
+
+	if r.Status != agent.Reserved || r.DepositAddress == "" {
+		return di, ErrKittyNotReserved
+	}
+
+	if r.CoinType != di.CoinType {
+		return di, ErrReassignCoinType
+	}
+
+	boundAddr, err := s.getBindAddressTx(tx, r.DepositAddress, di.CoinType)
+	if err != nil {
+		return di, err
+	}
+
+	if boundAddr == nil {
+		return di, ErrNoBoundAddress
+	}
+
+	if err := s.createDepositTrackTx(tx, boundAddr); err != nil {
+		return di, err
+	}
+
+	// move the deposit to the txs of the new deposit address
+	var txs []string
+	if err := dbutil.GetBucketObject(tx, TxsBkt, di.DepositAddress, &txs); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+		default:
+			return di, err
+		}
+	}
+
+	var kept []string
+	for _, id := range txs {
+		if id != di.DepositID {
+			kept = append(kept, id)
+		}
+	}
+
+	if err := dbutil.PutBucketValue(tx, TxsBkt, di.DepositAddress, kept); err != nil {
+		return di, err
+	}
+
+	txs = nil
+	if err := dbutil.GetBucketObject(tx, TxsBkt, r.DepositAddress, &txs); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+		default:
+			return di, err
+		}
+	}
+
+	txs = append(txs, di.DepositID)
+	if err := dbutil.PutBucketValue(tx, TxsBkt, r.DepositAddress, txs); err != nil {
+		return di, err
+	}
+
+	di.KittyID = kittyID
+	di.DepositAddress = r.DepositAddress
+	di.OwnerAddress = r.OwnerAddress
+
+	return di, nil
+}
+
+// createRefundTx records a refund of amount for a deposit. The refund is sent to
+// the refund address of the deposit address, if the buyer gave one.
+func (s *Store) createRefundTx(tx *bolt.Tx, di DepositInfo, amount int64, reason string) (Refund, error) {
+	if hasKey, err := dbutil.BucketHasKey(tx, RefundBkt, di.DepositID); err != nil {
+		return Refund{}, err
+	} else if hasKey {
+		return Refund{}, ErrRefundExists
+	}
+
+	boundAddr, err := s.getBindAddressTx(tx, di.DepositAddress, di.CoinType)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	now := time.Now().UTC().Unix()
+	r := Refund{
+		DepositID:      di.DepositID,
+		DepositAddress: di.DepositAddress,
+		KittyID:        di.KittyID,
+		CoinType:       di.CoinType,
+		Amount:         amount,
+		Reason:         reason,
+		Status:         RefundStatusWaitAddress,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	if boundAddr != nil && boundAddr.RefundAddress != "" {
+		r.RefundAddress = boundAddr.RefundAddress
+		r.Status = RefundStatusWaitSend
+	}
+
+	if err := dbutil.PutBucketValue(tx, RefundBkt, r.DepositID, r); err != nil {
+		return Refund{}, err
+	}
+
+	s.log.WithField("refund", r).Info("Created refund")
+
+	return r, nil
+}
+
+// GetRefunds returns the refunds that match the filter
+func (s *Store) GetRefunds(flt RefundFilter) ([]Refund, error) {
+	var refunds []Refund
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEach(tx, RefundBkt, func(k, v []byte) error {
+			var r Refund
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
 			}
 
-			// TotalBoxesSent = no. of deposits with status == done
-			if dpi.Status == StatusDone {
-				totalBoxesSent++
+			if flt(r) {
+				refunds = append(refunds, r)
 			}
 
 			return nil
 		})
 	}); err != nil {
-		return -1, -1, -1, err
+		return nil, err
+	}
+
+	return refunds, nil
+}
+
+// UpdateRefund updates the refund of a deposit. The update func takes a Refund
+// and returns a modified copy of it. If it returns an error, nothing is updated.
+func (s *Store) UpdateRefund(depositID string, update func(Refund) (Refund, error)) (Refund, error) {
+	var r Refund
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := dbutil.GetBucketObject(tx, RefundBkt, depositID, &r); err != nil {
+			return err
+		}
+
+		var err error
+		r, err = update(r)
+		if err != nil {
+			return err
+		}
+
+		r.UpdatedAt = time.Now().UTC().Unix()
+
+		return dbutil.PutBucketValue(tx, RefundBkt, depositID, r)
+	}); err != nil {
+		return Refund{}, err
+	}
+
+	return r, nil
+}
+
+// cancelRefundTx cancels the refund of an orphaned deposit, unless it has been sent already.
+// Returns the amount that is no longer owed.
+func (s *Store) cancelRefundTx(tx *bolt.Tx, depositID string) (int64, error) {
+	var r Refund
+	if err := dbutil.GetBucketObject(tx, RefundBkt, depositID, &r); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	switch r.Status {
+	case RefundStatusWaitAddress, RefundStatusWaitSend:
+	case RefundStatusCancelled:
+		return 0, nil
+	default:
+		s.log.WithField("refund", r).Error("Deposit was orphaned after it was refunded")
+		return 0, nil
+	}
+
+	r.Status = RefundStatusCancelled
+	r.Error = ErrDepositOrphaned.Error()
+	r.UpdatedAt = time.Now().UTC().Unix()
+
+	if err := dbutil.PutBucketValue(tx, RefundBkt, depositID, r); err != nil {
+		return 0, err
+	}
+
+	return r.Amount, nil
+}
+
+// GetRetries returns the retries and dead letters that match the filter
+func (s *Store) GetRetries(flt RetryFilter) ([]DepositRetry, error) {
+	var retries []DepositRetry
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		for _, bkt := range [][]byte{RetryBkt, DeadLetterBkt} {
+			if err := dbutil.ForEach(tx, bkt, func(k, v []byte) error {
+				var r DepositRetry
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+
+				if flt(r) {
+					retries = append(retries, r)
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return retries, nil
+}
+
+// getRetryTx returns the retry or dead letter of a deposit, or an empty DepositRetry if it has none
+func (s *Store) getRetryTx(tx *bolt.Tx, depositID string) (DepositRetry, error) {
+	var r DepositRetry
+	for _, bkt := range [][]byte{RetryBkt, DeadLetterBkt} {
+		err := dbutil.GetBucketObject(tx, bkt, depositID, &r)
+		switch err.(type) {
+		case nil:
+			return r, nil
+		case dbutil.ObjectNotExistErr:
+		default:
+			return DepositRetry{}, err
+		}
+	}
+
+	return DepositRetry{}, nil
+}
+
+// putRetryTx saves a retry in RetryBkt, or in DeadLetterBkt if it is dead
+func (s *Store) putRetryTx(tx *bolt.Tx, r DepositRetry) error {
+	bkt, other := RetryBkt, DeadLetterBkt
+	if r.Dead {
+		bkt, other = DeadLetterBkt, RetryBkt
+	}
+
+	if err := tx.Bucket(other).Delete([]byte(r.DepositID)); err != nil {
+		return err
+	}
+
+	return dbutil.PutBucketValue(tx, bkt, r.DepositID, r)
+}
+
+// UpdateRetry updates the retry of a deposit. The update func takes the DepositRetry, which is empty
+// if the deposit has none, and returns a modified copy of it. Dead retries are saved as dead letters.
+// If update returns an error, nothing is updated.
+func (s *Store) UpdateRetry(depositID string, update func(DepositRetry) (DepositRetry, error)) (DepositRetry, error) {
+	var r DepositRetry
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		r, err = s.getRetryTx(tx, depositID)
+		if err != nil {
+			return err
+		}
+
+		r, err = update(r)
+		if err != nil {
+			return err
+		}
+
+		if r.DepositID != depositID {
+			return fmt.Errorf("DepositRetry %+v saved under different key %s", r, depositID)
+		}
+
+		return s.putRetryTx(tx, r)
+	}); err != nil {
+		return DepositRetry{}, err
+	}
+
+	return r, nil
+}
+
+// DeleteRetry removes the retry or dead letter of a deposit
+func (s *Store) DeleteRetry(depositID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, bkt := range [][]byte{RetryBkt, DeadLetterBkt} {
+			if err := tx.Bucket(bkt).Delete([]byte(depositID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RequeueDeadLetter moves the dead letter of a deposit back to the retries, with its attempts reset.
+// Returns dbutil.ObjectNotExistErr if the deposit has no dead letter.
+func (s *Store) RequeueDeadLetter(depositID string, nextAttempt int64) (DepositRetry, error) {
+	var r DepositRetry
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := dbutil.GetBucketObject(tx, DeadLetterBkt, depositID, &r); err != nil {
+			return err
+		}
+
+		r.Dead = false
+		r.Attempts = 0
+		r.NextAttempt = nextAttempt
+		r.UpdatedAt = time.Now().UTC().Unix()
+
+		return s.putRetryTx(tx, r)
+	}); err != nil {
+		return DepositRetry{}, err
 	}
 
-	return totalBTCReceived, totalSKYReceived, totalBoxesSent, nil
+	return r, nil
 }
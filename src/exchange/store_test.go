@@ -1,14 +1,18 @@
 package exchange
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/kittycash/teller/src/agent"
 	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/dbutil"
 	"github.com/kittycash/teller/src/util/testutil"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 type MockStore struct {
@@ -37,8 +41,8 @@ func (m *MockStore) BindAddress(kittyID, depositAddr, coinType string) (*BoundAd
 	return ba.(*BoundAddress), args.Error(1)
 }
 
-func (m *MockStore) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*BoundAddress, error) {
-	args := m.Called(tx, kittyID, depositAddr, coinType)
+func (m *MockStore) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*BoundAddress, error) {
+	args := m.Called(tx, kittyID, depositAddr, coinType, refundAddr)
 
 	ba := args.Get(0)
 	if ba == nil {
@@ -53,6 +57,11 @@ func (m *MockStore) GetOrCreateDepositInfo(dv scanner.Deposit) (DepositInfo, err
 	return args.Get(0).(DepositInfo), args.Error(1)
 }
 
+func (m *MockStore) OrphanDepositInfo(dv scanner.Deposit) (DepositInfo, error) {
+	args := m.Called(dv)
+	return args.Get(0).(DepositInfo), args.Error(1)
+}
+
 func (m *MockStore) GetDepositInfoArray(filt DepositFilter) ([]DepositInfo, error) {
 	args := m.Called(filt)
 
@@ -64,6 +73,50 @@ func (m *MockStore) GetDepositInfoArray(filt DepositFilter) ([]DepositInfo, erro
 	return dis.([]DepositInfo), args.Error(1)
 }
 
+func (m *MockStore) GetDepositInfoByStatus(status Status, flt DepositFilter) ([]DepositInfo, error) {
+	args := m.Called(status, flt)
+
+	dis := args.Get(0)
+	if dis == nil {
+		return nil, args.Error(1)
+	}
+
+	return dis.([]DepositInfo), args.Error(1)
+}
+
+func (m *MockStore) GetDepositInfoByCoinType(coinType string, flt DepositFilter) ([]DepositInfo, error) {
+	args := m.Called(coinType, flt)
+
+	dis := args.Get(0)
+	if dis == nil {
+		return nil, args.Error(1)
+	}
+
+	return dis.([]DepositInfo), args.Error(1)
+}
+
+func (m *MockStore) GetDepositInfoByOwner(ownerAddr string, flt DepositFilter) ([]DepositInfo, error) {
+	args := m.Called(ownerAddr, flt)
+
+	dis := args.Get(0)
+	if dis == nil {
+		return nil, args.Error(1)
+	}
+
+	return dis.([]DepositInfo), args.Error(1)
+}
+
+func (m *MockStore) GetKittyStatusesOfOwner(ownerAddr string) ([]KittyStatus, error) {
+	args := m.Called(ownerAddr)
+
+	kss := args.Get(0)
+	if kss == nil {
+		return nil, args.Error(1)
+	}
+
+	return kss.([]KittyStatus), args.Error(1)
+}
+
 func (m *MockStore) GetDepositInfoOfKittyID(kittyID string) ([]DepositInfo, error) {
 	args := m.Called(kittyID)
 
@@ -96,9 +149,65 @@ func (m *MockStore) GetKittyBindAddress(kittyID string) (*BoundAddress, error) {
 	return bAddrs.(*BoundAddress), args.Error(1)
 }
 
-func (m *MockStore) GetDepositStats() (int64, int64, int64, error) {
+func (m *MockStore) GetDepositStats() (int64, int64, int64, int64, error) {
 	args := m.Called()
-	return args.Get(0).(int64), args.Get(1).(int64), args.Get(2).(int64), args.Error(2)
+	return args.Get(0).(int64), args.Get(1).(int64), args.Get(2).(int64), args.Get(3).(int64), args.Error(4)
+}
+
+func (m *MockStore) GetRefunds(flt RefundFilter) ([]Refund, error) {
+	args := m.Called(flt)
+
+	rs := args.Get(0)
+	if rs == nil {
+		return nil, args.Error(1)
+	}
+
+	return rs.([]Refund), args.Error(1)
+}
+
+func (m *MockStore) UpdateRefund(depositID string, update func(Refund) (Refund, error)) (Refund, error) {
+	args := m.Called(depositID, update)
+	return args.Get(0).(Refund), args.Error(1)
+}
+
+func (m *MockStore) GetRetries(flt RetryFilter) ([]DepositRetry, error) {
+	args := m.Called(flt)
+
+	rs := args.Get(0)
+	if rs == nil {
+		return nil, args.Error(1)
+	}
+
+	return rs.([]DepositRetry), args.Error(1)
+}
+
+func (m *MockStore) UpdateRetry(depositID string, update func(DepositRetry) (DepositRetry, error)) (DepositRetry, error) {
+	args := m.Called(depositID, update)
+	return args.Get(0).(DepositRetry), args.Error(1)
+}
+
+func (m *MockStore) DeleteRetry(depositID string) error {
+	args := m.Called(depositID)
+	return args.Error(0)
+}
+
+func (m *MockStore) RequeueDeadLetter(depositID string, nextAttempt int64) (DepositRetry, error) {
+	args := m.Called(depositID, nextAttempt)
+	return args.Get(0).(DepositRetry), args.Error(1)
+}
+
+func (m *MockStore) DecideDeposit(depositID string, d DepositDecision) (DepositInfo, error) {
+	args := m.Called(depositID, d)
+	return args.Get(0).(DepositInfo), args.Error(1)
+}
+
+func (m *MockStore) getDepositInfo(depositID string) (DepositInfo, error) {
+	args := m.Called(depositID)
+	return args.Get(0).(DepositInfo), args.Error(1)
+}
+
+func (m *MockStore) putDepositInfoTx(tx *bolt.Tx, di DepositInfo) error {
+	return nil
 }
 
 func (m *MockStore) getDepositTrack(depositAddr string) (DepositTrack, error) {
@@ -117,11 +226,30 @@ func (m *MockStore) updateDepositTrackTx(tx *bolt.Tx, depositAddr string, dt Dep
 	return nil
 }
 
+func (m *MockStore) isKittyReservedToTx(tx *bolt.Tx, kittyID, depositAddr string) (bool, error) {
+	return true, nil
+}
+
+func (m *MockStore) getReservationTx(tx *bolt.Tx, kittyID string) (agent.Reservation, error) {
+	return agent.Reservation{}, nil
+}
+
+func (m *MockStore) deliverReservationTx(tx *bolt.Tx, kittyID, depositAddr string) error {
+	return nil
+}
+
+func (m *MockStore) createRefundTx(tx *bolt.Tx, di DepositInfo, amount int64, reason string) (Refund, error) {
+	return Refund{}, nil
+}
+
 func newTestStore(t *testing.T) (*Store, func()) {
 	db, shutdown := testutil.PrepareDB(t)
 
 	log, _ := testutil.NewLogger(t)
-	s, err := NewStore(log, db)
+	events, err := webhook.NewStore(log, db)
+	require.NoError(t, err)
+
+	s, err := NewStore(log, db, events)
 	require.NoError(t, err)
 
 	return s, shutdown
@@ -175,3 +303,654 @@ func TestStoreBindAddressTwiceFails(t *testing.T) {
 }
 
 //@TODO (therealssj): Add tests
+
+func TestStoreUnbindKitty(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	scanStore, err := scanner.NewStore(log, s.db)
+	require.NoError(t, err)
+	err = scanStore.AddSupportedCoin(scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	mustBindAddress(t, s, "1", "b")
+	err = scanStore.AddScanAddress("b", scanner.CoinTypeBTC, "1")
+	require.NoError(t, err)
+
+	boundAddr, err := s.GetKittyBindAddress("1")
+	require.NoError(t, err)
+	require.Equal(t, "b", boundAddr.Address)
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return s.UnbindKittyTx(tx, "1")
+	})
+	require.NoError(t, err)
+
+	_, err = s.GetKittyBindAddress("1")
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+
+	// The deposit address stays bound, so that late deposits are recorded
+	boundAddr, err = s.GetBindAddress("b", scanner.CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, "1", boundAddr.KittyID)
+
+	// The scanner watches the address until the grace period is over
+	scanAddr, err := scanStore.GetScanAddress("b", scanner.CoinTypeBTC)
+	require.NoError(t, err)
+	require.False(t, scanAddr.Active)
+	require.NotZero(t, scanAddr.DeactivatedAt)
+
+	addrs, err := scanStore.GetScanAddresses(scanner.CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, addrs)
+
+	// Unbinding again is a no-op
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return s.UnbindKittyTx(tx, "1")
+	})
+	require.NoError(t, err)
+}
+
+func TestStoreIsPaid(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	isPaid := func() bool {
+		var paid bool
+		err := s.db.View(func(tx *bolt.Tx) error {
+			var err error
+			paid, err = s.IsPaidTx(tx, "b")
+			return err
+		})
+		require.NoError(t, err)
+		return paid
+	}
+
+	// No deposit received yet
+	require.False(t, isPaid())
+
+	err := s.updateDepositTrack("b", DepositTrack{
+		KittyID:         "1",
+		AmountDeposited: 100,
+		AmountRequired:  200,
+	})
+	require.NoError(t, err)
+	require.False(t, isPaid())
+
+	err = s.updateDepositTrack("b", DepositTrack{
+		KittyID:         "1",
+		AmountDeposited: 200,
+		AmountRequired:  200,
+	})
+	require.NoError(t, err)
+	require.True(t, isPaid())
+}
+
+func TestStoreRefunds(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, s.db)
+	require.NoError(t, err)
+
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        "1",
+		DepositAddress: "b",
+		OwnerAddress:   "a",
+		Status:         agent.Reserved,
+		PriceBTC:       100,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	mustBindAddress(t, s, "1", "b")
+
+	// A partial payment
+	di, err := s.GetOrCreateDepositInfo(scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  "b",
+		Value:    40,
+		Tx:       "t1",
+		N:        0,
+	})
+	require.NoError(t, err)
+	_, err = s.UpdateDepositInfo(di.DepositID, func(di DepositInfo) DepositInfo {
+		di.Status = StatusWaitPartial
+		return di
+	})
+	require.NoError(t, err)
+	err = s.updateDepositTrack("b", DepositTrack{
+		AmountDeposited: 40,
+		AmountRequired:  100,
+		KittyID:         "1",
+	})
+	require.NoError(t, err)
+
+	// The reservation is released, so the partial payment is refunded
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return s.UnbindKittyTx(tx, "1")
+	})
+	require.NoError(t, err)
+
+	dis, err := s.GetDepositInfoArray(func(d DepositInfo) bool {
+		return d.DepositID == di.DepositID
+	})
+	require.NoError(t, err)
+	require.Len(t, dis, 1)
+	require.Equal(t, StatusWaitRefund, dis[0].Status)
+
+	dt, err := s.getDepositTrack("b")
+	require.NoError(t, err)
+	require.Equal(t, int64(40), dt.AmountRefunded)
+	require.Equal(t, int64(0), dt.Refundable(false))
+
+	refunds, err := s.GetRefunds(func(r Refund) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, Refund{
+		DepositID:      di.DepositID,
+		DepositAddress: "b",
+		KittyID:        "1",
+		CoinType:       scanner.CoinTypeBTC,
+		Amount:         40,
+		Reason:         RefundReasonExpired,
+		Status:         RefundStatusWaitAddress,
+		CreatedAt:      refunds[0].CreatedAt,
+		UpdatedAt:      refunds[0].UpdatedAt,
+	}, refunds[0])
+
+	// A deposit can only have one refund
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.createRefundTx(tx, di, 40, RefundReasonExpired)
+		return err
+	})
+	require.Equal(t, ErrRefundExists, err)
+
+	// A failed update changes nothing
+	_, err = s.UpdateRefund(di.DepositID, func(r Refund) (Refund, error) {
+		r.Status = RefundStatusSent
+		return r, ErrRefundStatusInvalid
+	})
+	require.Equal(t, ErrRefundStatusInvalid, err)
+
+	r, err := s.UpdateRefund(di.DepositID, func(r Refund) (Refund, error) {
+		r.RefundAddress = "c"
+		r.Status = RefundStatusWaitSend
+		return r, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, RefundStatusWaitSend, r.Status)
+
+	refunds, err = s.GetRefunds(func(r Refund) bool { return r.Status == RefundStatusWaitSend })
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, "c", refunds[0].RefundAddress)
+
+	_, err = s.UpdateRefund("unknown", func(r Refund) (Refund, error) {
+		return r, nil
+	})
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+}
+
+func TestStoreRestoreOrphanedDepositInfo(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, s.db)
+	require.NoError(t, err)
+
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        "1",
+		DepositAddress: "b",
+		OwnerAddress:   "a",
+		Status:         agent.Reserved,
+		PriceBTC:       100,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	mustBindAddress(t, s, "1", "b")
+
+	// An overpayment, the kitty was sent and the excess is owed back
+	dv := scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  "b",
+		Value:    150,
+		Height:   10,
+		Tx:       "t1",
+		N:        0,
+	}
+	di, err := s.GetOrCreateDepositInfo(dv)
+	require.NoError(t, err)
+	_, err = s.UpdateDepositInfoCallback(di.DepositID, func(di DepositInfo) DepositInfo {
+		di.Status = StatusWaitConfirm
+		di.Txid = "k1"
+		return di
+	}, func(di DepositInfo, tx *bolt.Tx) error {
+		if _, err := s.createRefundTx(tx, di, 50, RefundReasonOverpaid); err != nil {
+			return err
+		}
+		return s.updateDepositTrackTx(tx, "b", DepositTrack{
+			AmountDeposited: 150,
+			AmountRequired:  100,
+			AmountRefunded:  50,
+			KittyID:         "1",
+		})
+	})
+	require.NoError(t, err)
+
+	_, err = s.OrphanDepositInfo(dv)
+	require.NoError(t, err)
+
+	dt, err := s.getDepositTrack("b")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), dt.AmountDeposited)
+	require.Equal(t, int64(0), dt.AmountRefunded)
+
+	// The deposit is included in the chain again, it is counted again without sending the kitty twice
+	dv.Height = 11
+	di, err = s.GetOrCreateDepositInfo(dv)
+	require.NoError(t, err)
+	require.Equal(t, StatusWaitConfirm, di.Status)
+	require.Equal(t, "k1", di.Txid)
+	require.Empty(t, di.Error)
+	require.Equal(t, dv, di.Deposit)
+
+	dt, err = s.getDepositTrack("b")
+	require.NoError(t, err)
+	require.Equal(t, int64(150), dt.AmountDeposited)
+	require.Equal(t, int64(50), dt.AmountRefunded)
+
+	refunds, err := s.GetRefunds(func(r Refund) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.Equal(t, RefundStatusWaitAddress, refunds[0].Status)
+	require.Empty(t, refunds[0].Error)
+
+	// A deposit that was not sent yet is set back to StatusWaitDecide, to be counted again.
+	// Its cancelled refund is removed, it is recorded again when the deposit is counted.
+	_, err = s.OrphanDepositInfo(dv)
+	require.NoError(t, err)
+	_, err = s.UpdateDepositInfo(di.DepositID, func(di DepositInfo) DepositInfo {
+		di.Txid = ""
+		return di
+	})
+	require.NoError(t, err)
+
+	di, err = s.GetOrCreateDepositInfo(dv)
+	require.NoError(t, err)
+	require.Equal(t, StatusWaitDecide, di.Status)
+
+	refunds, err = s.GetRefunds(func(r Refund) bool { return true })
+	require.NoError(t, err)
+	require.Empty(t, refunds)
+
+	dt, err = s.getDepositTrack("b")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), dt.AmountDeposited)
+}
+
+func TestStoreDepositEvents(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, s.db)
+	require.NoError(t, err)
+
+	err = agentStore.UpdateReservation(&agent.Reservation{
+		KittyID:        "1",
+		DepositAddress: "b",
+		OwnerAddress:   "a",
+		Status:         agent.Reserved,
+		PriceBTC:       100,
+		CoinType:       scanner.CoinTypeBTC,
+	})
+	require.NoError(t, err)
+
+	mustBindAddress(t, s, "1", "b")
+
+	eventTypes := func() []webhook.EventType {
+		ds, err := s.events.(*webhook.Store).GetDeliveries(func(webhook.Delivery) bool { return true })
+		require.NoError(t, err)
+
+		var types []webhook.EventType
+		for _, d := range ds {
+			types = append(types, d.Event.Type)
+		}
+		return types
+	}
+
+	dv := scanner.Deposit{
+		CoinType: scanner.CoinTypeBTC,
+		Address:  "b",
+		Value:    100,
+		Tx:       "t1",
+		N:        0,
+	}
+	di, err := s.GetOrCreateDepositInfo(dv)
+	require.NoError(t, err)
+	require.Equal(t, []webhook.EventType{webhook.EventDepositSeen}, eventTypes())
+
+	// Getting the existing deposit emits nothing
+	_, err = s.GetOrCreateDepositInfo(dv)
+	require.NoError(t, err)
+	require.Len(t, eventTypes(), 1)
+
+	// Only the final status set by the callback is emitted
+	_, err = s.UpdateDepositInfoCallback(di.DepositID, func(di DepositInfo) DepositInfo {
+		di.Status = StatusWaitPartial
+		return di
+	}, func(di DepositInfo, tx *bolt.Tx) error {
+		di.Status = StatusWaitSend
+		return s.putDepositInfoTx(tx, di)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []webhook.EventType{
+		webhook.EventDepositSeen,
+		webhook.EventDepositPaid,
+	}, eventTypes())
+
+	// No event if the status does not change
+	_, err = s.UpdateDepositInfo(di.DepositID, func(di DepositInfo) DepositInfo {
+		di.Error = "x"
+		return di
+	})
+	require.NoError(t, err)
+	require.Len(t, eventTypes(), 2)
+
+	// No event if the update is rolled back
+	_, err = s.UpdateDepositInfoCallback(di.DepositID, func(di DepositInfo) DepositInfo {
+		di.Status = StatusWaitConfirm
+		di.Txid = "k1"
+		return di
+	}, func(DepositInfo, *bolt.Tx) error {
+		return errors.New("broadcast failed")
+	})
+	require.Error(t, err)
+	require.Len(t, eventTypes(), 2)
+
+	_, err = s.OrphanDepositInfo(dv)
+	require.NoError(t, err)
+	require.Equal(t, []webhook.EventType{
+		webhook.EventDepositSeen,
+		webhook.EventDepositPaid,
+		webhook.EventDepositOrphaned,
+	}, eventTypes())
+}
+
+func TestStoreDepositIndexes(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, s.db)
+	require.NoError(t, err)
+
+	for _, r := range []agent.Reservation{
+		{KittyID: "1", DepositAddress: "b", OwnerAddress: "a", PriceBTC: 100, CoinType: scanner.CoinTypeBTC},
+		{KittyID: "2", DepositAddress: "c", OwnerAddress: "a", PriceSKY: 100, CoinType: scanner.CoinTypeSKY},
+		{KittyID: "3", DepositAddress: "d", OwnerAddress: "e", PriceBTC: 100, CoinType: scanner.CoinTypeBTC},
+	} {
+		r.Status = agent.Reserved
+		err := agentStore.UpdateReservation(&r)
+		require.NoError(t, err)
+	}
+
+	mustBindAddress(t, s, "1", "b")
+	_, err = s.BindAddress("2", "c", scanner.CoinTypeSKY)
+	require.NoError(t, err)
+	mustBindAddress(t, s, "3", "d")
+
+	for _, dv := range []scanner.Deposit{
+		{CoinType: scanner.CoinTypeBTC, Address: "b", Value: 100, Tx: "t1", N: 0},
+		{CoinType: scanner.CoinTypeSKY, Address: "c", Value: 30, Tx: "t2", N: 0},
+		{CoinType: scanner.CoinTypeBTC, Address: "d", Value: 50, Tx: "t3", N: 1},
+	} {
+		_, err := s.GetOrCreateDepositInfo(dv)
+		require.NoError(t, err)
+	}
+
+	_, err = s.UpdateDepositInfo("t1:0", func(di DepositInfo) DepositInfo {
+		di.Status = StatusDone
+		di.Txid = "k1"
+		return di
+	})
+	require.NoError(t, err)
+
+	depositIDs := func(dis []DepositInfo, err error) []string {
+		require.NoError(t, err)
+		var ids []string
+		for _, di := range dis {
+			ids = append(ids, di.DepositID)
+		}
+		return ids
+	}
+
+	all := func(DepositInfo) bool { return true }
+
+	checkIndexes := func() {
+		require.Equal(t, []string{"t1:0"}, depositIDs(s.GetDepositInfoByStatus(StatusDone, all)))
+		require.Equal(t, []string{"t2:0", "t3:1"}, depositIDs(s.GetDepositInfoByStatus(StatusWaitDecide, all)))
+		require.Empty(t, depositIDs(s.GetDepositInfoByStatus(StatusWaitSend, all)))
+		require.Equal(t, []string{"t1:0", "t3:1"}, depositIDs(s.GetDepositInfoByCoinType(scanner.CoinTypeBTC, all)))
+		require.Equal(t, []string{"t2:0"}, depositIDs(s.GetDepositInfoByCoinType(scanner.CoinTypeSKY, all)))
+		require.Equal(t, []string{"t1:0", "t2:0"}, depositIDs(s.GetDepositInfoByOwner("a", all)))
+		require.Equal(t, []string{"t3:1"}, depositIDs(s.GetDepositInfoByOwner("e", all)))
+		require.Equal(t, []string{"t2:0"}, depositIDs(s.GetDepositInfoByOwner("a", func(di DepositInfo) bool {
+			return di.Status == StatusWaitDecide
+		})))
+
+		btc, sky, eth, sent, err := s.GetDepositStats()
+		require.NoError(t, err)
+		require.Equal(t, int64(150), btc)
+		require.Equal(t, int64(30), sky)
+		require.Equal(t, int64(0), eth)
+		require.Equal(t, int64(1), sent)
+	}
+
+	checkIndexes()
+
+	// A rolled back update leaves the indexes unchanged
+	_, err = s.UpdateDepositInfoCallback("t3:1", func(di DepositInfo) DepositInfo {
+		di.Status = StatusDone
+		return di
+	}, func(DepositInfo, *bolt.Tx) error {
+		return errors.New("rollback")
+	})
+	require.Error(t, err)
+
+	checkIndexes()
+
+	// The indexes are built when opening a db saved before they existed
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, bkt := range [][]byte{DepositStatusIndexBkt, DepositCoinTypeIndexBkt, DepositOwnerIndexBkt, DepositInfoMetaBkt} {
+			if err := tx.DeleteBucket(bkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	s, err = NewStore(log, s.db, s.events)
+	require.NoError(t, err)
+
+	checkIndexes()
+
+	// An orphaned deposit moves to the orphaned status
+	_, err = s.OrphanDepositInfo(scanner.Deposit{CoinType: scanner.CoinTypeBTC, Address: "d", Value: 50, Tx: "t3", N: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"t3:1"}, depositIDs(s.GetDepositInfoByStatus(StatusOrphaned, all)))
+	require.Equal(t, []string{"t2:0"}, depositIDs(s.GetDepositInfoByStatus(StatusWaitDecide, all)))
+}
+
+func TestStoreKittyStatusesOfOwner(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	agentStore, err := agent.NewStore(log, s.db)
+	require.NoError(t, err)
+
+	reservations := []agent.Reservation{
+		{KittyID: "1", DepositAddress: "b", OwnerAddress: "a", PriceBTC: 100, CoinType: scanner.CoinTypeBTC, Expire: 10},
+		{KittyID: "2", DepositAddress: "c", OwnerAddress: "a", PriceSKY: 200, CoinType: scanner.CoinTypeSKY, Expire: 20},
+		{KittyID: "3", DepositAddress: "d", OwnerAddress: "e", PriceBTC: 100, CoinType: scanner.CoinTypeBTC, Expire: 30},
+	}
+	for _, r := range reservations {
+		r.Status = agent.Reserved
+		err := agentStore.UpdateReservation(&r)
+		require.NoError(t, err)
+	}
+
+	err = agentStore.AddUser(&agent.User{
+		Address:      "a",
+		Reservations: reservations[:2],
+	})
+	require.NoError(t, err)
+	err = agentStore.AddUser(&agent.User{
+		Address:      "e",
+		Reservations: reservations[2:],
+	})
+	require.NoError(t, err)
+
+	mustBindAddress(t, s, "1", "b")
+	_, err = s.BindAddress("2", "c", scanner.CoinTypeSKY)
+	require.NoError(t, err)
+	mustBindAddress(t, s, "3", "d")
+
+	kss, err := s.GetKittyStatusesOfOwner("unknown")
+	require.NoError(t, err)
+	require.Empty(t, kss)
+
+	// Nothing is paid yet
+	kss, err = s.GetKittyStatusesOfOwner("a")
+	require.NoError(t, err)
+	require.Equal(t, []KittyStatus{
+		{
+			KittyID:        "1",
+			CoinType:       scanner.CoinTypeBTC,
+			DepositAddress: "b",
+			Reserved:       true,
+			Expire:         10,
+			AmountRequired: 100,
+			Deposits:       []DepositStatus{},
+		},
+		{
+			KittyID:        "2",
+			CoinType:       scanner.CoinTypeSKY,
+			DepositAddress: "c",
+			Reserved:       true,
+			Expire:         20,
+			AmountRequired: 200,
+			Deposits:       []DepositStatus{},
+		},
+	}, kss)
+
+	// Kitty 1 is paid in two deposits and sent
+	for _, dv := range []scanner.Deposit{
+		{CoinType: scanner.CoinTypeBTC, Address: "b", Value: 40, Tx: "t1", N: 0},
+		{CoinType: scanner.CoinTypeBTC, Address: "b", Value: 60, Tx: "t2", N: 0},
+		{CoinType: scanner.CoinTypeBTC, Address: "d", Value: 100, Tx: "t3", N: 0},
+	} {
+		_, err := s.GetOrCreateDepositInfo(dv)
+		require.NoError(t, err)
+	}
+
+	_, err = s.UpdateDepositInfo("t1:0", func(di DepositInfo) DepositInfo {
+		di.Status = StatusWaitPartial
+		return di
+	})
+	require.NoError(t, err)
+	_, err = s.UpdateDepositInfo("t2:0", func(di DepositInfo) DepositInfo {
+		di.Status = StatusDone
+		di.Txid = "k1"
+		return di
+	})
+	require.NoError(t, err)
+	err = s.updateDepositTrack("b", DepositTrack{
+		AmountDeposited: 100,
+		AmountRequired:  100,
+		KittyID:         "1",
+	})
+	require.NoError(t, err)
+
+	// Kitty 2's reservation expires before it is paid
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		r, err := agentStore.GetReservationWithTx(tx, "2")
+		if err != nil {
+			return err
+		}
+		r.MakeAvailable()
+		return agentStore.UpdateReservationWithTx(tx, r)
+	})
+	require.NoError(t, err)
+
+	kss, err = s.GetKittyStatusesOfOwner("a")
+	require.NoError(t, err)
+	require.Len(t, kss, 1)
+
+	for i := range kss[0].Deposits {
+		require.NotZero(t, kss[0].Deposits[i].UpdatedAt)
+		kss[0].Deposits[i].UpdatedAt = 0
+	}
+
+	require.Equal(t, KittyStatus{
+		KittyID:        "1",
+		CoinType:       scanner.CoinTypeBTC,
+		DepositAddress: "b",
+		Reserved:       true,
+		Expire:         10,
+		AmountRequired: 100,
+		AmountPaid:     100,
+		Txid:           "k1",
+		Deposits: []DepositStatus{
+			{
+				Seq:      1,
+				Status:   StatusWaitPartial.String(),
+				CoinType: scanner.CoinTypeBTC,
+				Amount:   40,
+			},
+			{
+				Seq:      2,
+				Status:   StatusDone.String(),
+				CoinType: scanner.CoinTypeBTC,
+				Amount:   60,
+				Txid:     "k1",
+			},
+		},
+	}, kss[0])
+
+	// A deposit seen in the mempool is shown, but not counted as paid
+	scanStore, err := scanner.NewStore(log, s.db)
+	require.NoError(t, err)
+	err = scanStore.SetUnconfirmedDeposits(scanner.CoinTypeBTC, []scanner.Deposit{
+		{CoinType: scanner.CoinTypeBTC, Address: "d", Value: 30, Tx: "t4", N: 0},
+	})
+	require.NoError(t, err)
+
+	kss, err = s.GetKittyStatusesOfOwner("e")
+	require.NoError(t, err)
+	require.Len(t, kss, 1)
+	require.Equal(t, "3", kss[0].KittyID)
+	require.Equal(t, int64(0), kss[0].AmountPaid)
+	require.Equal(t, int64(30), kss[0].AmountUnconfirmed)
+	require.Len(t, kss[0].Deposits, 2)
+	require.Equal(t, int64(100), kss[0].Deposits[0].Amount)
+	require.Equal(t, DepositStatus{
+		UpdatedAt: kss[0].Deposits[1].UpdatedAt,
+		Status:    DepositStatusUnconfirmed,
+		CoinType:  scanner.CoinTypeBTC,
+		Amount:    30,
+	}, kss[0].Deposits[1])
+	require.NotZero(t, kss[0].Deposits[1].UpdatedAt)
+
+	kss, err = s.GetKittyStatusesOfOwner("a")
+	require.NoError(t, err)
+	require.Len(t, kss, 1)
+	require.Equal(t, int64(0), kss[0].AmountUnconfirmed)
+}
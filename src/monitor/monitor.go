@@ -6,13 +6,19 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/kittycash/teller/src/agent"
 	"github.com/kittycash/teller/src/exchange"
+	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/dbutil"
 	"github.com/kittycash/teller/src/util/httputil"
 	"github.com/kittycash/teller/src/util/logger"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 const (
@@ -34,9 +40,57 @@ type AddrManager interface {
 // DepositStatusGetter  interface provides api to access exchange resource
 type DepositStatusGetter interface {
 	GetDepositStatusDetail(flt exchange.DepositFilter) ([]exchange.DepositStatusDetail, error)
+	GetDepositStatusDetailByStatus(status exchange.Status) ([]exchange.DepositStatusDetail, error)
 	GetDepositStats() (*exchange.DepositStats, error)
 }
 
+// RefundManager interface provides apis to review and resolve refunds
+type RefundManager interface {
+	GetRefunds(flt exchange.RefundFilter) ([]exchange.Refund, error)
+	SetRefundAddress(depositID, addr string) (exchange.Refund, error)
+	CompleteRefund(depositID, txid string) (exchange.Refund, error)
+	CancelRefund(depositID string) (exchange.Refund, error)
+}
+
+// RetryManager interface provides apis to review failed deposits and requeue dead letters
+type RetryManager interface {
+	GetRetries(flt exchange.RetryFilter) ([]exchange.DepositRetry, error)
+	RequeueDeadLetter(depositID string) (exchange.DepositRetry, error)
+}
+
+// DepositDecider interface provides apis to decide on the suspicious deposits held for an operator
+type DepositDecider interface {
+	GetDepositsAwaitingDecision() ([]exchange.DepositInfo, error)
+	DecideDeposit(depositID string, d exchange.DepositDecision) (exchange.DepositInfo, error)
+}
+
+// CatalogueStatusGetter interface provides api to access the status of the kitty catalogue sync
+type CatalogueStatusGetter interface {
+	CatalogueStatus() agent.CatalogueStatus
+}
+
+// WebhookManager interface provides apis to review and replay webhook deliveries
+type WebhookManager interface {
+	GetDeliveries(flt webhook.DeliveryFilter) ([]webhook.Delivery, error)
+	Replay(id string) (webhook.Delivery, error)
+}
+
+// RejectedDepositGetter interface provides api to access the deposits rejected by the exchange
+type RejectedDepositGetter interface {
+	GetRejectedDeposits() ([]scanner.Deposit, error)
+}
+
+// ScannerManager interface provides apis to review and control the coin scanners at runtime
+type ScannerManager interface {
+	Health() []scanner.ScannerHealth
+	RegisterScanner(coinType string) error
+	PauseScanner(coinType string) error
+	ResumeScanner(coinType string) error
+	RemoveScanner(coinType string) error
+	StartRescan(req scanner.RescanRequest) (scanner.RescanProgress, error)
+	GetRescans() []scanner.RescanProgress
+}
+
 // ScanAddressGetter get scanning address interface
 type ScanAddressGetter interface {
 	GetScanAddresses() ([]string, error)
@@ -54,21 +108,35 @@ type Monitor struct {
 	SkyAddrManager AddrManager
 	DepositStatusGetter
 	ScanAddressGetter
+	RefundManager
+	RetryManager
+	DepositDecider
+	CatalogueStatusGetter
+	WebhookManager
+	ScannerManager
+	RejectedDepositGetter
 	cfg  Config
 	ln   *http.Server
 	quit chan struct{}
 }
 
 // New creates monitor service
-func New(log logrus.FieldLogger, cfg Config, addrManager, skyAddrManager AddrManager, dpstget DepositStatusGetter, sag ScanAddressGetter) *Monitor {
+func New(log logrus.FieldLogger, cfg Config, addrManager, skyAddrManager AddrManager, dpstget DepositStatusGetter, sag ScanAddressGetter, refunds RefundManager, retries RetryManager, decider DepositDecider, catalogue CatalogueStatusGetter, webhooks WebhookManager, scanners ScannerManager, rejected RejectedDepositGetter) *Monitor {
 	return &Monitor{
-		log:                 log.WithField("prefix", "teller.monitor"),
-		cfg:                 cfg,
-		AddrManager:         addrManager,
-		SkyAddrManager:      skyAddrManager,
-		DepositStatusGetter: dpstget,
-		ScanAddressGetter:   sag,
-		quit:                make(chan struct{}),
+		log:                   log.WithField("prefix", "teller.monitor"),
+		cfg:                   cfg,
+		AddrManager:           addrManager,
+		SkyAddrManager:        skyAddrManager,
+		DepositStatusGetter:   dpstget,
+		ScanAddressGetter:     sag,
+		RefundManager:         refunds,
+		RetryManager:          retries,
+		DepositDecider:        decider,
+		CatalogueStatusGetter: catalogue,
+		WebhookManager:        webhooks,
+		ScannerManager:        scanners,
+		RejectedDepositGetter: rejected,
+		quit:                  make(chan struct{}),
 	}
 }
 
@@ -105,6 +173,33 @@ func (m *Monitor) setupMux() *http.ServeMux {
 	mux.Handle("/api/address", httputil.LogHandler(m.log, m.addressHandler()))
 	mux.Handle("/api/deposit_status", httputil.LogHandler(m.log, m.depositStatus()))
 	mux.Handle("/api/stats", httputil.LogHandler(m.log, m.statsHandler()))
+	mux.Handle("/api/catalogue", httputil.LogHandler(m.log, m.catalogueHandler()))
+	mux.Handle("/api/refunds", httputil.LogHandler(m.log, m.refundsHandler()))
+	mux.Handle("/api/refunds/address", httputil.LogHandler(m.log, m.updateRefundHandler(func(r *http.Request) (exchange.Refund, error) {
+		return m.SetRefundAddress(r.FormValue("deposit_id"), r.FormValue("address"))
+	})))
+	mux.Handle("/api/refunds/complete", httputil.LogHandler(m.log, m.updateRefundHandler(func(r *http.Request) (exchange.Refund, error) {
+		return m.CompleteRefund(r.FormValue("deposit_id"), r.FormValue("txid"))
+	})))
+	mux.Handle("/api/refunds/cancel", httputil.LogHandler(m.log, m.updateRefundHandler(func(r *http.Request) (exchange.Refund, error) {
+		return m.CancelRefund(r.FormValue("deposit_id"))
+	})))
+	mux.Handle("/api/retries", httputil.LogHandler(m.log, m.retriesHandler()))
+	mux.Handle("/api/retries/requeue", httputil.LogHandler(m.log, m.requeueRetryHandler()))
+	mux.Handle("/api/decisions", httputil.LogHandler(m.log, m.decisionsHandler()))
+	mux.Handle("/api/decisions/approve", httputil.LogHandler(m.log, m.decideDepositHandler(exchange.DecisionApprove)))
+	mux.Handle("/api/decisions/reject", httputil.LogHandler(m.log, m.decideDepositHandler(exchange.DecisionReject)))
+	mux.Handle("/api/decisions/reassign", httputil.LogHandler(m.log, m.decideDepositHandler(exchange.DecisionReassign)))
+	mux.Handle("/api/webhooks", httputil.LogHandler(m.log, m.webhooksHandler()))
+	mux.Handle("/api/webhooks/replay", httputil.LogHandler(m.log, m.replayWebhookHandler()))
+	mux.Handle("/api/rejected_deposits", httputil.LogHandler(m.log, m.rejectedDepositsHandler()))
+	mux.Handle("/api/scanners", httputil.LogHandler(m.log, m.scannersHandler()))
+	mux.Handle("/api/scanners/register", httputil.LogHandler(m.log, m.updateScannerHandler(m.RegisterScanner)))
+	mux.Handle("/api/scanners/pause", httputil.LogHandler(m.log, m.updateScannerHandler(m.PauseScanner)))
+	mux.Handle("/api/scanners/resume", httputil.LogHandler(m.log, m.updateScannerHandler(m.ResumeScanner)))
+	mux.Handle("/api/scanners/remove", httputil.LogHandler(m.log, m.updateScannerHandler(m.RemoveScanner)))
+	mux.Handle("/api/rescans", httputil.LogHandler(m.log, m.rescansHandler()))
+	mux.Handle("/api/rescans/start", httputil.LogHandler(m.log, m.startRescanHandler()))
 	return mux
 }
 
@@ -166,7 +261,7 @@ func (m *Monitor) addressHandler() http.HandlerFunc {
 // Method: GET
 // URI: /api/deposit_status
 // Args:
-//     - status # available value("waiting_deposit", "waiting_send", "waiting_confirm", "done")
+//     - status # available value("waiting_deposit", "waiting_send", "waiting_confirm", "done", "orphaned")
 func (m *Monitor) depositStatus() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -204,11 +299,9 @@ func (m *Monitor) depositStatus() http.HandlerFunc {
 			log.WithField("depositStatus", status).Error("Unknown status")
 			return
 		default:
-			dpis, err := m.GetDepositStatusDetail(func(dpi exchange.DepositInfo) bool {
-				return dpi.Status == st
-			})
+			dpis, err := m.GetDepositStatusDetailByStatus(st)
 			if err != nil {
-				log.WithError(err).Error("GetDepositStatusDetail failed")
+				log.WithError(err).Error("GetDepositStatusDetailByStatus failed")
 				httputil.ErrResponse(w, http.StatusInternalServerError)
 				return
 			}
@@ -248,3 +341,580 @@ func (m *Monitor) statsHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// catalogueHandler returns the status of the kitty catalogue sync
+// Method: GET
+// URI: /api/catalogue
+func (m *Monitor) catalogueHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := httputil.JSONResponse(w, m.CatalogueStatus()); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// refundsHandler returns the refunds
+// Method: GET
+// URI: /api/refunds
+// Args:
+//     - status # optional, ("waiting_address", "waiting_send", "sending", "sent", "cancelled")
+func (m *Monitor) refundsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := exchange.RefundStatus(r.FormValue("status"))
+		refunds, err := m.GetRefunds(func(rf exchange.Refund) bool {
+			return status == "" || rf.Status == status
+		})
+		if err != nil {
+			log.WithError(err).Error("GetRefunds failed")
+			httputil.ErrResponse(w, http.StatusInternalServerError)
+			return
+		}
+
+		if refunds == nil {
+			refunds = []exchange.Refund{}
+		}
+
+		if err := httputil.JSONResponse(w, refunds); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// updateRefundHandler changes a refund with update and returns the updated refund
+// Method: POST
+// URI: /api/refunds/address
+// Args:
+//     - deposit_id
+//     - address # the address to send the refund to
+// URI: /api/refunds/complete
+// Args:
+//     - deposit_id
+//     - txid # the transaction of a refund that was sent manually
+// URI: /api/refunds/cancel
+// Args:
+//     - deposit_id
+func (m *Monitor) updateRefundHandler(update func(r *http.Request) (exchange.Refund, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.FormValue("deposit_id") == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "deposit_id is required")
+			return
+		}
+
+		refund, err := update(r)
+		if err != nil {
+			log.WithError(err).Error("Update refund failed")
+			switch err.(type) {
+			case dbutil.ObjectNotExistErr:
+				httputil.ErrResponse(w, http.StatusNotFound)
+				return
+			}
+
+			switch err {
+			case exchange.ErrRefundStatusInvalid, exchange.ErrInvalidRefundAddress:
+				httputil.ErrResponse(w, http.StatusBadRequest, err.Error())
+			default:
+				httputil.ErrResponse(w, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		log.WithField("refund", refund).Info("Refund updated")
+
+		if err := httputil.JSONResponse(w, refund); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// retriesHandler returns the deposits that failed to be processed
+// Method: GET
+// URI: /api/retries
+// Args:
+//     - dead # optional, "true" for the dead letters only, "false" for the scheduled retries only
+func (m *Monitor) retriesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		flt := func(exchange.DepositRetry) bool { return true }
+		switch r.FormValue("dead") {
+		case "":
+		case "true":
+			flt = func(rt exchange.DepositRetry) bool { return rt.Dead }
+		case "false":
+			flt = func(rt exchange.DepositRetry) bool { return !rt.Dead }
+		default:
+			httputil.ErrResponse(w, http.StatusBadRequest, "invalid dead")
+			return
+		}
+
+		retries, err := m.GetRetries(flt)
+		if err != nil {
+			log.WithError(err).Error("GetRetries failed")
+			httputil.ErrResponse(w, http.StatusInternalServerError)
+			return
+		}
+
+		if retries == nil {
+			retries = []exchange.DepositRetry{}
+		}
+
+		if err := httputil.JSONResponse(w, retries); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// requeueRetryHandler retries a dead letter, e.g. after the cause of the failures was fixed
+// Method: POST
+// URI: /api/retries/requeue
+// Args:
+//     - deposit_id
+func (m *Monitor) requeueRetryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		depositID := r.FormValue("deposit_id")
+		if depositID == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "deposit_id is required")
+			return
+		}
+
+		rt, err := m.RequeueDeadLetter(depositID)
+		if err != nil {
+			log.WithError(err).Error("RequeueDeadLetter failed")
+			switch err.(type) {
+			case dbutil.ObjectNotExistErr:
+				httputil.ErrResponse(w, http.StatusNotFound)
+			default:
+				httputil.ErrResponse(w, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := httputil.JSONResponse(w, rt); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// decisionsHandler returns the suspicious deposits waiting for an operator's decision
+// Method: GET
+// URI: /api/decisions
+func (m *Monitor) decisionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		dis, err := m.GetDepositsAwaitingDecision()
+		if err != nil {
+			log.WithError(err).Error("GetDepositsAwaitingDecision failed")
+			httputil.ErrResponse(w, http.StatusInternalServerError)
+			return
+		}
+
+		if dis == nil {
+			dis = []exchange.DepositInfo{}
+		}
+
+		if err := httputil.JSONResponse(w, dis); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// decideDepositHandler records an operator's decision on a deposit waiting for a decision
+// Method: POST
+// URI: /api/decisions/approve, /api/decisions/reject, /api/decisions/reassign
+// Args:
+//     - deposit_id
+//     - operator # who made the decision
+//     - kitty_id # the kitty to reassign the deposit to, only for reassign
+func (m *Monitor) decideDepositHandler(decision exchange.Decision) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		depositID := r.FormValue("deposit_id")
+		if depositID == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "deposit_id is required")
+			return
+		}
+
+		operator := r.FormValue("operator")
+		if operator == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "operator is required")
+			return
+		}
+
+		kittyID := r.FormValue("kitty_id")
+		if decision == exchange.DecisionReassign && kittyID == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "kitty_id is required")
+			return
+		}
+
+		di, err := m.DecideDeposit(depositID, exchange.DepositDecision{
+			Decision: decision,
+			Operator: operator,
+			KittyID:  kittyID,
+		})
+		if err != nil {
+			log.WithError(err).Error("DecideDeposit failed")
+			switch err {
+			case exchange.ErrDepositNotHeld, exchange.ErrKittyNotReserved, exchange.ErrReassignCoinType, exchange.ErrNoBoundAddress:
+				httputil.ErrResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			switch err.(type) {
+			case dbutil.ObjectNotExistErr:
+				httputil.ErrResponse(w, http.StatusNotFound)
+			default:
+				httputil.ErrResponse(w, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := httputil.JSONResponse(w, di); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// webhooksHandler returns the webhook deliveries, in the order the events were emitted
+// Method: GET
+// URI: /api/webhooks
+// Args:
+//     - status # optional, ("pending", "delivered", "failed")
+func (m *Monitor) webhooksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := webhook.DeliveryStatus(r.FormValue("status"))
+		if status != "" && !webhook.ValidDeliveryStatus(status) {
+			httputil.ErrResponse(w, http.StatusBadRequest, "invalid status")
+			return
+		}
+
+		deliveries, err := m.GetDeliveries(func(d webhook.Delivery) bool {
+			return status == "" || d.Status == status
+		})
+		if err != nil {
+			log.WithError(err).Error("GetDeliveries failed")
+			httputil.ErrResponse(w, http.StatusInternalServerError)
+			return
+		}
+
+		if deliveries == nil {
+			deliveries = []webhook.Delivery{}
+		}
+
+		if err := httputil.JSONResponse(w, deliveries); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// replayWebhookHandler sends an event again, e.g. after it failed or the receiver lost it
+// Method: POST
+// URI: /api/webhooks/replay
+// Args:
+//     - id # the event id
+func (m *Monitor) replayWebhookHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := r.FormValue("id")
+		if id == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "id is required")
+			return
+		}
+
+		d, err := m.Replay(id)
+		if err != nil {
+			log.WithError(err).Error("Replay failed")
+			switch err.(type) {
+			case dbutil.ObjectNotExistErr:
+				httputil.ErrResponse(w, http.StatusNotFound)
+			default:
+				httputil.ErrResponse(w, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		log.WithField("eventID", id).Info("Webhook replay scheduled")
+
+		if err := httputil.JSONResponse(w, d); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// rejectedDepositsHandler returns the deposits the exchange rejected, e.g. because their address is not bound to a kitty
+// Method: GET
+// URI: /api/rejected_deposits
+func (m *Monitor) rejectedDepositsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		dvs, err := m.GetRejectedDeposits()
+		if err != nil {
+			log.WithError(err).Error("GetRejectedDeposits failed")
+			httputil.ErrResponse(w, http.StatusInternalServerError)
+			return
+		}
+
+		if dvs == nil {
+			dvs = []scanner.Deposit{}
+		}
+
+		if err := httputil.JSONResponse(w, dvs); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// scannersHandler returns the health of the coin scanners
+// Method: GET
+// URI: /api/scanners
+func (m *Monitor) scannersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := httputil.JSONResponse(w, m.Health()); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// updateScannerHandler registers, pauses, resumes or removes a coin scanner, e.g. to stop the intake
+// of a coin during an incident. It returns the health of the coin scanners.
+// Method: POST
+// URI: /api/scanners/register, /api/scanners/pause, /api/scanners/resume, /api/scanners/remove
+// Args:
+//     - coin_type
+func (m *Monitor) updateScannerHandler(update func(coinType string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		coinType := r.FormValue("coin_type")
+		if coinType == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "coin_type is required")
+			return
+		}
+
+		if err := update(coinType); err != nil {
+			log.WithError(err).WithField("coinType", coinType).Error("Update scanner failed")
+			// The other errors are caused by the scanner's state or configuration,
+			// e.g. resuming a scanner that is not paused
+			switch err.(type) {
+			case scanner.ScannerNotExistErr:
+				httputil.ErrResponse(w, http.StatusNotFound)
+			default:
+				httputil.ErrResponse(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+
+		log.WithField("coinType", coinType).Info("Scanner updated")
+
+		if err := httputil.JSONResponse(w, m.Health()); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// rescansHandler returns the progress of the rescans started since teller started
+// Method: GET
+// URI: /api/rescans
+func (m *Monitor) rescansHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := httputil.JSONResponse(w, m.GetRescans()); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
+
+// startRescanHandler starts scanning the blocks of a height range again for deposits to some addresses,
+// e.g. after a scan address was missing from the db. Missed deposits are added and sent to the exchange.
+// The rescan runs in the background, its progress is returned by /api/rescans.
+// Method: POST
+// URI: /api/rescans/start
+// Args:
+//     - coin_type
+//     - from_height
+//     - to_height
+//     - addresses [comma separated]
+func (m *Monitor) startRescanHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httputil.ErrResponse(w, http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := scanner.RescanRequest{
+			CoinType: r.FormValue("coin_type"),
+		}
+		if req.CoinType == "" {
+			httputil.ErrResponse(w, http.StatusBadRequest, "coin_type is required")
+			return
+		}
+
+		var err error
+		req.FromHeight, err = strconv.ParseInt(r.FormValue("from_height"), 10, 64)
+		if err != nil {
+			httputil.ErrResponse(w, http.StatusBadRequest, "invalid from_height")
+			return
+		}
+
+		req.ToHeight, err = strconv.ParseInt(r.FormValue("to_height"), 10, 64)
+		if err != nil {
+			httputil.ErrResponse(w, http.StatusBadRequest, "invalid to_height")
+			return
+		}
+
+		for _, addr := range strings.Split(r.FormValue("addresses"), ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				req.Addresses = append(req.Addresses, addr)
+			}
+		}
+		if len(req.Addresses) == 0 {
+			httputil.ErrResponse(w, http.StatusBadRequest, "addresses is required")
+			return
+		}
+
+		log = log.WithField("rescanRequest", req)
+
+		p, err := m.StartRescan(req)
+		if err != nil {
+			log.WithError(err).Error("StartRescan failed")
+			switch err.(type) {
+			case scanner.ScannerNotExistErr:
+				httputil.ErrResponse(w, http.StatusNotFound)
+			default:
+				httputil.ErrResponse(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+
+		log.WithField("rescanID", p.ID).Info("Rescan started")
+
+		if err := httputil.JSONResponse(w, p); err != nil {
+			log.WithError(err).Error("Write json response failed")
+			return
+		}
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/kittycash/teller/src/agent"
 	"github.com/kittycash/teller/src/exchange"
 	"github.com/kittycash/teller/src/scanner"
+	"github.com/kittycash/teller/src/util/dbutil"
 	"github.com/kittycash/teller/src/util/testutil"
+	"github.com/kittycash/teller/src/webhook"
 )
 
 type dummyBtcAddrMgr struct {
@@ -52,9 +56,16 @@ func (dps dummyDepositStatusGetter) GetDepositStatusDetail(flt exchange.DepositF
 	return ds, nil
 }
 
+func (dps dummyDepositStatusGetter) GetDepositStatusDetailByStatus(status exchange.Status) ([]exchange.DepositStatusDetail, error) {
+	return dps.GetDepositStatusDetail(func(dpi exchange.DepositInfo) bool {
+		return dpi.Status == status
+	})
+}
+
 func (dps dummyDepositStatusGetter) GetDepositStats() (*exchange.DepositStats, error) {
 	var totalBTCReceived int64
 	var totalSKYReceived int64
+	var totalETHReceived int64
 	var totalBoxesSent int64
 	for _, dpi := range dps.dpis {
 		if dpi.CoinType == scanner.CoinTypeBTC {
@@ -65,6 +76,10 @@ func (dps dummyDepositStatusGetter) GetDepositStats() (*exchange.DepositStats, e
 			totalSKYReceived += dpi.DepositValue
 		}
 
+		if dpi.CoinType == scanner.CoinTypeETH {
+			totalETHReceived += dpi.DepositValue
+		}
+
 		// TotalBoxesSent = no. of deposits with status == done
 		if dpi.Status == exchange.StatusDone {
 			totalBoxesSent++
@@ -74,6 +89,7 @@ func (dps dummyDepositStatusGetter) GetDepositStats() (*exchange.DepositStats, e
 	return &exchange.DepositStats{
 		TotalBTCReceived: totalBTCReceived,
 		TotalSKYReceived: totalSKYReceived,
+		TotalETHReceived: totalETHReceived,
 		TotalBoxesSent:   totalBoxesSent,
 	}, nil
 }
@@ -86,6 +102,195 @@ func (ds dummyScanAddrs) GetScanAddresses() ([]string, error) {
 	return []string{}, nil
 }
 
+type dummyRejectedDeposits struct {
+	dvs []scanner.Deposit
+}
+
+func (dr *dummyRejectedDeposits) GetRejectedDeposits() ([]scanner.Deposit, error) {
+	return dr.dvs, nil
+}
+
+// dummyRescanScanner finds a deposit to each rescanned address in the first rescanned block
+type dummyRescanScanner struct {
+	*scanner.DummyScanner
+}
+
+func (ds dummyRescanScanner) Rescan(req scanner.RescanRequest, progress func(scanner.RescanProgress)) (scanner.RescanProgress, error) {
+	p := scanner.RescanProgress{
+		RescanRequest: req,
+		Height:        req.ToHeight,
+		Found:         len(req.Addresses),
+		StartedAt:     time.Now().UTC().Unix(),
+		FinishedAt:    time.Now().UTC().Unix(),
+		Done:          true,
+	}
+
+	for i, addr := range req.Addresses {
+		p.Deposits = append(p.Deposits, scanner.Deposit{
+			CoinType: req.CoinType,
+			Address:  addr,
+			Value:    100000,
+			Height:   req.FromHeight,
+			Tx:       fmt.Sprintf("t%d", i),
+			Status:   scanner.DepositNotProcessed,
+		})
+	}
+
+	progress(p)
+	return p, nil
+}
+
+type dummyRefunds struct {
+	refunds []exchange.Refund
+}
+
+func (dr *dummyRefunds) GetRefunds(flt exchange.RefundFilter) ([]exchange.Refund, error) {
+	var rs []exchange.Refund
+	for _, r := range dr.refunds {
+		if flt(r) {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+func (dr *dummyRefunds) update(depositID string, f func(r *exchange.Refund) error) (exchange.Refund, error) {
+	for i := range dr.refunds {
+		if dr.refunds[i].DepositID == depositID {
+			if err := f(&dr.refunds[i]); err != nil {
+				return exchange.Refund{}, err
+			}
+			return dr.refunds[i], nil
+		}
+	}
+	return exchange.Refund{}, dbutil.NewObjectNotExistErr([]byte("refunds"), []byte(depositID))
+}
+
+func (dr *dummyRefunds) SetRefundAddress(depositID, addr string) (exchange.Refund, error) {
+	return dr.update(depositID, func(r *exchange.Refund) error {
+		if addr == "invalid" {
+			return exchange.ErrInvalidRefundAddress
+		}
+		r.RefundAddress = addr
+		r.Status = exchange.RefundStatusWaitSend
+		return nil
+	})
+}
+
+func (dr *dummyRefunds) CompleteRefund(depositID, txid string) (exchange.Refund, error) {
+	return dr.update(depositID, func(r *exchange.Refund) error {
+		r.Txid = txid
+		r.Status = exchange.RefundStatusSent
+		return nil
+	})
+}
+
+func (dr *dummyRefunds) CancelRefund(depositID string) (exchange.Refund, error) {
+	return dr.update(depositID, func(r *exchange.Refund) error {
+		if r.Status == exchange.RefundStatusSent {
+			return exchange.ErrRefundStatusInvalid
+		}
+		r.Status = exchange.RefundStatusCancelled
+		return nil
+	})
+}
+
+type dummyRetries struct {
+	retries []exchange.DepositRetry
+}
+
+func (dr *dummyRetries) GetRetries(flt exchange.RetryFilter) ([]exchange.DepositRetry, error) {
+	var rs []exchange.DepositRetry
+	for _, rt := range dr.retries {
+		if flt(rt) {
+			rs = append(rs, rt)
+		}
+	}
+	return rs, nil
+}
+
+func (dr *dummyRetries) RequeueDeadLetter(depositID string) (exchange.DepositRetry, error) {
+	for i, rt := range dr.retries {
+		if rt.DepositID == depositID && rt.Dead {
+			dr.retries[i].Dead = false
+			dr.retries[i].Attempts = 0
+			return dr.retries[i], nil
+		}
+	}
+	return exchange.DepositRetry{}, dbutil.NewObjectNotExistErr(exchange.DeadLetterBkt, []byte(depositID))
+}
+
+type dummyDecider struct {
+	deposits  []exchange.DepositInfo
+	decisions map[string]exchange.DepositDecision
+}
+
+func (dd *dummyDecider) GetDepositsAwaitingDecision() ([]exchange.DepositInfo, error) {
+	var dis []exchange.DepositInfo
+	for _, di := range dd.deposits {
+		if di.AwaitingDecision() {
+			dis = append(dis, di)
+		}
+	}
+	return dis, nil
+}
+
+func (dd *dummyDecider) DecideDeposit(depositID string, d exchange.DepositDecision) (exchange.DepositInfo, error) {
+	for i, di := range dd.deposits {
+		if di.DepositID != depositID {
+			continue
+		}
+
+		if !di.AwaitingDecision() {
+			return exchange.DepositInfo{}, exchange.ErrDepositNotHeld
+		}
+
+		if dd.decisions == nil {
+			dd.decisions = make(map[string]exchange.DepositDecision)
+		}
+		dd.decisions[depositID] = d
+
+		dd.deposits[i].Decision = d.Decision
+		dd.deposits[i].DecidedBy = d.Operator
+		return dd.deposits[i], nil
+	}
+
+	return exchange.DepositInfo{}, dbutil.NewObjectNotExistErr(exchange.DepositInfoBkt, []byte(depositID))
+}
+
+type dummyCatalogue struct {
+	status agent.CatalogueStatus
+}
+
+func (dc *dummyCatalogue) CatalogueStatus() agent.CatalogueStatus {
+	return dc.status
+}
+
+type dummyWebhooks struct {
+	deliveries []webhook.Delivery
+}
+
+func (dw *dummyWebhooks) GetDeliveries(flt webhook.DeliveryFilter) ([]webhook.Delivery, error) {
+	var ds []webhook.Delivery
+	for _, d := range dw.deliveries {
+		if flt(d) {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+func (dw *dummyWebhooks) Replay(id string) (webhook.Delivery, error) {
+	for i, d := range dw.deliveries {
+		if d.Event.ID == id {
+			dw.deliveries[i].Status = webhook.DeliveryPending
+			dw.deliveries[i].Attempts = 0
+			return dw.deliveries[i], nil
+		}
+	}
+	return webhook.Delivery{}, dbutil.NewObjectNotExistErr(webhook.OutboxBkt, []byte(id))
+}
+
 func TestRunMonitor(t *testing.T) {
 	dpis := []exchange.DepositInfo{
 		{
@@ -122,7 +327,7 @@ func TestRunMonitor(t *testing.T) {
 	}
 
 	log, _ := testutil.NewLogger(t)
-	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDps, &dummyScanAddrs{})
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDps, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, &dummyDecider{}, &dummyCatalogue{}, &dummyWebhooks{}, scanner.NewMultiplexer(log), &dummyRejectedDeposits{})
 
 	time.AfterFunc(1*time.Second, func() {
 		rsp, err := http.Get(fmt.Sprintf("http://localhost:7908/api/address"))
@@ -208,3 +413,744 @@ func TestRunMonitor(t *testing.T) {
 		return
 	}
 }
+
+func TestMonitorRefunds(t *testing.T) {
+	refunds := &dummyRefunds{
+		refunds: []exchange.Refund{
+			{
+				DepositID: "t1:0",
+				Amount:    100,
+				Status:    exchange.RefundStatusWaitAddress,
+			},
+			{
+				DepositID: "t2:0",
+				Amount:    200,
+				Status:    exchange.RefundStatusWaitSend,
+			},
+		},
+	}
+
+	cfg := Config{
+		"localhost:7909",
+	}
+
+	log, _ := testutil.NewLogger(t)
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, refunds, &dummyRetries{}, &dummyDecider{}, &dummyCatalogue{}, &dummyWebhooks{}, scanner.NewMultiplexer(log), &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7909/api/refunds?status=waiting_address")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var rs []exchange.Refund
+		err = json.NewDecoder(rsp.Body).Decode(&rs)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, refunds.refunds[:1], rs)
+
+		var tt = []struct {
+			name       string
+			uri        string
+			form       url.Values
+			expectCode int
+		}{
+			{
+				"set refund address",
+				"/api/refunds/address",
+				url.Values{"deposit_id": {"t1:0"}, "address": {"a"}},
+				http.StatusOK,
+			},
+			{
+				"set invalid refund address",
+				"/api/refunds/address",
+				url.Values{"deposit_id": {"t1:0"}, "address": {"invalid"}},
+				http.StatusBadRequest,
+			},
+			{
+				"missing deposit id",
+				"/api/refunds/complete",
+				url.Values{"txid": {"tx"}},
+				http.StatusBadRequest,
+			},
+			{
+				"unknown refund",
+				"/api/refunds/cancel",
+				url.Values{"deposit_id": {"t3:0"}},
+				http.StatusNotFound,
+			},
+			{
+				"complete refund",
+				"/api/refunds/complete",
+				url.Values{"deposit_id": {"t2:0"}, "txid": {"tx"}},
+				http.StatusOK,
+			},
+			{
+				"cancel sent refund",
+				"/api/refunds/cancel",
+				url.Values{"deposit_id": {"t2:0"}},
+				http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				rsp, err := http.PostForm("http://localhost:7909"+tc.uri, tc.form)
+				require.NoError(t, err)
+				defer testutil.CheckError(t, rsp.Body.Close)
+				require.Equal(t, tc.expectCode, rsp.StatusCode)
+			})
+		}
+
+		rsp, err = http.Get("http://localhost:7909/api/refunds/cancel")
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+
+		require.Equal(t, "a", refunds.refunds[0].RefundAddress)
+		require.Equal(t, exchange.RefundStatusSent, refunds.refunds[1].Status)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorCatalogue(t *testing.T) {
+	catalogue := &dummyCatalogue{
+		status: agent.CatalogueStatus{
+			CatalogueCounts: agent.CatalogueCounts{
+				Total:   250,
+				Added:   200,
+				Updated: 3,
+			},
+			LastSync:    1520000000,
+			LastAttempt: 1520000300,
+			LastError:   "connection refused",
+			Failures:    1,
+		},
+	}
+
+	cfg := Config{
+		"localhost:7910",
+	}
+
+	log, _ := testutil.NewLogger(t)
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, &dummyDecider{}, catalogue, &dummyWebhooks{}, scanner.NewMultiplexer(log), &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7910/api/catalogue")
+		require.NoError(t, err)
+		defer testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var status agent.CatalogueStatus
+		err = json.NewDecoder(rsp.Body).Decode(&status)
+		require.NoError(t, err)
+		require.Equal(t, catalogue.status, status)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorWebhooks(t *testing.T) {
+	webhooks := &dummyWebhooks{
+		deliveries: []webhook.Delivery{
+			{
+				Event: webhook.Event{
+					ID:   "00000000000000000001",
+					Type: webhook.EventReservationCreated,
+					Data: json.RawMessage(`{"kitty_id":"1"}`),
+				},
+				Status:   webhook.DeliveryDelivered,
+				Attempts: 1,
+			},
+			{
+				Event: webhook.Event{
+					ID:   "00000000000000000002",
+					Type: webhook.EventDepositSeen,
+					Data: json.RawMessage(`{"deposit_id":"t1:0"}`),
+				},
+				Status:    webhook.DeliveryFailed,
+				Attempts:  20,
+				LastError: "webhook url responded with status 500",
+			},
+		},
+	}
+
+	cfg := Config{
+		"localhost:7911",
+	}
+
+	log, _ := testutil.NewLogger(t)
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, &dummyDecider{}, &dummyCatalogue{}, webhooks, scanner.NewMultiplexer(log), &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7911/api/webhooks?status=failed")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var ds []webhook.Delivery
+		err = json.NewDecoder(rsp.Body).Decode(&ds)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Len(t, ds, 1)
+		require.Equal(t, webhooks.deliveries[1].Event.ID, ds[0].Event.ID)
+		require.Equal(t, webhooks.deliveries[1].LastError, ds[0].LastError)
+		require.JSONEq(t, string(webhooks.deliveries[1].Event.Data), string(ds[0].Event.Data))
+
+		rsp, err = http.Get("http://localhost:7911/api/webhooks?status=unknown")
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+
+		var tt = []struct {
+			name       string
+			form       url.Values
+			expectCode int
+		}{
+			{
+				"missing id",
+				url.Values{},
+				http.StatusBadRequest,
+			},
+			{
+				"unknown event",
+				url.Values{"id": {"00000000000000000003"}},
+				http.StatusNotFound,
+			},
+			{
+				"replay failed event",
+				url.Values{"id": {"00000000000000000002"}},
+				http.StatusOK,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				rsp, err := http.PostForm("http://localhost:7911/api/webhooks/replay", tc.form)
+				require.NoError(t, err)
+				defer testutil.CheckError(t, rsp.Body.Close)
+				require.Equal(t, tc.expectCode, rsp.StatusCode)
+			})
+		}
+
+		rsp, err = http.Get("http://localhost:7911/api/webhooks/replay")
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+
+		require.Equal(t, webhook.DeliveryPending, webhooks.deliveries[1].Status)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorRetries(t *testing.T) {
+	retries := &dummyRetries{
+		retries: []exchange.DepositRetry{
+			{
+				DepositID: "t1:0",
+				Stage:     exchange.RetryStageProcess,
+				Attempts:  2,
+				LastError: "timeout",
+			},
+			{
+				DepositID: "t2:0",
+				Stage:     exchange.RetryStageSend,
+				Attempts:  10,
+				LastError: "insufficient balance",
+				Dead:      true,
+			},
+		},
+	}
+
+	cfg := Config{
+		"localhost:7912",
+	}
+
+	log, _ := testutil.NewLogger(t)
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, retries, &dummyDecider{}, &dummyCatalogue{}, &dummyWebhooks{}, scanner.NewMultiplexer(log), &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7912/api/retries?dead=true")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var rs []exchange.DepositRetry
+		err = json.NewDecoder(rsp.Body).Decode(&rs)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, retries.retries[1:], rs)
+
+		rsp, err = http.Get("http://localhost:7912/api/retries?dead=x")
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+
+		var tt = []struct {
+			name       string
+			form       url.Values
+			expectCode int
+		}{
+			{
+				"missing deposit id",
+				url.Values{},
+				http.StatusBadRequest,
+			},
+			{
+				"not a dead letter",
+				url.Values{"deposit_id": {"t1:0"}},
+				http.StatusNotFound,
+			},
+			{
+				"requeue dead letter",
+				url.Values{"deposit_id": {"t2:0"}},
+				http.StatusOK,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				rsp, err := http.PostForm("http://localhost:7912/api/retries/requeue", tc.form)
+				require.NoError(t, err)
+				defer testutil.CheckError(t, rsp.Body.Close)
+				require.Equal(t, tc.expectCode, rsp.StatusCode)
+			})
+		}
+
+		require.False(t, retries.retries[1].Dead)
+		require.Equal(t, 0, retries.retries[1].Attempts)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorDecisions(t *testing.T) {
+	decider := &dummyDecider{
+		deposits: []exchange.DepositInfo{
+			{
+				DepositID:  "t1:0",
+				Status:     exchange.StatusWaitDecide,
+				KittyID:    "1",
+				HoldReason: exchange.HoldReasonWrongAmount,
+			},
+			{
+				DepositID:  "t2:0",
+				Status:     exchange.StatusWaitDecide,
+				KittyID:    "2",
+				HoldReason: exchange.HoldReasonExpired,
+			},
+			{
+				DepositID: "t3:0",
+				Status:    exchange.StatusWaitSend,
+				KittyID:   "3",
+			},
+		},
+	}
+
+	cfg := Config{
+		"localhost:7913",
+	}
+
+	log, _ := testutil.NewLogger(t)
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, decider, &dummyCatalogue{}, &dummyWebhooks{}, scanner.NewMultiplexer(log), &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7913/api/decisions")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var dis []exchange.DepositInfo
+		err = json.NewDecoder(rsp.Body).Decode(&dis)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Len(t, dis, 2)
+		require.Equal(t, "t1:0", dis[0].DepositID)
+		require.Equal(t, "t2:0", dis[1].DepositID)
+
+		var tt = []struct {
+			name       string
+			uri        string
+			form       url.Values
+			expectCode int
+		}{
+			{
+				"missing operator",
+				"approve",
+				url.Values{"deposit_id": {"t1:0"}},
+				http.StatusBadRequest,
+			},
+			{
+				"reassign without kitty id",
+				"reassign",
+				url.Values{"deposit_id": {"t1:0"}, "operator": {"alice"}},
+				http.StatusBadRequest,
+			},
+			{
+				"unknown deposit",
+				"approve",
+				url.Values{"deposit_id": {"t9:0"}, "operator": {"alice"}},
+				http.StatusNotFound,
+			},
+			{
+				"not held",
+				"reject",
+				url.Values{"deposit_id": {"t3:0"}, "operator": {"alice"}},
+				http.StatusBadRequest,
+			},
+			{
+				"approve",
+				"approve",
+				url.Values{"deposit_id": {"t1:0"}, "operator": {"alice"}},
+				http.StatusOK,
+			},
+			{
+				"reassign",
+				"reassign",
+				url.Values{"deposit_id": {"t2:0"}, "operator": {"bob"}, "kitty_id": {"4"}},
+				http.StatusOK,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				rsp, err := http.PostForm("http://localhost:7913/api/decisions/"+tc.uri, tc.form)
+				require.NoError(t, err)
+				defer testutil.CheckError(t, rsp.Body.Close)
+				require.Equal(t, tc.expectCode, rsp.StatusCode)
+			})
+		}
+
+		require.Equal(t, map[string]exchange.DepositDecision{
+			"t1:0": {
+				Decision: exchange.DecisionApprove,
+				Operator: "alice",
+			},
+			"t2:0": {
+				Decision: exchange.DecisionReassign,
+				Operator: "bob",
+				KittyID:  "4",
+			},
+		}, decider.decisions)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorScanners(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+
+	scanners := scanner.NewMultiplexer(log)
+	btcScanner := scanner.NewDummyScanner(log)
+	btcScanner.RegisterCoinType(scanner.CoinTypeBTC)
+	err := scanners.AddScanner(btcScanner, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+
+	go testutil.CheckError(t, scanners.Multiplex)
+	defer scanners.Shutdown()
+
+	cfg := Config{
+		"localhost:7914",
+	}
+
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, &dummyDecider{}, &dummyCatalogue{}, &dummyWebhooks{}, scanners, &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7914/api/scanners")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var hs []scanner.ScannerHealth
+		err = json.NewDecoder(rsp.Body).Decode(&hs)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Len(t, hs, 1)
+		require.Equal(t, scanner.CoinTypeBTC, hs[0].CoinType)
+		require.Equal(t, scanner.ScannerRunning, hs[0].State)
+
+		var tt = []struct {
+			name       string
+			uri        string
+			form       url.Values
+			expectCode int
+			state      scanner.ScannerState
+		}{
+			{
+				"missing coin type",
+				"pause",
+				url.Values{},
+				http.StatusBadRequest,
+				scanner.ScannerRunning,
+			},
+			{
+				"unknown coin type",
+				"pause",
+				url.Values{"coin_type": {scanner.CoinTypeETH}},
+				http.StatusNotFound,
+				scanner.ScannerRunning,
+			},
+			{
+				"resume running scanner",
+				"resume",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}},
+				http.StatusBadRequest,
+				scanner.ScannerRunning,
+			},
+			{
+				"pause",
+				"pause",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}},
+				http.StatusOK,
+				scanner.ScannerPaused,
+			},
+			{
+				"resume",
+				"resume",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}},
+				http.StatusOK,
+				scanner.ScannerRunning,
+			},
+			{
+				"remove",
+				"remove",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}},
+				http.StatusOK,
+				"",
+			},
+			{
+				"register",
+				"register",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}},
+				http.StatusOK,
+				scanner.ScannerRunning,
+			},
+			{
+				"register again",
+				"register",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}},
+				http.StatusBadRequest,
+				scanner.ScannerRunning,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				rsp, err := http.PostForm("http://localhost:7914/api/scanners/"+tc.uri, tc.form)
+				require.NoError(t, err)
+				defer testutil.CheckError(t, rsp.Body.Close)
+				require.Equal(t, tc.expectCode, rsp.StatusCode)
+
+				var state scanner.ScannerState
+				for _, h := range scanners.Health() {
+					if h.CoinType == scanner.CoinTypeBTC {
+						state = h.State
+					}
+				}
+				require.Equal(t, tc.state, state)
+			})
+		}
+
+		rsp, err = http.Get("http://localhost:7914/api/scanners/pause")
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorRejectedDeposits(t *testing.T) {
+	rejected := &dummyRejectedDeposits{
+		dvs: []scanner.Deposit{
+			{
+				CoinType:     scanner.CoinTypeBTC,
+				Address:      "b1",
+				Value:        100000,
+				Height:       20,
+				Tx:           "t1",
+				Status:       scanner.DepositRejected,
+				RejectReason: "Deposit has no bound skycoin address",
+			},
+		},
+	}
+
+	cfg := Config{
+		"localhost:7915",
+	}
+
+	log, _ := testutil.NewLogger(t)
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, &dummyDecider{}, &dummyCatalogue{}, &dummyWebhooks{}, scanner.NewMultiplexer(log), rejected)
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		rsp, err := http.Get("http://localhost:7915/api/rejected_deposits")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var dvs []scanner.Deposit
+		err = json.NewDecoder(rsp.Body).Decode(&dvs)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, rejected.dvs, dvs)
+
+		rsp, err = http.PostForm("http://localhost:7915/api/rejected_deposits", url.Values{})
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
+
+func TestMonitorRescans(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+
+	scanners := scanner.NewMultiplexer(log)
+	btcScanner := dummyRescanScanner{scanner.NewDummyScanner(log)}
+	btcScanner.RegisterCoinType(scanner.CoinTypeBTC)
+	err := scanners.AddScanner(btcScanner, scanner.CoinTypeBTC)
+	require.NoError(t, err)
+	skyScanner := scanner.NewDummyScanner(log)
+	skyScanner.RegisterCoinType(scanner.CoinTypeSKY)
+	err = scanners.AddScanner(skyScanner, scanner.CoinTypeSKY)
+	require.NoError(t, err)
+
+	go testutil.CheckError(t, scanners.Multiplex)
+	defer scanners.Shutdown()
+
+	cfg := Config{
+		"localhost:7916",
+	}
+
+	m := New(log, cfg, &dummyBtcAddrMgr{10}, &dummySkyAddrMgr{10}, &dummyDepositStatusGetter{}, &dummyScanAddrs{}, &dummyRefunds{}, &dummyRetries{}, &dummyDecider{}, &dummyCatalogue{}, &dummyWebhooks{}, scanners, &dummyRejectedDeposits{})
+
+	time.AfterFunc(1*time.Second, func() {
+		defer m.Shutdown()
+
+		var tt = []struct {
+			name       string
+			form       url.Values
+			expectCode int
+		}{
+			{
+				"missing coin type",
+				url.Values{"from_height": {"10"}, "to_height": {"20"}, "addresses": {"b1"}},
+				http.StatusBadRequest,
+			},
+			{
+				"invalid from height",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}, "from_height": {"a"}, "to_height": {"20"}, "addresses": {"b1"}},
+				http.StatusBadRequest,
+			},
+			{
+				"invalid to height",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}, "from_height": {"10"}, "addresses": {"b1"}},
+				http.StatusBadRequest,
+			},
+			{
+				"to height lower than from height",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}, "from_height": {"20"}, "to_height": {"10"}, "addresses": {"b1"}},
+				http.StatusBadRequest,
+			},
+			{
+				"missing addresses",
+				url.Values{"coin_type": {scanner.CoinTypeBTC}, "from_height": {"10"}, "to_height": {"20"}, "addresses": {" , "}},
+				http.StatusBadRequest,
+			},
+			{
+				"unknown coin type",
+				url.Values{"coin_type": {scanner.CoinTypeETH}, "from_height": {"10"}, "to_height": {"20"}, "addresses": {"e1"}},
+				http.StatusNotFound,
+			},
+			{
+				"rescan not supported",
+				url.Values{"coin_type": {scanner.CoinTypeSKY}, "from_height": {"10"}, "to_height": {"20"}, "addresses": {"s1"}},
+				http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				rsp, err := http.PostForm("http://localhost:7916/api/rescans/start", tc.form)
+				require.NoError(t, err)
+				testutil.CheckError(t, rsp.Body.Close)
+				require.Equal(t, tc.expectCode, rsp.StatusCode)
+			})
+		}
+
+		rsp, err := http.PostForm("http://localhost:7916/api/rescans/start", url.Values{
+			"coin_type":   {scanner.CoinTypeBTC},
+			"from_height": {"10"},
+			"to_height":   {"20"},
+			"addresses":   {"b1, b2"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+		var p scanner.RescanProgress
+		err = json.NewDecoder(rsp.Body).Decode(&p)
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, 1, p.ID)
+		require.Equal(t, []string{"b1", "b2"}, p.Addresses)
+		require.Equal(t, int64(10), p.FromHeight)
+		require.Equal(t, int64(20), p.ToHeight)
+
+		var ps []scanner.RescanProgress
+		for i := 0; i < 10; i++ {
+			rsp, err = http.Get("http://localhost:7916/api/rescans")
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+			err = json.NewDecoder(rsp.Body).Decode(&ps)
+			require.NoError(t, err)
+			testutil.CheckError(t, rsp.Body.Close)
+			require.Len(t, ps, 1)
+			if ps[0].Done {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		require.True(t, ps[0].Done)
+		require.Equal(t, 1, ps[0].ID)
+		require.Equal(t, int64(20), ps[0].Height)
+		require.Equal(t, 2, ps[0].Found)
+		require.Len(t, ps[0].Deposits, 2)
+		require.Empty(t, ps[0].Error)
+
+		rsp, err = http.Get("http://localhost:7916/api/rescans/start")
+		require.NoError(t, err)
+		testutil.CheckError(t, rsp.Body.Close)
+		require.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	})
+
+	if err := m.Run(); err != nil {
+		return
+	}
+}
@@ -1,30 +1,47 @@
 package scanner
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	blockScanPeriod   = time.Second * 5
-	depositBufferSize = 100
+	blockScanPeriod    = time.Second * 5
+	notifyScanPeriod   = time.Minute * 5
+	depositBufferSize  = 100
+	catchUpConcurrency = 4
+	// catchUpThreshold is how many confirmed blocks the scanner must be behind to catch up
+	catchUpThreshold = 10
+	// catchUpBatchSize is how many caught up blocks are written to the db in one transaction
+	catchUpBatchSize = 20
 )
 
+// ErrReorgTooDeep is returned if no fork point is found within the recently scanned blocks
+var ErrReorgTooDeep = errors.New("Chain reorganization is deeper than the recently scanned blocks")
+
 // CommonScanner defines the interface a scanner should implement
 type CommonScanner interface {
 	GetScanPeriod() time.Duration
+	GetNotifyChan() <-chan struct{}
+	Notify()
+	SetNotified(bool)
 	GetStorer() Storer
 	GetDeposit() <-chan DepositNote
 	GetQuitChan() <-chan struct{}
 	GetScannedDepositChan() chan<- Deposit
 	Shutdown()
+	Rescan(RescanRequest, func() (int64, error), func(int64) (*CommonBlock, error), func(RescanProgress)) (RescanProgress, error)
 	Run(
 		getBlockCount func() (int64, error),
 		getBlockAtHeight func(int64) (*CommonBlock, error),
 		waitForNextBlock func(*CommonBlock) (*CommonBlock, error),
 		scanBlock func(*CommonBlock) (int, error),
+		scanBlocks func([]*CommonBlock) (int, error),
 	) error
 }
 
@@ -39,6 +56,12 @@ type BaseScanner struct {
 	quit            chan struct{}
 	done            chan struct{}
 	CoinType        string
+	// Wakes up the scan before ScanPeriod elapses, when a new block is announced
+	notifyC chan struct{}
+	// Set to 1 while new blocks are announced by notifications
+	notified int32
+	// Set to 1 while Run is processing deposits, so that rescanned deposits are sent
+	running int32
 }
 
 // CommonVout common transaction output info
@@ -58,6 +81,7 @@ type CommonTx struct {
 type CommonBlock struct {
 	Height   int64
 	Hash     string
+	PrevHash string
 	NextHash string
 	RawTx    []CommonTx
 }
@@ -68,9 +92,17 @@ func NewBaseScanner(store Storer, log logrus.FieldLogger, coinType string, cfg C
 		cfg.ScanPeriod = blockScanPeriod
 	}
 
+	if cfg.NotifyScanPeriod == 0 {
+		cfg.NotifyScanPeriod = notifyScanPeriod
+	}
+
 	if cfg.DepositBufferSize == 0 {
 		cfg.DepositBufferSize = depositBufferSize
 	}
+
+	if cfg.CatchUpConcurrency <= 0 {
+		cfg.CatchUpConcurrency = catchUpConcurrency
+	}
 	return &BaseScanner{
 		log:             log,
 		store:           store,
@@ -78,6 +110,7 @@ func NewBaseScanner(store Storer, log logrus.FieldLogger, coinType string, cfg C
 		depositC:        make(chan DepositNote),
 		scannedDeposits: make(chan Deposit, cfg.DepositBufferSize),
 		done:            make(chan struct{}),
+		notifyC:         make(chan struct{}, 1),
 		Cfg:             cfg,
 		CoinType:        coinType,
 	}
@@ -108,8 +141,12 @@ func (s *BaseScanner) loadUnprocessedDeposits() error {
 }
 
 // processDeposit sends a deposit to depositC, which is read by exchange.Exchange.
-// Exchange will reply with an error or nil on the DepositNote's ErrC channel.
-// If no error is reported, the deposit will be marked as "processed".
+// Exchange will accept or reject the deposit on the DepositNote's UpdateC channel,
+// or reply with an error or nil on its ErrC channel.
+// An accepted deposit, or a deposit with no error reported, will be marked as "processed".
+// A rejected deposit is marked as "rejected" with the reason, and is not sent again.
+// Deposits invalidated by a chain reorganization are sent the same way,
+// with a Status of DepositInvalidated.
 // If this exits early, or the exchange reported an error, the deposit will
 // not be marked as processed. When restarted, unprocessed deposits will be
 // sent to the exchange for processing again.
@@ -126,17 +163,14 @@ func (s *BaseScanner) processDeposit(dv Deposit) error {
 		select {
 		case <-s.quit:
 			return errQuit
+		case update := <-dn.UpdateC:
+			return s.updateDepositStatus(log, dv, update)
 		case err, ok := <-dn.ErrC:
 			if err == nil {
 				if ok {
-					if err := s.store.SetDepositProcessed(dv.ID()); err != nil {
-						log.WithError(err).Error("SetDepositProcessed error")
-						return err
-					}
-					log.Info("Deposit is processed")
-				} else {
-					log.Warn("DepositNote.ErrC unexpectedly closed")
+					return s.updateDepositStatus(log, dv, DepositStatusUpdate{Status: DepositAccepted})
 				}
+				log.Warn("DepositNote.ErrC unexpectedly closed")
 			} else {
 				log.WithError(err).Error("DepositNote.ErrC error")
 				return err
@@ -147,11 +181,78 @@ func (s *BaseScanner) processDeposit(dv Deposit) error {
 	return nil
 }
 
-// GetScanPeriod returns scan period
+// updateDepositStatus saves the final status of a deposit, reported by the exchange
+func (s *BaseScanner) updateDepositStatus(log logrus.FieldLogger, dv Deposit, update DepositStatusUpdate) error {
+	switch update.Status {
+	case DepositAccepted:
+		if dv.Status == DepositInvalidated {
+			if err := s.store.SetDepositInvalidationProcessed(dv.ID()); err != nil {
+				log.WithError(err).Error("SetDepositInvalidationProcessed error")
+				return err
+			}
+			log.Info("Deposit invalidation is processed")
+			return nil
+		}
+
+		if err := s.store.SetDepositProcessed(dv.ID()); err != nil {
+			log.WithError(err).Error("SetDepositProcessed error")
+			return err
+		}
+		log.Info("Deposit is processed")
+
+	case DepositRejected:
+		var reason string
+		if update.Err != nil {
+			reason = update.Err.Error()
+		}
+
+		if err := s.store.SetDepositRejected(dv.ID(), reason); err != nil {
+			log.WithError(err).Error("SetDepositRejected error")
+			return err
+		}
+		log.WithError(update.Err).Warn("Deposit is rejected")
+
+	default:
+		err := fmt.Errorf("Invalid deposit status update %q", update.Status)
+		log.WithError(err).Error("DepositNote.UpdateC error")
+		return err
+	}
+
+	return nil
+}
+
+// GetScanPeriod returns scan period. While new blocks are announced by notifications,
+// the chain is only polled every NotifyScanPeriod in case a notification is missed.
 func (s *BaseScanner) GetScanPeriod() time.Duration {
+	if atomic.LoadInt32(&s.notified) == 1 {
+		return s.Cfg.NotifyScanPeriod
+	}
 	return s.Cfg.ScanPeriod
 }
 
+// GetNotifyChan returns the channel that receives a value when the scan should not wait for the scan period
+func (s *BaseScanner) GetNotifyChan() <-chan struct{} {
+	return s.notifyC
+}
+
+// Notify wakes up the scan, e.g. when a new block is announced.
+// It does not block, a pending notification is not repeated.
+func (s *BaseScanner) Notify() {
+	select {
+	case s.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+// SetNotified sets whether new blocks are announced by notifications, which changes the scan period
+func (s *BaseScanner) SetNotified(notified bool) {
+	var v int32
+	if notified {
+		v = 1
+	}
+	atomic.StoreInt32(&s.notified, v)
+}
+
 // GetStorer returns base storer
 func (s *BaseScanner) GetStorer() Storer {
 	return s.store
@@ -179,22 +280,30 @@ func (s *BaseScanner) Shutdown() {
 	close(s.depositC)
 }
 
-// Run starts the scanner
+// Run starts the scanner.
+// scanBlocks scans consecutive blocks, with their store writes batched. If it is not nil,
+// the scanner catches up with the chain with concurrently fetched blocks when it is far behind.
 func (s *BaseScanner) Run(
 	getBlockCount func() (int64, error),
 	getBlockAtHeight func(int64) (*CommonBlock, error),
 	waitForNextBlock func(*CommonBlock) (*CommonBlock, error),
 	scanBlock func(*CommonBlock) (int, error),
+	scanBlocks func([]*CommonBlock) (int, error),
 ) error {
 	log := s.log.WithField("config", s.Cfg)
 	log.Info("Start blockchain scan service")
 	defer func() {
 		log.Info("Blockchain scan service closed")
+		atomic.StoreInt32(&s.running, 0)
 		close(s.done)
 	}()
 
 	var wg sync.WaitGroup
 
+	// Deposits added by a rescan from now on are sent by the deposit pipe,
+	// the ones added before are loaded with the unprocessed deposits
+	atomic.StoreInt32(&s.running, 1)
+
 	// Load unprocessed deposits
 	log.Info("Loading unprocessed deposits")
 	if err := s.loadUnprocessedDeposits(); err != nil {
@@ -208,9 +317,9 @@ func (s *BaseScanner) Run(
 
 	// Load the initial scan block
 	log.Info("Loading the initial scan block")
-	initialBlock, err := getBlockAtHeight(s.Cfg.InitialScanHeight)
+	initialBlock, resumed, err := s.loadInitialBlock(getBlockAtHeight)
 	if err != nil {
-		log.WithError(err).Error("getBlockAtHeight failed")
+		log.WithError(err).Error("loadInitialBlock failed")
 		return err
 	}
 
@@ -218,14 +327,15 @@ func (s *BaseScanner) Run(
 	log.WithFields(logrus.Fields{
 		"initialHash":   initHash,
 		"initialHeight": initHeight,
+		"resumed":       resumed,
 	}).Info("Begin scanning blockchain")
 
-	// This loop scans for a new block every ScanPeriod.
+	// This loop scans for a new block every ScanPeriod, or when notified.
 	// When a new block is found, it compares the block against our scanning
 	// deposit addresses. If a matching deposit is found, it saves it to the DB.
 	log.Info("Launching scan goroutine")
 	wg.Add(1)
-	go func(log logrus.FieldLogger, block *CommonBlock) {
+	go func(log logrus.FieldLogger, block *CommonBlock, scanned bool) {
 		defer wg.Done()
 		defer log.Info("Scan goroutine exited")
 
@@ -235,7 +345,9 @@ func (s *BaseScanner) Run(
 			select {
 			case <-s.quit:
 				return errQuit
-			case <-time.After(s.Cfg.ScanPeriod):
+			case <-s.notifyC:
+				return nil
+			case <-time.After(s.GetScanPeriod()):
 				return nil
 			}
 		}
@@ -248,10 +360,54 @@ func (s *BaseScanner) Run(
 			default:
 			}
 
+			// Wait for the next block, if the current block was already scanned
+			if scanned {
+				nextBlock, err := waitForNextBlock(block)
+				if err != nil {
+					if err == errQuit {
+						return
+					}
+
+					log.WithError(err).Error("s.waitForNextBlock failed")
+					if wait() != nil {
+						return
+					}
+					continue
+				}
+
+				// If the next block does not build on the scanned block,
+				// the chain was reorganized
+				if nextBlock.PrevHash != "" && nextBlock.PrevHash != block.Hash {
+					log.WithFields(logrus.Fields{
+						"nextHash":     nextBlock.Hash,
+						"nextPrevHash": nextBlock.PrevHash,
+					}).Warn("Chain reorganization detected")
+
+					forkBlock, err := s.rollbackFrom(getBlockAtHeight, block.Height)
+					if err != nil {
+						if err == errQuit {
+							return
+						}
+
+						log.WithError(err).Error("s.rollback failed")
+						if wait() != nil {
+							return
+						}
+						continue
+					}
+
+					block = forkBlock
+					continue
+				}
+
+				block = nextBlock
+				scanned = false
+			}
+
 			blockHash, blockHeight := getBlockHashAndHeight(block)
 			log = log.WithFields(logrus.Fields{
-				"height": blockHash,
-				"hash":   blockHeight,
+				"height": blockHeight,
+				"hash":   blockHash,
 			})
 
 			// Check for necessary confirmations
@@ -276,6 +432,29 @@ func (s *BaseScanner) Run(
 				continue
 			}
 
+			// Catch up with the chain if it is far ahead, e.g. after downtime
+			if scanBlocks != nil && bestHeight-s.Cfg.ConfirmationsRequired-blockHeight >= catchUpThreshold {
+				lastBlock, n, err := s.catchUp(block, bestHeight-s.Cfg.ConfirmationsRequired, getBlockAtHeight, scanBlocks)
+				deposits += n
+				if lastBlock != nil {
+					block = lastBlock
+					scanned = true
+				}
+
+				if err != nil {
+					if err == errQuit {
+						return
+					}
+
+					log.WithError(err).Error("Catch up failed")
+					if wait() != nil {
+						return
+					}
+				}
+
+				continue
+			}
+
 			// Scan the block for deposits
 			n, err := scanBlock(block)
 			if err != nil {
@@ -291,27 +470,14 @@ func (s *BaseScanner) Run(
 				continue
 			}
 
+			scanned = true
 			deposits += n
 			log.WithFields(logrus.Fields{
 				"scannedDeposits":      n,
 				"totalScannedDeposits": deposits,
 			}).Infof("Scanned %d deposits from block", n)
-
-			// Wait for the next block
-			block, err = waitForNextBlock(block)
-			if err != nil {
-				if err == errQuit {
-					return
-				}
-
-				log.WithError(err).Error("s.waitForNextBlock failed")
-				if wait() != nil {
-					return
-				}
-				continue
-			}
 		}
-	}(log, initialBlock)
+	}(log, initialBlock, resumed)
 
 	// This loop gets the head deposit value (from an array saved in the db)
 	// It sends each head to depositC, which is processed by Exchange.
@@ -344,6 +510,287 @@ func (s *BaseScanner) Run(
 
 }
 
+// fetchedBlock is a block fetched by a catch up worker
+type fetchedBlock struct {
+	block *CommonBlock
+	err   error
+}
+
+// catchUp scans block and the blocks after it up to toHeight, when the scanner is far behind the chain.
+// The blocks are fetched concurrently by up to Cfg.CatchUpConcurrency workers, a bounded number of
+// them ahead of the scan. They are scanned in height order, in batches of catchUpBatchSize blocks.
+// A block that does not build on its previous block, e.g. during a chain reorganization, stops the
+// catch up, the scan loop handles it. The last scanned block is returned, or nil if none was scanned.
+func (s *BaseScanner) catchUp(
+	block *CommonBlock,
+	toHeight int64,
+	getBlockAtHeight func(int64) (*CommonBlock, error),
+	scanBlocks func([]*CommonBlock) (int, error),
+) (*CommonBlock, int, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"fromHeight":  block.Height,
+		"toHeight":    toHeight,
+		"concurrency": s.Cfg.CatchUpConcurrency,
+	})
+	log.Info("Catching up with the chain")
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	defer func() {
+		close(stop)
+		workers.Wait()
+	}()
+
+	// The fetch results are queued in height order. The queue is bounded,
+	// so that no more than 2 * Cfg.CatchUpConcurrency blocks are fetched ahead.
+	fetched := make(chan chan fetchedBlock, s.Cfg.CatchUpConcurrency)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		defer close(fetched)
+
+		sem := make(chan struct{}, s.Cfg.CatchUpConcurrency)
+		for height := block.Height + 1; height <= toHeight; height++ {
+			c := make(chan fetchedBlock, 1)
+			select {
+			case <-stop:
+				return
+			case fetched <- c:
+			}
+
+			select {
+			case <-stop:
+				return
+			case sem <- struct{}{}:
+			}
+
+			workers.Add(1)
+			go func(height int64) {
+				defer workers.Done()
+				defer func() { <-sem }()
+				b, err := getBlockAtHeight(height)
+				c <- fetchedBlock{b, err}
+			}(height)
+		}
+	}()
+
+	var lastBlock *CommonBlock
+	deposits := 0
+	batch := []*CommonBlock{block}
+	prev := block
+
+	flush := func() error {
+		n, err := scanBlocks(batch)
+		if err != nil {
+			return err
+		}
+
+		deposits += n
+		lastBlock = batch[len(batch)-1]
+		batch = batch[:0]
+
+		log.WithFields(logrus.Fields{
+			"height":               lastBlock.Height,
+			"totalScannedDeposits": deposits,
+		}).Info("Caught up to height")
+		return nil
+	}
+
+	for c := range fetched {
+		var fb fetchedBlock
+		select {
+		case <-s.quit:
+			return lastBlock, deposits, errQuit
+		case fb = <-c:
+		}
+
+		if fb.err != nil {
+			log.WithError(fb.err).Error("getBlockAtHeight failed")
+			if len(batch) > 0 {
+				if err := flush(); err != nil {
+					return lastBlock, deposits, err
+				}
+			}
+			return lastBlock, deposits, fb.err
+		}
+
+		if fb.block.PrevHash != "" && fb.block.PrevHash != prev.Hash {
+			log.WithFields(logrus.Fields{
+				"height":   fb.block.Height,
+				"prevHash": fb.block.PrevHash,
+			}).Warn("Block does not build on the previous block, stopping the catch up")
+			break
+		}
+
+		batch = append(batch, fb.block)
+		prev = fb.block
+		if len(batch) == catchUpBatchSize {
+			if err := flush(); err != nil {
+				return lastBlock, deposits, err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return lastBlock, deposits, err
+		}
+	}
+
+	log.WithField("totalScannedDeposits", deposits).Info("Caught up with the chain")
+	return lastBlock, deposits, nil
+}
+
+// loadInitialBlock returns the block to begin scanning from.
+// If a last scanned block was recorded, that block is returned and
+// the returned bool is true, indicating that it was already scanned.
+// Otherwise, the block at Cfg.InitialScanHeight is returned.
+func (s *BaseScanner) loadInitialBlock(getBlockAtHeight func(int64) (*CommonBlock, error)) (*CommonBlock, bool, error) {
+	lsb, err := s.store.GetLastScannedBlock(s.CoinType)
+	if err != nil {
+		s.log.WithError(err).Error("GetLastScannedBlock failed")
+		return nil, false, err
+	}
+
+	if lsb == nil {
+		block, err := getBlockAtHeight(s.Cfg.InitialScanHeight)
+		if err != nil {
+			s.log.WithError(err).Error("getBlockAtHeight failed")
+			return nil, false, err
+		}
+
+		return block, false, nil
+	}
+
+	log := s.log.WithFields(logrus.Fields{
+		"lastScannedHeight": lsb.Height,
+		"lastScannedHash":   lsb.Hash,
+	})
+	log.Info("Resuming from the last scanned block")
+
+	block, err := getBlockAtHeight(lsb.Height)
+	if err != nil {
+		log.WithError(err).Error("getBlockAtHeight failed")
+		return nil, false, err
+	}
+
+	if block.Hash != lsb.Hash {
+		log.WithField("blockHash", block.Hash).Warn("Last scanned block hash does not match the block at its height, chain reorganization detected")
+
+		block, err = s.rollbackFrom(getBlockAtHeight, lsb.Height)
+		if err != nil {
+			log.WithError(err).Error("s.rollback failed")
+			return nil, false, err
+		}
+	}
+
+	return block, true, nil
+}
+
+// rollbackFrom rolls back to the fork point of a chain reorganization detected
+// above the scanned block at lastHeight. If no fork point is found in the recently
+// scanned blocks, because they are not recorded in a db written before they were,
+// or they were all orphaned, it resumes from before the blocks they would cover.
+// Deposits that are still in the chain are recorded again when it is rescanned.
+func (s *BaseScanner) rollbackFrom(getBlockAtHeight func(int64) (*CommonBlock, error), lastHeight int64) (*CommonBlock, error) {
+	block, err := s.rollback(getBlockAtHeight)
+	if err != ErrReorgTooDeep {
+		return block, err
+	}
+
+	height := lastHeight - scannedBlocksWindow
+	if height < 0 {
+		height = 0
+	}
+
+	s.log.WithError(err).WithFields(logrus.Fields{
+		"lastScannedHeight": lastHeight,
+		"forkHeight":        height,
+	}).Warn("No fork point found in the recently scanned blocks, resuming from an earlier block")
+
+	block, err = getBlockAtHeight(height)
+	if err != nil {
+		s.log.WithError(err).Error("getBlockAtHeight failed")
+		return nil, err
+	}
+
+	if err := s.rollbackTo(block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// rollback walks back the recently scanned blocks until it finds the fork point,
+// the most recent scanned block that is still in the chain. Deposits of the
+// orphaned blocks are invalidated and sent to the exchange.
+// The fork point block is returned, scanning continues from its next block.
+func (s *BaseScanner) rollback(getBlockAtHeight func(int64) (*CommonBlock, error)) (*CommonBlock, error) {
+	blocks, err := s.store.GetRecentScannedBlocks(s.CoinType)
+	if err != nil {
+		s.log.WithError(err).Error("GetRecentScannedBlocks failed")
+		return nil, err
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		log := s.log.WithFields(logrus.Fields{
+			"height": blocks[i].Height,
+			"hash":   blocks[i].Hash,
+		})
+
+		block, err := getBlockAtHeight(blocks[i].Height)
+		if err != nil {
+			log.WithError(err).Error("getBlockAtHeight failed")
+			return nil, err
+		}
+
+		if block.Hash != blocks[i].Hash {
+			log.WithField("chainHash", block.Hash).Info("Scanned block was orphaned")
+			continue
+		}
+
+		log.Info("Found chain reorganization fork point")
+
+		if err := s.rollbackTo(block); err != nil {
+			return nil, err
+		}
+
+		return block, nil
+	}
+
+	return nil, ErrReorgTooDeep
+}
+
+// rollbackTo rolls the scanned blocks back to a fork point block.
+// Deposits of the blocks above it are invalidated and sent to the exchange.
+func (s *BaseScanner) rollbackTo(forkBlock *CommonBlock) error {
+	log := s.log.WithFields(logrus.Fields{
+		"height": forkBlock.Height,
+		"hash":   forkBlock.Hash,
+	})
+
+	dvs, err := s.store.RollbackScannedBlocks(s.CoinType, ScannedBlock{
+		Height: forkBlock.Height,
+		Hash:   forkBlock.Hash,
+	})
+	if err != nil {
+		log.WithError(err).Error("RollbackScannedBlocks failed")
+		return err
+	}
+
+	log.WithField("invalidatedDeposits", len(dvs)).Warnf("Invalidated %d deposits from orphaned blocks", len(dvs))
+
+	for _, dv := range dvs {
+		select {
+		case <-s.quit:
+			return errQuit
+		case s.scannedDeposits <- dv:
+		}
+	}
+
+	return nil
+}
+
 func getBlockHashAndHeight(block *CommonBlock) (string, int64) {
 	return block.Hash, block.Height
 }
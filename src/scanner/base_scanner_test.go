@@ -0,0 +1,700 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+// fakeChain returns CommonBlocks with hashes derived from a chain name,
+// so that a reorganized chain can be simulated from a fork height
+type fakeChain struct {
+	name       string
+	forkHeight int64
+	height     int64
+}
+
+func (c *fakeChain) hash(height int64) string {
+	if height <= c.forkHeight {
+		return fmt.Sprintf("main-%d", height)
+	}
+	return fmt.Sprintf("%s-%d", c.name, height)
+}
+
+func (c *fakeChain) getBlockAtHeight(height int64) (*CommonBlock, error) {
+	if height > c.height {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+
+	b := &CommonBlock{
+		Height: height,
+		Hash:   c.hash(height),
+		RawTx: []CommonTx{
+			{
+				Txid: c.hash(height),
+				Vout: []CommonVout{
+					{
+						Value:     100,
+						Addresses: []string{"a1"},
+					},
+				},
+			},
+		},
+	}
+
+	if height > 0 {
+		b.PrevHash = c.hash(height - 1)
+	}
+
+	return b, nil
+}
+
+func setupBaseScanner(t *testing.T) (*BaseScanner, func()) {
+	db, shutdown := testutil.PrepareDB(t)
+
+	log, _ := testutil.NewLogger(t)
+
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+	err = store.AddScanAddress("a1", CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	s := NewBaseScanner(store, log, CoinTypeBTC, Config{
+		ScanPeriod:        time.Millisecond * 10,
+		DepositBufferSize: 10,
+	})
+
+	return s, shutdown
+}
+
+func TestBaseScannerRollback(t *testing.T) {
+	s, shutdown := setupBaseScanner(t)
+	defer shutdown()
+
+	mainChain := &fakeChain{
+		name:       "main",
+		forkHeight: 10,
+		height:     10,
+	}
+
+	for i := int64(0); i <= mainChain.height; i++ {
+		b, err := mainChain.getBlockAtHeight(i)
+		require.NoError(t, err)
+		_, err = s.store.ScanBlock(b, CoinTypeBTC)
+		require.NoError(t, err)
+	}
+
+	// The chain is reorganized from height 8
+	reorgChain := &fakeChain{
+		name:       "reorg",
+		forkHeight: 7,
+		height:     11,
+	}
+
+	forkBlock, err := s.rollback(reorgChain.getBlockAtHeight)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), forkBlock.Height)
+	require.Equal(t, "main-7", forkBlock.Hash)
+
+	// Deposits from the orphaned blocks are sent for processing as invalidated
+	require.Len(t, s.scannedDeposits, 3)
+	var txs []string
+	for i := 0; i < 3; i++ {
+		dv := <-s.scannedDeposits
+		require.Equal(t, DepositInvalidated, dv.Status)
+		txs = append(txs, dv.Tx)
+	}
+	require.ElementsMatch(t, []string{"main-8", "main-9", "main-10"}, txs)
+
+	lsb, err := s.store.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, &ScannedBlock{
+		Height: 7,
+		Hash:   "main-7",
+	}, lsb)
+
+	// A reorganization deeper than the recently scanned blocks cannot be rolled back
+	deepChain := &fakeChain{
+		name:       "deep",
+		forkHeight: -1,
+		height:     11,
+	}
+	_, err = s.rollback(deepChain.getBlockAtHeight)
+	require.Equal(t, ErrReorgTooDeep, err)
+}
+
+func TestBaseScannerLoadInitialBlockReorgTooDeep(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+	err = store.AddScanAddress("a1", CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	s := NewBaseScanner(store, log, CoinTypeBTC, Config{
+		DepositBufferSize: scannedBlocksWindow,
+	})
+
+	mainChain := &fakeChain{
+		name:       "main",
+		forkHeight: scannedBlocksWindow + 4,
+		height:     scannedBlocksWindow + 4,
+	}
+
+	for i := int64(0); i <= mainChain.height; i++ {
+		b, err := mainChain.getBlockAtHeight(i)
+		require.NoError(t, err)
+		_, err = store.ScanBlock(b, CoinTypeBTC)
+		require.NoError(t, err)
+	}
+
+	// The recently scanned blocks are not recorded in a db written before they were
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(MustGetScanMetaBkt(CoinTypeBTC)).Delete([]byte(recentScannedBlocksKey))
+	})
+	require.NoError(t, err)
+
+	// The last scanned block was orphaned
+	reorgChain := &fakeChain{
+		name:       "reorg",
+		forkHeight: mainChain.height - 1,
+		height:     mainChain.height + 1,
+	}
+
+	block, resumed, err := s.loadInitialBlock(reorgChain.getBlockAtHeight)
+	require.NoError(t, err)
+	require.True(t, resumed)
+	require.Equal(t, int64(4), block.Height)
+	require.Equal(t, "main-4", block.Hash)
+
+	lsb, err := store.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, &ScannedBlock{
+		Height: 4,
+		Hash:   "main-4",
+	}, lsb)
+
+	// Deposits above the block are invalidated, they are recorded again when the blocks are rescanned
+	require.Len(t, s.scannedDeposits, scannedBlocksWindow)
+	for i := 0; i < scannedBlocksWindow; i++ {
+		dv := <-s.scannedDeposits
+		require.Equal(t, DepositInvalidated, dv.Status)
+	}
+
+	b, err := reorgChain.getBlockAtHeight(5)
+	require.NoError(t, err)
+	dvs, err := store.ScanBlock(b, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.Equal(t, DepositNotProcessed, dvs[0].Status)
+}
+
+func TestBaseScannerRunDetectsReorg(t *testing.T) {
+	s, shutdown := setupBaseScanner(t)
+	defer shutdown()
+
+	chain := &fakeChain{
+		name:       "main",
+		forkHeight: 5,
+		height:     5,
+	}
+
+	reorged := make(chan struct{})
+	var reorgOnce bool
+
+	getBlockCount := func() (int64, error) {
+		return chain.height, nil
+	}
+
+	getBlockAtHeight := func(height int64) (*CommonBlock, error) {
+		return chain.getBlockAtHeight(height)
+	}
+
+	waitForNextBlock := func(b *CommonBlock) (*CommonBlock, error) {
+		for {
+			if nb, err := chain.getBlockAtHeight(b.Height + 1); err == nil {
+				return nb, nil
+			}
+
+			// Once the main chain is scanned to the tip, switch to a reorganized chain
+			if !reorgOnce {
+				reorgOnce = true
+				chain = &fakeChain{
+					name:       "reorg",
+					forkHeight: 3,
+					height:     6,
+				}
+				close(reorged)
+				continue
+			}
+
+			select {
+			case <-s.quit:
+				return nil, errQuit
+			case <-time.After(s.Cfg.ScanPeriod):
+			}
+		}
+	}
+
+	scanBlock := func(b *CommonBlock) (int, error) {
+		dvs, err := s.store.ScanBlock(b, CoinTypeBTC)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, dv := range dvs {
+			s.scannedDeposits <- dv
+		}
+
+		return len(dvs), nil
+	}
+
+	var dvs []DepositNote
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for dn := range s.GetDeposit() {
+			dvs = append(dvs, dn)
+			dn.ErrC <- nil
+		}
+	}()
+
+	go func() {
+		<-reorged
+		time.Sleep(time.Millisecond * 500)
+		s.Shutdown()
+	}()
+
+	err := s.Run(getBlockCount, getBlockAtHeight, waitForNextBlock, scanBlock, nil)
+	require.NoError(t, err)
+	<-done
+
+	// main-0 ... main-5 are scanned, main-4 and main-5 are invalidated,
+	// then reorg-4 ... reorg-6 are scanned
+	var invalidated []string
+	var scanned []string
+	for _, dn := range dvs {
+		if dn.Status == DepositInvalidated {
+			invalidated = append(invalidated, dn.Tx)
+		} else {
+			scanned = append(scanned, dn.Tx)
+		}
+	}
+
+	require.Equal(t, []string{"main-4", "main-5"}, invalidated)
+	require.Equal(t, []string{
+		"main-0",
+		"main-1",
+		"main-2",
+		"main-3",
+		"main-4",
+		"main-5",
+		"reorg-4",
+		"reorg-5",
+		"reorg-6",
+	}, scanned)
+
+	lsb, err := s.store.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, "reorg-6", lsb.Hash)
+}
+
+func TestBaseScannerRunReorgTooDeep(t *testing.T) {
+	s, shutdown := setupBaseScanner(t)
+	defer shutdown()
+
+	chain := &fakeChain{
+		name:       "main",
+		forkHeight: scannedBlocksWindow + 5,
+		height:     scannedBlocksWindow + 5,
+	}
+
+	// The reorganized chain forks below all of the recently scanned blocks
+	reorgChain := &fakeChain{
+		name:       "reorg",
+		forkHeight: 2,
+		height:     scannedBlocksWindow + 6,
+	}
+
+	var reorgOnce bool
+
+	getBlockCount := func() (int64, error) {
+		return chain.height, nil
+	}
+
+	getBlockAtHeight := func(height int64) (*CommonBlock, error) {
+		return chain.getBlockAtHeight(height)
+	}
+
+	waitForNextBlock := func(b *CommonBlock) (*CommonBlock, error) {
+		for {
+			if nb, err := chain.getBlockAtHeight(b.Height + 1); err == nil {
+				return nb, nil
+			}
+
+			// Once the main chain is scanned to the tip, switch to the reorganized chain
+			if !reorgOnce {
+				reorgOnce = true
+				chain = reorgChain
+				continue
+			}
+
+			select {
+			case <-s.quit:
+				return nil, errQuit
+			case <-time.After(s.Cfg.ScanPeriod):
+			}
+		}
+	}
+
+	scanBlock := func(b *CommonBlock) (int, error) {
+		dvs, err := s.store.ScanBlock(b, CoinTypeBTC)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, dv := range dvs {
+			s.scannedDeposits <- dv
+		}
+
+		return len(dvs), nil
+	}
+
+	// Shutdown once the deposit in the tip of the reorganized chain is received
+	tip := reorgChain.hash(reorgChain.height)
+	var dvs []DepositNote
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for dn := range s.GetDeposit() {
+			dvs = append(dvs, dn)
+			dn.ErrC <- nil
+			if dn.Tx == tip {
+				go s.Shutdown()
+			}
+		}
+	}()
+
+	err := s.Run(getBlockCount, getBlockAtHeight, waitForNextBlock, scanBlock, nil)
+	require.NoError(t, err)
+	<-done
+
+	// The scanner resumes from scannedBlocksWindow blocks below the last scanned block,
+	// the deposits above it are invalidated and the reorganized chain is scanned from there
+	var invalidated []string
+	var scanned []string
+	for _, dn := range dvs {
+		if dn.Status == DepositInvalidated {
+			invalidated = append(invalidated, dn.Tx)
+		} else {
+			scanned = append(scanned, dn.Tx)
+		}
+	}
+
+	var expectInvalidated []string
+	for i := int64(6); i <= scannedBlocksWindow+5; i++ {
+		expectInvalidated = append(expectInvalidated, fmt.Sprintf("main-%d", i))
+	}
+	require.ElementsMatch(t, expectInvalidated, invalidated)
+
+	var expectScanned []string
+	for i := int64(0); i <= scannedBlocksWindow+5; i++ {
+		expectScanned = append(expectScanned, fmt.Sprintf("main-%d", i))
+	}
+	for i := int64(6); i <= scannedBlocksWindow+6; i++ {
+		expectScanned = append(expectScanned, fmt.Sprintf("reorg-%d", i))
+	}
+	require.Equal(t, expectScanned, scanned)
+
+	lsb, err := s.store.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, tip, lsb.Hash)
+}
+
+func TestBaseScannerNotify(t *testing.T) {
+	s, shutdown := setupBaseScanner(t)
+	defer shutdown()
+
+	s.Cfg.ScanPeriod = time.Hour
+	s.Cfg.ConfirmationsRequired = 1
+
+	// The scan period is longer while new blocks are notified
+	s.SetNotified(true)
+	require.Equal(t, notifyScanPeriod, s.GetScanPeriod())
+	s.SetNotified(false)
+	require.Equal(t, time.Hour, s.GetScanPeriod())
+
+	chain := &fakeChain{
+		name:       "main",
+		forkHeight: 0,
+		height:     0,
+	}
+
+	var bestHeight int64
+	getBlockCount := func() (int64, error) {
+		return atomic.LoadInt64(&bestHeight), nil
+	}
+
+	waitForNextBlock := func(b *CommonBlock) (*CommonBlock, error) {
+		<-s.quit
+		return nil, errQuit
+	}
+
+	scanBlock := func(b *CommonBlock) (int, error) {
+		dvs, err := s.store.ScanBlock(b, CoinTypeBTC)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, dv := range dvs {
+			s.scannedDeposits <- dv
+		}
+
+		return len(dvs), nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := s.Run(getBlockCount, chain.getBlockAtHeight, waitForNextBlock, scanBlock, nil)
+		require.NoError(t, err)
+	}()
+
+	// Block 0 waits for a confirmation, which is announced long before the scan period elapses
+	time.Sleep(time.Millisecond * 50)
+	atomic.StoreInt64(&bestHeight, 1)
+	s.Notify()
+
+	select {
+	case dn := <-s.GetDeposit():
+		require.Equal(t, "main-0", dn.Tx)
+		dn.ErrC <- nil
+	case <-time.After(time.Second * 5):
+		t.Fatal("Notify did not wake up the scan")
+	}
+
+	s.Shutdown()
+	<-done
+}
+
+func TestBaseScannerDepositStatusUpdate(t *testing.T) {
+	s, shutdown := setupBaseScanner(t)
+	defer shutdown()
+
+	dvs, err := s.store.ScanBlock(&CommonBlock{
+		Height: 1,
+		Hash:   "hash1",
+		RawTx: []CommonTx{
+			{
+				Txid: "tx1",
+				Vout: []CommonVout{
+					{Value: 100, Addresses: []string{"a1"}},
+					{Value: 100, N: 1, Addresses: []string{"a1"}},
+					{Value: 100, N: 2, Addresses: []string{"a1"}},
+				},
+			},
+		},
+	}, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 3)
+
+	errNotBound := errors.New("Deposit has no bound skycoin address")
+	replies := map[string]func(DepositNote){
+		"tx1:0": func(dn DepositNote) { dn.Accept() },
+		"tx1:1": func(dn DepositNote) { dn.Reject(errNotBound) },
+		"tx1:2": func(dn DepositNote) { dn.ErrC <- errors.New("db is locked") },
+	}
+
+	for _, dv := range dvs {
+		errC := make(chan error, 1)
+		go func(dv Deposit) {
+			errC <- s.processDeposit(dv)
+		}(dv)
+
+		dn := <-s.GetDeposit()
+		require.Equal(t, dv, dn.Deposit)
+		replies[dv.ID()](dn)
+
+		err := <-errC
+		if dv.ID() == "tx1:2" {
+			require.Error(t, err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	// The rejected deposit is recorded with the reason, the failed deposit is processed again
+	rdvs, err := s.store.(*Store).GetRejectedDeposits()
+	require.NoError(t, err)
+	require.Len(t, rdvs, 1)
+	require.Equal(t, "tx1:1", rdvs[0].ID())
+	require.Equal(t, errNotBound.Error(), rdvs[0].RejectReason)
+
+	udvs, err := s.store.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 1)
+	require.Equal(t, "tx1:2", udvs[0].ID())
+}
+
+func TestBaseScannerCatchUp(t *testing.T) {
+	s, shutdown := setupBaseScanner(t)
+	defer shutdown()
+
+	s.Cfg.CatchUpConcurrency = 3
+
+	chain := &fakeChain{
+		name:       "main",
+		forkHeight: 60,
+		height:     60,
+	}
+
+	getBlockCount := func() (int64, error) {
+		return chain.height, nil
+	}
+
+	var mu sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	// Height 25 is fetched from another chain once, and fetching height 40 fails once
+	failed := map[int64]bool{}
+	getBlockAtHeight := func(height int64) (*CommonBlock, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		fail := (height == 25 || height == 40) && !failed[height]
+		failed[height] = true
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		time.Sleep(time.Millisecond)
+
+		if fail && height == 40 {
+			return nil, errors.New("getBlockAtHeight failed")
+		}
+
+		b, err := chain.getBlockAtHeight(height)
+		if err == nil && fail {
+			b.Hash = fmt.Sprintf("other-%d", height)
+			b.PrevHash = fmt.Sprintf("other-%d", height-1)
+		}
+		return b, err
+	}
+
+	waitForNextBlock := func(b *CommonBlock) (*CommonBlock, error) {
+		for {
+			if nb, err := chain.getBlockAtHeight(b.Height + 1); err == nil {
+				return nb, nil
+			}
+
+			select {
+			case <-s.quit:
+				return nil, errQuit
+			case <-time.After(s.Cfg.ScanPeriod):
+			}
+		}
+	}
+
+	var scanned []int64
+	scanBlock := func(b *CommonBlock) (int, error) {
+		scanned = append(scanned, b.Height)
+
+		dvs, err := s.store.ScanBlock(b, CoinTypeBTC)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, dv := range dvs {
+			s.scannedDeposits <- dv
+		}
+
+		return len(dvs), nil
+	}
+
+	var batches [][]int64
+	scanBlocks := func(bs []*CommonBlock) (int, error) {
+		var heights []int64
+		for _, b := range bs {
+			heights = append(heights, b.Height)
+		}
+		batches = append(batches, heights)
+		scanned = append(scanned, heights...)
+
+		dvs, err := s.store.ScanBlocks(bs, CoinTypeBTC)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, dv := range dvs {
+			s.scannedDeposits <- dv
+		}
+
+		return len(dvs), nil
+	}
+
+	var txs []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for dn := range s.GetDeposit() {
+			txs = append(txs, dn.Tx)
+			dn.ErrC <- nil
+			if len(txs) == int(chain.height)+1 {
+				go s.Shutdown()
+			}
+		}
+	}()
+
+	err := s.Run(getBlockCount, getBlockAtHeight, waitForNextBlock, scanBlock, scanBlocks)
+	require.NoError(t, err)
+	<-done
+
+	// Every block is scanned once, in height order
+	var expectedTxs []string
+	var expectedScanned []int64
+	for i := int64(0); i <= chain.height; i++ {
+		expectedTxs = append(expectedTxs, fmt.Sprintf("main-%d", i))
+		expectedScanned = append(expectedScanned, i)
+	}
+	require.Equal(t, expectedTxs, txs)
+	require.Equal(t, expectedScanned, scanned)
+
+	// The blocks are written in batches. The block from another chain stops the first catch up,
+	// the scan loop gets the block at its height again and catches up from it.
+	// The failed fetch stops the second catch up, which is retried after the scan period.
+	require.Equal(t, [][]int64{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19},
+		{20, 21, 22, 23, 24},
+		{25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39},
+		{40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59},
+		{60},
+	}, batches)
+
+	require.True(t, maxInFlight > 1)
+	require.True(t, maxInFlight <= 3)
+
+	lsb, err := s.store.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, "main-60", lsb.Hash)
+}
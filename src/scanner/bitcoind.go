@@ -0,0 +1,304 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+const bitcoindRequestTimeout = time.Second * 30
+
+// ErrBitcoindUnauthorized is returned if bitcoind rejects the RPC credentials
+var ErrBitcoindUnauthorized = errors.New("bitcoind RPC authentication failed, check the user and password or the cookie file")
+
+// BitcoindConfig configures a BitcoindClient
+type BitcoindConfig struct {
+	// Server is the host:port of the bitcoind RPC server
+	Server string
+	// User and Pass are the rpcuser and rpcpassword of bitcoind
+	User string
+	Pass string
+	// CookiePath is the path of bitcoind's .cookie file, used instead of User and Pass if set
+	CookiePath string
+	// Params are the chain params used to encode addresses that bitcoind does not decode
+	Params *chaincfg.Params
+}
+
+// BitcoindClient implements the BtcRPCClient interface for a bitcoind JSON-RPC server over HTTP.
+// Blocks are fetched with getblock verbosity 2, which does not need txindex.
+type BitcoindClient struct {
+	cfg        BitcoindConfig
+	httpClient *http.Client
+	id         uint64
+}
+
+// NewBitcoindClient creates a BitcoindClient
+func NewBitcoindClient(cfg BitcoindConfig) *BitcoindClient {
+	if cfg.Params == nil {
+		cfg.Params = &chaincfg.MainNetParams
+	}
+
+	return &BitcoindClient{
+		cfg: cfg,
+		httpClient: &http.Client{
+			Timeout: bitcoindRequestTimeout,
+		},
+	}
+}
+
+type bitcoindRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type bitcoindResponse struct {
+	Result json.RawMessage   `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+}
+
+// credentials returns the RPC user and password. The cookie file is read for each request,
+// since bitcoind writes a new one each time it starts.
+func (c *BitcoindClient) credentials() (string, string, error) {
+	if c.cfg.CookiePath == "" {
+		return c.cfg.User, c.cfg.Pass, nil
+	}
+
+	cookie, err := ioutil.ReadFile(c.cfg.CookiePath)
+	if err != nil {
+		return "", "", fmt.Errorf("Read bitcoind cookie file failed: %v", err)
+	}
+
+	pts := strings.SplitN(strings.TrimSpace(string(cookie)), ":", 2)
+	if len(pts) != 2 {
+		return "", "", errors.New("Invalid bitcoind cookie file")
+	}
+
+	return pts[0], pts[1], nil
+}
+
+// call calls a bitcoind RPC method and decodes its result into v.
+// An error reported by bitcoind is returned as a *btcjson.RPCError.
+func (c *BitcoindClient) call(method string, v interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	body, err := json.Marshal(bitcoindRequest{
+		JSONRPC: "1.0",
+		ID:      atomic.AddUint64(&c.id, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	user, pass, err := c.credentials()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+c.cfg.Server, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(user, pass)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrBitcoindUnauthorized
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// bitcoind replies to failed calls with an error status and a JSON-RPC error
+	var rpcResp bitcoindResponse
+	if err := json.Unmarshal(respBody, &rpcResp); err != nil {
+		return fmt.Errorf("bitcoind %s failed: %s: %s", method, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	if rpcResp.Error != nil {
+		return rpcResp.Error
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(rpcResp.Result, v)
+}
+
+type bitcoindScriptPubKey struct {
+	Hex  string `json:"hex"`
+	Type string `json:"type"`
+	// Address is set by bitcoind v22 and later
+	Address string `json:"address"`
+	// Addresses is set by bitcoind before v22
+	Addresses []string `json:"addresses"`
+}
+
+type bitcoindVout struct {
+	Value        float64              `json:"value"`
+	N            uint32               `json:"n"`
+	ScriptPubKey bitcoindScriptPubKey `json:"scriptPubKey"`
+}
+
+type bitcoindTx struct {
+	Txid          string         `json:"txid"`
+	Hash          string         `json:"hash"`
+	Vout          []bitcoindVout `json:"vout"`
+	BlockHash     string         `json:"blockhash"`
+	Confirmations int64          `json:"confirmations"`
+	Time          int64          `json:"time"`
+	Blocktime     int64          `json:"blocktime"`
+}
+
+type bitcoindBlock struct {
+	Hash string `json:"hash"`
+	// Confirmations is -1 if the block is not in the main chain
+	Confirmations int64        `json:"confirmations"`
+	Height        int64        `json:"height"`
+	Time          int64        `json:"time"`
+	PreviousHash  string       `json:"previousblockhash"`
+	NextHash      string       `json:"nextblockhash"`
+	Tx            []bitcoindTx `json:"tx"`
+}
+
+// GetBlockVerboseTx returns a block with its transactions, in the form returned by btcd
+func (c *BitcoindClient) GetBlockVerboseTx(hash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+	var b bitcoindBlock
+	if err := c.call("getblock", &b, hash.String(), 2); err != nil {
+		return nil, err
+	}
+
+	block := &btcjson.GetBlockVerboseResult{
+		Hash:         b.Hash,
+		Height:       b.Height,
+		Time:         b.Time,
+		PreviousHash: b.PreviousHash,
+		NextHash:     b.NextHash,
+		RawTx:        make([]btcjson.TxRawResult, 0, len(b.Tx)),
+	}
+
+	if b.Confirmations > 0 {
+		block.Confirmations = uint64(b.Confirmations)
+	}
+
+	for _, tx := range b.Tx {
+		block.RawTx = append(block.RawTx, c.convertTx(tx))
+	}
+
+	return block, nil
+}
+
+// GetBlockHash returns the hash of the block at a height in the main chain
+func (c *BitcoindClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	var hash string
+	if err := c.call("getblockhash", &hash, height); err != nil {
+		return nil, err
+	}
+
+	return chainhash.NewHashFromStr(hash)
+}
+
+// GetBlockCount returns the height of the main chain
+func (c *BitcoindClient) GetBlockCount() (int64, error) {
+	var n int64
+	if err := c.call("getblockcount", &n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// GetRawMempoolVerbose returns the transactions in the mempool, by txid
+func (c *BitcoindClient) GetRawMempoolVerbose() (map[string]btcjson.GetRawMempoolVerboseResult, error) {
+	var mempool map[string]btcjson.GetRawMempoolVerboseResult
+	if err := c.call("getrawmempool", &mempool, true); err != nil {
+		return nil, err
+	}
+
+	return mempool, nil
+}
+
+// GetRawTransactionVerbose returns a transaction. Without txindex, bitcoind only finds
+// the transactions in the mempool, and returns ErrRPCNoTxInfo for the others.
+func (c *BitcoindClient) GetRawTransactionVerbose(hash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+	var tx bitcoindTx
+	if err := c.call("getrawtransaction", &tx, hash.String(), true); err != nil {
+		return nil, err
+	}
+
+	rawTx := c.convertTx(tx)
+	return &rawTx, nil
+}
+
+// Shutdown does nothing, the client has no connection to close
+func (c *BitcoindClient) Shutdown() {
+}
+
+func (c *BitcoindClient) convertTx(tx bitcoindTx) btcjson.TxRawResult {
+	rawTx := btcjson.TxRawResult{
+		Txid:      tx.Txid,
+		Hash:      tx.Hash,
+		BlockHash: tx.BlockHash,
+		Time:      tx.Time,
+		Blocktime: tx.Blocktime,
+		Vout:      make([]btcjson.Vout, 0, len(tx.Vout)),
+	}
+
+	if tx.Confirmations > 0 {
+		rawTx.Confirmations = uint64(tx.Confirmations)
+	}
+
+	for _, v := range tx.Vout {
+		rawTx.Vout = append(rawTx.Vout, btcjson.Vout{
+			Value: v.Value,
+			N:     v.N,
+			ScriptPubKey: btcjson.ScriptPubKeyResult{
+				Hex:       v.ScriptPubKey.Hex,
+				Type:      v.ScriptPubKey.Type,
+				Addresses: scriptPubKeyAddresses(v.ScriptPubKey, c.cfg.Params),
+			},
+		})
+	}
+
+	return rawTx
+}
+
+// scriptPubKeyAddresses returns the addresses of an output script.
+// bitcoind v22 and later set address, older versions set addresses.
+// If neither is set, e.g. for segwit outputs with versions that do not decode them,
+// the address is decoded from the script for the standard script types.
+func scriptPubKeyAddresses(spk bitcoindScriptPubKey, params *chaincfg.Params) []string {
+	if spk.Address != "" {
+		return []string{spk.Address}
+	}
+
+	if len(spk.Addresses) != 0 {
+		return spk.Addresses
+	}
+
+	return scriptHexAddresses(spk.Hex, params)
+}
@@ -0,0 +1,405 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+const (
+	bitcoindTestBlockHash = "0000000000000000000b6a3c1e7e9d4a2f9b3d9f3a1f4c9e6c1b0a9d8e7f6a5b"
+	bitcoindTestPrevHash  = "00000000000000000004c2a1f5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6"
+	bitcoindTestMempoolTx = "d61be86942d69dc7ba6d49c817957ecd0918798f030c73739206e6f48fe2a7c5"
+)
+
+// bitcoindTestBlock is the result of getblock verbosity 2, with the address fields of different bitcoind versions
+var bitcoindTestBlock = `{
+	"hash": "` + bitcoindTestBlockHash + `",
+	"confirmations": 2,
+	"height": 600000,
+	"time": 1573000000,
+	"previousblockhash": "` + bitcoindTestPrevHash + `",
+	"tx": [
+		{
+			"txid": "239e007dc20805add047d305cdfb87de1bae9bea1e47acbf58f38731ad58d70d",
+			"hash": "239e007dc20805add047d305cdfb87de1bae9bea1e47acbf58f38731ad58d70d",
+			"vin": [{"coinbase": "03c0270904"}],
+			"vout": [
+				{
+					"value": 12.5,
+					"n": 0,
+					"scriptPubKey": {
+						"asm": "0 751e76e8199196d454941c45d1b3a323f1433bd6",
+						"hex": "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+						"type": "witness_v0_keyhash",
+						"address": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+					}
+				},
+				{
+					"value": 0,
+					"n": 1,
+					"scriptPubKey": {
+						"asm": "OP_RETURN aa21a9ed",
+						"hex": "6a04aa21a9ed",
+						"type": "nulldata"
+					}
+				}
+			]
+		},
+		{
+			"txid": "bf41a5352b6d59a401cd946432117b25fd5fc43186aef5cbbe3170c40050d104",
+			"hash": "bf41a5352b6d59a401cd946432117b25fd5fc43186aef5cbbe3170c40050d104",
+			"vout": [
+				{
+					"value": 0.1,
+					"n": 0,
+					"scriptPubKey": {
+						"hex": "76a914e7c1345fc8f87c68170b3aa798a956c2fe6a9eff88ac",
+						"type": "pubkeyhash",
+						"reqSigs": 1,
+						"addresses": ["1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA"]
+					}
+				}
+			]
+		},
+		{
+			"txid": "d61be86942d69dc7ba6d49c817957ecd0918798f030c73739206e6f48fe2a7c6",
+			"hash": "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+			"vout": [
+				{
+					"value": 0.002,
+					"n": 0,
+					"scriptPubKey": {
+						"hex": "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262",
+						"type": "witness_v0_scripthash"
+					}
+				},
+				{
+					"value": 0.003,
+					"n": 1,
+					"scriptPubKey": {
+						"hex": "a914000000000000000000000000000000000000000087",
+						"type": "scripthash"
+					}
+				},
+				{
+					"value": 0.004,
+					"n": 2,
+					"scriptPubKey": {
+						"hex": "76a914000000000000000000000000000000000000000088ac",
+						"type": "pubkeyhash"
+					}
+				}
+			]
+		}
+	]
+}`
+
+var bitcoindTestMempoolTxResult = `{
+	"txid": "` + bitcoindTestMempoolTx + `",
+	"hash": "` + bitcoindTestMempoolTx + `",
+	"vout": [
+		{
+			"value": 1,
+			"n": 0,
+			"scriptPubKey": {
+				"hex": "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+				"type": "witness_v0_keyhash",
+				"address": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+			}
+		}
+	]
+}`
+
+// newFakeBitcoind starts an HTTP server that answers like bitcoind, to the user and password returned by auth
+func newFakeBitcoind(t *testing.T, auth func() (string, string)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		expectedUser, expectedPass := auth()
+		if !ok || user != expectedUser || pass != expectedPass {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			ID     uint64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		require.NoError(t, err)
+
+		reply := func(status int, result, rpcErr string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"result":%s,"error":%s,"id":%d}`, result, rpcErr, req.ID)
+		}
+
+		param := func(i int) string {
+			require.True(t, len(req.Params) > i)
+			return strings.Trim(string(req.Params[i]), `"`)
+		}
+
+		switch req.Method {
+		case "getblockcount":
+			reply(http.StatusOK, "600001", "null")
+		case "getblockhash":
+			if param(0) != "600000" {
+				reply(http.StatusInternalServerError, "null", `{"code":-8,"message":"Block height out of range"}`)
+				return
+			}
+			reply(http.StatusOK, `"`+bitcoindTestBlockHash+`"`, "null")
+		case "getblock":
+			require.Equal(t, "2", param(1))
+			if param(0) != bitcoindTestBlockHash {
+				reply(http.StatusInternalServerError, "null", `{"code":-5,"message":"Block not found"}`)
+				return
+			}
+			reply(http.StatusOK, bitcoindTestBlock, "null")
+		case "getrawmempool":
+			require.Equal(t, "true", param(0))
+			reply(http.StatusOK, `{"`+bitcoindTestMempoolTx+`":{"vsize":141,"weight":561,"time":1573000100,"height":600001,"depends":[]}}`, "null")
+		case "getrawtransaction":
+			require.Equal(t, "true", param(1))
+			if param(0) != bitcoindTestMempoolTx {
+				reply(http.StatusInternalServerError, "null", `{"code":-5,"message":"No such mempool transaction. Use -txindex or provide a block hash to enable blockchain transaction queries."}`)
+				return
+			}
+			reply(http.StatusOK, bitcoindTestMempoolTxResult, "null")
+		default:
+			reply(http.StatusNotFound, "null", `{"code":-32601,"message":"Method not found"}`)
+		}
+	}))
+}
+
+func TestBitcoindClientAuth(t *testing.T) {
+	user, pass := "user", "pass"
+	srv := newFakeBitcoind(t, func() (string, string) {
+		return user, pass
+	})
+	defer srv.Close()
+
+	server := strings.TrimPrefix(srv.URL, "http://")
+
+	// User and password
+	c := NewBitcoindClient(BitcoindConfig{
+		Server: server,
+		User:   "user",
+		Pass:   "pass",
+	})
+	n, err := c.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(600001), n)
+
+	c = NewBitcoindClient(BitcoindConfig{
+		Server: server,
+		User:   "user",
+		Pass:   "wrong",
+	})
+	_, err = c.GetBlockCount()
+	require.Equal(t, ErrBitcoindUnauthorized, err)
+
+	// Cookie file, which is read again when bitcoind restarts with a new cookie
+	dir, err := ioutil.TempDir("", "bitcoind")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cookiePath := filepath.Join(dir, ".cookie")
+
+	c = NewBitcoindClient(BitcoindConfig{
+		Server:     server,
+		CookiePath: cookiePath,
+	})
+
+	_, err = c.GetBlockCount()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Read bitcoind cookie file failed")
+
+	user, pass = "__cookie__", "0123abcd"
+	err = ioutil.WriteFile(cookiePath, []byte("__cookie__:0123abcd"), 0600)
+	require.NoError(t, err)
+	n, err = c.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(600001), n)
+
+	pass = "4567ef01"
+	err = ioutil.WriteFile(cookiePath, []byte("__cookie__:4567ef01\n"), 0600)
+	require.NoError(t, err)
+	n, err = c.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(600001), n)
+}
+
+func TestBitcoindClient(t *testing.T) {
+	srv := newFakeBitcoind(t, func() (string, string) {
+		return "user", "pass"
+	})
+	defer srv.Close()
+
+	c := NewBitcoindClient(BitcoindConfig{
+		Server: strings.TrimPrefix(srv.URL, "http://"),
+		User:   "user",
+		Pass:   "pass",
+	})
+
+	hash, err := c.GetBlockHash(600000)
+	require.NoError(t, err)
+	require.Equal(t, bitcoindTestBlockHash, hash.String())
+
+	// bitcoind errors are returned as RPCErrors
+	_, err = c.GetBlockHash(700000)
+	require.Equal(t, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCInvalidParameter,
+		Message: "Block height out of range",
+	}, err)
+
+	err = c.call("getblocktemplate", nil)
+	require.Equal(t, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCMethodNotFound.Code,
+		Message: "Method not found",
+	}, err)
+
+	block, err := c.GetBlockVerboseTx(hash)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), block.Confirmations)
+	require.Equal(t, bitcoindTestPrevHash, block.PreviousHash)
+
+	// The addresses come from the address field, the addresses field or the script
+	p2pkh, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	p2sh, err := btcutil.NewAddressScriptHashFromHash(make([]byte, 20), &chaincfg.MainNetParams)
+	require.NoError(t, err)
+
+	cb, err := btcBlock2CommonBlock(block, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	require.Equal(t, &CommonBlock{
+		Height:   600000,
+		Hash:     bitcoindTestBlockHash,
+		PrevHash: bitcoindTestPrevHash,
+		RawTx: []CommonTx{
+			{
+				Txid: "239e007dc20805add047d305cdfb87de1bae9bea1e47acbf58f38731ad58d70d",
+				Vout: []CommonVout{
+					{Value: 125e7, Addresses: []string{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}},
+					{Value: 0},
+				},
+			},
+			{
+				Txid: "bf41a5352b6d59a401cd946432117b25fd5fc43186aef5cbbe3170c40050d104",
+				Vout: []CommonVout{
+					{Value: 1e7, Addresses: []string{"1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA"}},
+				},
+			},
+			{
+				Txid: "d61be86942d69dc7ba6d49c817957ecd0918798f030c73739206e6f48fe2a7c6",
+				Vout: []CommonVout{
+					{Value: 2e5, Addresses: []string{"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"}},
+					{Value: 3e5, Addresses: []string{p2sh.EncodeAddress()}},
+					{Value: 4e5, Addresses: []string{p2pkh.EncodeAddress()}},
+				},
+			},
+		},
+	}, cb)
+
+	// A block that is not found
+	otherHash, err := chainhash.NewHashFromStr(bitcoindTestPrevHash)
+	require.NoError(t, err)
+	_, err = c.GetBlockVerboseTx(otherHash)
+	require.Equal(t, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCNoTxInfo,
+		Message: "Block not found",
+	}, err)
+
+	mempool, err := c.GetRawMempoolVerbose()
+	require.NoError(t, err)
+	require.Len(t, mempool, 1)
+	require.Equal(t, int64(1573000100), mempool[bitcoindTestMempoolTx].Time)
+
+	txHash, err := chainhash.NewHashFromStr(bitcoindTestMempoolTx)
+	require.NoError(t, err)
+	tx, err := c.GetRawTransactionVerbose(txHash)
+	require.NoError(t, err)
+	require.Equal(t, bitcoindTestMempoolTx, tx.Txid)
+	require.Equal(t, []string{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}, tx.Vout[0].ScriptPubKey.Addresses)
+}
+
+func TestBtcScannerBitcoind(t *testing.T) {
+	srv := newFakeBitcoind(t, func() (string, string) {
+		return "user", "pass"
+	})
+	defer srv.Close()
+
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	c := NewBitcoindClient(BitcoindConfig{
+		Server: strings.TrimPrefix(srv.URL, "http://"),
+		User:   "user",
+		Pass:   "pass",
+	})
+
+	scr, err := NewBTCScanner(log, store, c, Config{
+		InitialScanHeight: 600000,
+		ScanMempool:       true,
+	})
+	require.NoError(t, err)
+
+	// Notifications need a btcd websocket connection
+	err = scr.EnableNotifications(NewBtcNotifications())
+	require.Equal(t, ErrBtcNotificationsUnsupported, err)
+
+	segwitAddr := "bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"
+	err = scr.AddScanAddress(segwitAddr, CoinTypeBTC, "")
+	require.NoError(t, err)
+	err = scr.AddScanAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	// A mempool transaction found without txindex
+	err = scr.scanMempool()
+	require.NoError(t, err)
+	dvs, err := store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.Equal(t, bitcoindTestMempoolTx, dvs[0].Tx)
+
+	// A transaction that bitcoind does not know is dropped
+	dropped, err := scr.isTxDropped("239e007dc20805add047d305cdfb87de1bae9bea1e47acbf58f38731ad58d70d")
+	require.NoError(t, err)
+	require.True(t, dropped)
+
+	// Segwit deposits are found in the block
+	block, err := scr.getBlockAtHeight(600000)
+	require.NoError(t, err)
+
+	scanned, err := store.ScanBlock(block, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, scanned, 2)
+
+	values := make(map[string]int64)
+	for _, dv := range scanned {
+		values[dv.Address] += dv.Value
+	}
+	require.Equal(t, map[string]int64{
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4": 125e7,
+		segwitAddr: 2e5,
+	}, values)
+}
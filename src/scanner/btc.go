@@ -7,13 +7,19 @@
 package scanner
 
 import (
+	"encoding/hex"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcutil"
 	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/util/btcaddr"
 )
 
 var (
@@ -26,10 +32,14 @@ var (
 
 // Config scanner config info
 type Config struct {
-	ScanPeriod            time.Duration // scan period in seconds
-	DepositBufferSize     int           // size of GetDeposit() channel
-	InitialScanHeight     int64         // what blockchain height to begin scanning from
-	ConfirmationsRequired int64         // how many confirmations to wait for block
+	ScanPeriod            time.Duration    // scan period in seconds
+	DepositBufferSize     int              // size of GetDeposit() channel
+	InitialScanHeight     int64            // what blockchain height to begin scanning from
+	ConfirmationsRequired int64            // how many confirmations to wait for block
+	ScanMempool           bool             // also scan the mempool for unconfirmed deposits [BTC]
+	NotifyScanPeriod      time.Duration    // scan period while new blocks are announced by notifications [BTC]
+	BtcParams             *chaincfg.Params // chain params of the bitcoin network, defaults to mainnet [BTC]
+	CatchUpConcurrency    int              // how many blocks are fetched concurrently while catching up with the chain
 }
 
 // BTCScanner blockchain scanner to check if there're deposit coins
@@ -38,22 +48,220 @@ type BTCScanner struct {
 	btcClient BtcRPCClient
 	// Deposit value channel, exposed by public API, intended for public consumption
 	Base CommonScanner
+	// params are the chain params of the scanned network, used to decode addresses
+	params *chaincfg.Params
+
+	scanMempoolEnabled bool
+	// mempoolTxs caches the transactions in the mempool, so that each is fetched once
+	mempoolTxs map[string]CommonTx
+	// mempoolC wakes up the mempool scan, when a transaction to a scan address is announced
+	mempoolC chan struct{}
+
+	// notifier and notifications are set if new blocks and transactions are announced by btcd
+	notifier      BtcNotifier
+	notifications *BtcNotifications
+	// checkPeriod is how often the connection to btcd is checked while using notifications
+	checkPeriod time.Duration
+	// subscribed is set to 1 while subscribed to btcd notifications
+	subscribed int32
 }
 
 // NewBTCScanner creates scanner instance
 func NewBTCScanner(log logrus.FieldLogger, store Storer, btc BtcRPCClient, cfg Config) (*BTCScanner, error) {
 	bs := NewBaseScanner(store, log.WithField("prefix", "scanner.btc"), CoinTypeBTC, cfg)
 
+	params := cfg.BtcParams
+	if params == nil {
+		params = &chaincfg.MainNetParams
+	}
+
 	return &BTCScanner{
-		btcClient: btc,
-		log:       log.WithField("prefix", "scanner.btc"),
-		Base:      bs,
+		btcClient:          btc,
+		log:                log.WithField("prefix", "scanner.btc"),
+		Base:               bs,
+		params:             params,
+		scanMempoolEnabled: cfg.ScanMempool,
+		mempoolTxs:         make(map[string]CommonTx),
+		mempoolC:           make(chan struct{}, 1),
+		checkPeriod:        bs.Cfg.ScanPeriod,
 	}, nil
 }
 
 // Run begins the BTCScanner
 func (s *BTCScanner) Run() error {
-	return s.Base.Run(s.GetBlockCount, s.getBlockAtHeight, s.waitForNextBlock, s.scanBlock)
+	var background []func(<-chan struct{})
+	if s.scanMempoolEnabled {
+		background = append(background, s.runMempoolScan)
+	}
+	if s.notifications != nil {
+		background = append(background, s.runNotifications)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, run := range background {
+		wg.Add(1)
+		go func(run func(<-chan struct{})) {
+			defer wg.Done()
+			run(stop)
+		}(run)
+	}
+
+	err := s.Base.Run(s.GetBlockCount, s.getBlockAtHeight, s.waitForNextBlock, s.scanBlock, s.scanBlocks)
+
+	close(stop)
+	wg.Wait()
+
+	return err
+}
+
+// runMempoolScan scans the mempool every ScanPeriod, or when a transaction to a scan address is announced,
+// until stop is closed or the scanner quits
+func (s *BTCScanner) runMempoolScan(stop <-chan struct{}) {
+	log := s.log.WithField("scan", "mempool")
+	log.Info("Start mempool scan")
+	defer log.Info("Mempool scan stopped")
+
+	for {
+		if err := s.scanMempool(); err != nil {
+			log.WithError(err).Error("scanMempool failed")
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.Base.GetQuitChan():
+			return
+		case <-s.mempoolC:
+		case <-time.After(s.Base.GetScanPeriod()):
+		}
+	}
+}
+
+// scanMempool records the outputs of mempool transactions to the scan addresses as unconfirmed deposits.
+// Unconfirmed deposits are only shown to buyers, they are not sent to depositC.
+// The deposit is sent when its block is scanned with enough confirmations, like any other deposit.
+func (s *BTCScanner) scanMempool() error {
+	addrs, err := s.GetScanAddresses()
+	if err != nil {
+		s.log.WithError(err).Error("GetScanAddresses failed")
+		return err
+	}
+
+	mempool, err := s.btcClient.GetRawMempoolVerbose()
+	if err != nil {
+		s.log.WithError(err).Error("btcClient.GetRawMempoolVerbose failed")
+		return err
+	}
+
+	for txid := range s.mempoolTxs {
+		if _, ok := mempool[txid]; !ok {
+			delete(s.mempoolTxs, txid)
+		}
+	}
+
+	for txid := range mempool {
+		if _, ok := s.mempoolTxs[txid]; ok {
+			continue
+		}
+
+		tx, err := s.getRawTransaction(txid)
+		if err != nil {
+			// The transaction may have left the mempool, it is retried the next time if not
+			s.log.WithField("txid", txid).WithError(err).Warn("getRawTransaction failed")
+			continue
+		}
+
+		s.mempoolTxs[txid] = *tx
+	}
+
+	block := &CommonBlock{
+		RawTx: make([]CommonTx, 0, len(s.mempoolTxs)),
+	}
+	for _, tx := range s.mempoolTxs {
+		block.RawTx = append(block.RawTx, tx)
+	}
+
+	dvs, err := scanSpecifiedBlock(block, CoinTypeBTC, addrs)
+	if err != nil {
+		s.log.WithError(err).Error("scanSpecifiedBlock failed")
+		return err
+	}
+
+	found := make(map[string]struct{}, len(dvs))
+	for _, dv := range dvs {
+		found[dv.ID()] = struct{}{}
+	}
+
+	// A deposit that left the mempool was either included in a block that is not scanned yet,
+	// and it is kept until it is, or its transaction was dropped or replaced
+	unconfirmed, err := s.Base.GetStorer().GetUnconfirmedDeposits(CoinTypeBTC)
+	if err != nil {
+		s.log.WithError(err).Error("GetUnconfirmedDeposits failed")
+		return err
+	}
+
+	for _, dv := range unconfirmed {
+		if _, ok := found[dv.ID()]; ok {
+			continue
+		}
+
+		dropped, err := s.isTxDropped(dv.Tx)
+		if err != nil {
+			s.log.WithField("txid", dv.Tx).WithError(err).Error("isTxDropped failed")
+			return err
+		}
+
+		if dropped {
+			s.log.WithField("deposit", dv.Deposit).Info("Unconfirmed deposit was dropped from the mempool")
+			continue
+		}
+
+		dvs = append(dvs, dv.Deposit)
+	}
+
+	if len(dvs) > 0 {
+		s.log.WithField("unconfirmedDeposits", len(dvs)).Debug("Found unconfirmed deposits")
+	}
+
+	return s.Base.GetStorer().SetUnconfirmedDeposits(CoinTypeBTC, dvs)
+}
+
+// getRawTransaction returns a transaction in the mempool or in the chain
+func (s *BTCScanner) getRawTransaction(txid string) (*CommonTx, error) {
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.btcClient.GetRawTransactionVerbose(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := btcTx2CommonTx(*tx, s.params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctx, nil
+}
+
+// isTxDropped returns true if a transaction is neither in the mempool nor in the chain
+func (s *BTCScanner) isTxDropped(txid string) (bool, error) {
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s.btcClient.GetRawTransactionVerbose(hash); err != nil {
+		if rpcErr, ok := err.(*btcjson.RPCError); ok && rpcErr.Code == btcjson.ErrRPCNoTxInfo {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return false, nil
 }
 
 // Shutdown shutdown the scanner
@@ -65,6 +273,11 @@ func (s *BTCScanner) Shutdown() {
 	s.log.Info("BTC scanner stopped")
 }
 
+// Rescan scans the blocks of a height range again for deposits to the request's addresses, and adds the missed deposits
+func (s *BTCScanner) Rescan(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+	return s.Base.Rescan(req, s.GetBlockCount, s.getBlockAtHeight, progress)
+}
+
 // scanBlock scans for a new BTC block every ScanPeriod.
 // When a new block is found, it compares the block deposit addresses
 // against our scanning deposit addresses.
@@ -97,6 +310,37 @@ func (s *BTCScanner) scanBlock(block *CommonBlock) (int, error) {
 	return n, nil
 }
 
+// scanBlocks scans consecutive BTC blocks while catching up with the chain, with one store write
+func (s *BTCScanner) scanBlocks(blocks []*CommonBlock) (int, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"fromHeight": blocks[0].Height,
+		"toHeight":   blocks[len(blocks)-1].Height,
+	})
+
+	log.Debug("Scanning blocks")
+
+	dvs, err := s.Base.GetStorer().ScanBlocks(blocks, CoinTypeBTC)
+	if err != nil {
+		log.WithError(err).Error("store.ScanBlocks failed")
+		return 0, err
+	}
+
+	log = log.WithField("scannedDeposits", len(dvs))
+	log.Infof("Counted %d deposits from %d blocks", len(dvs), len(blocks))
+
+	n := 0
+	for _, dv := range dvs {
+		select {
+		case s.Base.GetScannedDepositChan() <- dv:
+			n++
+		case <-s.Base.GetQuitChan():
+			return n, errQuit
+		}
+	}
+
+	return n, nil
+}
+
 //GetBlockCount returns bitcoin block count
 func (s *BTCScanner) GetBlockCount() (int64, error) {
 	return s.btcClient.GetBlockCount()
@@ -118,33 +362,25 @@ func (s *BTCScanner) getBlockAtHeight(height int64) (*CommonBlock, error) {
 		return nil, err
 	}
 
-	return btcBlock2CommonBlock(block)
+	return btcBlock2CommonBlock(block, s.params)
 
 }
 
 // btcBlock2CommonBlock convert bitcoin block to common block
-func btcBlock2CommonBlock(block *btcjson.GetBlockVerboseResult) (*CommonBlock, error) {
+func btcBlock2CommonBlock(block *btcjson.GetBlockVerboseResult, params *chaincfg.Params) (*CommonBlock, error) {
 	if len(block.RawTx) == 0 {
 		return nil, ErrBtcdTxindexDisabled
 	}
 	cb := CommonBlock{}
 	cb.Hash = block.Hash
+	cb.PrevHash = block.PreviousHash
 	cb.NextHash = block.NextHash
 	cb.Height = block.Height
 	cb.RawTx = make([]CommonTx, 0, len(block.RawTx))
 	for _, tx := range block.RawTx {
-		cbTx := CommonTx{}
-		cbTx.Txid = tx.Txid
-		cbTx.Vout = make([]CommonVout, 0, len(tx.Vout))
-		for _, v := range tx.Vout {
-			amt, err := btcutil.NewAmount(v.Value)
-			if err != nil {
-				return nil, err
-			}
-			cv := CommonVout{}
-			cv.Value = int64(amt)
-			cv.Addresses = v.ScriptPubKey.Addresses
-			cbTx.Vout = append(cbTx.Vout, cv)
+		cbTx, err := btcTx2CommonTx(tx, params)
+		if err != nil {
+			return nil, err
 		}
 		cb.RawTx = append(cb.RawTx, cbTx)
 	}
@@ -152,6 +388,45 @@ func btcBlock2CommonBlock(block *btcjson.GetBlockVerboseResult) (*CommonBlock, e
 	return &cb, nil
 }
 
+// btcTx2CommonTx convert bitcoin transaction to common transaction.
+// If the node did not decode the address of an output, e.g. a segwit output for an old node,
+// it is decoded from the script with the params of the network.
+func btcTx2CommonTx(tx btcjson.TxRawResult, params *chaincfg.Params) (CommonTx, error) {
+	cbTx := CommonTx{}
+	cbTx.Txid = tx.Txid
+	cbTx.Vout = make([]CommonVout, 0, len(tx.Vout))
+	for _, v := range tx.Vout {
+		amt, err := btcutil.NewAmount(v.Value)
+		if err != nil {
+			return CommonTx{}, err
+		}
+		cv := CommonVout{}
+		cv.Value = int64(amt)
+		cv.Addresses = v.ScriptPubKey.Addresses
+		if len(cv.Addresses) == 0 && v.ScriptPubKey.Hex != "" {
+			cv.Addresses = scriptHexAddresses(v.ScriptPubKey.Hex, params)
+		}
+		cbTx.Vout = append(cbTx.Vout, cv)
+	}
+
+	return cbTx, nil
+}
+
+// scriptHexAddresses returns the address of a hex encoded standard output script, or nil
+func scriptHexAddresses(scriptHex string, params *chaincfg.Params) []string {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return nil
+	}
+
+	addr, err := btcaddr.ScriptAddress(script, params)
+	if err != nil || addr == "" {
+		return nil
+	}
+
+	return []string{addr}
+}
+
 // getNextBlock returns the next block from another block, return nil if next block does not exist
 func (s *BTCScanner) getNextBlock(block *CommonBlock) (*CommonBlock, error) {
 	if block.NextHash == "" {
@@ -170,7 +445,7 @@ func (s *BTCScanner) getNextBlock(block *CommonBlock) (*CommonBlock, error) {
 		s.log.WithError(err).Error("chainhash.NewHashFromStr failed")
 		return nil, err
 	}
-	return btcBlock2CommonBlock(btc)
+	return btcBlock2CommonBlock(btc, s.params)
 }
 
 // waitForNextBlock scans for the next block until it is available
@@ -194,15 +469,27 @@ func (s *BTCScanner) waitForNextBlock(block *CommonBlock) (*CommonBlock, error)
 				log.WithError(err).Error("btcClient.GetBlockVerboseTx failed, retrying")
 			}
 
+			// An orphaned block never gets a NextHash, return the block at the next
+			// height instead, so that the chain reorganization is detected
+			if err == nil && btcBlock.Confirmations < 0 {
+				log.Warn("Block is orphaned, loading the block at the next height")
+				nextBlock, err := s.getBlockAtHeight(block.Height + 1)
+				if err == nil {
+					return nextBlock, nil
+				}
+			}
+
 			if err != nil || btcBlock.NextHash == "" {
 				select {
 				case <-s.Base.GetQuitChan():
 					return nil, errQuit
+				case <-s.Base.GetNotifyChan():
+					continue
 				case <-time.After(s.Base.GetScanPeriod()):
 					continue
 				}
 			}
-			block, err = btcBlock2CommonBlock(btcBlock)
+			block, err = btcBlock2CommonBlock(btcBlock, s.params)
 			if err != nil {
 				log.WithError(err).Error("btc block 2 common block failed")
 				return nil, err
@@ -223,6 +510,8 @@ func (s *BTCScanner) waitForNextBlock(block *CommonBlock) (*CommonBlock, error)
 			select {
 			case <-s.Base.GetQuitChan():
 				return nil, errQuit
+			case <-s.Base.GetNotifyChan():
+				continue
 			case <-time.After(s.Base.GetScanPeriod()):
 				continue
 			}
@@ -238,8 +527,19 @@ func (s *BTCScanner) waitForNextBlock(block *CommonBlock) (*CommonBlock, error)
 }
 
 // AddScanAddress adds new scan address
-func (s *BTCScanner) AddScanAddress(addr, coinType string) error {
-	return s.Base.GetStorer().AddScanAddress(addr, coinType)
+func (s *BTCScanner) AddScanAddress(addr, coinType, kittyID string) error {
+	if err := s.Base.GetStorer().AddScanAddress(addr, coinType, kittyID); err != nil {
+		return err
+	}
+
+	// The address is scanned by polling until the next subscription if this fails
+	if atomic.LoadInt32(&s.subscribed) == 1 {
+		if err := s.notifyReceived([]string{addr}); err != nil {
+			s.log.WithError(err).WithField("addr", addr).Error("notifyReceived failed")
+		}
+	}
+
+	return nil
 }
 
 // GetScanAddresses returns the deposit addresses that need to scan
@@ -0,0 +1,522 @@
+package scanner
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BTCEsploraScanner scans BTC deposits with an Esplora-compatible address indexer instead of a full node.
+// Only the transaction histories of the scan addresses are fetched, blocks are never downloaded.
+type BTCEsploraScanner struct {
+	log    logrus.FieldLogger
+	client BtcIndexerClient
+	// Deposit value channel, exposed by public API, intended for public consumption
+	Base CommonScanner
+
+	confirmationsRequired int64
+	scanMempoolEnabled    bool
+
+	// history caches the confirmed transactions of the scan addresses.
+	// It is only used by the scan goroutine.
+	history *esploraHistory
+	// historyStale is set to 1 when a scan address is added, to fetch the history again
+	historyStale int32
+}
+
+// esploraHistory is the transaction history of the scan addresses, fetched at a chain tip
+type esploraHistory struct {
+	// tipHeight is the best block height when the history was fetched, the blocks up to it are covered
+	tipHeight int64
+	// txs are the confirmed transactions to or from the scan addresses, by block height
+	txs map[int64][]EsploraTx
+}
+
+// NewBTCEsploraScanner creates a BTCEsploraScanner
+func NewBTCEsploraScanner(log logrus.FieldLogger, store Storer, client BtcIndexerClient, cfg Config) (*BTCEsploraScanner, error) {
+	bs := NewBaseScanner(store, log.WithField("prefix", "scanner.btc"), CoinTypeBTC, cfg)
+
+	return &BTCEsploraScanner{
+		log:                   log.WithField("prefix", "scanner.btc"),
+		client:                client,
+		Base:                  bs,
+		confirmationsRequired: cfg.ConfirmationsRequired,
+		scanMempoolEnabled:    cfg.ScanMempool,
+	}, nil
+}
+
+// Run begins the BTCEsploraScanner
+func (s *BTCEsploraScanner) Run() error {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if s.scanMempoolEnabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runMempoolScan(stop)
+		}()
+	}
+
+	// Blocks are not downloaded, the history of the scan addresses is fetched from the
+	// block to scan up to the tip, which catches up without the concurrent block fetching
+	err := s.Base.Run(s.GetBlockCount, s.getBlockAtHeight, s.waitForNextBlock, s.scanBlock, nil)
+
+	close(stop)
+	wg.Wait()
+
+	return err
+}
+
+// Shutdown shutdown the scanner
+func (s *BTCEsploraScanner) Shutdown() {
+	s.log.Info("Closing BTC scanner")
+	s.Base.Shutdown()
+	s.log.Info("BTC scanner stopped")
+}
+
+// Rescan scans the blocks of a height range again for deposits to the request's addresses, and adds the missed deposits.
+// Blocks are not downloaded, they are made of the transactions in the addresses' histories,
+// so a range above the indexer's tip minus the required confirmations is rejected before any block is made.
+func (s *BTCEsploraScanner) Rescan(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+	// The histories are fetched with the first block, so that a failure is reported as progress
+	var txs map[int64][]EsploraTx
+	getBlockAtHeight := func(height int64) (*CommonBlock, error) {
+		if txs == nil {
+			var err error
+			txs, _, err = s.fetchAddressTxs(req.Addresses, req.FromHeight)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		block := &CommonBlock{
+			Height: height,
+		}
+		for _, tx := range txs[height] {
+			block.Hash = tx.Status.BlockHash
+			block.RawTx = append(block.RawTx, esploraTx2CommonTx(tx))
+		}
+
+		return block, nil
+	}
+
+	return s.Base.Rescan(req, s.GetBlockCount, getBlockAtHeight, progress)
+}
+
+// GetBlockCount returns the height of the best block known by the indexer
+func (s *BTCEsploraScanner) GetBlockCount() (int64, error) {
+	return s.client.GetTipHeight()
+}
+
+// getBlock returns the header of the block at a height, without transactions
+func (s *BTCEsploraScanner) getBlock(height int64) (*CommonBlock, error) {
+	log := s.log.WithField("blockHeight", height)
+
+	hash, err := s.client.GetBlockHash(height)
+	if err != nil {
+		log.WithError(err).Error("client.GetBlockHash failed")
+		return nil, err
+	}
+
+	block, err := s.client.GetBlock(hash)
+	if err != nil {
+		log.WithError(err).Error("client.GetBlock failed")
+		return nil, err
+	}
+
+	return &CommonBlock{
+		Height:   block.Height,
+		Hash:     block.ID,
+		PrevHash: block.PreviousBlockHash,
+	}, nil
+}
+
+// getBlockAtHeight returns the block at a height. It is called for the initial block and
+// when rolling back a chain reorganization, so the address history is fetched again.
+func (s *BTCEsploraScanner) getBlockAtHeight(height int64) (*CommonBlock, error) {
+	s.history = nil
+	return s.getBlock(height)
+}
+
+// waitForNextBlock waits until the indexer has a block after block, and returns the next block to scan
+func (s *BTCEsploraScanner) waitForNextBlock(block *CommonBlock) (*CommonBlock, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"blockHash":   block.Hash,
+		"blockHeight": block.Height,
+	})
+	log.Debug("Waiting for the next block")
+
+	for {
+		nextBlock, err := s.getNextBlock(block)
+		if err != nil {
+			log.WithError(err).Error("getNextBlock failed")
+		}
+		if err == nil && nextBlock != nil {
+			return nextBlock, nil
+		}
+
+		select {
+		case <-s.Base.GetQuitChan():
+			return nil, errQuit
+		case <-s.Base.GetNotifyChan():
+		case <-time.After(s.Base.GetScanPeriod()):
+		}
+	}
+}
+
+// getNextBlock returns the next block to scan, or nil if the indexer has no block after block yet.
+// Blocks without transactions of the scan addresses in the fetched history are skipped.
+// A chain reorganization is only detected if the returned block directly follows block,
+// so the deposits of skipped blocks rely on the confirmations required.
+func (s *BTCEsploraScanner) getNextBlock(block *CommonBlock) (*CommonBlock, error) {
+	tip, err := s.client.GetTipHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	if tip <= block.Height {
+		return nil, nil
+	}
+
+	height := s.nextScanHeight(block.Height, tip)
+	nextBlock, err := s.getBlock(height)
+	if err != nil {
+		return nil, err
+	}
+
+	if height > block.Height+1 {
+		s.log.WithFields(logrus.Fields{
+			"fromHeight": block.Height,
+			"toHeight":   height,
+		}).Debug("Skipping blocks without deposits")
+		nextBlock.PrevHash = ""
+	}
+
+	return nextBlock, nil
+}
+
+// nextScanHeight returns the height of the next block to scan after height.
+// It is the lowest height with transactions in the history, or the highest height with
+// enough confirmations. The block after the history is scanned to fetch the history again.
+func (s *BTCEsploraScanner) nextScanHeight(height, tip int64) int64 {
+	next := height + 1
+	last := tip - s.confirmationsRequired
+
+	if s.history == nil || atomic.LoadInt32(&s.historyStale) == 1 || s.history.tipHeight < next {
+		return next
+	}
+
+	if last > s.history.tipHeight+1 {
+		last = s.history.tipHeight + 1
+	}
+
+	for h := range s.history.txs {
+		if h >= next && h < last {
+			last = h
+		}
+	}
+
+	if last < next {
+		return next
+	}
+
+	return last
+}
+
+// scanBlock scans the transactions of the scan addresses in a block for deposits, and saves them to the DB
+func (s *BTCEsploraScanner) scanBlock(block *CommonBlock) (int, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"hash":   block.Hash,
+		"height": block.Height,
+	})
+
+	log.Debug("Scanning block")
+
+	txs, err := s.getBlockTxs(block)
+	if err != nil {
+		log.WithError(err).Error("getBlockTxs failed")
+		return 0, err
+	}
+
+	block.RawTx = make([]CommonTx, 0, len(txs))
+	for _, tx := range txs {
+		block.RawTx = append(block.RawTx, esploraTx2CommonTx(tx))
+	}
+
+	dvs, err := s.Base.GetStorer().ScanBlock(block, CoinTypeBTC)
+	if err != nil {
+		log.WithError(err).Error("store.ScanBlock failed")
+		return 0, err
+	}
+
+	log = log.WithField("scannedDeposits", len(dvs))
+	log.Infof("Counted %d deposits from block", len(dvs))
+
+	n := 0
+	for _, dv := range dvs {
+		select {
+		case s.Base.GetScannedDepositChan() <- dv:
+			n++
+		case <-s.Base.GetQuitChan():
+			return n, errQuit
+		}
+	}
+
+	return n, nil
+}
+
+// getBlockTxs returns the transactions of the scan addresses in a block.
+// The history is fetched again if it does not cover the block, if a scan address was added,
+// or if it has transactions of another block at the same height.
+func (s *BTCEsploraScanner) getBlockTxs(block *CommonBlock) ([]EsploraTx, error) {
+	if s.history == nil || atomic.LoadInt32(&s.historyStale) == 1 ||
+		block.Height > s.history.tipHeight || !s.history.hasBlock(block) {
+		// Reset the flag first, so that an address added while fetching makes the history stale again
+		atomic.StoreInt32(&s.historyStale, 0)
+
+		history, err := s.fetchHistory(block.Height)
+		if err != nil {
+			s.history = nil
+			return nil, err
+		}
+		s.history = history
+	}
+
+	var txs []EsploraTx
+	for _, tx := range s.history.txs[block.Height] {
+		if tx.Status.BlockHash != block.Hash {
+			s.log.WithFields(logrus.Fields{
+				"txid":      tx.Txid,
+				"txBlock":   tx.Status.BlockHash,
+				"blockHash": block.Hash,
+			}).Warn("Transaction is confirmed in another block at this height, chain reorganization in progress")
+			continue
+		}
+		txs = append(txs, tx)
+	}
+
+	return txs, nil
+}
+
+// hasBlock returns false if the history has transactions of another block at the height of block
+func (h *esploraHistory) hasBlock(block *CommonBlock) bool {
+	for _, tx := range h.txs[block.Height] {
+		if tx.Status.BlockHash != block.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchHistory fetches the confirmed transactions of the scan addresses from fromHeight up to the tip
+func (s *BTCEsploraScanner) fetchHistory(fromHeight int64) (*esploraHistory, error) {
+	// The tip is read first, the history of every block up to it is complete
+	tip, err := s.client.GetTipHeight()
+	if err != nil {
+		s.log.WithError(err).Error("client.GetTipHeight failed")
+		return nil, err
+	}
+
+	addrs, err := s.GetScanAddresses()
+	if err != nil {
+		s.log.WithError(err).Error("GetScanAddresses failed")
+		return nil, err
+	}
+
+	txs, n, err := s.fetchAddressTxs(addrs, fromHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"fromHeight": fromHeight,
+		"tipHeight":  tip,
+		"addrs":      len(addrs),
+		"txs":        n,
+	}).Debug("Fetched scan address history")
+
+	return &esploraHistory{
+		tipHeight: tip,
+		txs:       txs,
+	}, nil
+}
+
+// fetchAddressTxs fetches the confirmed transactions of addrs at or above fromHeight, by block height.
+// The number of transactions is returned too.
+func (s *BTCEsploraScanner) fetchAddressTxs(addrs []string, fromHeight int64) (map[int64][]EsploraTx, int, error) {
+	txsByHeight := make(map[int64][]EsploraTx)
+
+	// A transaction to several addresses is in the history of each
+	seen := make(map[string]struct{})
+	for _, addr := range addrs {
+		select {
+		case <-s.Base.GetQuitChan():
+			return nil, 0, errQuit
+		default:
+		}
+
+		txs, err := s.getAddressTxs(addr, fromHeight)
+		if err != nil {
+			s.log.WithError(err).WithField("addr", addr).Error("getAddressTxs failed")
+			return nil, 0, err
+		}
+
+		for _, tx := range txs {
+			if _, ok := seen[tx.Txid]; ok {
+				continue
+			}
+			seen[tx.Txid] = struct{}{}
+
+			height := tx.Status.BlockHeight
+			txsByHeight[height] = append(txsByHeight[height], tx)
+		}
+	}
+
+	return txsByHeight, len(seen), nil
+}
+
+// getAddressTxs returns the confirmed transactions of an address at or above minHeight.
+// The history is paged from the newest transaction, so the older pages are not fetched.
+func (s *BTCEsploraScanner) getAddressTxs(addr string, minHeight int64) ([]EsploraTx, error) {
+	var txs []EsploraTx
+	lastSeenTxid := ""
+
+	for {
+		page, err := s.client.GetAddressTxs(addr, lastSeenTxid)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tx := range page {
+			if !tx.Status.Confirmed {
+				continue
+			}
+			if tx.Status.BlockHeight < minHeight {
+				return txs, nil
+			}
+			txs = append(txs, tx)
+		}
+
+		if len(page) < esploraTxsPageSize {
+			return txs, nil
+		}
+
+		lastSeenTxid = page[len(page)-1].Txid
+	}
+}
+
+// runMempoolScan scans the mempool transactions of the scan addresses every ScanPeriod,
+// until stop is closed or the scanner quits
+func (s *BTCEsploraScanner) runMempoolScan(stop <-chan struct{}) {
+	log := s.log.WithField("scan", "mempool")
+	log.Info("Start mempool scan")
+	defer log.Info("Mempool scan stopped")
+
+	for {
+		if err := s.scanMempool(); err != nil {
+			log.WithError(err).Error("scanMempool failed")
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.Base.GetQuitChan():
+			return
+		case <-time.After(s.Base.GetScanPeriod()):
+		}
+	}
+}
+
+// scanMempool records the outputs of mempool transactions to the scan addresses as unconfirmed deposits.
+// Unconfirmed deposits are only shown to buyers, they are not sent to depositC.
+func (s *BTCEsploraScanner) scanMempool() error {
+	addrs, err := s.GetScanAddresses()
+	if err != nil {
+		s.log.WithError(err).Error("GetScanAddresses failed")
+		return err
+	}
+
+	block := &CommonBlock{}
+	seen := make(map[string]struct{})
+	for _, addr := range addrs {
+		txs, err := s.client.GetAddressMempoolTxs(addr)
+		if err != nil {
+			s.log.WithError(err).WithField("addr", addr).Error("client.GetAddressMempoolTxs failed")
+			return err
+		}
+
+		for _, tx := range txs {
+			if _, ok := seen[tx.Txid]; ok {
+				continue
+			}
+			seen[tx.Txid] = struct{}{}
+			block.RawTx = append(block.RawTx, esploraTx2CommonTx(tx))
+		}
+	}
+
+	dvs, err := scanSpecifiedBlock(block, CoinTypeBTC, addrs)
+	if err != nil {
+		s.log.WithError(err).Error("scanSpecifiedBlock failed")
+		return err
+	}
+
+	found := make(map[string]struct{}, len(dvs))
+	for _, dv := range dvs {
+		found[dv.ID()] = struct{}{}
+	}
+
+	// A deposit that left the mempool was either included in a block that is not scanned yet,
+	// and it is kept until it is, or its transaction was dropped or replaced
+	unconfirmed, err := s.Base.GetStorer().GetUnconfirmedDeposits(CoinTypeBTC)
+	if err != nil {
+		s.log.WithError(err).Error("GetUnconfirmedDeposits failed")
+		return err
+	}
+
+	for _, dv := range unconfirmed {
+		if _, ok := found[dv.ID()]; ok {
+			continue
+		}
+
+		if _, err := s.client.GetTxStatus(dv.Tx); err != nil {
+			if err == ErrEsploraNotFound {
+				s.log.WithField("deposit", dv.Deposit).Info("Unconfirmed deposit was dropped from the mempool")
+				continue
+			}
+			s.log.WithField("txid", dv.Tx).WithError(err).Error("client.GetTxStatus failed")
+			return err
+		}
+
+		dvs = append(dvs, dv.Deposit)
+	}
+
+	if len(dvs) > 0 {
+		s.log.WithField("unconfirmedDeposits", len(dvs)).Debug("Found unconfirmed deposits")
+	}
+
+	return s.Base.GetStorer().SetUnconfirmedDeposits(CoinTypeBTC, dvs)
+}
+
+// AddScanAddress adds new scan address
+func (s *BTCEsploraScanner) AddScanAddress(addr, coinType, kittyID string) error {
+	if err := s.Base.GetStorer().AddScanAddress(addr, coinType, kittyID); err != nil {
+		return err
+	}
+
+	// The history of the new address is fetched when the next block is scanned
+	atomic.StoreInt32(&s.historyStale, 1)
+
+	return nil
+}
+
+// GetScanAddresses returns the deposit addresses that need to scan
+func (s *BTCEsploraScanner) GetScanAddresses() ([]string, error) {
+	return s.Base.GetStorer().GetScanAddresses(CoinTypeBTC)
+}
+
+// GetDeposit returns channel of depositnote
+func (s *BTCEsploraScanner) GetDeposit() <-chan DepositNote {
+	return s.Base.GetDeposit()
+}
@@ -0,0 +1,184 @@
+package scanner
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+
+	"github.com/kittycash/teller/src/util/btcaddr"
+)
+
+// ErrBtcNotificationsUnsupported is returned by EnableNotifications if the btc client can't subscribe to notifications,
+// which needs a websocket connection to btcd
+var ErrBtcNotificationsUnsupported = errors.New("btc client does not support notifications")
+
+// BtcNotifier subscribes to btcd websocket notifications, implemented by rpcclient.Client
+type BtcNotifier interface {
+	NotifyBlocks() error
+	NotifyReceived([]btcutil.Address) error
+	Disconnected() bool
+}
+
+// BtcNotifications receives the btcd websocket notifications.
+// Its Handlers must be passed to rpcclient.New when creating the btc client.
+type BtcNotifications struct {
+	connected chan struct{}
+	blocks    chan struct{}
+	txs       chan struct{}
+}
+
+// NewBtcNotifications creates BtcNotifications
+func NewBtcNotifications() *BtcNotifications {
+	return &BtcNotifications{
+		connected: make(chan struct{}, 1),
+		blocks:    make(chan struct{}, 1),
+		txs:       make(chan struct{}, 1),
+	}
+}
+
+// signal sends to a buffered channel without blocking, a pending signal is not repeated
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Handlers returns the notification handlers for rpcclient.New.
+// The handlers only signal the scanner, which fetches the blocks and transactions itself.
+func (n *BtcNotifications) Handlers() *rpcclient.NotificationHandlers {
+	return &rpcclient.NotificationHandlers{
+		OnClientConnected: func() {
+			signal(n.connected)
+		},
+		OnBlockConnected: func(*chainhash.Hash, int32, time.Time) {
+			signal(n.blocks)
+		},
+		OnFilteredBlockConnected: func(int32, *wire.BlockHeader, []*btcutil.Tx) {
+			signal(n.blocks)
+		},
+		OnRecvTx: func(*btcutil.Tx, *btcjson.BlockDetails) {
+			signal(n.txs)
+		},
+	}
+}
+
+// EnableNotifications makes the scanner react to the blocks and transactions announced by btcd,
+// instead of waiting for the scan period. It must be called before Run.
+func (s *BTCScanner) EnableNotifications(n *BtcNotifications) error {
+	notifier, ok := s.btcClient.(BtcNotifier)
+	if !ok {
+		return ErrBtcNotificationsUnsupported
+	}
+
+	s.notifier = notifier
+	s.notifications = n
+	return nil
+}
+
+// runNotifications subscribes to new blocks and to the transactions to the scan addresses each time
+// the client connects to btcd, and wakes up the scans when they are announced.
+// While subscribed, the chain is polled every NotifyScanPeriod in case a notification is missed.
+// When btcd disconnects, the scanner falls back to polling every ScanPeriod until the client reconnects.
+func (s *BTCScanner) runNotifications(stop <-chan struct{}) {
+	log := s.log.WithField("scan", "notifications")
+	log.Info("Start notifications")
+	defer log.Info("Notifications stopped")
+
+	subscribe := func() {
+		if err := s.subscribe(); err != nil {
+			log.WithError(err).Error("Subscribing to notifications failed, polling until it is retried")
+			s.setSubscribed(false)
+			return
+		}
+
+		log.Info("Subscribed to notifications")
+		s.setSubscribed(true)
+
+		// Scan what was missed while not subscribed
+		s.Base.Notify()
+		signal(s.mempoolC)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.Base.GetQuitChan():
+			return
+		case <-s.notifications.connected:
+			subscribe()
+		case <-s.notifications.blocks:
+			s.Base.Notify()
+			// Transactions of the block left the mempool
+			signal(s.mempoolC)
+		case <-s.notifications.txs:
+			signal(s.mempoolC)
+		case <-time.After(s.checkPeriod):
+			subscribed := atomic.LoadInt32(&s.subscribed) == 1
+			disconnected := s.notifier.Disconnected()
+			switch {
+			case subscribed && disconnected:
+				log.Warn("Disconnected from btcd, polling until reconnected")
+				s.setSubscribed(false)
+			case !subscribed && !disconnected:
+				subscribe()
+			}
+		}
+	}
+}
+
+func (s *BTCScanner) setSubscribed(subscribed bool) {
+	var v int32
+	if subscribed {
+		v = 1
+	}
+	atomic.StoreInt32(&s.subscribed, v)
+	s.Base.SetNotified(subscribed)
+}
+
+// subscribe subscribes to new blocks and to the transactions to the scan addresses
+func (s *BTCScanner) subscribe() error {
+	if err := s.notifier.NotifyBlocks(); err != nil {
+		s.log.WithError(err).Error("btcClient.NotifyBlocks failed")
+		return err
+	}
+
+	addrs, err := s.GetScanAddresses()
+	if err != nil {
+		s.log.WithError(err).Error("GetScanAddresses failed")
+		return err
+	}
+
+	return s.notifyReceived(addrs)
+}
+
+// notifyReceived subscribes to the transactions to addresses
+func (s *BTCScanner) notifyReceived(addrs []string) error {
+	var btcAddrs []btcutil.Address
+	for _, addr := range addrs {
+		a, err := btcaddr.Decode(addr, s.params)
+		if err != nil {
+			s.log.WithError(err).WithField("addr", addr).Warn("Invalid scan address, its transactions are not notified")
+			continue
+		}
+		btcAddrs = append(btcAddrs, a)
+	}
+
+	if len(btcAddrs) == 0 {
+		return nil
+	}
+
+	if err := s.notifier.NotifyReceived(btcAddrs); err != nil {
+		s.log.WithError(err).Error("btcClient.NotifyReceived failed")
+		return err
+	}
+
+	return nil
+}
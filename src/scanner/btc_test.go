@@ -5,12 +5,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
 	"github.com/stretchr/testify/require"
 
 	"github.com/kittycash/teller/src/util/dbutil"
@@ -32,6 +35,9 @@ var (
 )
 
 type dummyBtcrpcclient struct {
+	// The scanner fetches blocks concurrently while catching up
+	sync.Mutex
+
 	db                           *bolt.DB
 	blockHashes                  map[int64]string
 	blockCount                   int64
@@ -43,6 +49,55 @@ type dummyBtcrpcclient struct {
 	// used for testBtcScannerBlockNextHashAppears
 	blockNextHashMissingOnceAt int64
 	hasSetMissingHash          bool
+
+	// used for TestBtcScannerMempool
+	mempool                 map[string]btcjson.TxRawResult
+	confirmedTxs            map[string]btcjson.TxRawResult
+	rawTransactionCallCount int
+}
+
+// dummyBtcNotifier is a dummyBtcrpcclient that can subscribe to notifications
+type dummyBtcNotifier struct {
+	*dummyBtcrpcclient
+
+	sync.Mutex
+	notifyBlocksCallCount int
+	receivedAddrs         []string
+	disconnected          bool
+}
+
+func (n *dummyBtcNotifier) NotifyBlocks() error {
+	n.Lock()
+	defer n.Unlock()
+	n.notifyBlocksCallCount++
+	return nil
+}
+
+func (n *dummyBtcNotifier) NotifyReceived(addrs []btcutil.Address) error {
+	n.Lock()
+	defer n.Unlock()
+	for _, a := range addrs {
+		n.receivedAddrs = append(n.receivedAddrs, a.EncodeAddress())
+	}
+	return nil
+}
+
+func (n *dummyBtcNotifier) Disconnected() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.disconnected
+}
+
+func (n *dummyBtcNotifier) setDisconnected(disconnected bool) {
+	n.Lock()
+	defer n.Unlock()
+	n.disconnected = disconnected
+}
+
+func (n *dummyBtcNotifier) state() (int, []string) {
+	n.Lock()
+	defer n.Unlock()
+	return n.notifyBlocksCallCount, append([]string{}, n.receivedAddrs...)
 }
 
 func openDummyBtcDB(t *testing.T) *bolt.DB {
@@ -66,6 +121,9 @@ func (dbc *dummyBtcrpcclient) GetBlockVerbose(hash *chainhash.Hash) (*btcjson.Ge
 	return dbc.GetBlockVerboseTx(hash)
 }
 func (dbc *dummyBtcrpcclient) GetBlockVerboseTx(hash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+	dbc.Lock()
+	defer dbc.Unlock()
+
 	dbc.blockVerboseTxCallCount++
 	if dbc.blockVerboseTxCallCount == dbc.blockVerboseTxErrorCallCount {
 		return nil, dbc.blockVerboseTxError
@@ -109,6 +167,9 @@ func (dbc *dummyBtcrpcclient) GetBlockVerboseTx(hash *chainhash.Hash) (*btcjson.
 }
 
 func (dbc *dummyBtcrpcclient) GetBlockCount() (int64, error) {
+	dbc.Lock()
+	defer dbc.Unlock()
+
 	if dbc.blockCountError != nil {
 		// blockCountError is only returned once
 		err := dbc.blockCountError
@@ -119,7 +180,39 @@ func (dbc *dummyBtcrpcclient) GetBlockCount() (int64, error) {
 	return dbc.blockCount, nil
 }
 
+func (dbc *dummyBtcrpcclient) GetRawMempoolVerbose() (map[string]btcjson.GetRawMempoolVerboseResult, error) {
+	mempool := make(map[string]btcjson.GetRawMempoolVerboseResult, len(dbc.mempool))
+	for txid := range dbc.mempool {
+		mempool[txid] = btcjson.GetRawMempoolVerboseResult{
+			Height: dbc.blockCount,
+		}
+	}
+
+	return mempool, nil
+}
+
+func (dbc *dummyBtcrpcclient) GetRawTransactionVerbose(hash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+	dbc.rawTransactionCallCount++
+
+	if tx, ok := dbc.mempool[hash.String()]; ok {
+		return &tx, nil
+	}
+
+	if tx, ok := dbc.confirmedTxs[hash.String()]; ok {
+		tx.Confirmations = 1
+		return &tx, nil
+	}
+
+	return nil, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCNoTxInfo,
+		Message: "No information available about transaction",
+	}
+}
+
 func (dbc *dummyBtcrpcclient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	dbc.Lock()
+	defer dbc.Unlock()
+
 	hash := dbc.blockHashes[height]
 	if hash == "" {
 		return nil, errNoBlockHash
@@ -224,14 +317,14 @@ func testBtcScannerRun(t *testing.T, scr *BTCScanner) {
 	var nDeposits int64
 
 	// This address has 0 deposits
-	err := scr.AddScanAddress("1LcEkgX8DCrQczLMVh9LDTRnkdVV2oun3A", CoinTypeBTC)
+	err := scr.AddScanAddress("1LcEkgX8DCrQczLMVh9LDTRnkdVV2oun3A", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 0
 
 	// This address has:
 	// 1 deposit, in block 235206
 	// 1 deposit, in block 235207
-	err = scr.AddScanAddress("1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA", CoinTypeBTC)
+	err = scr.AddScanAddress("1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 2
 
@@ -240,7 +333,7 @@ func testBtcScannerRun(t *testing.T, scr *BTCScanner) {
 	// 47 deposits in block 235206
 	// 22 deposits, in block 235207
 	// 26 deposits, in block 235214
-	err = scr.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC)
+	err = scr.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 126
 
@@ -303,7 +396,7 @@ func testBtcScannerConfirmationsRequired(t *testing.T, btcDB *bolt.DB) {
 	// 26 deposits, in block 235214
 	// Only blocks 235205 and 235206 are processed, because blockCount is set
 	// to 235208 and the confirmations required is set to 2
-	err := scr.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC)
+	err := scr.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 78
 
@@ -351,7 +444,7 @@ func testBtcScannerDuplicateDepositScans(t *testing.T, btcDB *bolt.DB) {
 	// 1 deposit, in block 235206
 	// 1 deposit, in block 235207
 	scr := setupBtcScannerWithDB(t, btcDB, db)
-	err := scr.AddScanAddress("1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA", CoinTypeBTC)
+	err := scr.AddScanAddress("1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 2
 
@@ -430,7 +523,7 @@ func testBtcScannerProcessDepositError(t *testing.T, btcDB *bolt.DB) {
 	// 47 deposits in block 235206
 	// 22 deposits, in block 235207
 	// 26 deposits, in block 235214
-	err := scr.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC)
+	err := scr.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 126
 
@@ -573,3 +666,280 @@ func TestBtcScanner(t *testing.T) {
 		})
 	})
 }
+
+func TestBtcScannerMempool(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	scr := setupBtcScannerWithDB(t, nil, db)
+	rpc := scr.btcClient.(*dummyBtcrpcclient)
+	store := scr.Base.GetStorer()
+
+	addr := "1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA"
+	err := scr.AddScanAddress(addr, CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	tx1 := btcjson.TxRawResult{
+		Txid: "239e007dc20805add047d305cdfb87de1bae9bea1e47acbf58f38731ad58d70d",
+		Vout: []btcjson.Vout{
+			{Value: 0.1, ScriptPubKey: btcjson.ScriptPubKeyResult{Addresses: []string{addr}}},
+			{Value: 0.2, ScriptPubKey: btcjson.ScriptPubKeyResult{Addresses: []string{"1LEkderht5M5yWj82M87bEd4XDBsczLkp9"}}},
+		},
+	}
+	tx2 := btcjson.TxRawResult{
+		Txid: "bf41a5352b6d59a401cd946432117b25fd5fc43186aef5cbbe3170c40050d104",
+		Vout: []btcjson.Vout{
+			{Value: 0.3, ScriptPubKey: btcjson.ScriptPubKeyResult{Addresses: []string{"1LEkderht5M5yWj82M87bEd4XDBsczLkp9"}}},
+		},
+	}
+
+	rpc.mempool = map[string]btcjson.TxRawResult{
+		tx1.Txid: tx1,
+		tx2.Txid: tx2,
+	}
+	rpc.confirmedTxs = make(map[string]btcjson.TxRawResult)
+
+	// The output to the scan address is recorded as an unconfirmed deposit
+	err = scr.scanMempool()
+	require.NoError(t, err)
+
+	dvs, err := store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.NotZero(t, dvs[0].SeenAt)
+	seenAt := dvs[0].SeenAt
+	require.Equal(t, Deposit{
+		CoinType: CoinTypeBTC,
+		Address:  addr,
+		Value:    1e7,
+		Tx:       tx1.Txid,
+		Status:   DepositUnconfirmed,
+	}, dvs[0].Deposit)
+	require.Equal(t, 2, rpc.rawTransactionCallCount)
+
+	// It is not a deposit to process yet
+	unprocessed, err := store.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Empty(t, unprocessed)
+
+	// The mempool transactions are only fetched once
+	err = scr.scanMempool()
+	require.NoError(t, err)
+	require.Equal(t, 2, rpc.rawTransactionCallCount)
+
+	dvs, err = store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.Equal(t, seenAt, dvs[0].SeenAt)
+
+	// The transaction is included in a block, which is not scanned yet
+	delete(rpc.mempool, tx1.Txid)
+	rpc.confirmedTxs[tx1.Txid] = tx1
+
+	err = scr.scanMempool()
+	require.NoError(t, err)
+
+	dvs, err = store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.Equal(t, tx1.Txid, dvs[0].Tx)
+
+	// Scanning the block confirms the deposit
+	block, err := btcBlock2CommonBlock(&btcjson.GetBlockVerboseResult{
+		Hash:   "000000000000018d8ece83a004c5a919210d67798d13aa901c4d07f8bf87b719",
+		Height: 235206,
+		RawTx:  []btcjson.TxRawResult{tx1},
+	}, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	scanned, err := store.ScanBlock(block, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, scanned, 1)
+	require.Equal(t, dvs[0].ID(), scanned[0].ID())
+
+	dvs, err = store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+
+	// A confirmed deposit is not recorded as unconfirmed again
+	rpc.mempool[tx1.Txid] = tx1
+	err = scr.scanMempool()
+	require.NoError(t, err)
+
+	dvs, err = store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+
+	// A transaction dropped from the mempool removes its unconfirmed deposit
+	delete(rpc.mempool, tx1.Txid)
+	tx3 := btcjson.TxRawResult{
+		Txid: "d61be86942d69dc7ba6d49c817957ecd0918798f030c73739206e6f48fe2a7c5",
+		Vout: []btcjson.Vout{
+			{Value: 1, ScriptPubKey: btcjson.ScriptPubKeyResult{Addresses: []string{addr}}},
+		},
+	}
+	rpc.mempool[tx3.Txid] = tx3
+
+	err = scr.scanMempool()
+	require.NoError(t, err)
+
+	dvs, err = store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.Equal(t, tx3.Txid, dvs[0].Tx)
+	require.Equal(t, int64(1e8), dvs[0].Value)
+
+	delete(rpc.mempool, tx3.Txid)
+	err = scr.scanMempool()
+	require.NoError(t, err)
+
+	dvs, err = store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+}
+
+func TestBtcScannerNotifications(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	scr := setupBtcScannerWithDB(t, nil, db)
+
+	// A client without a websocket connection can't notify
+	err := scr.EnableNotifications(NewBtcNotifications())
+	require.Equal(t, ErrBtcNotificationsUnsupported, err)
+
+	rpc := &dummyBtcNotifier{
+		dummyBtcrpcclient: scr.btcClient.(*dummyBtcrpcclient),
+	}
+	scr.btcClient = rpc
+
+	ntfns := NewBtcNotifications()
+	err = scr.EnableNotifications(ntfns)
+	require.NoError(t, err)
+
+	waitFor := func(cond func() bool) {
+		for i := 0; i < 500; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("Timed out")
+	}
+
+	waitNotified := func() {
+		select {
+		case <-scr.Base.GetNotifyChan():
+		case <-time.After(time.Second * 5):
+			t.Fatal("Scan was not notified")
+		}
+	}
+
+	addr1 := "1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA"
+	addr2 := "1LEkderht5M5yWj82M87bEd4XDBsczLkp9"
+
+	// Not subscribed until connected
+	rpc.setDisconnected(true)
+	err = scr.AddScanAddress(addr1, CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scr.runNotifications(stop)
+	}()
+
+	handlers := ntfns.Handlers()
+	scanPeriod := scr.Base.(*BaseScanner).Cfg.ScanPeriod
+	notifyScanPeriod := scr.Base.(*BaseScanner).Cfg.NotifyScanPeriod
+	require.Equal(t, scanPeriod, scr.Base.GetScanPeriod())
+
+	// Connecting subscribes to blocks and to the scan addresses, then scans what was missed
+	rpc.setDisconnected(false)
+	handlers.OnClientConnected()
+	waitNotified()
+
+	n, addrs := rpc.state()
+	require.Equal(t, 1, n)
+	require.Equal(t, []string{addr1}, addrs)
+	require.Equal(t, notifyScanPeriod, scr.Base.GetScanPeriod())
+
+	// A new scan address is subscribed to
+	err = scr.AddScanAddress(addr2, CoinTypeBTC, "")
+	require.NoError(t, err)
+	_, addrs = rpc.state()
+	require.Equal(t, []string{addr1, addr2}, addrs)
+
+	// A new block wakes up the scan
+	handlers.OnBlockConnected(nil, 0, time.Time{})
+	waitNotified()
+
+	// A transaction to a scan address wakes up the mempool scan
+	<-scr.mempoolC
+	handlers.OnRecvTx(nil, nil)
+	select {
+	case <-scr.mempoolC:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Mempool scan was not notified")
+	}
+
+	// Polling every ScanPeriod while disconnected
+	rpc.setDisconnected(true)
+	waitFor(func() bool {
+		return scr.Base.GetScanPeriod() == scanPeriod
+	})
+
+	// Subscribed again once reconnected
+	rpc.setDisconnected(false)
+	waitFor(func() bool {
+		return scr.Base.GetScanPeriod() == notifyScanPeriod
+	})
+
+	n, addrs = rpc.state()
+	require.Equal(t, 2, n)
+	require.ElementsMatch(t, []string{addr1, addr2, addr1, addr2}, addrs)
+
+	close(stop)
+	<-done
+}
+
+func TestBtcTx2CommonTxNetwork(t *testing.T) {
+	tx := btcjson.TxRawResult{
+		Txid: "bf41a5352b6d59a401cd946432117b25fd5fc43186aef5cbbe3170c40050d104",
+		Vout: []btcjson.Vout{
+			{
+				// Decoded by the node
+				Value: 0.1,
+				ScriptPubKey: btcjson.ScriptPubKeyResult{
+					Hex:       "76a914243f1394f44554f4ce3fd68649c19adc483ce92488ac",
+					Addresses: []string{"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"},
+				},
+			},
+			{
+				// Not decoded by the node
+				Value: 0.2,
+				ScriptPubKey: btcjson.ScriptPubKeyResult{
+					Hex: "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+				},
+			},
+			{
+				Value: 0,
+				ScriptPubKey: btcjson.ScriptPubKeyResult{
+					Hex: "6a04aa21a9ed",
+				},
+			},
+		},
+	}
+
+	ctx, err := btcTx2CommonTx(tx, &chaincfg.TestNet3Params)
+	require.NoError(t, err)
+	require.Len(t, ctx.Vout, 3)
+	require.Equal(t, []string{"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"}, ctx.Vout[0].Addresses)
+	require.Equal(t, []string{"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}, ctx.Vout[1].Addresses)
+	require.Equal(t, int64(2e7), ctx.Vout[1].Value)
+	require.Empty(t, ctx.Vout[2].Addresses)
+
+	ctx, err = btcTx2CommonTx(tx, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}, ctx.Vout[1].Addresses)
+}
@@ -42,7 +42,7 @@ func (s *DummyScanner) RegisterCoinType(coinType string) {
 }
 
 // AddScanAddress adds an address
-func (s *DummyScanner) AddScanAddress(addr, coinType string) error {
+func (s *DummyScanner) AddScanAddress(addr, coinType, kittyID string) error {
 	s.Lock()
 	defer s.Unlock()
 
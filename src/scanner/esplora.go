@@ -0,0 +1,193 @@
+package scanner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	esploraRequestTimeout = time.Second * 30
+	// esploraTxsPageSize is the number of confirmed transactions returned per page of an address history
+	esploraTxsPageSize = 25
+)
+
+// ErrEsploraNotFound is returned if the Esplora API does not know the requested block or transaction
+var ErrEsploraNotFound = errors.New("Not found by the Esplora API")
+
+// EsploraTxStatus is the confirmation status of a transaction returned by the Esplora API
+type EsploraTxStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight int64  `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+	BlockTime   int64  `json:"block_time"`
+}
+
+// EsploraVout is a transaction output returned by the Esplora API
+type EsploraVout struct {
+	ScriptPubKey        string `json:"scriptpubkey"`
+	ScriptPubKeyType    string `json:"scriptpubkey_type"`
+	ScriptPubKeyAddress string `json:"scriptpubkey_address"`
+	Value               int64  `json:"value"` // satoshis
+}
+
+// EsploraTx is a transaction returned by the Esplora API
+type EsploraTx struct {
+	Txid   string          `json:"txid"`
+	Vout   []EsploraVout   `json:"vout"`
+	Status EsploraTxStatus `json:"status"`
+}
+
+// EsploraBlock is a block header returned by the Esplora API
+type EsploraBlock struct {
+	ID                string `json:"id"`
+	Height            int64  `json:"height"`
+	PreviousBlockHash string `json:"previousblockhash"`
+	Timestamp         int64  `json:"timestamp"`
+}
+
+// EsploraClient implements the BtcIndexerClient interface for an Esplora-compatible REST API,
+// such as blockstream's electrs or a self-hosted esplora instance
+type EsploraClient struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewEsploraClient creates an EsploraClient for the API at baseURL, e.g. https://blockstream.info/api
+func NewEsploraClient(baseURL string) *EsploraClient {
+	return &EsploraClient{
+		url: strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{
+			Timeout: esploraRequestTimeout,
+		},
+	}
+}
+
+// get requests a path of the API and returns the response body.
+// ErrEsploraNotFound is returned if the API replies with 404.
+func (c *EsploraClient) get(path string) ([]byte, error) {
+	resp, err := c.httpClient.Get(c.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, ErrEsploraNotFound
+	default:
+		return nil, fmt.Errorf("esplora GET %s failed: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// getJSON requests a path of the API and decodes the JSON response into v
+func (c *EsploraClient) getJSON(path string, v interface{}) error {
+	body, err := c.get(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// GetTipHeight returns the height of the best block
+func (c *EsploraClient) GetTipHeight() (int64, error) {
+	body, err := c.get("/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+// GetBlockHash returns the hash of the block at a height in the main chain
+func (c *EsploraClient) GetBlockHash(height int64) (string, error) {
+	body, err := c.get(fmt.Sprintf("/block-height/%d", height))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// GetBlock returns a block header
+func (c *EsploraClient) GetBlock(hash string) (*EsploraBlock, error) {
+	var b EsploraBlock
+	if err := c.getJSON("/block/"+url.PathEscape(hash), &b); err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// GetAddressTxs returns a page of the confirmed transactions of an address, newest first.
+// The first page is returned if lastSeenTxid is empty, otherwise the page after the transaction lastSeenTxid.
+func (c *EsploraClient) GetAddressTxs(addr, lastSeenTxid string) ([]EsploraTx, error) {
+	path := "/address/" + url.PathEscape(addr) + "/txs/chain"
+	if lastSeenTxid != "" {
+		path += "/" + url.PathEscape(lastSeenTxid)
+	}
+
+	var txs []EsploraTx
+	if err := c.getJSON(path, &txs); err != nil {
+		return nil, err
+	}
+
+	return txs, nil
+}
+
+// GetAddressMempoolTxs returns the unconfirmed transactions of an address
+func (c *EsploraClient) GetAddressMempoolTxs(addr string) ([]EsploraTx, error) {
+	var txs []EsploraTx
+	if err := c.getJSON("/address/"+url.PathEscape(addr)+"/txs/mempool", &txs); err != nil {
+		return nil, err
+	}
+
+	return txs, nil
+}
+
+// GetTxStatus returns the confirmation status of a transaction.
+// ErrEsploraNotFound is returned if the transaction is neither in the mempool nor in the chain.
+func (c *EsploraClient) GetTxStatus(txid string) (*EsploraTxStatus, error) {
+	var status EsploraTxStatus
+	if err := c.getJSON("/tx/"+url.PathEscape(txid)+"/status", &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// esploraTx2CommonTx converts an Esplora transaction to a common transaction.
+// The vout index is kept as N, since outputs without an address are kept too.
+func esploraTx2CommonTx(tx EsploraTx) CommonTx {
+	cbTx := CommonTx{
+		Txid: tx.Txid,
+		Vout: make([]CommonVout, 0, len(tx.Vout)),
+	}
+
+	for i, v := range tx.Vout {
+		cv := CommonVout{
+			Value: v.Value,
+			N:     uint32(i),
+		}
+		if v.ScriptPubKeyAddress != "" {
+			cv.Addresses = []string{v.ScriptPubKeyAddress}
+		}
+		cbTx.Vout = append(cbTx.Vout, cv)
+	}
+
+	return cbTx
+}
@@ -0,0 +1,545 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+// fakeEsplora is a stand-in for an Esplora API, serving a chain of blocks without transactions
+// and the transaction histories of addresses
+type fakeEsplora struct {
+	sync.Mutex
+	t *testing.T
+	// hashes are the block hashes by height
+	hashes map[int64]string
+	tip    int64
+	// txs are the transactions by txid
+	txs map[string]EsploraTx
+	// history are the txids of each address, oldest first
+	history map[string][]string
+	mempool map[string]struct{}
+	// blockHeights are the heights requested from /block-height
+	blockHeights []int64
+}
+
+func newFakeEsplora(t *testing.T, tip int64) *fakeEsplora {
+	f := &fakeEsplora{
+		t:       t,
+		hashes:  make(map[int64]string),
+		txs:     make(map[string]EsploraTx),
+		history: make(map[string][]string),
+		mempool: make(map[string]struct{}),
+	}
+	f.setTip(tip)
+	return f
+}
+
+func fakeEsploraBlockHash(height int64) string {
+	return fmt.Sprintf("%064x", height)
+}
+
+func (f *fakeEsplora) setTip(tip int64) {
+	f.Lock()
+	defer f.Unlock()
+	for h := f.tip + 1; h <= tip; h++ {
+		f.hashes[h] = fakeEsploraBlockHash(h)
+	}
+	f.tip = tip
+}
+
+// addTx adds a transaction paying values to addresses, confirmed at height or in the mempool if height is 0
+func (f *fakeEsplora) addTx(txid string, height int64, outputs ...EsploraVout) {
+	f.Lock()
+	defer f.Unlock()
+
+	tx := EsploraTx{
+		Txid: txid,
+		Vout: outputs,
+	}
+	if height != 0 {
+		tx.Status = EsploraTxStatus{
+			Confirmed:   true,
+			BlockHeight: height,
+			BlockHash:   fakeEsploraBlockHash(height),
+		}
+	} else {
+		f.mempool[txid] = struct{}{}
+	}
+	f.txs[txid] = tx
+
+	seen := make(map[string]struct{})
+	for _, v := range outputs {
+		if _, ok := seen[v.ScriptPubKeyAddress]; ok || v.ScriptPubKeyAddress == "" {
+			continue
+		}
+		seen[v.ScriptPubKeyAddress] = struct{}{}
+		f.history[v.ScriptPubKeyAddress] = append(f.history[v.ScriptPubKeyAddress], txid)
+	}
+}
+
+// confirmTx moves a mempool transaction to a block
+func (f *fakeEsplora) confirmTx(txid string, height int64) {
+	f.Lock()
+	defer f.Unlock()
+
+	tx := f.txs[txid]
+	tx.Status = EsploraTxStatus{
+		Confirmed:   true,
+		BlockHeight: height,
+		BlockHash:   fakeEsploraBlockHash(height),
+	}
+	f.txs[txid] = tx
+	delete(f.mempool, txid)
+}
+
+// dropTx removes a mempool transaction
+func (f *fakeEsplora) dropTx(txid string) {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.txs, txid)
+	delete(f.mempool, txid)
+	for addr, txids := range f.history {
+		for i, id := range txids {
+			if id == txid {
+				f.history[addr] = append(txids[:i:i], txids[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (f *fakeEsplora) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	require.Equal(f.t, http.MethodGet, r.Method)
+
+	writeJSON := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(v)
+		require.NoError(f.t, err)
+	}
+
+	notFound := func(msg string) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, msg)
+	}
+
+	pts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/blocks/tip/height":
+		fmt.Fprint(w, f.tip)
+
+	case len(pts) == 2 && pts[0] == "block-height":
+		height, err := strconv.ParseInt(pts[1], 10, 64)
+		require.NoError(f.t, err)
+		f.blockHeights = append(f.blockHeights, height)
+		hash, ok := f.hashes[height]
+		if !ok {
+			notFound("Block not found")
+			return
+		}
+		fmt.Fprint(w, hash)
+
+	case len(pts) == 2 && pts[0] == "block":
+		for height, hash := range f.hashes {
+			if hash == pts[1] {
+				writeJSON(EsploraBlock{
+					ID:                hash,
+					Height:            height,
+					PreviousBlockHash: f.hashes[height-1],
+				})
+				return
+			}
+		}
+		notFound("Block not found")
+
+	case len(pts) >= 4 && pts[0] == "address" && pts[2] == "txs" && pts[3] == "chain":
+		txids := f.history[pts[1]]
+		// Newest first, paged after the last seen transaction
+		var page []EsploraTx
+		seen := len(pts) == 4
+		for i := len(txids) - 1; i >= 0 && len(page) < esploraTxsPageSize; i-- {
+			tx := f.txs[txids[i]]
+			if !seen {
+				seen = tx.Txid == pts[4]
+				continue
+			}
+			if tx.Status.Confirmed && tx.Status.BlockHeight <= f.tip {
+				page = append(page, tx)
+			}
+		}
+		writeJSON(page)
+
+	case len(pts) == 4 && pts[0] == "address" && pts[2] == "txs" && pts[3] == "mempool":
+		page := []EsploraTx{}
+		for _, txid := range f.history[pts[1]] {
+			if _, ok := f.mempool[txid]; ok {
+				page = append(page, f.txs[txid])
+			}
+		}
+		writeJSON(page)
+
+	case len(pts) == 3 && pts[0] == "tx" && pts[2] == "status":
+		tx, ok := f.txs[pts[1]]
+		if !ok {
+			notFound("Transaction not found")
+			return
+		}
+		writeJSON(tx.Status)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request")
+	}
+}
+
+func (f *fakeEsplora) getBlockHeights() []int64 {
+	f.Lock()
+	defer f.Unlock()
+	return append([]int64{}, f.blockHeights...)
+}
+
+func TestEsploraClient(t *testing.T) {
+	f := newFakeEsplora(t, 110)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	addr := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	for i := 0; i < 30; i++ {
+		f.addTx(fmt.Sprintf("tx%d", i), int64(100+i/3), EsploraVout{
+			ScriptPubKeyAddress: addr,
+			Value:               int64(i),
+		})
+	}
+	f.addTx("mempool", 0, EsploraVout{
+		ScriptPubKeyAddress: addr,
+		Value:               1e8,
+	})
+
+	c := NewEsploraClient(srv.URL + "/")
+
+	tip, err := c.GetTipHeight()
+	require.NoError(t, err)
+	require.Equal(t, int64(110), tip)
+
+	hash, err := c.GetBlockHash(105)
+	require.NoError(t, err)
+	require.Equal(t, fakeEsploraBlockHash(105), hash)
+
+	_, err = c.GetBlockHash(111)
+	require.Equal(t, ErrEsploraNotFound, err)
+
+	block, err := c.GetBlock(hash)
+	require.NoError(t, err)
+	require.Equal(t, &EsploraBlock{
+		ID:                hash,
+		Height:            105,
+		PreviousBlockHash: fakeEsploraBlockHash(104),
+	}, block)
+
+	// Confirmed transactions are paged, newest first
+	txs, err := c.GetAddressTxs(addr, "")
+	require.NoError(t, err)
+	require.Len(t, txs, esploraTxsPageSize)
+	require.Equal(t, "tx29", txs[0].Txid)
+	require.Equal(t, int64(109), txs[0].Status.BlockHeight)
+	require.Equal(t, int64(29), txs[0].Vout[0].Value)
+
+	txs, err = c.GetAddressTxs(addr, txs[len(txs)-1].Txid)
+	require.NoError(t, err)
+	require.Len(t, txs, 5)
+	require.Equal(t, "tx0", txs[4].Txid)
+
+	txs, err = c.GetAddressMempoolTxs(addr)
+	require.NoError(t, err)
+	require.Len(t, txs, 1)
+	require.Equal(t, "mempool", txs[0].Txid)
+	require.False(t, txs[0].Status.Confirmed)
+
+	status, err := c.GetTxStatus("tx3")
+	require.NoError(t, err)
+	require.True(t, status.Confirmed)
+	require.Equal(t, fakeEsploraBlockHash(101), status.BlockHash)
+
+	_, err = c.GetTxStatus("unknown")
+	require.Equal(t, ErrEsploraNotFound, err)
+
+	_, err = c.GetBlock("invalid/path")
+	require.Error(t, err)
+	require.NotEqual(t, ErrEsploraNotFound, err)
+}
+
+func setupEsploraScanner(t *testing.T, f *fakeEsplora, cfg Config) (*BTCEsploraScanner, *Store, func()) {
+	srv := httptest.NewServer(f)
+	db, shutdown := testutil.PrepareDB(t)
+
+	log, _ := testutil.NewLogger(t)
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	scr, err := NewBTCEsploraScanner(log, store, NewEsploraClient(srv.URL), cfg)
+	require.NoError(t, err)
+
+	return scr, store, func() {
+		shutdown()
+		srv.Close()
+	}
+}
+
+func TestBTCEsploraScanner(t *testing.T) {
+	f := newFakeEsplora(t, 150)
+
+	addr1 := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	addr2 := "1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA"
+	addr3 := "bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"
+
+	// Before the initial scan height
+	f.addTx("old", 99, EsploraVout{ScriptPubKeyAddress: addr1, Value: 1})
+	// The deposit's vout index is kept
+	f.addTx("a", 101,
+		EsploraVout{ScriptPubKeyAddress: "1LEkderht5M5yWj82M87bEd4XDBsczLkp9", Value: 2},
+		EsploraVout{ScriptPubKeyAddress: addr1, Value: 3},
+	)
+	// Paying two scan addresses
+	f.addTx("b", 120,
+		EsploraVout{ScriptPubKeyAddress: addr2, Value: 4},
+		EsploraVout{ScriptPubKeyType: "op_return"},
+		EsploraVout{ScriptPubKeyAddress: addr1, Value: 5},
+	)
+	// Not enough confirmations
+	f.addTx("c", 149, EsploraVout{ScriptPubKeyAddress: addr1, Value: 6})
+
+	scr, store, shutdown := setupEsploraScanner(t, f, Config{
+		ScanPeriod:            time.Millisecond * 10,
+		InitialScanHeight:     100,
+		ConfirmationsRequired: 2,
+	})
+	defer shutdown()
+
+	err := scr.AddScanAddress(addr1, CoinTypeBTC, "")
+	require.NoError(t, err)
+	err = scr.AddScanAddress(addr2, CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := scr.Run()
+		require.NoError(t, err)
+	}()
+
+	nextDeposit := func() Deposit {
+		select {
+		case dn := <-scr.GetDeposit():
+			dn.ErrC <- nil
+			return dn.Deposit
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for a deposit")
+			return Deposit{}
+		}
+	}
+
+	noDeposit := func() {
+		select {
+		case dn := <-scr.GetDeposit():
+			t.Fatalf("Unexpected deposit %v", dn.Deposit)
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+
+	waitLastScanned := func(height int64) {
+		for i := 0; i < 500; i++ {
+			lsb, err := store.GetLastScannedBlock(CoinTypeBTC)
+			require.NoError(t, err)
+			if lsb != nil && lsb.Height == height {
+				require.Equal(t, fakeEsploraBlockHash(height), lsb.Hash)
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("Timed out waiting for block %d to be scanned", height)
+	}
+
+	require.Equal(t, Deposit{
+		CoinType: CoinTypeBTC,
+		Address:  addr1,
+		Value:    3,
+		Height:   101,
+		Tx:       "a",
+		N:        1,
+		Status:   DepositNotProcessed,
+	}, nextDeposit())
+
+	dvs := []Deposit{nextDeposit(), nextDeposit()}
+	require.ElementsMatch(t, []Deposit{
+		{
+			CoinType: CoinTypeBTC,
+			Address:  addr2,
+			Value:    4,
+			Height:   120,
+			Tx:       "b",
+			N:        0,
+			Status:   DepositNotProcessed,
+		},
+		{
+			CoinType: CoinTypeBTC,
+			Address:  addr1,
+			Value:    5,
+			Height:   120,
+			Tx:       "b",
+			N:        2,
+			Status:   DepositNotProcessed,
+		},
+	}, dvs)
+
+	waitLastScanned(148)
+	noDeposit()
+
+	// Blocks without deposits were skipped
+	require.True(t, len(f.getBlockHeights()) < 20, "%v", f.getBlockHeights())
+
+	// The deposit is sent once it has enough confirmations
+	f.setTip(151)
+	waitLastScanned(149)
+	require.Equal(t, "c", nextDeposit().Tx)
+
+	// The history of an added address is fetched
+	f.addTx("d", 152, EsploraVout{ScriptPubKeyAddress: addr3, Value: 7})
+	err = scr.AddScanAddress(addr3, CoinTypeBTC, "")
+	require.NoError(t, err)
+	f.setTip(154)
+
+	dv := nextDeposit()
+	require.Equal(t, "d", dv.Tx)
+	require.Equal(t, addr3, dv.Address)
+	require.Equal(t, int64(152), dv.Height)
+	waitLastScanned(152)
+	noDeposit()
+
+	scr.Shutdown()
+	<-done
+
+	dvs, err = store.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+}
+
+func TestBTCEsploraScannerMempool(t *testing.T) {
+	f := newFakeEsplora(t, 100)
+
+	addr := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	f.addTx("a", 0, EsploraVout{ScriptPubKeyAddress: addr, Value: 1})
+	f.addTx("b", 0,
+		EsploraVout{ScriptPubKeyAddress: "1LEkderht5M5yWj82M87bEd4XDBsczLkp9", Value: 2},
+		EsploraVout{ScriptPubKeyAddress: addr, Value: 3},
+	)
+
+	scr, store, shutdown := setupEsploraScanner(t, f, Config{
+		ScanMempool: true,
+	})
+	defer shutdown()
+
+	err := scr.AddScanAddress(addr, CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	unconfirmedTxs := func() []string {
+		dvs, err := store.GetUnconfirmedDeposits(CoinTypeBTC)
+		require.NoError(t, err)
+		var txs []string
+		for _, dv := range dvs {
+			require.Equal(t, addr, dv.Address)
+			txs = append(txs, fmt.Sprintf("%s:%d", dv.Tx, dv.Value))
+		}
+		return txs
+	}
+
+	err = scr.scanMempool()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a:1", "b:3"}, unconfirmedTxs())
+
+	// A confirmed transaction is kept until its block is scanned, a dropped one is removed
+	f.confirmTx("a", 101)
+	f.dropTx("b")
+
+	err = scr.scanMempool()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1"}, unconfirmedTxs())
+}
+
+func TestBTCEsploraScannerRescan(t *testing.T) {
+	f := newFakeEsplora(t, 150)
+
+	addr1 := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	addr2 := "1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA"
+
+	// Before the rescanned range
+	f.addTx("old", 99, EsploraVout{ScriptPubKeyAddress: addr1, Value: 1})
+	f.addTx("a", 105,
+		EsploraVout{ScriptPubKeyAddress: addr2, Value: 2},
+		EsploraVout{ScriptPubKeyAddress: addr1, Value: 3},
+	)
+	// Only to an address that is not rescanned
+	f.addTx("b", 110, EsploraVout{ScriptPubKeyAddress: addr2, Value: 4})
+	// After the rescanned range
+	f.addTx("c", 130, EsploraVout{ScriptPubKeyAddress: addr1, Value: 5})
+	// In the mempool
+	f.addTx("d", 0, EsploraVout{ScriptPubKeyAddress: addr1, Value: 6})
+
+	scr, store, shutdown := setupEsploraScanner(t, f, Config{})
+	defer shutdown()
+
+	p, err := scr.Rescan(RescanRequest{
+		CoinType:   CoinTypeBTC,
+		FromHeight: 100,
+		ToHeight:   120,
+		Addresses:  []string{addr1},
+	}, nil)
+	require.NoError(t, err)
+	require.True(t, p.Done)
+	require.Equal(t, int64(120), p.Height)
+	require.Equal(t, 1, p.Found)
+	require.Equal(t, []Deposit{
+		{
+			CoinType: CoinTypeBTC,
+			Address:  addr1,
+			Value:    3,
+			Height:   105,
+			Tx:       "a",
+			N:        1,
+			Status:   DepositNotProcessed,
+		},
+	}, p.Deposits)
+
+	dvs, err := store.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Equal(t, p.Deposits, dvs)
+
+	// Blocks are not downloaded
+	require.Empty(t, f.getBlockHeights())
+
+	// Heights past the tip are not made of the histories
+	p, err = scr.Rescan(RescanRequest{
+		CoinType:   CoinTypeBTC,
+		FromHeight: 140,
+		ToHeight:   151,
+		Addresses:  []string{addr1},
+	}, nil)
+	require.Error(t, err)
+	require.True(t, p.Done)
+	require.Equal(t, int64(139), p.Height)
+}
@@ -0,0 +1,371 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/util/ethutil"
+	"github.com/kittycash/teller/src/util/mathutil"
+)
+
+const ethRPCTimeout = time.Second * 30
+
+var (
+	// ErrEthBlockNotFound is returned by EthClient when the requested block does not exist yet
+	ErrEthBlockNotFound = errors.New("ethereum block not found")
+)
+
+// EthBlock is the block returned by geth's eth_getBlockByNumber with full transactions
+type EthBlock struct {
+	Number       string           `json:"number"`
+	Hash         string           `json:"hash"`
+	ParentHash   string           `json:"parentHash"`
+	Transactions []EthTransaction `json:"transactions"`
+}
+
+// EthTransaction is a transaction included in an EthBlock
+type EthTransaction struct {
+	Hash  string `json:"hash"`
+	From  string `json:"from"`
+	To    string `json:"to"` // empty for contract creation transactions
+	Value string `json:"value"`
+}
+
+// ETHScanner blockchain scanner to check if there're deposit coins
+type ETHScanner struct {
+	log       logrus.FieldLogger
+	ethClient EthRPCClient
+	// Deposit value channel, exposed by public API, intended for public consumption
+	Base CommonScanner
+}
+
+// EthClient implements the EthRPCClient interface with geth's HTTP JSON-RPC API
+type EthClient struct {
+	url    string
+	c      *http.Client
+	nextID uint64
+}
+
+// NewEthClient create a new ethclient instance
+func NewEthClient(server, port string) *EthClient {
+	return &EthClient{
+		url: fmt.Sprintf("http://%s:%s", server, port),
+		c: &http.Client{
+			Timeout: ethRPCTimeout,
+		},
+	}
+}
+
+// NewETHScanner creates scanner instance
+func NewETHScanner(log logrus.FieldLogger, store Storer, eth EthRPCClient, cfg Config) (*ETHScanner, error) {
+	bs := NewBaseScanner(store, log.WithField("prefix", "scanner.eth"), CoinTypeETH, cfg)
+
+	return &ETHScanner{
+		ethClient: eth,
+		log:       log.WithField("prefix", "scanner.eth"),
+		Base:      bs,
+	}, nil
+}
+
+// Run begins the ETHScanner
+func (s *ETHScanner) Run() error {
+	return s.Base.Run(s.ethClient.GetBlockCount, s.getBlockAtHeight, s.waitForNextBlock, s.scanBlock, s.scanBlocks)
+}
+
+// Shutdown shutdown the scanner
+func (s *ETHScanner) Shutdown() {
+	s.log.Info("Closing ETH scanner")
+	s.ethClient.Shutdown()
+	s.Base.Shutdown()
+	s.log.Info("Waiting for ETH scanner to stop")
+	s.log.Info("ETH scanner stopped")
+}
+
+// Rescan scans the blocks of a height range again for deposits to the request's addresses, and adds the missed deposits
+func (s *ETHScanner) Rescan(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+	return s.Base.Rescan(req, s.ethClient.GetBlockCount, s.getBlockAtHeight, progress)
+}
+
+// scanBlock scans for a new ETH block every ScanPeriod.
+// When a new block is found, it compares the block against our scanning
+// deposit addresses. If a matching deposit is found, it saves it to the DB.
+func (s *ETHScanner) scanBlock(block *CommonBlock) (int, error) {
+	log := s.log.WithField("hash", block.Hash)
+	log = log.WithField("height", block.Height)
+
+	log.Debug("Scanning block")
+
+	dvs, err := s.Base.GetStorer().ScanBlock(block, CoinTypeETH)
+	if err != nil {
+		log.WithError(err).Error("store.ScanBlock failed")
+		return 0, err
+	}
+
+	log = log.WithField("scannedDeposits", len(dvs))
+	log.Infof("Counted %d deposits from block", len(dvs))
+
+	n := 0
+	for _, dv := range dvs {
+		select {
+		case s.Base.GetScannedDepositChan() <- dv:
+			n++
+		case <-s.Base.GetQuitChan():
+			return n, errQuit
+		}
+	}
+
+	return n, nil
+}
+
+// scanBlocks scans consecutive ETH blocks while catching up with the chain, with one store write
+func (s *ETHScanner) scanBlocks(blocks []*CommonBlock) (int, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"fromHeight": blocks[0].Height,
+		"toHeight":   blocks[len(blocks)-1].Height,
+	})
+
+	log.Debug("Scanning blocks")
+
+	dvs, err := s.Base.GetStorer().ScanBlocks(blocks, CoinTypeETH)
+	if err != nil {
+		log.WithError(err).Error("store.ScanBlocks failed")
+		return 0, err
+	}
+
+	log = log.WithField("scannedDeposits", len(dvs))
+	log.Infof("Counted %d deposits from %d blocks", len(dvs), len(blocks))
+
+	n := 0
+	for _, dv := range dvs {
+		select {
+		case s.Base.GetScannedDepositChan() <- dv:
+			n++
+		case <-s.Base.GetQuitChan():
+			return n, errQuit
+		}
+	}
+
+	return n, nil
+}
+
+type ethRPCRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type ethRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ethRPCError) Error() string {
+	return fmt.Sprintf("geth rpc error %d: %s", e.Code, e.Message)
+}
+
+type ethRPCResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *ethRPCError    `json:"error"`
+}
+
+// call makes a JSON-RPC request to geth and decodes the result into v
+func (ec *EthClient) call(v interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	req := ethRPCRequest{
+		JSONRPC: "2.0",
+		ID:      atomic.AddUint64(&ec.nextID, 1),
+		Method:  method,
+		Params:  params,
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ec.c.Post(ec.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geth rpc %s returned status %d", method, resp.StatusCode)
+	}
+
+	var rpcResp ethRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return err
+	}
+
+	if rpcResp.Error != nil {
+		return rpcResp.Error
+	}
+
+	return json.Unmarshal(rpcResp.Result, v)
+}
+
+// GetBlockCount returns the height of the latest ethereum block
+func (ec *EthClient) GetBlockCount() (int64, error) {
+	var number string
+	if err := ec.call(&number, "eth_blockNumber"); err != nil {
+		logrus.WithError(err).Error("ethClient.GetBlockCount failed")
+		return 0, err
+	}
+
+	return parseHexInt64(number)
+}
+
+// GetBlockVerboseTx returns ethereum block data with full transactions for a given height.
+// Returns ErrEthBlockNotFound if the block does not exist yet.
+func (ec *EthClient) GetBlockVerboseTx(seq uint64) (*EthBlock, error) {
+	var block *EthBlock
+	if err := ec.call(&block, "eth_getBlockByNumber", fmt.Sprintf("0x%x", seq), true); err != nil {
+		logrus.WithError(err).Error("ethClient.GetBlockVerboseTx failed")
+		return nil, err
+	}
+
+	// geth returns a null result for blocks beyond the tip
+	if block == nil {
+		return nil, ErrEthBlockNotFound
+	}
+
+	return block, nil
+}
+
+// Shutdown placeholder
+func (ec *EthClient) Shutdown() {
+}
+
+// getBlockAtHeight returns that block at a specific height
+func (s *ETHScanner) getBlockAtHeight(height int64) (*CommonBlock, error) {
+	block, err := s.ethClient.GetBlockVerboseTx(uint64(height))
+	if err != nil {
+		return nil, err
+	}
+	return ethBlock2CommonBlock(block)
+}
+
+// ethBlock2CommonBlock convert ethereum block to common block
+func ethBlock2CommonBlock(block *EthBlock) (*CommonBlock, error) {
+	height, err := parseHexInt64(block.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	cb := CommonBlock{}
+	cb.Hash = block.Hash
+	cb.PrevHash = block.ParentHash
+	cb.Height = height
+	cb.RawTx = make([]CommonTx, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		cbTx := CommonTx{}
+		cbTx.Txid = tx.Hash
+
+		// An ethereum transaction has a single recipient and no outputs.
+		// Contract creation transactions have no recipient and are skipped.
+		if tx.To != "" {
+			// Deposit addresses are stored in checksum encoding,
+			// while geth returns lowercase addresses
+			to, err := ethutil.ChecksumAddress(tx.To)
+			if err != nil {
+				return nil, err
+			}
+
+			wei, ok := new(big.Int).SetString(strings.TrimPrefix(tx.Value, "0x"), 16)
+			if !ok {
+				return nil, fmt.Errorf("Invalid value %q in ethereum transaction %s", tx.Value, tx.Hash)
+			}
+
+			// internally ether is always represented as gwei
+			cv := CommonVout{}
+			cv.Value = mathutil.Wei2Gwei(wei)
+			cv.Addresses = []string{to}
+			cbTx.Vout = []CommonVout{cv}
+		}
+
+		cb.RawTx = append(cb.RawTx, cbTx)
+	}
+
+	return &cb, nil
+}
+
+// parseHexInt64 parses a 0x prefixed hex quantity
+func parseHexInt64(s string) (int64, error) {
+	if !strings.HasPrefix(s, "0x") {
+		return 0, fmt.Errorf("Invalid hex quantity %q", s)
+	}
+
+	return strconv.ParseInt(s[2:], 16, 64)
+}
+
+// getNextBlock returns the next block from another block
+func (s *ETHScanner) getNextBlock(seq int64) (*CommonBlock, error) {
+	b, err := s.ethClient.GetBlockVerboseTx(uint64(seq + 1))
+	if err != nil {
+		return nil, err
+	}
+	return ethBlock2CommonBlock(b)
+}
+
+// waitForNextBlock scans for the next block until it is available
+func (s *ETHScanner) waitForNextBlock(block *CommonBlock) (*CommonBlock, error) {
+	log := s.log.WithField("blockHash", block.Hash)
+	log = log.WithField("blockHeight", block.Height)
+	log.Debug("Waiting for the next block")
+
+	for {
+		nextBlock, err := s.getNextBlock(block.Height)
+		if err != nil {
+			if err == ErrEthBlockNotFound {
+				log.Debug("No new block yet")
+			} else {
+				log.WithError(err).Error("getNextBlock failed")
+			}
+
+			select {
+			case <-s.Base.GetQuitChan():
+				return nil, errQuit
+			case <-time.After(s.Base.GetScanPeriod()):
+				continue
+			}
+		}
+
+		log.WithFields(logrus.Fields{
+			"hash":   nextBlock.Hash,
+			"height": nextBlock.Height,
+		}).Debug("Found nextBlock")
+
+		return nextBlock, nil
+	}
+}
+
+// AddScanAddress adds new scan address
+func (s *ETHScanner) AddScanAddress(addr, coinType, kittyID string) error {
+	return s.Base.GetStorer().AddScanAddress(addr, coinType, kittyID)
+}
+
+// GetScanAddresses returns the deposit addresses that need to scan
+func (s *ETHScanner) GetScanAddresses() ([]string, error) {
+	return s.Base.GetStorer().GetScanAddresses(CoinTypeETH)
+}
+
+// GetDeposit returns channel of depositnote
+func (s *ETHScanner) GetDeposit() <-chan DepositNote {
+	return s.Base.GetDeposit()
+}
@@ -0,0 +1,319 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/dbutil"
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+const (
+	// geth returns addresses in lowercase, deposit addresses are checksummed
+	ethDepositAddr        = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+	ethDepositAddrLower   = "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"
+	ethOtherAddrLower     = "0xfb6916095ca1df60bb79ce92ce3ea74c37c5d359"
+	ethDummyInitialHeight = 100
+)
+
+// dummyEthrpcclient serves ethereum blocks from memory
+type dummyEthrpcclient struct {
+	sync.Mutex
+	blocks          map[uint64]*EthBlock
+	bestHeight      int64
+	blockCountError error
+}
+
+func newDummyEthrpcclient() *dummyEthrpcclient {
+	return &dummyEthrpcclient{
+		blocks: make(map[uint64]*EthBlock),
+	}
+}
+
+func (dec *dummyEthrpcclient) ethBlockHash(height int64) string {
+	return fmt.Sprintf("0x%064x", height)
+}
+
+// addBlock appends a block paying each value in wei to the given lowercase addresses
+func (dec *dummyEthrpcclient) addBlock(height int64, txs ...EthTransaction) {
+	dec.Lock()
+	defer dec.Unlock()
+
+	for i := range txs {
+		txs[i].Hash = fmt.Sprintf("0x%x%02d", height, i)
+	}
+
+	dec.blocks[uint64(height)] = &EthBlock{
+		Number:       fmt.Sprintf("0x%x", height),
+		Hash:         dec.ethBlockHash(height),
+		ParentHash:   dec.ethBlockHash(height - 1),
+		Transactions: txs,
+	}
+
+	if height > dec.bestHeight {
+		dec.bestHeight = height
+	}
+}
+
+func (dec *dummyEthrpcclient) GetBlockCount() (int64, error) {
+	dec.Lock()
+	defer dec.Unlock()
+
+	if dec.blockCountError != nil {
+		// blockCountError is only returned once
+		err := dec.blockCountError
+		dec.blockCountError = nil
+		return 0, err
+	}
+
+	return dec.bestHeight, nil
+}
+
+func (dec *dummyEthrpcclient) GetBlockVerboseTx(seq uint64) (*EthBlock, error) {
+	dec.Lock()
+	defer dec.Unlock()
+
+	b, ok := dec.blocks[seq]
+	if !ok {
+		return nil, ErrEthBlockNotFound
+	}
+
+	return b, nil
+}
+
+func (dec *dummyEthrpcclient) Shutdown() {}
+
+func setupEthScanner(t *testing.T, rpc *dummyEthrpcclient) (*ETHScanner, func()) {
+	db, shutdown := testutil.PrepareDB(t)
+
+	log, _ := testutil.NewLogger(t)
+
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+
+	err = store.AddSupportedCoin(CoinTypeETH)
+	require.NoError(t, err)
+
+	cfg := Config{
+		ScanPeriod:            time.Millisecond * 10,
+		DepositBufferSize:     1,
+		InitialScanHeight:     ethDummyInitialHeight,
+		ConfirmationsRequired: 0,
+	}
+
+	scr, err := NewETHScanner(log, store, rpc, cfg)
+	require.NoError(t, err)
+
+	return scr, shutdown
+}
+
+func TestEthBlock2CommonBlock(t *testing.T) {
+	block := &EthBlock{
+		Number:     "0x2a",
+		Hash:       "0xaa",
+		ParentHash: "0xbb",
+		Transactions: []EthTransaction{
+			{
+				Hash:  "0x01",
+				To:    ethDepositAddrLower,
+				Value: "0xde0b6b3a7640000", // 1 ETH
+			},
+			{
+				// contract creation
+				Hash:  "0x02",
+				Value: "0x0",
+			},
+			{
+				// less than 1 gwei is truncated
+				Hash:  "0x03",
+				To:    ethOtherAddrLower,
+				Value: "0x3b9ac9ff",
+			},
+		},
+	}
+
+	cb, err := ethBlock2CommonBlock(block)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(42), cb.Height)
+	require.Equal(t, "0xaa", cb.Hash)
+	require.Equal(t, "0xbb", cb.PrevHash)
+	require.Len(t, cb.RawTx, 3)
+
+	require.Equal(t, "0x01", cb.RawTx[0].Txid)
+	require.Equal(t, []CommonVout{
+		{
+			Value:     1e9,
+			Addresses: []string{ethDepositAddr},
+		},
+	}, cb.RawTx[0].Vout)
+
+	require.Equal(t, "0x02", cb.RawTx[1].Txid)
+	require.Empty(t, cb.RawTx[1].Vout)
+
+	require.Equal(t, int64(0), cb.RawTx[2].Vout[0].Value)
+
+	block.Transactions[0].Value = "0xzz"
+	_, err = ethBlock2CommonBlock(block)
+	require.Error(t, err)
+
+	block.Number = "42"
+	_, err = ethBlock2CommonBlock(block)
+	require.Error(t, err)
+}
+
+func TestEthClient(t *testing.T) {
+	block := EthBlock{
+		Number:     "0x64",
+		Hash:       "0xaa",
+		ParentHash: "0xbb",
+		Transactions: []EthTransaction{
+			{
+				Hash:  "0x01",
+				From:  ethOtherAddrLower,
+				To:    ethDepositAddrLower,
+				Value: "0x3b9aca00",
+			},
+		},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     uint64        `json:"id"`
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+		}
+
+		switch req.Method {
+		case "eth_blockNumber":
+			resp["result"] = "0x64"
+		case "eth_getBlockByNumber":
+			require.Equal(t, true, req.Params[1])
+			switch req.Params[0] {
+			case "0x64":
+				resp["result"] = block
+			case "0x65":
+				resp["result"] = nil
+			default:
+				resp["error"] = map[string]interface{}{
+					"code":    -32602,
+					"message": "invalid argument",
+				}
+			}
+		default:
+			t.Fatalf("unexpected method %s", req.Method)
+		}
+
+		require.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer srv.Close()
+
+	hostPort := strings.Split(strings.TrimPrefix(srv.URL, "http://"), ":")
+	ec := NewEthClient(hostPort[0], hostPort[1])
+
+	n, err := ec.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(100), n)
+
+	b, err := ec.GetBlockVerboseTx(100)
+	require.NoError(t, err)
+	require.Equal(t, block, *b)
+
+	_, err = ec.GetBlockVerboseTx(101)
+	require.Equal(t, ErrEthBlockNotFound, err)
+
+	_, err = ec.GetBlockVerboseTx(102)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid argument")
+}
+
+func TestEthScannerRunProcessDeposits(t *testing.T) {
+	rpc := newDummyEthrpcclient()
+	for i := int64(ethDummyInitialHeight); i < ethDummyInitialHeight+5; i++ {
+		rpc.addBlock(i)
+	}
+
+	// deposits in blocks 101 and 103, 1.5 ETH and 2 gwei
+	rpc.addBlock(ethDummyInitialHeight+1, EthTransaction{
+		To:    ethDepositAddrLower,
+		Value: "0x14d1120d7b160000",
+	}, EthTransaction{
+		To:    ethOtherAddrLower,
+		Value: "0x1",
+	})
+	rpc.addBlock(ethDummyInitialHeight+3, EthTransaction{
+		To:    ethDepositAddrLower,
+		Value: "0x77359400",
+	})
+
+	scr, shutdown := setupEthScanner(t, rpc)
+	defer shutdown()
+
+	// A block that appears after the scanner has started is also scanned
+	time.AfterFunc(time.Millisecond*100, func() {
+		rpc.addBlock(ethDummyInitialHeight+5, EthTransaction{
+			To:    ethDepositAddrLower,
+			Value: "0x3b9aca00",
+		})
+	})
+
+	err := scr.AddScanAddress(ethDepositAddr, CoinTypeETH, "")
+	require.NoError(t, err)
+
+	nDeposits := 3
+	expectedValues := []int64{15e8, 2, 1}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var dvs []DepositNote
+		for dv := range scr.GetDeposit() {
+			dvs = append(dvs, dv)
+			dv.ErrC <- nil
+		}
+
+		require.Equal(t, nDeposits, len(dvs))
+
+		err := scr.Base.GetStorer().(*Store).db.View(func(tx *bolt.Tx) error {
+			for i, dv := range dvs {
+				var d Deposit
+				err := dbutil.GetBucketObject(tx, DepositBkt, dv.ID(), &d)
+				require.NoError(t, err)
+
+				require.Equal(t, DepositAccepted, d.Status)
+				require.Equal(t, CoinTypeETH, d.CoinType)
+				require.Equal(t, ethDepositAddr, d.Address)
+				require.Equal(t, expectedValues[i], d.Value)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}()
+
+	time.AfterFunc(*minShutdownWait, func() {
+		scr.Shutdown()
+	})
+
+	err = scr.Run()
+	require.NoError(t, err)
+	<-done
+
+	lsb, err := scr.Base.GetStorer().GetLastScannedBlock(CoinTypeETH)
+	require.NoError(t, err)
+	require.Equal(t, int64(ethDummyInitialHeight+5), lsb.Height)
+}
@@ -3,18 +3,99 @@ package scanner
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ScannerState is the state of a scanner in the multiplexer
+type ScannerState string
+
+const (
+	// ScannerRunning represents the state in which the scanner's deposits are forwarded
+	ScannerRunning = ScannerState("running")
+	// ScannerPaused represents the state in which the scanner's deposits are held back.
+	// They are forwarded when the scanner is resumed.
+	ScannerPaused = ScannerState("paused")
+	// ScannerClosed represents the state in which the scanner closed its deposit channel
+	ScannerClosed = ScannerState("closed")
+	// ScannerFailed represents the state in which a scanner run by the multiplexer stopped with an error
+	ScannerFailed = ScannerState("failed")
+)
+
+var (
+	// ErrMultiplexerClosed is returned if the multiplexer was shutdown
+	ErrMultiplexerClosed = errors.New("multiplexer is closed")
+	// ErrScannerPaused is returned if a coin type's scanner is paused, it does not take new scan addresses
+	ErrScannerPaused = errors.New("scanner is paused")
+	// ErrScannerNotPaused is returned when resuming a scanner that is not paused
+	ErrScannerNotPaused = errors.New("scanner is not paused")
+)
+
+// ScannerNotExistErr is returned if no scanner of a coin type is registered
+type ScannerNotExistErr struct {
+	CoinType string
+}
+
+func (e ScannerNotExistErr) Error() string {
+	return fmt.Sprintf("unknown cointype \"%s\"", e.CoinType)
+}
+
+// ManagedScanner is a Scanner that the multiplexer runs and shuts down itself
+type ManagedScanner interface {
+	Scanner
+	Run() error
+	Shutdown()
+}
+
+// ScannerFactory creates the scanner of a coin type, when it is registered at runtime
+type ScannerFactory func() (ManagedScanner, error)
+
+// ScannerHealth is the status of a scanner registered in the multiplexer
+type ScannerHealth struct {
+	CoinType      string       `json:"coin_type"`
+	State         ScannerState `json:"state"`
+	RegisteredAt  int64        `json:"registered_at"`
+	Deposits      int64        `json:"deposits"`        // number of deposits forwarded
+	LastDepositAt int64        `json:"last_deposit_at"` // when the last deposit was forwarded
+	Error         string       `json:"error,omitempty"`
+}
+
+// scannerEntry is a scanner registered in the multiplexer, and the state of its forwarding goroutine
+type scannerEntry struct {
+	coinType string
+	scanner  Scanner
+	// Set if the scanner was created by a ScannerFactory, and is run by the multiplexer
+	managed bool
+	health  ScannerHealth
+	// Closed and replaced whenever the state changes, to wake up the forwarding goroutine
+	wake chan struct{}
+	// Closed to stop the forwarding goroutine when the scanner is removed
+	stop chan struct{}
+	// Closed when the forwarding goroutine exits
+	done chan struct{}
+	// Closed when a managed scanner's Run returns
+	runDone chan struct{}
+}
+
 // Multiplexer manager of scanner
 type Multiplexer struct {
-	scannerMap   map[string]Scanner
+	scannerMap map[string]*scannerEntry
+	// Scanners removed at runtime that are not run by the multiplexer.
+	// They are still running, and are added back when registered again.
+	detached  map[string]Scanner
+	factories map[string]ScannerFactory
+	// The progress of the rescans started by StartRescan, by ID - 1
+	rescans      []RescanProgress
 	outChan      chan DepositNote
-	scannerCount int
+	multiplexing bool
+	closed       bool
 	quit         chan struct{}
 	done         chan struct{}
+	forwarders   sync.WaitGroup
+	shutdownOnce sync.Once
 	log          logrus.FieldLogger
 	sync.RWMutex
 }
@@ -22,98 +103,378 @@ type Multiplexer struct {
 // NewMultiplexer create multiplexer instance
 func NewMultiplexer(log logrus.FieldLogger) *Multiplexer {
 	return &Multiplexer{
-		scannerMap:   map[string]Scanner{},
-		outChan:      make(chan DepositNote, 1000),
-		scannerCount: 0,
-		log:          log.WithField("prefix", "scanner.multiplex"),
-		quit:         make(chan struct{}),
-		done:         make(chan struct{}, 1),
+		scannerMap: map[string]*scannerEntry{},
+		detached:   map[string]Scanner{},
+		factories:  map[string]ScannerFactory{},
+		outChan:    make(chan DepositNote, 1000),
+		log:        log.WithField("prefix", "scanner.multiplex"),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
-// AddScanner add scanner of coinType
+// AddScanner add scanner of coinType. It can be called before or after Multiplex starts.
+// The caller runs and shuts down the scanner.
 func (m *Multiplexer) AddScanner(scanner Scanner, coinType string) error {
 	if scanner == nil {
 		return errors.New("nil scanner")
 	}
-	m.RWMutex.Lock()
-	defer m.RWMutex.Unlock()
-	_, existsScanner := m.scannerMap[coinType]
-	if existsScanner {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.canAddScanner(coinType); err != nil {
+		return err
+	}
+
+	delete(m.detached, coinType)
+	m.addScanner(scanner, coinType, false)
+	return nil
+}
+
+// SetScannerFactory sets the factory that creates the scanner of coinType when it is registered
+// with RegisterScanner, and no scanner of coinType was removed before
+func (m *Multiplexer) SetScannerFactory(coinType string, factory ScannerFactory) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.factories[coinType] = factory
+}
+
+// RegisterScanner registers the scanner of coinType at runtime.
+// A scanner of coinType that was added with AddScanner and removed is added back,
+// otherwise the scanner is created by the coinType's ScannerFactory, and run by the multiplexer.
+func (m *Multiplexer) RegisterScanner(coinType string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.canAddScanner(coinType); err != nil {
+		return err
+	}
+
+	if scanner, ok := m.detached[coinType]; ok {
+		delete(m.detached, coinType)
+		m.addScanner(scanner, coinType, false)
+		m.log.WithField("coinType", coinType).Info("Registered removed scanner again")
+		return nil
+	}
+
+	factory, ok := m.factories[coinType]
+	if !ok {
+		return fmt.Errorf("no scanner factory of coinType %s", coinType)
+	}
+
+	scanner, err := factory()
+	if err != nil {
+		return err
+	}
+
+	e := m.addScanner(scanner, coinType, true)
+
+	go func() {
+		defer close(e.runDone)
+		if err := scanner.Run(); err != nil {
+			m.log.WithError(err).WithField("coinType", coinType).Error("Scanner run failed")
+			m.Lock()
+			e.health.State = ScannerFailed
+			e.health.Error = err.Error()
+			m.Unlock()
+		}
+	}()
+
+	m.log.WithField("coinType", coinType).Info("Registered scanner")
+	return nil
+}
+
+// canAddScanner returns an error if a scanner of coinType can't be added. The lock must be held.
+func (m *Multiplexer) canAddScanner(coinType string) error {
+	if m.closed {
+		return ErrMultiplexerClosed
+	}
+
+	if _, ok := m.scannerMap[coinType]; ok {
 		return fmt.Errorf("scanner of coinType %s already exists", coinType)
 	}
 
-	m.scannerMap[coinType] = scanner
-	m.scannerCount++
 	return nil
 }
 
-// AddScanAddress adds new scan address to scanner according to coinType
-func (m *Multiplexer) AddScanAddress(depositAddr, coinType string) error {
-	m.RWMutex.Lock()
-	defer m.RWMutex.Unlock()
+// addScanner adds the scanner, and starts forwarding its deposits if Multiplex is running. The lock must be held.
+func (m *Multiplexer) addScanner(scanner Scanner, coinType string, managed bool) *scannerEntry {
+	e := &scannerEntry{
+		coinType: coinType,
+		scanner:  scanner,
+		managed:  managed,
+		health: ScannerHealth{
+			CoinType:     coinType,
+			State:        ScannerRunning,
+			RegisteredAt: time.Now().UTC().Unix(),
+		},
+		wake: make(chan struct{}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if managed {
+		e.runDone = make(chan struct{})
+	}
+
+	m.scannerMap[coinType] = e
+
+	if m.multiplexing {
+		m.startForwarding(e)
+	}
+
+	return e
+}
+
+// PauseScanner stops forwarding the deposits of coinType's scanner until it is resumed.
+// The scanner does not take new scan addresses while paused.
+func (m *Multiplexer) PauseScanner(coinType string) error {
+	return m.setPaused(coinType, true)
+}
+
+// ResumeScanner forwards the deposits of coinType's paused scanner again
+func (m *Multiplexer) ResumeScanner(coinType string) error {
+	return m.setPaused(coinType, false)
+}
+
+func (m *Multiplexer) setPaused(coinType string, paused bool) error {
+	m.Lock()
+	defer m.Unlock()
 
-	scanner, ok := m.scannerMap[coinType]
+	e, ok := m.scannerMap[coinType]
 	if !ok {
-		return fmt.Errorf("unknown cointype \"%s\"", coinType)
+		return ScannerNotExistErr{coinType}
+	}
+
+	switch {
+	case paused && e.health.State == ScannerPaused:
+		return ErrScannerPaused
+	case paused && e.health.State != ScannerRunning:
+		return fmt.Errorf("scanner of coinType %s is %s", coinType, e.health.State)
+	case !paused && e.health.State != ScannerPaused:
+		return ErrScannerNotPaused
 	}
 
-	return scanner.AddScanAddress(depositAddr, coinType)
+	if paused {
+		e.health.State = ScannerPaused
+	} else {
+		e.health.State = ScannerRunning
+	}
+
+	close(e.wake)
+	e.wake = make(chan struct{})
+
+	m.log.WithFields(logrus.Fields{
+		"coinType": coinType,
+		"state":    e.health.State,
+	}).Info("Scanner state changed")
+
+	return nil
 }
 
-// ValidateCoinType returns an error if the coinType is invalid
-func (m *Multiplexer) ValidateCoinType(coinType string) error {
-	m.RWMutex.RLock()
-	defer m.RWMutex.RUnlock()
+// RemoveScanner stops forwarding the deposits of coinType's scanner and removes it.
+// A deposit that was already read from the scanner is forwarded before it returns.
+// A scanner run by the multiplexer is shut down.
+func (m *Multiplexer) RemoveScanner(coinType string) error {
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return ErrMultiplexerClosed
+	}
+
+	e, ok := m.scannerMap[coinType]
+	if !ok {
+		m.Unlock()
+		return ScannerNotExistErr{coinType}
+	}
 
-	if _, ok := m.scannerMap[coinType]; !ok {
-		return fmt.Errorf("unknown cointype \"%s\"", coinType)
+	delete(m.scannerMap, coinType)
+	if !e.managed {
+		m.detached[coinType] = e.scanner
 	}
+	close(e.stop)
+	forwarding := m.multiplexing
+	m.Unlock()
 
+	if forwarding {
+		<-e.done
+	}
+
+	if e.managed {
+		m.shutdownScanner(e)
+	}
+
+	m.log.WithField("coinType", coinType).Info("Removed scanner")
 	return nil
 }
 
-// Multiplex forward multi-scanner deposit to a shared aggregate channel, think of "Goroutine merging channel"
+func (m *Multiplexer) shutdownScanner(e *scannerEntry) {
+	e.scanner.(ManagedScanner).Shutdown()
+	<-e.runDone
+}
+
+// AddScanAddress adds new scan address bound to kittyID to scanner according to coinType
+func (m *Multiplexer) AddScanAddress(depositAddr, coinType, kittyID string) error {
+	scanner, err := m.acceptingScanner(coinType)
+	if err != nil {
+		return err
+	}
+
+	return scanner.AddScanAddress(depositAddr, coinType, kittyID)
+}
+
+// ValidateCoinType returns an error if the coinType is invalid, or its scanner is paused
+func (m *Multiplexer) ValidateCoinType(coinType string) error {
+	_, err := m.acceptingScanner(coinType)
+	return err
+}
+
+// acceptingScanner returns the scanner of coinType if it takes new scan addresses
+func (m *Multiplexer) acceptingScanner(coinType string) (Scanner, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	e, ok := m.scannerMap[coinType]
+	if !ok {
+		return nil, ScannerNotExistErr{coinType}
+	}
+
+	if e.health.State == ScannerPaused {
+		return nil, ErrScannerPaused
+	}
+
+	return e.scanner, nil
+}
+
+// Multiplex forward multi-scanner deposit to a shared aggregate channel, think of "Goroutine merging channel".
+// Scanners added while it runs are forwarded as well. It returns when the multiplexer is shutdown.
 func (m *Multiplexer) Multiplex() error {
-	log := m.log.WithField("scanner-count", m.scannerCount)
+	m.Lock()
+	if m.closed || m.multiplexing {
+		m.Unlock()
+		return nil
+	}
+
+	m.multiplexing = true
+	for _, e := range m.scannerMap {
+		m.startForwarding(e)
+	}
+	count := len(m.scannerMap)
+	m.Unlock()
+
+	log := m.log.WithField("scanner-count", count)
 	log.Info("Start multiplex service")
 	defer func() {
 		log.Info("Multiplex service closed")
 		close(m.done)
 	}()
 
-	var wg sync.WaitGroup
-	for scannerName, scan := range m.scannerMap {
-		wg.Add(1)
-		go func(name string, scan Scanner) {
-			defer log.Info("Scan goroutine exited")
-			defer wg.Done()
-			for {
-				select {
-				case dv, ok := <-scan.GetDeposit():
-					if !ok {
-						log.WithField("name", name).Info("sub-scanner closed")
-						return
-					}
-					m.outChan <- dv
-				case <-m.quit:
-					return
+	<-m.quit
+	m.forwarders.Wait()
+
+	return nil
+}
+
+// startForwarding starts the goroutine forwarding the scanner's deposits. The lock must be held.
+func (m *Multiplexer) startForwarding(e *scannerEntry) {
+	m.forwarders.Add(1)
+	go func() {
+		defer m.forwarders.Done()
+		defer close(e.done)
+		m.forward(e)
+	}()
+}
+
+// forward forwards the scanner's deposits to outChan until the scanner is removed, closed, or the multiplexer quits.
+// While the scanner is paused, its deposits are not read. They are not acknowledged, so the scanner holds them.
+func (m *Multiplexer) forward(e *scannerEntry) {
+	log := m.log.WithField("coinType", e.coinType)
+	log.Info("Scan goroutine started")
+	defer log.Info("Scan goroutine exited")
+
+	for {
+		m.RLock()
+		paused := e.health.State == ScannerPaused
+		wake := e.wake
+		m.RUnlock()
+
+		if paused {
+			select {
+			case <-wake:
+				continue
+			case <-e.stop:
+				return
+			case <-m.quit:
+				return
+			}
+		}
+
+		select {
+		case dv, ok := <-e.scanner.GetDeposit():
+			if !ok {
+				log.Info("sub-scanner closed")
+				m.Lock()
+				if e.health.State != ScannerFailed {
+					e.health.State = ScannerClosed
 				}
+				m.Unlock()
+				return
 			}
-		}(scannerName, scan)
-	}
-	wg.Wait()
 
-	return nil
+			// The deposit is not acknowledged if the multiplexer quits before it is forwarded,
+			// so the scanner processes it again when restarted
+			select {
+			case m.outChan <- dv:
+				m.Lock()
+				e.health.Deposits++
+				e.health.LastDepositAt = time.Now().UTC().Unix()
+				m.Unlock()
+			case <-m.quit:
+				log.WithField("deposit", dv.Deposit).Warn("Multiplexer quit before the deposit was forwarded")
+				return
+			}
+		case <-wake:
+		case <-e.stop:
+			return
+		case <-m.quit:
+			return
+		}
+	}
 }
 
-// Shutdown shutdown the multiplexer
+// Shutdown shutdown the multiplexer. The forwarding goroutines are stopped before the deposit channel is closed,
+// and the scanners run by the multiplexer are shut down. It is safe to call more than once.
 func (m *Multiplexer) Shutdown() {
-	m.log.Info("Closing Multiplexer")
-	close(m.quit)
-	close(m.outChan)
-	m.log.Info("Waiting for Multiplexer to stop")
-	<-m.done
+	m.shutdownOnce.Do(func() {
+		m.log.Info("Closing Multiplexer")
+
+		m.Lock()
+		m.closed = true
+		multiplexing := m.multiplexing
+		var managed []*scannerEntry
+		for _, e := range m.scannerMap {
+			if e.managed {
+				managed = append(managed, e)
+			}
+		}
+		m.Unlock()
+
+		close(m.quit)
+
+		if multiplexing {
+			m.log.Info("Waiting for Multiplexer to stop")
+			<-m.done
+		}
+
+		close(m.outChan)
+
+		for _, e := range managed {
+			m.log.WithField("coinType", e.coinType).Info("Shutting down scanner")
+			m.shutdownScanner(e)
+		}
+	})
 }
 
 // GetDeposit returns deposit values channel.
@@ -123,14 +484,132 @@ func (m *Multiplexer) GetDeposit() <-chan DepositNote {
 
 // GetScannerCount returns scanner count.
 func (m *Multiplexer) GetScannerCount() int {
-	return m.scannerCount
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.scannerMap)
 }
 
 // GetScanner returns Scanner according to coinType
 func (m *Multiplexer) GetScanner(coinType string) Scanner {
-	scanner, existsScanner := m.scannerMap[coinType]
-	if !existsScanner {
+	m.RLock()
+	defer m.RUnlock()
+
+	e, ok := m.scannerMap[coinType]
+	if !ok {
 		return nil
 	}
-	return scanner
+	return e.scanner
+}
+
+// Health returns the status of the registered scanners, ordered by coin type
+func (m *Multiplexer) Health() []ScannerHealth {
+	m.RLock()
+	defer m.RUnlock()
+
+	hs := make([]ScannerHealth, 0, len(m.scannerMap))
+	for _, e := range m.scannerMap {
+		hs = append(hs, e.health)
+	}
+
+	sort.Slice(hs, func(i, j int) bool {
+		return hs[i].CoinType < hs[j].CoinType
+	})
+
+	return hs
+}
+
+// StartRescan starts a rescan with the scanner of the request's coin type in the background,
+// and returns its initial progress. Only one rescan of a coin type runs at a time.
+func (m *Multiplexer) StartRescan(req RescanRequest) (RescanProgress, error) {
+	if err := req.Validate(); err != nil {
+		return RescanProgress{}, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return RescanProgress{}, ErrMultiplexerClosed
+	}
+
+	e, ok := m.scannerMap[req.CoinType]
+	if !ok {
+		return RescanProgress{}, ScannerNotExistErr{req.CoinType}
+	}
+
+	rs, ok := e.scanner.(Rescanner)
+	if !ok {
+		return RescanProgress{}, ErrRescanNotSupported
+	}
+
+	for _, p := range m.rescans {
+		if p.CoinType == req.CoinType && !p.Done {
+			return RescanProgress{}, ErrRescanRunning
+		}
+	}
+
+	p := RescanProgress{
+		RescanRequest: req,
+		ID:            len(m.rescans) + 1,
+		Height:        req.FromHeight - 1,
+		StartedAt:     time.Now().UTC().Unix(),
+	}
+	m.rescans = append(m.rescans, p)
+
+	go m.rescan(rs, p)
+
+	return p, nil
+}
+
+// rescan runs a rescan started by StartRescan, and records its progress
+func (m *Multiplexer) rescan(rs Rescanner, started RescanProgress) {
+	log := m.log.WithFields(logrus.Fields{
+		"coinType": started.CoinType,
+		"rescanID": started.ID,
+	})
+
+	update := func(p RescanProgress) {
+		p.ID = started.ID
+
+		m.Lock()
+		defer m.Unlock()
+		m.rescans[started.ID-1] = p
+	}
+
+	reported := false
+	p, err := rs.Rescan(started.RescanRequest, func(p RescanProgress) {
+		reported = true
+		update(p)
+	})
+
+	// Rescan may fail without reporting its progress
+	if !reported {
+		p = started
+	}
+
+	if err != nil {
+		log.WithError(err).Error("Rescan failed")
+		if p.Error == "" {
+			p.Error = err.Error()
+		}
+	} else {
+		log.WithField("deposits", len(p.Deposits)).Info("Rescan done")
+	}
+
+	if p.FinishedAt == 0 {
+		p.FinishedAt = time.Now().UTC().Unix()
+	}
+	p.Done = true
+	update(p)
+}
+
+// GetRescans returns the progress of the rescans started by StartRescan, ordered by ID
+func (m *Multiplexer) GetRescans() []RescanProgress {
+	m.RLock()
+	defer m.RUnlock()
+
+	rescans := make([]RescanProgress, len(m.rescans))
+	copy(rescans, m.rescans)
+	return rescans
 }
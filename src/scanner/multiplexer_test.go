@@ -3,6 +3,7 @@ package scanner
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,14 +22,14 @@ var (
 func testAddBtcScanAddresses(t *testing.T, m *Multiplexer) int64 {
 	var nDeposits int64
 	// This address has 0 deposits
-	err := m.AddScanAddress("1LcEkgX8DCrQczLMVh9LDTRnkdVV2oun3A", CoinTypeBTC)
+	err := m.AddScanAddress("1LcEkgX8DCrQczLMVh9LDTRnkdVV2oun3A", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 0
 
 	// This address has:
 	// 1 deposit, in block 235206
 	// 1 deposit, in block 235207
-	err = m.AddScanAddress("1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA", CoinTypeBTC)
+	err = m.AddScanAddress("1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 2
 
@@ -37,7 +38,7 @@ func testAddBtcScanAddresses(t *testing.T, m *Multiplexer) int64 {
 	// 47 deposits in block 235206
 	// 22 deposits, in block 235207
 	// 26 deposits, in block 235214
-	err = m.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC)
+	err = m.AddScanAddress("1LEkderht5M5yWj82M87bEd4XDBsczLkp9", CoinTypeBTC, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 126
 
@@ -66,12 +67,12 @@ func testAddSkyScanAddresses(t *testing.T, m *Multiplexer) int64 {
 	var nDeposits int64
 	// This address has 0 deposits
 	// 1 deposit, in block 176
-	err := m.AddScanAddress("v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", CoinTypeSKY)
+	err := m.AddScanAddress("v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", CoinTypeSKY, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 1
 
 	// 2 deposits in block 117
-	err = m.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY)
+	err = m.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 2
 
@@ -207,3 +208,282 @@ func TestMultiplexerForAll(t *testing.T) {
 	require.NoError(t, err)
 	<-done
 }
+
+type testMultiplexScanner struct {
+	depositC chan DepositNote
+	quit     chan struct{}
+	addrs    []string
+	sync.Mutex
+}
+
+func newTestMultiplexScanner() *testMultiplexScanner {
+	return &testMultiplexScanner{
+		depositC: make(chan DepositNote),
+		quit:     make(chan struct{}),
+	}
+}
+
+func (s *testMultiplexScanner) AddScanAddress(addr, coinType, kittyID string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.addrs = append(s.addrs, addr)
+	return nil
+}
+
+func (s *testMultiplexScanner) GetDeposit() <-chan DepositNote {
+	return s.depositC
+}
+
+func (s *testMultiplexScanner) Run() error {
+	<-s.quit
+	return nil
+}
+
+func (s *testMultiplexScanner) Shutdown() {
+	close(s.quit)
+}
+
+// sendDeposit sends a deposit in the background, and returns a channel that is closed when it was read
+func (s *testMultiplexScanner) sendDeposit(tx string) <-chan struct{} {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		select {
+		case s.depositC <- NewDepositNote(Deposit{Tx: tx}):
+		case <-s.quit:
+		}
+	}()
+	return sent
+}
+
+func requireMultiplexedDeposit(t *testing.T, m *Multiplexer, tx string) {
+	select {
+	case dn, ok := <-m.GetDeposit():
+		require.True(t, ok)
+		require.Equal(t, tx, dn.Tx)
+	case <-time.After(time.Second * 3):
+		t.Fatalf("deposit %s was not forwarded", tx)
+	}
+}
+
+func requireNoMultiplexedDeposit(t *testing.T, m *Multiplexer) {
+	select {
+	case dn := <-m.GetDeposit():
+		t.Fatalf("unexpected deposit %s", dn.Tx)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestMultiplexerRuntimeScanners(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+	m := NewMultiplexer(log)
+
+	multiplexDone := make(chan struct{})
+	go func() {
+		defer close(multiplexDone)
+		testutil.CheckError(t, m.Multiplex)
+	}()
+
+	// Add a scanner after Multiplex started
+	scr := newTestMultiplexScanner()
+	defer scr.Shutdown()
+	require.NoError(t, m.AddScanner(scr, CoinTypeSKY))
+	require.Equal(t, 1, m.GetScannerCount())
+
+	<-scr.sendDeposit("t1")
+	requireMultiplexedDeposit(t, m, "t1")
+
+	hs := m.Health()
+	require.Len(t, hs, 1)
+	require.Equal(t, CoinTypeSKY, hs[0].CoinType)
+	require.Equal(t, ScannerRunning, hs[0].State)
+	require.Equal(t, int64(1), hs[0].Deposits)
+	require.NotZero(t, hs[0].LastDepositAt)
+
+	// A paused scanner's deposits are held until it is resumed,
+	// and it does not take new scan addresses
+	require.NoError(t, m.PauseScanner(CoinTypeSKY))
+	require.Equal(t, ErrScannerPaused, m.PauseScanner(CoinTypeSKY))
+	require.Equal(t, ErrScannerPaused, m.ValidateCoinType(CoinTypeSKY))
+	require.Equal(t, ErrScannerPaused, m.AddScanAddress("a1", CoinTypeSKY, "1"))
+	require.Equal(t, ScannerPaused, m.Health()[0].State)
+
+	sent := scr.sendDeposit("t2")
+	requireNoMultiplexedDeposit(t, m)
+
+	require.NoError(t, m.ResumeScanner(CoinTypeSKY))
+	require.Equal(t, ErrScannerNotPaused, m.ResumeScanner(CoinTypeSKY))
+	<-sent
+	requireMultiplexedDeposit(t, m, "t2")
+	require.NoError(t, m.AddScanAddress("a1", CoinTypeSKY, "1"))
+	require.Equal(t, []string{"a1"}, scr.addrs)
+
+	// A removed scanner is unknown, until it is registered again
+	require.NoError(t, m.RemoveScanner(CoinTypeSKY))
+	require.Equal(t, ScannerNotExistErr{CoinTypeSKY}, m.RemoveScanner(CoinTypeSKY))
+	require.Equal(t, ScannerNotExistErr{CoinTypeSKY}, m.ValidateCoinType(CoinTypeSKY))
+	require.Equal(t, ScannerNotExistErr{CoinTypeSKY}, m.PauseScanner(CoinTypeSKY))
+	require.Empty(t, m.Health())
+	require.Nil(t, m.GetScanner(CoinTypeSKY))
+
+	sent = scr.sendDeposit("t3")
+	requireNoMultiplexedDeposit(t, m)
+
+	require.NoError(t, m.RegisterScanner(CoinTypeSKY))
+	<-sent
+	requireMultiplexedDeposit(t, m, "t3")
+	require.Equal(t, Scanner(scr), m.GetScanner(CoinTypeSKY))
+
+	// A scanner of a coin type without a factory can't be registered
+	require.Error(t, m.RegisterScanner(CoinTypeETH))
+
+	// The deposit channel is closed by the scanner
+	close(scr.depositC)
+	require.Equal(t, ScannerClosed, waitScannerState(t, m, CoinTypeSKY, ScannerClosed))
+
+	m.Shutdown()
+	<-multiplexDone
+
+	_, ok := <-m.GetDeposit()
+	require.False(t, ok)
+}
+
+func waitScannerState(t *testing.T, m *Multiplexer, coinType string, state ScannerState) ScannerState {
+	var current ScannerState
+	for i := 0; i < 100; i++ {
+		for _, h := range m.Health() {
+			if h.CoinType == coinType {
+				current = h.State
+			}
+		}
+		if current == state {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return current
+}
+
+func TestMultiplexerRegisterScanner(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+	m := NewMultiplexer(log)
+
+	var created []*testMultiplexScanner
+	m.SetScannerFactory(CoinTypeETH, func() (ManagedScanner, error) {
+		scr := newTestMultiplexScanner()
+		created = append(created, scr)
+		return scr, nil
+	})
+	m.SetScannerFactory(CoinTypeSKY, func() (ManagedScanner, error) {
+		return nil, errors.New("sky_rpc is not configured")
+	})
+
+	go testutil.CheckError(t, m.Multiplex)
+
+	require.Error(t, m.RegisterScanner(CoinTypeSKY))
+	require.Equal(t, 0, m.GetScannerCount())
+
+	require.NoError(t, m.RegisterScanner(CoinTypeETH))
+	require.Equal(t, fmt.Errorf("scanner of coinType %s already exists", CoinTypeETH), m.RegisterScanner(CoinTypeETH))
+	require.Len(t, created, 1)
+
+	<-created[0].sendDeposit("t1")
+	requireMultiplexedDeposit(t, m, "t1")
+
+	// A scanner run by the multiplexer is shut down when removed,
+	// and created again when registered again
+	require.NoError(t, m.RemoveScanner(CoinTypeETH))
+	select {
+	case <-created[0].quit:
+	default:
+		t.Fatal("removed scanner was not shut down")
+	}
+
+	require.NoError(t, m.RegisterScanner(CoinTypeETH))
+	require.Len(t, created, 2)
+
+	<-created[1].sendDeposit("t2")
+	requireMultiplexedDeposit(t, m, "t2")
+
+	// Scanners run by the multiplexer are shut down with it
+	m.Shutdown()
+	select {
+	case <-created[1].quit:
+	default:
+		t.Fatal("scanner was not shut down")
+	}
+
+	require.Equal(t, ErrMultiplexerClosed, m.RegisterScanner(CoinTypeETH))
+}
+
+func TestMultiplexerShutdown(t *testing.T) {
+	t.Run("before multiplex", func(t *testing.T) {
+		log, _ := testutil.NewLogger(t)
+		m := NewMultiplexer(log)
+		require.NoError(t, m.AddScanner(newTestMultiplexScanner(), CoinTypeBTC))
+
+		m.Shutdown()
+		m.Shutdown()
+
+		require.NoError(t, m.Multiplex())
+		_, ok := <-m.GetDeposit()
+		require.False(t, ok)
+
+		require.Equal(t, ErrMultiplexerClosed, m.AddScanner(newTestMultiplexScanner(), CoinTypeSKY))
+		require.Equal(t, ErrMultiplexerClosed, m.RemoveScanner(CoinTypeBTC))
+	})
+
+	t.Run("while forwarding", func(t *testing.T) {
+		log, _ := testutil.NewLogger(t)
+		m := NewMultiplexer(log)
+
+		// The scanners send more deposits than fit in the deposit channel,
+		// so that forwarding goroutines are blocked when shutting down
+		var scrs []*testMultiplexScanner
+		for _, coinType := range GetCoinTypes() {
+			scr := newTestMultiplexScanner()
+			scrs = append(scrs, scr)
+			require.NoError(t, m.AddScanner(scr, coinType))
+		}
+
+		multiplexDone := make(chan struct{})
+		go func() {
+			defer close(multiplexDone)
+			testutil.CheckError(t, m.Multiplex)
+		}()
+
+		var wg sync.WaitGroup
+		for _, scr := range scrs {
+			wg.Add(1)
+			go func(scr *testMultiplexScanner) {
+				defer wg.Done()
+				for i := 0; i < cap(m.outChan); i++ {
+					<-scr.sendDeposit(fmt.Sprint(i))
+				}
+			}(scr)
+		}
+
+		// Pause and remove scanners concurrently with forwarding
+		require.NoError(t, m.PauseScanner(CoinTypeETH))
+		require.NoError(t, m.RemoveScanner(CoinTypeSKY))
+		require.NoError(t, m.ResumeScanner(CoinTypeETH))
+		require.Len(t, m.Health(), 2)
+
+		time.Sleep(time.Millisecond * 100)
+		m.Shutdown()
+		<-multiplexDone
+
+		// Unblock the senders
+		for _, scr := range scrs {
+			scr.Shutdown()
+		}
+		wg.Wait()
+
+		// The deposit channel is drained and closed
+		n := 0
+		for range m.GetDeposit() {
+			n++
+		}
+		require.True(t, n <= cap(m.outChan))
+	})
+}
@@ -0,0 +1,204 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rescanLogInterval is how many blocks are rescanned between progress log messages
+const rescanLogInterval = 100
+
+var (
+	// ErrRescanNotSupported is returned if a coin type's scanner cannot rescan blocks
+	ErrRescanNotSupported = errors.New("scanner does not support rescanning")
+	// ErrRescanRunning is returned if a rescan of the coin type is already running
+	ErrRescanRunning = errors.New("a rescan of this coin type is already running")
+)
+
+// RescanRequest describes the blocks to scan again, and the addresses to scan them for
+type RescanRequest struct {
+	CoinType   string   `json:"coin_type"`
+	FromHeight int64    `json:"from_height"`
+	ToHeight   int64    `json:"to_height"`
+	Addresses  []string `json:"addresses"`
+}
+
+// Validate returns an error if the request is not valid
+func (r RescanRequest) Validate() error {
+	if r.CoinType == "" {
+		return errors.New("coin type is empty")
+	}
+
+	if r.FromHeight < 0 {
+		return fmt.Errorf("from height %d is negative", r.FromHeight)
+	}
+
+	if r.ToHeight < r.FromHeight {
+		return fmt.Errorf("to height %d is lower than from height %d", r.ToHeight, r.FromHeight)
+	}
+
+	if len(r.Addresses) == 0 {
+		return errors.New("no addresses to rescan")
+	}
+
+	for _, a := range r.Addresses {
+		if a == "" {
+			return errors.New("address is empty")
+		}
+	}
+
+	return nil
+}
+
+// RescanProgress is the progress of a rescan
+type RescanProgress struct {
+	RescanRequest
+	ID int `json:"id"`
+	// Height is the last rescanned block height, FromHeight-1 before the first block is rescanned
+	Height int64 `json:"height"`
+	// Found is the number of deposits to the addresses in the rescanned blocks
+	Found int `json:"found"`
+	// Deposits are the missed deposits that were added, found deposits that were already recorded are omitted
+	Deposits   []Deposit `json:"deposits"`
+	StartedAt  int64     `json:"started_at"`
+	FinishedAt int64     `json:"finished_at"`
+	Done       bool      `json:"done"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Rescanner is implemented by scanners that can scan a height range again for deposits to specific addresses
+type Rescanner interface {
+	Rescan(RescanRequest, func(RescanProgress)) (RescanProgress, error)
+}
+
+// rescan scans the blocks from req.FromHeight to req.ToHeight for deposits to req.Addresses,
+// with the same logic as the block scan. Missed deposits are added to the store, deposits
+// that were already recorded are skipped. progress is called after each rescanned block,
+// and when the rescan is done. The last scanned block of the scanner is not changed.
+// req.ToHeight must have confirmationsRequired confirmations, like the blocks of the block scan.
+func rescan(store Storer, log logrus.FieldLogger, req RescanRequest, getBlockCount func() (int64, error),
+	getBlockAtHeight func(int64) (*CommonBlock, error), confirmationsRequired int64,
+	quit <-chan struct{}, progress func(RescanProgress)) (RescanProgress, error) {
+	p := RescanProgress{
+		RescanRequest: req,
+		Height:        req.FromHeight - 1,
+		StartedAt:     time.Now().UTC().Unix(),
+	}
+
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	finish := func(err error) (RescanProgress, error) {
+		p.Done = true
+		p.FinishedAt = time.Now().UTC().Unix()
+		if err != nil {
+			p.Error = err.Error()
+		}
+		report()
+		return p, err
+	}
+
+	if err := req.Validate(); err != nil {
+		return finish(err)
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"fromHeight": req.FromHeight,
+		"toHeight":   req.ToHeight,
+		"addrs":      len(req.Addresses),
+	})
+
+	bestHeight, err := getBlockCount()
+	if err != nil {
+		log.WithError(err).Error("getBlockCount failed")
+		return finish(err)
+	}
+
+	if confirmedHeight := bestHeight - confirmationsRequired; req.ToHeight > confirmedHeight {
+		err := fmt.Errorf("to height %d is above the last confirmed height %d", req.ToHeight, confirmedHeight)
+		log.WithError(err).WithField("bestHeight", bestHeight).Error("Rescan rejected")
+		return finish(err)
+	}
+
+	log.Info("Start rescan")
+
+	for height := req.FromHeight; height <= req.ToHeight; height++ {
+		select {
+		case <-quit:
+			log.WithField("height", p.Height).Info("Rescan stopped")
+			return finish(errQuit)
+		default:
+		}
+
+		block, err := getBlockAtHeight(height)
+		if err != nil {
+			log.WithError(err).WithField("height", height).Error("getBlockAtHeight failed")
+			return finish(err)
+		}
+
+		dvs, found, err := store.RescanBlock(block, req.CoinType, req.Addresses)
+		if err != nil {
+			log.WithError(err).WithField("height", height).Error("RescanBlock failed")
+			return finish(err)
+		}
+
+		for _, dv := range dvs {
+			log.WithField("deposit", dv).Info("Rescan added missed deposit")
+		}
+
+		p.Height = height
+		p.Found += found
+		p.Deposits = append(p.Deposits, dvs...)
+
+		if (height-req.FromHeight+1)%rescanLogInterval == 0 {
+			log.WithFields(logrus.Fields{
+				"height": height,
+				"found":  p.Found,
+				"added":  len(p.Deposits),
+			}).Info("Rescan progress")
+		}
+
+		report()
+	}
+
+	log.WithFields(logrus.Fields{
+		"found": p.Found,
+		"added": len(p.Deposits),
+	}).Info("Rescan done")
+
+	return finish(nil)
+}
+
+// Rescan scans the blocks of a height range again for deposits to the request's addresses,
+// and adds the missed deposits. If the scanner is running, they are sent to the exchange,
+// otherwise they are sent when the scanner is started and loads the unprocessed deposits.
+// A range that ends above the best height minus Cfg.ConfirmationsRequired is rejected.
+func (s *BaseScanner) Rescan(req RescanRequest, getBlockCount func() (int64, error),
+	getBlockAtHeight func(int64) (*CommonBlock, error), progress func(RescanProgress)) (RescanProgress, error) {
+	if req.CoinType != s.CoinType {
+		return RescanProgress{}, fmt.Errorf("rescan of coin type %s requested from the %s scanner", req.CoinType, s.CoinType)
+	}
+
+	p, err := rescan(s.store, s.log.WithField("scan", "rescan"), req, getBlockCount, getBlockAtHeight,
+		s.Cfg.ConfirmationsRequired, s.quit, progress)
+
+	// Deposits added before a failure are sent too
+	if atomic.LoadInt32(&s.running) == 1 {
+		for _, dv := range p.Deposits {
+			select {
+			case <-s.quit:
+				return p, errQuit
+			case s.scannedDeposits <- dv:
+			}
+		}
+	}
+
+	return p, err
+}
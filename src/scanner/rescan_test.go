@@ -0,0 +1,417 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+func TestRescanRequestValidate(t *testing.T) {
+	tt := []struct {
+		name string
+		req  RescanRequest
+		err  bool
+	}{
+		{
+			"valid",
+			RescanRequest{CoinType: CoinTypeBTC, FromHeight: 0, ToHeight: 0, Addresses: []string{"a1"}},
+			false,
+		},
+		{
+			"missing coin type",
+			RescanRequest{FromHeight: 1, ToHeight: 2, Addresses: []string{"a1"}},
+			true,
+		},
+		{
+			"negative from height",
+			RescanRequest{CoinType: CoinTypeBTC, FromHeight: -1, ToHeight: 2, Addresses: []string{"a1"}},
+			true,
+		},
+		{
+			"to height lower than from height",
+			RescanRequest{CoinType: CoinTypeBTC, FromHeight: 3, ToHeight: 2, Addresses: []string{"a1"}},
+			true,
+		},
+		{
+			"no addresses",
+			RescanRequest{CoinType: CoinTypeBTC, FromHeight: 1, ToHeight: 2},
+			true,
+		},
+		{
+			"empty address",
+			RescanRequest{CoinType: CoinTypeBTC, FromHeight: 1, ToHeight: 2, Addresses: []string{"a1", ""}},
+			true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.req.Validate()
+			if tc.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestBaseScannerRescan(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	blocks := map[int64]*CommonBlock{
+		10: {
+			Height: 10,
+			Hash:   "hash10",
+			RawTx: []CommonTx{
+				{
+					Txid: "tx1",
+					Vout: []CommonVout{
+						{N: 0, Value: 1, Addresses: []string{"a1"}},
+						{N: 1, Value: 2, Addresses: []string{"a2"}},
+					},
+				},
+			},
+		},
+		11: {
+			Height: 11,
+			Hash:   "hash11",
+			RawTx: []CommonTx{
+				{
+					Txid: "tx2",
+					Vout: []CommonVout{
+						{N: 0, Value: 3, Addresses: []string{"a2"}},
+						{N: 1, Value: 4, Addresses: []string{"b1"}},
+					},
+				},
+			},
+		},
+		12: {
+			Height: 12,
+			Hash:   "hash12",
+		},
+	}
+
+	getBlockAtHeight := func(height int64) (*CommonBlock, error) {
+		block, ok := blocks[height]
+		if !ok {
+			return nil, fmt.Errorf("no block at height %d", height)
+		}
+		return block, nil
+	}
+
+	bestHeight := int64(13)
+	getBlockCount := func() (int64, error) {
+		return bestHeight, nil
+	}
+
+	// a1 was watched when block 10 was scanned, a2 was missing
+	err = store.AddScanAddress("a1", CoinTypeBTC, "1")
+	require.NoError(t, err)
+	dvs, err := store.ScanBlock(blocks[10], CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+
+	// The payment to a2 in block 11 was seen in the mempool
+	err = store.SetUnconfirmedDeposits(CoinTypeBTC, []Deposit{
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a2",
+			Value:    3,
+			Tx:       "tx2",
+			N:        0,
+			Status:   DepositUnconfirmed,
+		},
+	})
+	require.NoError(t, err)
+
+	scr := NewBaseScanner(store, log, CoinTypeBTC, Config{
+		ConfirmationsRequired: 1,
+	})
+
+	req := RescanRequest{
+		CoinType:   CoinTypeBTC,
+		FromHeight: 10,
+		ToHeight:   12,
+		Addresses:  []string{"a1", "a2"},
+	}
+
+	var reports []RescanProgress
+	p, err := scr.Rescan(req, getBlockCount, getBlockAtHeight, func(p RescanProgress) {
+		reports = append(reports, p)
+	})
+	require.NoError(t, err)
+
+	expectedDvs := []Deposit{
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a2",
+			Value:    2,
+			Height:   10,
+			Tx:       "tx1",
+			N:        1,
+			Status:   DepositNotProcessed,
+		},
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a2",
+			Value:    3,
+			Height:   11,
+			Tx:       "tx2",
+			N:        0,
+			Status:   DepositNotProcessed,
+		},
+	}
+
+	require.True(t, p.Done)
+	require.Empty(t, p.Error)
+	require.Equal(t, req, p.RescanRequest)
+	require.Equal(t, int64(12), p.Height)
+	require.Equal(t, 3, p.Found)
+	require.Equal(t, expectedDvs, p.Deposits)
+	require.NotZero(t, p.StartedAt)
+	require.NotZero(t, p.FinishedAt)
+
+	// Reported after each block, and when done
+	require.Len(t, reports, 4)
+	for i, h := range []int64{10, 11, 12} {
+		require.Equal(t, h, reports[i].Height)
+		require.False(t, reports[i].Done)
+	}
+	require.Equal(t, p, reports[3])
+
+	// The missed deposits are recorded as unprocessed, the deposit to a1 only once
+	dvs, err = store.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, dvs, 3)
+
+	// The rescanned deposits are confirmed now
+	udvs, err := store.GetUnconfirmedDeposits(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, udvs)
+
+	// The last scanned block is not changed
+	lsb, err := store.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, &ScannedBlock{Height: 10, Hash: "hash10"}, lsb)
+
+	// The scanner is not running, the deposits are loaded when it starts
+	require.Len(t, scr.scannedDeposits, 0)
+
+	// Rescanning again adds nothing
+	p, err = scr.Rescan(req, getBlockCount, getBlockAtHeight, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, p.Found)
+	require.Empty(t, p.Deposits)
+
+	// While the scanner is running, added deposits are sent to the exchange
+	blocks[12].RawTx = []CommonTx{
+		{
+			Txid: "tx3",
+			Vout: []CommonVout{
+				{N: 0, Value: 5, Addresses: []string{"a1"}},
+			},
+		},
+	}
+	atomic.StoreInt32(&scr.running, 1)
+	p, err = scr.Rescan(req, getBlockCount, getBlockAtHeight, nil)
+	require.NoError(t, err)
+	require.Len(t, p.Deposits, 1)
+	require.Len(t, scr.scannedDeposits, 1)
+	require.Equal(t, p.Deposits[0], <-scr.scannedDeposits)
+	atomic.StoreInt32(&scr.running, 0)
+
+	// Blocks without enough confirmations are not rescanned
+	req.ToHeight = 13
+	p, err = scr.Rescan(req, getBlockCount, getBlockAtHeight, nil)
+	require.Error(t, err)
+	require.True(t, p.Done)
+	require.Equal(t, err.Error(), p.Error)
+	require.Equal(t, int64(9), p.Height)
+	require.Zero(t, p.Found)
+
+	// A failure stops the rescan, the progress up to it is kept
+	bestHeight = 14
+	p, err = scr.Rescan(req, getBlockCount, getBlockAtHeight, nil)
+	require.Error(t, err)
+	require.True(t, p.Done)
+	require.Equal(t, err.Error(), p.Error)
+	require.Equal(t, int64(12), p.Height)
+
+	// The request must be valid, and for the scanner's coin type
+	_, err = scr.Rescan(RescanRequest{CoinType: CoinTypeBTC, FromHeight: 10, ToHeight: 12}, getBlockCount, getBlockAtHeight, nil)
+	require.Error(t, err)
+	_, err = scr.Rescan(RescanRequest{CoinType: CoinTypeSKY, FromHeight: 10, ToHeight: 12, Addresses: []string{"a1"}}, getBlockCount, getBlockAtHeight, nil)
+	require.Error(t, err)
+}
+
+func TestBaseScannerRescanQuit(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	scr := NewBaseScanner(store, log, CoinTypeBTC, Config{})
+
+	p, err := scr.Rescan(RescanRequest{
+		CoinType:   CoinTypeBTC,
+		FromHeight: 1,
+		ToHeight:   100,
+		Addresses:  []string{"a1"},
+	}, func() (int64, error) {
+		return 100, nil
+	}, func(height int64) (*CommonBlock, error) {
+		if height == 5 {
+			close(scr.quit)
+		}
+		return &CommonBlock{Height: height}, nil
+	}, nil)
+	require.Equal(t, errQuit, err)
+	require.True(t, p.Done)
+	require.Equal(t, int64(5), p.Height)
+}
+
+// rescanScanner is a DummyScanner that rescans with a function
+type rescanScanner struct {
+	*DummyScanner
+	rescan func(RescanRequest, func(RescanProgress)) (RescanProgress, error)
+}
+
+func (s rescanScanner) Rescan(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+	return s.rescan(req, progress)
+}
+
+func TestMultiplexerStartRescan(t *testing.T) {
+	log, _ := testutil.NewLogger(t)
+	m := NewMultiplexer(log)
+
+	release := make(chan struct{})
+	btcScanner := rescanScanner{
+		DummyScanner: NewDummyScanner(log),
+		rescan: func(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+			p := RescanProgress{
+				RescanRequest: req,
+				Height:        req.FromHeight,
+				Found:         1,
+			}
+			progress(p)
+
+			<-release
+
+			p.Height = req.ToHeight
+			p.Done = true
+			progress(p)
+			return p, nil
+		},
+	}
+	err := m.AddScanner(btcScanner, CoinTypeBTC)
+	require.NoError(t, err)
+
+	rescanErr := errors.New("rescan failed")
+	ethScanner := rescanScanner{
+		DummyScanner: NewDummyScanner(log),
+		rescan: func(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+			return RescanProgress{}, rescanErr
+		},
+	}
+	err = m.AddScanner(ethScanner, CoinTypeETH)
+	require.NoError(t, err)
+
+	err = m.AddScanner(NewDummyScanner(log), CoinTypeSKY)
+	require.NoError(t, err)
+
+	req := RescanRequest{
+		CoinType:   CoinTypeBTC,
+		FromHeight: 10,
+		ToHeight:   20,
+		Addresses:  []string{"a1"},
+	}
+
+	p, err := m.StartRescan(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, p.ID)
+	require.Equal(t, req, p.RescanRequest)
+	require.Equal(t, int64(9), p.Height)
+	require.False(t, p.Done)
+
+	// One rescan of a coin type runs at a time
+	_, err = m.StartRescan(req)
+	require.Equal(t, ErrRescanRunning, err)
+
+	waitRescan := func(id int, check func(RescanProgress) bool) RescanProgress {
+		for i := 0; i < 100; i++ {
+			ps := m.GetRescans()
+			if len(ps) >= id && check(ps[id-1]) {
+				return ps[id-1]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("rescan %d progress not reported", id)
+		return RescanProgress{}
+	}
+
+	p = waitRescan(1, func(p RescanProgress) bool { return p.Found == 1 })
+	require.Equal(t, 1, p.ID)
+	require.Equal(t, int64(10), p.Height)
+	require.False(t, p.Done)
+
+	close(release)
+
+	p = waitRescan(1, func(p RescanProgress) bool { return p.Done })
+	require.Equal(t, int64(20), p.Height)
+	require.NotZero(t, p.FinishedAt)
+	require.Empty(t, p.Error)
+
+	// A rescan that fails without reporting progress is done with its error
+	ethReq := req
+	ethReq.CoinType = CoinTypeETH
+	p, err = m.StartRescan(ethReq)
+	require.NoError(t, err)
+	require.Equal(t, 2, p.ID)
+
+	p = waitRescan(2, func(p RescanProgress) bool { return p.Done })
+	require.Equal(t, ethReq, p.RescanRequest)
+	require.Equal(t, rescanErr.Error(), p.Error)
+	require.Equal(t, int64(9), p.Height)
+
+	// The BTC rescan can be started again
+	p, err = m.StartRescan(req)
+	require.NoError(t, err)
+	require.Equal(t, 3, p.ID)
+
+	skyReq := req
+	skyReq.CoinType = CoinTypeSKY
+	_, err = m.StartRescan(skyReq)
+	require.Equal(t, ErrRescanNotSupported, err)
+
+	unknownReq := req
+	unknownReq.CoinType = "UNKNOWN"
+	_, err = m.StartRescan(unknownReq)
+	require.Equal(t, ScannerNotExistErr{"UNKNOWN"}, err)
+
+	_, err = m.StartRescan(RescanRequest{CoinType: CoinTypeBTC})
+	require.Error(t, err)
+
+	m.Shutdown()
+	_, err = m.StartRescan(req)
+	require.Equal(t, ErrMultiplexerClosed, err)
+
+	require.Len(t, m.GetRescans(), 3)
+}
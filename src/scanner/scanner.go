@@ -11,7 +11,7 @@ import (
 
 // Scanner provids apis for interacting with a scan service
 type Scanner interface {
-	AddScanAddress(string, string) error
+	AddScanAddress(string, string, string) error
 	GetDeposit() <-chan DepositNote
 }
 
@@ -20,9 +20,22 @@ type BtcRPCClient interface {
 	GetBlockVerboseTx(*chainhash.Hash) (*btcjson.GetBlockVerboseResult, error)
 	GetBlockHash(int64) (*chainhash.Hash, error)
 	GetBlockCount() (int64, error)
+	GetRawMempoolVerbose() (map[string]btcjson.GetRawMempoolVerboseResult, error)
+	GetRawTransactionVerbose(*chainhash.Hash) (*btcjson.TxRawResult, error)
 	Shutdown()
 }
 
+// BtcIndexerClient is an address indexer API, such as Esplora,
+// required so that we can mock it for testing
+type BtcIndexerClient interface {
+	GetTipHeight() (int64, error)
+	GetBlockHash(int64) (string, error)
+	GetBlock(string) (*EsploraBlock, error)
+	GetAddressTxs(string, string) ([]EsploraTx, error)
+	GetAddressMempoolTxs(string) ([]EsploraTx, error)
+	GetTxStatus(string) (*EsploraTxStatus, error)
+}
+
 // SkyRPCClient rpcclient interface
 // required so that we can mock it for testing
 type SkyRPCClient interface {
@@ -31,6 +44,14 @@ type SkyRPCClient interface {
 	Shutdown()
 }
 
+// EthRPCClient rpcclient interface
+// required so that we can mock it for testing
+type EthRPCClient interface {
+	GetBlockVerboseTx(seq uint64) (*EthBlock, error)
+	GetBlockCount() (int64, error)
+	Shutdown()
+}
+
 // DepositStatus represents status of a scanned deposit
 type DepositStatus string
 
@@ -43,15 +64,31 @@ const (
 
 	// DepositAccepted represents the status in which the deposit is accepted by the external service.
 	DepositAccepted = DepositStatus("deposit_status:accepted")
+
+	// DepositInvalidated represents the status in which the deposit's block was orphaned by a chain
+	// reorganization, and the external service has not yet been notified.
+	DepositInvalidated = DepositStatus("deposit_status:invalidated")
+
+	// DepositInvalidatedProcessed represents the status in which the deposit's block was orphaned by a chain
+	// reorganization, and the external service was notified.
+	DepositInvalidatedProcessed = DepositStatus("deposit_status:invalidated_processed")
+
+	// DepositUnconfirmed represents the status in which the deposit was seen in the mempool,
+	// but is not yet confirmed in a block. It is not sent to the external service.
+	DepositUnconfirmed = DepositStatus("deposit_status:unconfirmed")
 )
 
 // DepositStatusUpdate is to be sent from external service -> scanner.
+// Status is DepositAccepted or DepositRejected, Err is why a deposit was rejected.
 type DepositStatusUpdate struct {
 	Status DepositStatus
 	Err    error
 }
 
-// DepositNote wraps a Deposit with an ack channel
+// DepositNote wraps a Deposit with ack channels.
+// The external service replies on UpdateC when it accepts or rejects the deposit, which is final.
+// It replies with an error on ErrC if it failed to process the deposit, which is then processed again
+// when the scanner is restarted. A nil error on ErrC accepts the deposit.
 type DepositNote struct {
 	Deposit
 	ErrC    chan error
@@ -63,6 +100,20 @@ func NewDepositNote(dv Deposit) DepositNote {
 	return DepositNote{
 		Deposit: dv,
 		ErrC:    make(chan error, 1),
+		UpdateC: make(chan DepositStatusUpdate, 1),
+	}
+}
+
+// Accept reports to the scanner that the deposit was accepted
+func (dn DepositNote) Accept() {
+	dn.UpdateC <- DepositStatusUpdate{Status: DepositAccepted}
+}
+
+// Reject reports to the scanner that the deposit was rejected, and why
+func (dn DepositNote) Reject(err error) {
+	dn.UpdateC <- DepositStatusUpdate{
+		Status: DepositRejected,
+		Err:    err,
 	}
 }
 
@@ -70,11 +121,24 @@ func NewDepositNote(dv Deposit) DepositNote {
 type Deposit struct {
 	CoinType string        // coin type
 	Address  string        // deposit address
-	Value    int64         // deposit amount. For BTC, measured in satoshis.
+	Value    int64         // deposit amount. For BTC, measured in satoshis. For ETH, measured in gwei.
 	Height   int64         // the block height
 	Tx       string        // the transaction id
 	N        uint32        // the index of vout in the tx [BTC]
 	Status   DepositStatus // whether this was received by the exchange and saved
+	// Why the exchange rejected the deposit, if its Status is DepositRejected
+	RejectReason string `json:",omitempty"`
+}
+
+// UnconfirmedDeposit is a deposit seen in the mempool, that is not yet confirmed in a block
+type UnconfirmedDeposit struct {
+	Deposit
+	SeenAt int64 // when the deposit was first seen in the mempool
+}
+
+// IsInvalidated returns true if the deposit's block was orphaned by a chain reorganization
+func (d Deposit) IsInvalidated() bool {
+	return d.Status == DepositInvalidated || d.Status == DepositInvalidatedProcessed
 }
 
 // ID returns $tx:$n formatted ID string
@@ -84,5 +148,5 @@ func (d Deposit) ID() string {
 
 // GetCoinTypes returns supported coin types
 func GetCoinTypes() []string {
-	return []string{CoinTypeBTC, CoinTypeSKY}
+	return []string{CoinTypeBTC, CoinTypeSKY, CoinTypeETH}
 }
@@ -1,6 +1,7 @@
 package scanner
 
 import (
+	"errors"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -44,7 +45,7 @@ func NewSKYScanner(log logrus.FieldLogger, store Storer, sky SkyRPCClient, cfg C
 
 // Run begins the SKYScanner
 func (s *SKYScanner) Run() error {
-	return s.Base.Run(s.skyClient.GetBlockCount, s.getBlockAtHeight, s.waitForNextBlock, s.scanBlock)
+	return s.Base.Run(s.skyClient.GetBlockCount, s.getBlockAtHeight, s.waitForNextBlock, s.scanBlock, s.scanBlocks)
 }
 
 // Shutdown shutdown the scanner
@@ -56,6 +57,11 @@ func (s *SKYScanner) Shutdown() {
 	s.log.Info("SKY scanner stopped")
 }
 
+// Rescan scans the blocks of a height range again for deposits to the request's addresses, and adds the missed deposits
+func (s *SKYScanner) Rescan(req RescanRequest, progress func(RescanProgress)) (RescanProgress, error) {
+	return s.Base.Rescan(req, s.skyClient.GetBlockCount, s.getBlockAtHeight, progress)
+}
+
 // scanBlock scans for a new SKY block every ScanPeriod.
 // When a new block is found, it compares the block against our scanning
 // deposit addresses. If a matching deposit is found, it saves it to the DB.
@@ -87,7 +93,40 @@ func (s *SKYScanner) scanBlock(block *CommonBlock) (int, error) {
 	return n, nil
 }
 
-//GetBlockCount returns skycoin block count
+// scanBlocks scans consecutive SKY blocks while catching up with the chain, with one store write
+func (s *SKYScanner) scanBlocks(blocks []*CommonBlock) (int, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"fromHeight": blocks[0].Height,
+		"toHeight":   blocks[len(blocks)-1].Height,
+	})
+
+	log.Debug("Scanning blocks")
+
+	dvs, err := s.Base.GetStorer().ScanBlocks(blocks, CoinTypeSKY)
+	if err != nil {
+		log.WithError(err).Error("store.ScanBlocks failed")
+		return 0, err
+	}
+
+	log = log.WithField("scannedDeposits", len(dvs))
+	log.Infof("Counted %d deposits from %d blocks", len(dvs), len(blocks))
+
+	n := 0
+	for _, dv := range dvs {
+		select {
+		case s.Base.GetScannedDepositChan() <- dv:
+			n++
+		case <-s.Base.GetQuitChan():
+			return n, errQuit
+		}
+	}
+
+	return n, nil
+}
+
+// GetBlockCount returns the seq of the last skycoin block.
+// Like bitcoind's getblockcount, it is the height of the best block rather than the number of blocks,
+// so that BaseScanner counts ConfirmationsRequired the same way for every coin.
 func (sc *SkyClient) GetBlockCount() (int64, error) {
 	// get the last block
 	lastBlock, err := sc.c.LastBlocks(1)
@@ -96,9 +135,11 @@ func (sc *SkyClient) GetBlockCount() (int64, error) {
 		return 0, err
 	}
 
-	// block seq of last block is the block count
-	blockCnt := lastBlock.Blocks[0].Head.BkSeq + 1
-	return int64(blockCnt), nil
+	if len(lastBlock.Blocks) == 0 {
+		return 0, errors.New("skycoin node returned no blocks")
+	}
+
+	return int64(lastBlock.Blocks[0].Head.BkSeq), nil
 }
 
 // GetBlockVerboseTx returns skycoin block data for a give height
@@ -129,6 +170,7 @@ func (s *SKYScanner) getBlockAtHeight(height int64) (*CommonBlock, error) {
 func skyBlock2CommonBlock(block *visor.ReadableBlock) (*CommonBlock, error) {
 	cb := CommonBlock{}
 	cb.Hash = block.Head.BlockHash
+	cb.PrevHash = block.Head.PreviousBlockHash
 	cb.Height = int64(block.Head.BkSeq)
 	cb.RawTx = make([]CommonTx, 0, len(block.Body.Transactions))
 	for _, tx := range block.Body.Transactions {
@@ -194,8 +236,8 @@ func (s *SKYScanner) waitForNextBlock(block *CommonBlock) (*CommonBlock, error)
 }
 
 // AddScanAddress adds new scan address
-func (s *SKYScanner) AddScanAddress(addr, coinType string) error {
-	return s.Base.GetStorer().AddScanAddress(addr, coinType)
+func (s *SKYScanner) AddScanAddress(addr, coinType, kittyID string) error {
+	return s.Base.GetStorer().AddScanAddress(addr, coinType, kittyID)
 }
 
 // GetScanAddresses returns the deposit addresses that need to scan
@@ -3,6 +3,8 @@ package scanner
 import (
 	"encoding/binary"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,6 +27,9 @@ var (
 )
 
 type dummySkyrpcclient struct {
+	// The scanner fetches blocks concurrently while catching up
+	sync.Mutex
+
 	db                           *bolt.DB
 	blockHashes                  map[int64]string
 	blockCount                   int64
@@ -53,6 +58,9 @@ func newDummySkyrpcclient(db *bolt.DB) *dummySkyrpcclient {
 }
 
 func (dsc *dummySkyrpcclient) GetBlockCount() (int64, error) {
+	dsc.Lock()
+	defer dsc.Unlock()
+
 	if dsc.blockCountError != nil {
 		// blockCountError is only returned once
 		err := dsc.blockCountError
@@ -64,6 +72,9 @@ func (dsc *dummySkyrpcclient) GetBlockCount() (int64, error) {
 }
 
 func (dsc *dummySkyrpcclient) GetBlockVerboseTx(seq uint64) (*visor.ReadableBlock, error) {
+	dsc.Lock()
+	defer dsc.Unlock()
+
 	if seq > 0 && seq == dsc.blockNextHeightMissingOnceAt && !dsc.hasSetMissingHeight {
 		dsc.hasSetMissingHeight = true
 		return nil, errNoSkyBlockHash
@@ -245,14 +256,14 @@ func testSkyScannerRun(t *testing.T, scr *SKYScanner) {
 
 	// This address has:
 	// 1 deposit, in block 176
-	err := scr.AddScanAddress("v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", CoinTypeSKY)
+	err := scr.AddScanAddress("v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", CoinTypeSKY, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 1
 
 	// This address has:
 	// 1 deposit in block 116
 	// 1 deposit in block 117
-	err = scr.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY)
+	err = scr.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 2
 
@@ -310,7 +321,7 @@ func testSkyScannerProcessDepositError(t *testing.T, skyDB *bolt.DB) {
 	var nDeposits int64
 
 	// This address has deposits in: Block 52, 54, 59, 108, 134, 137, 141
-	err := scr.AddScanAddress("2J3rWX7pciQwmvcATSnxEeCHRs1mSkWmt4L", CoinTypeSKY)
+	err := scr.AddScanAddress("2J3rWX7pciQwmvcATSnxEeCHRs1mSkWmt4L", CoinTypeSKY, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 7
 
@@ -451,7 +462,7 @@ func testSkyScannerDuplicateDepositScans(t *testing.T, skyDB *bolt.DB) {
 	// This address has:
 	// 1 deposit in block 116
 	// 1 deposit in block 117
-	err := scr.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY)
+	err := scr.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY, "")
 	require.NoError(t, err)
 	nDeposits = nDeposits + 2
 
@@ -462,6 +473,46 @@ func testSkyScannerDuplicateDepositScans(t *testing.T, skyDB *bolt.DB) {
 	testSkyScannerRunProcessedLoop(t, scr, 0)
 }
 
+func testSkyScannerResumeFromLastScannedBlock(t *testing.T, skyDB *bolt.DB) {
+	// Test that the scanner resumes from the last scanned block,
+	// instead of the initial scan height, when restarted
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	scr := setupSkyScannerWithDB(t, skyDB, db)
+
+	// This address has:
+	// 1 deposit in block 116
+	// 1 deposit in block 117
+	err := scr.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY, "")
+	require.NoError(t, err)
+
+	testSkyScannerRunProcessedLoop(t, scr, 2)
+
+	lsb, err := scr.Base.GetStorer().GetLastScannedBlock(CoinTypeSKY)
+	require.NoError(t, err)
+	require.NotNil(t, lsb)
+	require.Equal(t, int64(180), lsb.Height)
+	require.NotEmpty(t, lsb.Hash)
+
+	// This address has:
+	// 1 deposit, in block 176
+	// It is added after block 176 was scanned, so it is not found on restart
+	scr = setupSkyScannerWithDB(t, skyDB, db)
+	err = scr.AddScanAddress("v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", CoinTypeSKY, "")
+	require.NoError(t, err)
+
+	testSkyScannerRunProcessedLoop(t, scr, 0)
+
+	// After resetting the last scanned block, scanning begins from
+	// the initial scan height again and the deposit is found
+	err = scr.Base.GetStorer().(*Store).ResetLastScannedBlock(CoinTypeSKY)
+	require.NoError(t, err)
+
+	scr = setupSkyScannerWithDB(t, skyDB, db)
+	testSkyScannerRunProcessedLoop(t, scr, 1)
+}
+
 func testSkyScannerBlockNextHashAppears(t *testing.T, skyDB *bolt.DB) {
 	scr, shutdown := setupSkyScanner(t, skyDB)
 	defer shutdown()
@@ -471,6 +522,178 @@ func testSkyScannerBlockNextHashAppears(t *testing.T, skyDB *bolt.DB) {
 	testSkyScannerRun(t, scr)
 }
 
+// advancingSkyrpcclient is a dummySkyrpcclient whose chain ends at tip, which is advanced by the test
+type advancingSkyrpcclient struct {
+	*dummySkyrpcclient
+	tip int64
+}
+
+func newAdvancingSkyrpcclient(db *bolt.DB, tip int64) *advancingSkyrpcclient {
+	return &advancingSkyrpcclient{
+		dummySkyrpcclient: newDummySkyrpcclient(db),
+		tip:               tip,
+	}
+}
+
+func (c *advancingSkyrpcclient) setTip(tip int64) {
+	atomic.StoreInt64(&c.tip, tip)
+}
+
+func (c *advancingSkyrpcclient) GetBlockCount() (int64, error) {
+	return atomic.LoadInt64(&c.tip), nil
+}
+
+func (c *advancingSkyrpcclient) GetBlockVerboseTx(seq uint64) (*visor.ReadableBlock, error) {
+	if int64(seq) > atomic.LoadInt64(&c.tip) {
+		return nil, errNoSkyBlockHeight
+	}
+
+	return c.dummySkyrpcclient.GetBlockVerboseTx(seq)
+}
+
+func setupSkyScannerAdvancingTip(t *testing.T, skyDB, db *bolt.DB, initialHeight, tip, confirmationsRequired int64) (*SKYScanner, *advancingSkyrpcclient) {
+	log, _ := testutil.NewLogger(t)
+
+	rpc := newAdvancingSkyrpcclient(skyDB, tip)
+
+	store, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = store.AddSupportedCoin(CoinTypeSKY)
+	require.NoError(t, err)
+
+	scr, err := NewSKYScanner(log, store, rpc, Config{
+		ScanPeriod:            time.Millisecond * 10,
+		DepositBufferSize:     5,
+		InitialScanHeight:     initialHeight,
+		ConfirmationsRequired: confirmationsRequired,
+	})
+	require.NoError(t, err)
+
+	return scr, rpc
+}
+
+// runSkyScannerAdvancingTip runs the scanner and returns a channel of the processed deposits,
+// and a function that shuts the scanner down
+func runSkyScannerAdvancingTip(t *testing.T, scr *SKYScanner) (<-chan Deposit, func()) {
+	deposits := make(chan Deposit, 10)
+	go func() {
+		defer close(deposits)
+		for dv := range scr.GetDeposit() {
+			dv.ErrC <- nil
+			deposits <- dv.Deposit
+		}
+	}()
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- scr.Run()
+	}()
+
+	return deposits, func() {
+		scr.Shutdown()
+		require.NoError(t, <-errC)
+	}
+}
+
+func requireSkyLastScannedBlock(t *testing.T, scr *SKYScanner, height int64) {
+	var lsb *ScannedBlock
+	for i := 0; i < 500; i++ {
+		var err error
+		lsb, err = scr.Base.GetStorer().GetLastScannedBlock(CoinTypeSKY)
+		require.NoError(t, err)
+		if lsb != nil && lsb.Height == height {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatalf("last scanned block is %v, expected height %d", lsb, height)
+}
+
+func requireNoSkyDeposit(t *testing.T, deposits <-chan Deposit) {
+	select {
+	case dv := <-deposits:
+		t.Fatalf("unexpected deposit %v", dv)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func requireSkyDeposit(t *testing.T, deposits <-chan Deposit, addr string, height int64) {
+	select {
+	case dv := <-deposits:
+		require.Equal(t, addr, dv.Address)
+		require.Equal(t, height, dv.Height)
+		require.Equal(t, CoinTypeSKY, dv.CoinType)
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no deposit at height %d", height)
+	}
+}
+
+func testSkyScannerConfirmationsRequired(t *testing.T, skyDB *bolt.DB) {
+	// Test that a deposit is only processed once its block has ConfirmationsRequired blocks on top of it
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	scr, rpc := setupSkyScannerAdvancingTip(t, skyDB, db, 170, 170, 2)
+
+	// This address has:
+	// 1 deposit, in block 176
+	err := scr.AddScanAddress("v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", CoinTypeSKY, "")
+	require.NoError(t, err)
+
+	deposits, stop := runSkyScannerAdvancingTip(t, scr)
+	defer stop()
+
+	// The initial block is the tip, it is not scanned yet
+	requireNoSkyDeposit(t, deposits)
+	lsb, err := scr.Base.GetStorer().GetLastScannedBlock(CoinTypeSKY)
+	require.NoError(t, err)
+	require.Nil(t, lsb)
+
+	// Block 176 has one confirmation
+	rpc.setTip(177)
+	requireSkyLastScannedBlock(t, scr, 175)
+	requireNoSkyDeposit(t, deposits)
+
+	// Block 176 has two confirmations
+	rpc.setTip(178)
+	requireSkyLastScannedBlock(t, scr, 176)
+	requireSkyDeposit(t, deposits, "v4qF7Ceq276tZpTS3HKsZbDguMAcAGAG1q", 176)
+
+	rpc.setTip(180)
+	requireSkyLastScannedBlock(t, scr, 178)
+	requireNoSkyDeposit(t, deposits)
+}
+
+func testSkyScannerConfirmationsRequiredEachBlock(t *testing.T, skyDB *bolt.DB) {
+	// Test that deposits in consecutive blocks are processed one at a time, as the tip advances
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	scr, rpc := setupSkyScannerAdvancingTip(t, skyDB, db, 115, 116, 1)
+
+	// This address has:
+	// 1 deposit in block 116
+	// 1 deposit in block 117
+	err := scr.AddScanAddress("8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", CoinTypeSKY, "")
+	require.NoError(t, err)
+
+	deposits, stop := runSkyScannerAdvancingTip(t, scr)
+	defer stop()
+
+	requireSkyLastScannedBlock(t, scr, 115)
+	requireNoSkyDeposit(t, deposits)
+
+	rpc.setTip(117)
+	requireSkyLastScannedBlock(t, scr, 116)
+	requireSkyDeposit(t, deposits, "8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", 116)
+	requireNoSkyDeposit(t, deposits)
+
+	rpc.setTip(118)
+	requireSkyLastScannedBlock(t, scr, 117)
+	requireSkyDeposit(t, deposits, "8MQsjc5HYbSjPTZikFZYeHHDtLungBEHYS", 117)
+}
+
 func TestSkyScanner(t *testing.T) {
 	skyDB := openDummySkyDB(t)
 	defer testutil.CheckError(t, skyDB.Close)
@@ -525,12 +748,33 @@ func TestSkyScanner(t *testing.T) {
 			testSkyScannerDuplicateDepositScans(t, skyDB)
 		})
 
+		t.Run("ResumeFromLastScannedBlock", func(t *testing.T) {
+			if parallel {
+				t.Parallel()
+			}
+			testSkyScannerResumeFromLastScannedBlock(t, skyDB)
+		})
+
 		t.Run("BlockNextHashAppears", func(t *testing.T) {
 			if parallel {
 				t.Parallel()
 			}
 			testSkyScannerBlockNextHashAppears(t, skyDB)
 		})
+
+		t.Run("ConfirmationsRequired", func(t *testing.T) {
+			if parallel {
+				t.Parallel()
+			}
+			testSkyScannerConfirmationsRequired(t, skyDB)
+		})
+
+		t.Run("ConfirmationsRequiredEachBlock", func(t *testing.T) {
+			if parallel {
+				t.Parallel()
+			}
+			testSkyScannerConfirmationsRequiredEachBlock(t, skyDB)
+		})
 	})
 
 }
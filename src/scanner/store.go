@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/sirupsen/logrus"
@@ -16,20 +17,45 @@ const (
 	CoinTypeBTC = "BTC"
 	// CoinTypeSKY is SKY coin type
 	CoinTypeSKY = "SKY"
+	// CoinTypeETH is ETH coin type
+	CoinTypeETH = "ETH"
 )
 
 var (
 	// DepositBkt maps a deposit transaction to a Deposit
 	DepositBkt = []byte("deposit_value")
 
-	// deposit address bucket
+	// UnconfirmedDepositBkt maps a deposit transaction seen in the mempool to an UnconfirmedDeposit,
+	// until the deposit is confirmed in a scanned block
+	UnconfirmedDepositBkt = []byte("unconfirmed_deposit_value")
+
+	// deposit addresses key in the scan_meta bucket, where the watched addresses were kept as one array
+	// before they were moved to the scan_addresses bucket
 	depositAddressesKey = "deposit_addresses"
 
+	// last fully scanned block key in the scan_meta bucket
+	lastScannedBlockKey = "last_scanned_block"
+
+	// recently scanned blocks key in the scan_meta bucket, used to detect chain reorganizations
+	recentScannedBlocksKey = "recent_scanned_blocks"
+
 	// ErrUnsupportedCoinType unsupported coin type
 	ErrUnsupportedCoinType = errors.New("unsupported coin type")
 )
 
-const scanMetaBktPrefix = "scan_meta"
+const (
+	scanMetaBktPrefix      = "scan_meta"
+	scanAddressesBktPrefix = "scan_addresses"
+
+	// deactivatedScanAddressGracePeriod is how long a deactivated address is still watched,
+	// so that deposits sent just before its reservation expired are recorded once they are confirmed,
+	// and can be refunded
+	deactivatedScanAddressGracePeriod = time.Hour * 24 * 7
+
+	// scannedBlocksWindow is the number of recently scanned blocks remembered,
+	// which limits how deep a chain reorganization can be rolled back
+	scannedBlocksWindow = 100
+)
 
 // GetScanMetaBkt return the name of the scan_meta bucket for a given coin type
 func GetScanMetaBkt(coinType string) ([]byte, error) {
@@ -39,6 +65,8 @@ func GetScanMetaBkt(coinType string) ([]byte, error) {
 		suffix = "btc"
 	case CoinTypeSKY:
 		suffix = "sky"
+	case CoinTypeETH:
+		suffix = "eth"
 	default:
 		return nil, ErrUnsupportedCoinType
 	}
@@ -57,6 +85,19 @@ func MustGetScanMetaBkt(coinType string) []byte {
 	return name
 }
 
+// GetScanAddressesBkt returns the name of the bucket of the watched addresses of a given coin type,
+// which maps a deposit address to a ScanAddress
+func GetScanAddressesBkt(coinType string) ([]byte, error) {
+	metaBkt, err := GetScanMetaBkt(coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := string(metaBkt[len(scanMetaBktPrefix):])
+
+	return []byte(scanAddressesBktPrefix + suffix), nil
+}
+
 func init() {
 	// Check that GetScanMetaBkt handles all possible coin types
 	// TODO -- do similar init checks for other switches over coinType
@@ -99,13 +140,49 @@ func NewDuplicateDepositAddressErr(addr string) error {
 	}
 }
 
+// ScanAddress is a deposit address watched by the scanner
+type ScanAddress struct {
+	Address       string
+	KittyID       string // the kitty the address is bound to, empty for addresses migrated from the old array
+	AddedAt       int64  // when the address was added
+	Active        bool   // false once the reservation of the kitty expired
+	DeactivatedAt int64  // when the address was deactivated
+}
+
+// isWatched returns true if deposits to the address are still recorded at time now.
+// A deactivated address is watched for deactivatedScanAddressGracePeriod.
+func (a ScanAddress) isWatched(now time.Time) bool {
+	if a.Active {
+		return true
+	}
+
+	return now.Before(time.Unix(a.DeactivatedAt, 0).Add(deactivatedScanAddressGracePeriod))
+}
+
+// ScannedBlock records the height and hash of a block that was fully scanned
+type ScannedBlock struct {
+	Height int64
+	Hash   string
+}
+
 // Storer interface for scanner meta info storage
 type Storer interface {
 	GetScanAddresses(string) ([]string, error)
-	AddScanAddress(string, string) error
+	AddScanAddress(string, string, string) error
+	DeactivateScanAddress(string, string) error
+	RemoveScanAddress(string, string) error
 	SetDepositProcessed(string) error
+	SetDepositRejected(string, string) error
 	GetUnprocessedDeposits() ([]Deposit, error)
 	ScanBlock(*CommonBlock, string) ([]Deposit, error)
+	ScanBlocks([]*CommonBlock, string) ([]Deposit, error)
+	RescanBlock(*CommonBlock, string, []string) ([]Deposit, int, error)
+	GetLastScannedBlock(string) (*ScannedBlock, error)
+	GetRecentScannedBlocks(string) ([]ScannedBlock, error)
+	RollbackScannedBlocks(string, ScannedBlock) ([]Deposit, error)
+	SetDepositInvalidationProcessed(string) error
+	GetUnconfirmedDeposits(string) ([]UnconfirmedDeposit, error)
+	SetUnconfirmedDeposits(string, []Deposit) error
 }
 
 // Store records scanner meta info for BTC deposits
@@ -121,7 +198,11 @@ func NewStore(log logrus.FieldLogger, db *bolt.DB) (*Store, error) {
 	}
 
 	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(DepositBkt)
+		if _, err := tx.CreateBucketIfNotExists(DepositBkt); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists(UnconfirmedDepositBkt)
 		return err
 	}); err != nil {
 		return nil, err
@@ -133,6 +214,7 @@ func NewStore(log logrus.FieldLogger, db *bolt.DB) (*Store, error) {
 }
 
 //AddSupportedCoin create scaninfo bucket and callback for specified coin
+// The watched addresses saved as one array by older versions are migrated to the scan_addresses bucket.
 func (s *Store) AddSupportedCoin(coinType string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		scanBktFullName, err := GetScanMetaBkt(coinType)
@@ -140,12 +222,76 @@ func (s *Store) AddSupportedCoin(coinType string) error {
 			return err
 		}
 
-		_, err = tx.CreateBucketIfNotExists(scanBktFullName)
-		return err
+		if _, err := tx.CreateBucketIfNotExists(scanBktFullName); err != nil {
+			return err
+		}
+
+		scanAddrsBktName, err := GetScanAddressesBkt(coinType)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(scanAddrsBktName); err != nil {
+			return err
+		}
+
+		return s.migrateScanAddressesTx(tx, coinType)
 	})
 }
 
-// GetScanAddresses returns all scan addresses
+// migrateScanAddressesTx moves the addresses of the deposit_addresses array in the scan_meta bucket
+// to individual keys of the scan_addresses bucket, and deletes the array
+func (s *Store) migrateScanAddressesTx(tx *bolt.Tx, coinType string) error {
+	scanBktFullName, err := GetScanMetaBkt(coinType)
+	if err != nil {
+		return err
+	}
+
+	var addrs []string
+	if err := dbutil.GetBucketObject(tx, scanBktFullName, depositAddressesKey, &addrs); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	scanAddrsBktName, err := GetScanAddressesBkt(coinType)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, a := range addrs {
+		if hasKey, err := dbutil.BucketHasKey(tx, scanAddrsBktName, a); err != nil {
+			return err
+		} else if hasKey {
+			continue
+		}
+
+		if err := dbutil.PutBucketValue(tx, scanAddrsBktName, a, ScanAddress{
+			Address: a,
+			AddedAt: now,
+			Active:  true,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Bucket(scanBktFullName).Delete([]byte(depositAddressesKey)); err != nil {
+		return err
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"coinType": coinType,
+		"addrs":    len(addrs),
+	}).Info("Migrated scan addresses to their own bucket")
+
+	return nil
+}
+
+// GetScanAddresses returns all scan addresses, which are active or deactivated recently
 func (s *Store) GetScanAddresses(coinType string) ([]string, error) {
 	var addrs []string
 
@@ -164,51 +310,362 @@ func (s *Store) GetScanAddresses(coinType string) ([]string, error) {
 func (s *Store) getScanAddressesTx(tx *bolt.Tx, coinType string) ([]string, error) {
 	var addrs []string
 
-	scanBktFullName, err := GetScanMetaBkt(coinType)
+	scanAddrsBktName, err := GetScanAddressesBkt(coinType)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := dbutil.GetBucketObject(tx, scanBktFullName, depositAddressesKey, &addrs); err != nil {
+	now := time.Now()
+	if err := dbutil.ForEach(tx, scanAddrsBktName, func(k, v []byte) error {
+		var a ScanAddress
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+
+		if a.isWatched(now) {
+			addrs = append(addrs, a.Address)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return addrs, nil
+}
+
+// GetScanAddress returns the ScanAddress of a deposit address.
+// Returns dbutil.ObjectNotExistErr if the address is not watched.
+func (s *Store) GetScanAddress(addr, coinType string) (*ScanAddress, error) {
+	var a *ScanAddress
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		a, err = getScanAddressTx(tx, addr, coinType)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func getScanAddressTx(tx *bolt.Tx, addr, coinType string) (*ScanAddress, error) {
+	scanAddrsBktName, err := GetScanAddressesBkt(coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	var a ScanAddress
+	if err := dbutil.GetBucketObject(tx, scanAddrsBktName, addr, &a); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// AddScanAddress adds an address bound to kittyID to the scan list
+func (s *Store) AddScanAddress(addr, coinType, kittyID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		scanAddrsBktName, err := GetScanAddressesBkt(coinType)
+		if err != nil {
+			return err
+		}
+
+		if hasKey, err := dbutil.BucketHasKey(tx, scanAddrsBktName, addr); err != nil {
+			return err
+		} else if hasKey {
+			return NewDuplicateDepositAddressErr(addr)
+		}
+
+		return dbutil.PutBucketValue(tx, scanAddrsBktName, addr, ScanAddress{
+			Address: addr,
+			KittyID: kittyID,
+			AddedAt: time.Now().Unix(),
+			Active:  true,
+		})
+	})
+}
+
+// DeactivateScanAddress deactivates a watched address, e.g. when the reservation of its kitty expires
+func (s *Store) DeactivateScanAddress(addr, coinType string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return DeactivateScanAddressTx(tx, addr, coinType)
+	})
+}
+
+// DeactivateScanAddressTx deactivates a watched address in a bolt.Tx.
+// It is watched for deactivatedScanAddressGracePeriod more, then deposits to it are ignored.
+// Deactivating an address that is not watched or already deactivated is a no-op.
+func DeactivateScanAddressTx(tx *bolt.Tx, addr, coinType string) error {
+	a, err := getScanAddressTx(tx, addr, coinType)
+	if err != nil {
 		switch err.(type) {
-		case dbutil.ObjectNotExistErr:
+		case dbutil.ObjectNotExistErr, dbutil.BucketNotExistErr:
+			return nil
 		default:
-			return nil, err
+			return err
 		}
 	}
 
-	if len(addrs) == 0 {
-		addrs = nil
+	if !a.Active {
+		return nil
 	}
 
-	return addrs, nil
+	a.Active = false
+	a.DeactivatedAt = time.Now().Unix()
+
+	scanAddrsBktName, err := GetScanAddressesBkt(coinType)
+	if err != nil {
+		return err
+	}
+
+	return dbutil.PutBucketValue(tx, scanAddrsBktName, addr, a)
 }
 
-// AddScanAddress adds an address to the scan list
-func (s *Store) AddScanAddress(addr, coinType string) error {
+// RemoveScanAddress stops watching an address immediately.
+// Removing an address that is not watched is a no-op.
+func (s *Store) RemoveScanAddress(addr, coinType string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		addrs, err := s.getScanAddressesTx(tx, coinType)
+		scanAddrsBktName, err := GetScanAddressesBkt(coinType)
 		if err != nil {
 			return err
 		}
 
-		for _, a := range addrs {
-			if a == addr {
-				return NewDuplicateDepositAddressErr(addr)
+		bkt := tx.Bucket(scanAddrsBktName)
+		if bkt == nil {
+			return dbutil.NewBucketNotExistErr(scanAddrsBktName)
+		}
+
+		return bkt.Delete([]byte(addr))
+	})
+}
+
+// getWatchedAddressesTx returns the addresses paid by the outputs of a block that are watched
+func getWatchedAddressesTx(tx *bolt.Tx, block *CommonBlock, coinType string) ([]string, error) {
+	scanAddrsBktName, err := GetScanAddressesBkt(coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	bkt := tx.Bucket(scanAddrsBktName)
+	if bkt == nil {
+		return nil, dbutil.NewBucketNotExistErr(scanAddrsBktName)
+	}
+
+	now := time.Now()
+	seen := make(map[string]struct{})
+	var addrs []string
+	for _, t := range block.RawTx {
+		for _, v := range t.Vout {
+			for _, a := range v.Addresses {
+				if _, ok := seen[a]; ok {
+					continue
+				}
+				seen[a] = struct{}{}
+
+				value := bkt.Get([]byte(a))
+				if value == nil {
+					continue
+				}
+
+				var sa ScanAddress
+				if err := json.Unmarshal(value, &sa); err != nil {
+					return nil, err
+				}
+
+				if sa.isWatched(now) {
+					addrs = append(addrs, a)
+				}
 			}
 		}
+	}
+
+	return addrs, nil
+}
+
+// GetLastScannedBlock returns the last fully scanned block of a coin type.
+// Returns nil if no block has been scanned yet.
+func (s *Store) GetLastScannedBlock(coinType string) (*ScannedBlock, error) {
+	var lsb *ScannedBlock
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lsb, err = s.getLastScannedBlockTx(tx, coinType)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return lsb, nil
+}
+
+// getLastScannedBlockTx returns the last fully scanned block of a coin type in a bolt.Tx
+func (s *Store) getLastScannedBlockTx(tx *bolt.Tx, coinType string) (*ScannedBlock, error) {
+	scanBktFullName, err := GetScanMetaBkt(coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	var lsb ScannedBlock
+	if err := dbutil.GetBucketObject(tx, scanBktFullName, lastScannedBlockKey, &lsb); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
 
-		addrs = append(addrs, addr)
+	return &lsb, nil
+}
 
+// ResetLastScannedBlock removes the last scanned block of a coin type,
+// so that the scanner begins from its configured initial scan height on the next start
+func (s *Store) ResetLastScannedBlock(coinType string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		scanBktFullName, err := GetScanMetaBkt(coinType)
 		if err != nil {
 			return err
 		}
 
-		return dbutil.PutBucketValue(tx, scanBktFullName, depositAddressesKey, addrs)
+		bkt := tx.Bucket(scanBktFullName)
+		if bkt == nil {
+			return dbutil.NewBucketNotExistErr(scanBktFullName)
+		}
+
+		if err := bkt.Delete([]byte(recentScannedBlocksKey)); err != nil {
+			return err
+		}
+
+		return bkt.Delete([]byte(lastScannedBlockKey))
 	})
 }
 
+// GetRecentScannedBlocks returns the recently scanned blocks of a coin type, ordered by height
+func (s *Store) GetRecentScannedBlocks(coinType string) ([]ScannedBlock, error) {
+	var blocks []ScannedBlock
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		blocks, err = s.getRecentScannedBlocksTx(tx, coinType)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// getRecentScannedBlocksTx returns the recently scanned blocks of a coin type in a bolt.Tx
+func (s *Store) getRecentScannedBlocksTx(tx *bolt.Tx, coinType string) ([]ScannedBlock, error) {
+	scanBktFullName, err := GetScanMetaBkt(coinType)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []ScannedBlock
+	if err := dbutil.GetBucketObject(tx, scanBktFullName, recentScannedBlocksKey, &blocks); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+		default:
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+// setScannedBlockTx records a block as the last scanned block, and adds it to the recently scanned blocks
+func (s *Store) setScannedBlockTx(tx *bolt.Tx, coinType string, block ScannedBlock) error {
+	scanBktFullName, err := GetScanMetaBkt(coinType)
+	if err != nil {
+		return err
+	}
+
+	blocks, err := s.getRecentScannedBlocksTx(tx, coinType)
+	if err != nil {
+		return err
+	}
+
+	// Drop any blocks at or above this height, in case a block is scanned again
+	for len(blocks) > 0 && blocks[len(blocks)-1].Height >= block.Height {
+		blocks = blocks[:len(blocks)-1]
+	}
+
+	blocks = append(blocks, block)
+	if len(blocks) > scannedBlocksWindow {
+		blocks = blocks[len(blocks)-scannedBlocksWindow:]
+	}
+
+	if err := dbutil.PutBucketValue(tx, scanBktFullName, recentScannedBlocksKey, blocks); err != nil {
+		return err
+	}
+
+	return dbutil.PutBucketValue(tx, scanBktFullName, lastScannedBlockKey, block)
+}
+
+// RollbackScannedBlocks rolls the scanned blocks of a coin type back to a fork point
+// after a chain reorganization. Every scanned block above the fork point is forgotten
+// and the fork point becomes the last scanned block. Deposits of the orphaned blocks
+// are marked as DepositInvalidated and returned.
+func (s *Store) RollbackScannedBlocks(coinType string, forkBlock ScannedBlock) ([]Deposit, error) {
+	var dvs []Deposit
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		blocks, err := s.getRecentScannedBlocksTx(tx, coinType)
+		if err != nil {
+			return err
+		}
+
+		for len(blocks) > 0 && blocks[len(blocks)-1].Height > forkBlock.Height {
+			blocks = blocks[:len(blocks)-1]
+		}
+
+		scanBktFullName, err := GetScanMetaBkt(coinType)
+		if err != nil {
+			return err
+		}
+
+		if err := dbutil.PutBucketValue(tx, scanBktFullName, recentScannedBlocksKey, blocks); err != nil {
+			return err
+		}
+
+		if err := dbutil.PutBucketValue(tx, scanBktFullName, lastScannedBlockKey, forkBlock); err != nil {
+			return err
+		}
+
+		if err := dbutil.ForEach(tx, DepositBkt, func(k, v []byte) error {
+			var dv Deposit
+			if err := json.Unmarshal(v, &dv); err != nil {
+				return err
+			}
+
+			if dv.CoinType != coinType || dv.Height <= forkBlock.Height || dv.IsInvalidated() {
+				return nil
+			}
+
+			dv.Status = DepositInvalidated
+			dvs = append(dvs, dv)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, dv := range dvs {
+			if err := dbutil.PutBucketValue(tx, DepositBkt, dv.ID(), dv); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return dvs, nil
+}
+
 // SetDepositProcessed marks a Deposit as processed
 func (s *Store) SetDepositProcessed(dvKey string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
@@ -221,13 +678,69 @@ func (s *Store) SetDepositProcessed(dvKey string) error {
 			return errors.New("CRITICAL ERROR: dv.ID() != dvKey")
 		}
 
+		// The deposit was invalidated while it was being processed,
+		// keep it invalidated so that the invalidation is processed too
+		if dv.IsInvalidated() {
+			return nil
+		}
+
 		dv.Status = DepositAccepted
 
 		return dbutil.PutBucketValue(tx, DepositBkt, dv.ID(), dv)
 	})
 }
 
-// GetUnprocessedDeposits returns all Deposits not marked as Processed
+// SetDepositRejected marks a Deposit as rejected by the exchange, with the reason it was rejected
+func (s *Store) SetDepositRejected(dvKey, reason string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var dv Deposit
+		if err := dbutil.GetBucketObject(tx, DepositBkt, dvKey, &dv); err != nil {
+			return err
+		}
+
+		if dv.ID() != dvKey {
+			return errors.New("CRITICAL ERROR: dv.ID() != dvKey")
+		}
+
+		// The deposit was invalidated while it was being processed,
+		// keep it invalidated so that the invalidation is processed too
+		if dv.IsInvalidated() {
+			return nil
+		}
+
+		dv.Status = DepositRejected
+		dv.RejectReason = reason
+
+		return dbutil.PutBucketValue(tx, DepositBkt, dv.ID(), dv)
+	})
+}
+
+// SetDepositInvalidationProcessed marks an invalidated Deposit as processed
+func (s *Store) SetDepositInvalidationProcessed(dvKey string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var dv Deposit
+		if err := dbutil.GetBucketObject(tx, DepositBkt, dvKey, &dv); err != nil {
+			return err
+		}
+
+		if dv.ID() != dvKey {
+			return errors.New("CRITICAL ERROR: dv.ID() != dvKey")
+		}
+
+		// The deposit was included in the chain again while the invalidation
+		// was being processed, it is processed as a new deposit
+		if dv.Status != DepositInvalidated {
+			return nil
+		}
+
+		dv.Status = DepositInvalidatedProcessed
+
+		return dbutil.PutBucketValue(tx, DepositBkt, dv.ID(), dv)
+	})
+}
+
+// GetUnprocessedDeposits returns all Deposits not marked as Processed,
+// including invalidated Deposits that were not processed yet
 func (s *Store) GetUnprocessedDeposits() ([]Deposit, error) {
 	var dvs []Deposit
 
@@ -238,7 +751,7 @@ func (s *Store) GetUnprocessedDeposits() ([]Deposit, error) {
 				return err
 			}
 
-			if dv.Status == DepositNotProcessed {
+			if dv.Status == DepositNotProcessed || dv.Status == DepositInvalidated {
 				dvs = append(dvs, dv)
 			}
 
@@ -251,16 +764,152 @@ func (s *Store) GetUnprocessedDeposits() ([]Deposit, error) {
 	return dvs, nil
 }
 
+// GetRejectedDeposits returns all Deposits rejected by the exchange
+func (s *Store) GetRejectedDeposits() ([]Deposit, error) {
+	var dvs []Deposit
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEach(tx, DepositBkt, func(k, v []byte) error {
+			var dv Deposit
+			if err := json.Unmarshal(v, &dv); err != nil {
+				return err
+			}
+
+			if dv.Status == DepositRejected {
+				dvs = append(dvs, dv)
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return dvs, nil
+}
+
+// GetUnconfirmedDeposits returns the deposits of a coin type that were seen in the mempool,
+// but are not yet confirmed in a scanned block
+func (s *Store) GetUnconfirmedDeposits(coinType string) ([]UnconfirmedDeposit, error) {
+	var dvs []UnconfirmedDeposit
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		dvs, err = GetUnconfirmedDepositsTx(tx, func(dv UnconfirmedDeposit) bool {
+			return dv.CoinType == coinType
+		})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return dvs, nil
+}
+
+// GetUnconfirmedDepositsTx returns the unconfirmed deposits that match the filter in a bolt.Tx.
+// It lets the exchange, which shares the db, show the deposits before they are confirmed.
+func GetUnconfirmedDepositsTx(tx *bolt.Tx, flt func(UnconfirmedDeposit) bool) ([]UnconfirmedDeposit, error) {
+	var dvs []UnconfirmedDeposit
+
+	if tx.Bucket(UnconfirmedDepositBkt) == nil {
+		return nil, nil
+	}
+
+	if err := dbutil.ForEach(tx, UnconfirmedDepositBkt, func(k, v []byte) error {
+		var dv UnconfirmedDeposit
+		if err := json.Unmarshal(v, &dv); err != nil {
+			return err
+		}
+
+		if flt(dv) {
+			dvs = append(dvs, dv)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return dvs, nil
+}
+
+// SetUnconfirmedDeposits replaces the unconfirmed deposits of a coin type.
+// Deposits that are already confirmed are ignored, deposits seen before keep their SeenAt time.
+func (s *Store) SetUnconfirmedDeposits(coinType string, dvs []Deposit) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prev, err := GetUnconfirmedDepositsTx(tx, func(dv UnconfirmedDeposit) bool {
+			return dv.CoinType == coinType
+		})
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]UnconfirmedDeposit, len(prev))
+		for _, dv := range prev {
+			seen[dv.ID()] = dv
+		}
+
+		now := time.Now().UTC().Unix()
+		kept := make(map[string]struct{}, len(dvs))
+		for _, dv := range dvs {
+			if hasKey, err := dbutil.BucketHasKey(tx, DepositBkt, dv.ID()); err != nil {
+				return err
+			} else if hasKey {
+				continue
+			}
+
+			udv := UnconfirmedDeposit{
+				Deposit: dv,
+				SeenAt:  now,
+			}
+			udv.CoinType = coinType
+			udv.Height = 0
+			udv.Status = DepositUnconfirmed
+
+			if p, ok := seen[dv.ID()]; ok {
+				udv.SeenAt = p.SeenAt
+			}
+
+			if err := dbutil.PutBucketValue(tx, UnconfirmedDepositBkt, dv.ID(), udv); err != nil {
+				return err
+			}
+
+			kept[dv.ID()] = struct{}{}
+		}
+
+		for id := range seen {
+			if _, ok := kept[id]; ok {
+				continue
+			}
+
+			if err := tx.Bucket(UnconfirmedDepositBkt).Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
 // pushDepositTx adds an Deposit in a bolt.Tx
-// Returns DepositExistsErr if the deposit already exists
+// Returns DepositExistsErr if the deposit already exists.
+// An invalidated deposit that is included again in the new chain after a
+// chain reorganization is replaced by the new deposit, to be processed again.
 func (s *Store) pushDepositTx(tx *bolt.Tx, dv Deposit) error {
 	key := dv.ID()
 
 	// Check if the deposit value already exists
-	if hasKey, err := dbutil.BucketHasKey(tx, DepositBkt, key); err != nil {
-		return err
-	} else if hasKey {
+	var existing Deposit
+	if err := dbutil.GetBucketObject(tx, DepositBkt, key, &existing); err != nil {
+		switch err.(type) {
+		case dbutil.ObjectNotExistErr:
+		default:
+			return err
+		}
+	} else if !existing.IsInvalidated() {
 		return DepositExistsErr{}
+	} else {
+		s.log.WithField("deposit", dv).Warn("Invalidated deposit was included in the chain again")
 	}
 
 	// Save deposit value
@@ -273,36 +922,119 @@ func (s *Store) ScanBlock(block *CommonBlock, coinType string) ([]Deposit, error
 	return s.scanBlock(block, coinType)
 }
 
+// ScanBlocks scans consecutive coin blocks for deposits and adds them, in one transaction.
+// The last block is recorded as the last scanned block.
+// If the deposit already exists, the result is omitted from the returned list
+func (s *Store) ScanBlocks(blocks []*CommonBlock, coinType string) ([]Deposit, error) {
+	var dvs []Deposit
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, block := range blocks {
+			blockDvs, err := s.scanBlockTx(tx, block, coinType)
+			if err != nil {
+				return err
+			}
+			dvs = append(dvs, blockDvs...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return dvs, nil
+}
+
 // scanBlock scans a coin block for deposits and adds them
-// 1. get deposit address by coinType
-// 2. call callback function to get deposit
-// 3. push deposit into db, finished at one transaction
 func (s *Store) scanBlock(block *CommonBlock, coinType string) ([]Deposit, error) {
 	var dvs []Deposit
 
 	if err := s.db.Update(func(tx *bolt.Tx) error {
-		// return a list of deposit addresses
-		addrs, err := s.getScanAddressesTx(tx, coinType)
-		if err != nil {
-			s.log.WithError(err).Error("getScanAddressesTx failed")
-			return err
+		var err error
+		dvs, err = s.scanBlockTx(tx, block, coinType)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return dvs, nil
+}
+
+// scanBlockTx scans a coin block for deposits and adds them
+// 1. get the watched deposit addresses paid in the block
+// 2. call callback function to get deposit
+// 3. push deposit into db
+// 4. record the block as the last scanned block
+func (s *Store) scanBlockTx(tx *bolt.Tx, block *CommonBlock, coinType string) ([]Deposit, error) {
+	// look up the addresses paid in the block, instead of loading every watched address
+	addrs, err := getWatchedAddressesTx(tx, block, coinType)
+	if err != nil {
+		s.log.WithError(err).Error("getWatchedAddressesTx failed")
+		return nil, err
+	}
+
+	deposits, err := scanSpecifiedBlock(block, coinType, addrs)
+	if err != nil {
+		s.log.WithError(err).Error("ScanBlock failed")
+		return nil, err
+	}
+
+	var dvs []Deposit
+	for _, dv := range deposits {
+		if err := s.pushDepositTx(tx, dv); err != nil {
+			log := s.log.WithField("deposit", dv)
+			switch err.(type) {
+			case DepositExistsErr:
+				log.Warning("Deposit already exists in db")
+				continue
+			default:
+				log.WithError(err).Error("pushDepositTx failed")
+				return nil, err
+			}
+		}
+
+		dvs = append(dvs, dv)
+	}
+
+	// The deposits are confirmed now
+	for _, dv := range deposits {
+		if err := tx.Bucket(UnconfirmedDepositBkt).Delete([]byte(dv.ID())); err != nil {
+			return nil, err
 		}
+	}
+
+	if err := s.setScannedBlockTx(tx, coinType, ScannedBlock{
+		Height: block.Height,
+		Hash:   block.Hash,
+	}); err != nil {
+		return nil, err
+	}
 
+	return dvs, nil
+}
+
+// RescanBlock scans a coin block again for deposits to the given addresses, and adds the missed ones.
+// Deposits that already exist are omitted from the returned list, the number of all deposits found is returned too.
+// Unlike ScanBlock, the last scanned block is not changed.
+func (s *Store) RescanBlock(block *CommonBlock, coinType string, addrs []string) ([]Deposit, int, error) {
+	var dvs []Deposit
+	var found int
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
 		deposits, err := scanSpecifiedBlock(block, coinType, addrs)
 		if err != nil {
 			s.log.WithError(err).Error("ScanBlock failed")
 			return err
 		}
 
+		found = len(deposits)
+
 		for _, dv := range deposits {
 			if err := s.pushDepositTx(tx, dv); err != nil {
-				log := s.log.WithField("deposit", dv)
 				switch err.(type) {
 				case DepositExistsErr:
-					log.Warning("Deposit already exists in db")
 					continue
 				default:
-					log.WithError(err).Error("pushDepositTx failed")
+					s.log.WithField("deposit", dv).WithError(err).Error("pushDepositTx failed")
 					return err
 				}
 			}
@@ -310,12 +1042,19 @@ func (s *Store) scanBlock(block *CommonBlock, coinType string) ([]Deposit, error
 			dvs = append(dvs, dv)
 		}
 
+		// The deposits are confirmed now
+		for _, dv := range deposits {
+			if err := tx.Bucket(UnconfirmedDepositBkt).Delete([]byte(dv.ID())); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	}); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return dvs, nil
+	return dvs, found, nil
 }
 
 func scanSpecifiedBlock(block *CommonBlock, coinType string, depositAddrs []string) ([]Deposit, error) {
@@ -2,8 +2,10 @@ package scanner
 
 import (
 	"errors"
+	"fmt"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/require"
@@ -61,8 +63,8 @@ func TestGetDepositAddresses(t *testing.T) {
 		"s3",
 	}
 
-	for _, a := range addrs {
-		err := s.AddScanAddress(a, CoinTypeBTC)
+	for i, a := range addrs {
+		err := s.AddScanAddress(a, CoinTypeBTC, fmt.Sprint(i))
 		require.NoError(t, err)
 	}
 
@@ -76,15 +78,19 @@ func TestGetDepositAddresses(t *testing.T) {
 
 	// check db
 	err = s.db.View(func(tx *bolt.Tx) error {
-		var as []string
-		scanBktFullName := MustGetScanMetaBkt(CoinTypeBTC)
-		err := dbutil.GetBucketObject(tx, scanBktFullName, depositAddressesKey, &as)
+		scanAddrsBktName, err := GetScanAddressesBkt(CoinTypeBTC)
 		require.NoError(t, err)
+		require.Equal(t, "scan_addresses_btc", string(scanAddrsBktName))
 
-		require.Equal(t, len(addrs), len(as))
+		for i, a := range addrs {
+			var sa ScanAddress
+			err := dbutil.GetBucketObject(tx, scanAddrsBktName, a, &sa)
+			require.NoError(t, err)
 
-		for _, a := range addrs {
-			require.Contains(t, as, a)
+			require.Equal(t, a, sa.Address)
+			require.Equal(t, fmt.Sprint(i), sa.KittyID)
+			require.True(t, sa.Active)
+			require.NotZero(t, sa.AddedAt)
 		}
 
 		return nil
@@ -134,14 +140,13 @@ func TestAddDepositAddress(t *testing.T) {
 			err = s.AddSupportedCoin(CoinTypeBTC)
 			require.NoError(t, err)
 
-			err = db.Update(func(tx *bolt.Tx) error {
-				scanBktFullName := MustGetScanMetaBkt(CoinTypeBTC)
-				return dbutil.PutBucketValue(tx, scanBktFullName, depositAddressesKey, tc.initAddrs)
-			})
-			require.NoError(t, err)
+			for _, a := range tc.initAddrs {
+				err = s.AddScanAddress(a, CoinTypeBTC, "")
+				require.NoError(t, err)
+			}
 
 			for _, a := range tc.addAddrs {
-				if er := s.AddScanAddress(a, CoinTypeBTC); er != nil {
+				if er := s.AddScanAddress(a, CoinTypeBTC, ""); er != nil {
 					err = er
 				}
 			}
@@ -390,6 +395,642 @@ func TestGetBktValue(t *testing.T) {
 	}
 }
 
+func TestMigrateScanAddresses(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+
+	// The addresses were saved as one array by older versions
+	addrs := []string{"a1", "a2", "a3"}
+	err = db.Update(func(tx *bolt.Tx) error {
+		scanBktFullName := MustGetScanMetaBkt(CoinTypeBTC)
+		if _, err := tx.CreateBucketIfNotExists(scanBktFullName); err != nil {
+			return err
+		}
+		return dbutil.PutBucketValue(tx, scanBktFullName, depositAddressesKey, addrs)
+	})
+	require.NoError(t, err)
+
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	as, err := s.GetScanAddresses(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, addrs, as)
+
+	for _, a := range addrs {
+		sa, err := s.GetScanAddress(a, CoinTypeBTC)
+		require.NoError(t, err)
+		require.True(t, sa.Active)
+		require.Empty(t, sa.KittyID)
+	}
+
+	// The array is deleted
+	err = db.View(func(tx *bolt.Tx) error {
+		hasKey, err := dbutil.BucketHasKey(tx, MustGetScanMetaBkt(CoinTypeBTC), depositAddressesKey)
+		require.NoError(t, err)
+		require.False(t, hasKey)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Migrating again is a no-op
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	as, err = s.GetScanAddresses(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, addrs, as)
+
+	err = s.AddScanAddress("a1", CoinTypeBTC, "1")
+	require.Equal(t, NewDuplicateDepositAddressErr("a1"), err)
+}
+
+func TestDeactivateScanAddress(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	err = s.AddScanAddress("a1", CoinTypeBTC, "1")
+	require.NoError(t, err)
+	err = s.AddScanAddress("a2", CoinTypeBTC, "2")
+	require.NoError(t, err)
+
+	err = s.DeactivateScanAddress("a1", CoinTypeBTC)
+	require.NoError(t, err)
+
+	sa, err := s.GetScanAddress("a1", CoinTypeBTC)
+	require.NoError(t, err)
+	require.False(t, sa.Active)
+	require.NotZero(t, sa.DeactivatedAt)
+	require.Equal(t, "1", sa.KittyID)
+
+	// A recently deactivated address is still watched
+	as, err := s.GetScanAddresses(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a1", "a2"}, as)
+
+	// Deactivating again does not extend the grace period
+	deactivatedAt := sa.DeactivatedAt
+	err = s.DeactivateScanAddress("a1", CoinTypeBTC)
+	require.NoError(t, err)
+	sa, err = s.GetScanAddress("a1", CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, deactivatedAt, sa.DeactivatedAt)
+
+	// Not watched after the grace period
+	sa.DeactivatedAt = time.Now().Add(-deactivatedScanAddressGracePeriod).Unix()
+	err = db.Update(func(tx *bolt.Tx) error {
+		return dbutil.PutBucketValue(tx, []byte("scan_addresses_btc"), "a1", sa)
+	})
+	require.NoError(t, err)
+
+	as, err = s.GetScanAddresses(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a2"}, as)
+
+	// Unknown addresses are ignored
+	err = s.DeactivateScanAddress("a3", CoinTypeBTC)
+	require.NoError(t, err)
+
+	err = s.RemoveScanAddress("a2", CoinTypeBTC)
+	require.NoError(t, err)
+
+	as, err = s.GetScanAddresses(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, as)
+
+	_, err = s.GetScanAddress("a2", CoinTypeBTC)
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+}
+
 func TestScanBlock(t *testing.T) {
-	// TODO
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	// active
+	err = s.AddScanAddress("a1", CoinTypeBTC, "1")
+	require.NoError(t, err)
+
+	// deactivated recently
+	err = s.AddScanAddress("a2", CoinTypeBTC, "2")
+	require.NoError(t, err)
+	err = s.DeactivateScanAddress("a2", CoinTypeBTC)
+	require.NoError(t, err)
+
+	// deactivated before the grace period
+	err = db.Update(func(tx *bolt.Tx) error {
+		return dbutil.PutBucketValue(tx, []byte("scan_addresses_btc"), "a3", ScanAddress{
+			Address:       "a3",
+			KittyID:       "3",
+			DeactivatedAt: time.Now().Add(-deactivatedScanAddressGracePeriod - time.Hour).Unix(),
+		})
+	})
+	require.NoError(t, err)
+
+	// removed
+	err = s.AddScanAddress("a4", CoinTypeBTC, "4")
+	require.NoError(t, err)
+	err = s.RemoveScanAddress("a4", CoinTypeBTC)
+	require.NoError(t, err)
+
+	block := &CommonBlock{
+		Height: 10,
+		Hash:   "hash10",
+		RawTx: []CommonTx{
+			{
+				Txid: "tx1",
+				Vout: []CommonVout{
+					{N: 0, Value: 1, Addresses: []string{"a1"}},
+					{N: 1, Value: 2, Addresses: []string{"a2"}},
+					{N: 2, Value: 3, Addresses: []string{"a3"}},
+				},
+			},
+			{
+				Txid: "tx2",
+				Vout: []CommonVout{
+					{N: 0, Value: 4, Addresses: []string{"a4"}},
+					{N: 1, Value: 5, Addresses: []string{"a1"}},
+					{N: 2, Value: 6, Addresses: []string{"b1"}},
+				},
+			},
+		},
+	}
+
+	dvs, err := s.ScanBlock(block, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, []Deposit{
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a1",
+			Value:    1,
+			Height:   10,
+			Tx:       "tx1",
+			N:        0,
+			Status:   DepositNotProcessed,
+		},
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a2",
+			Value:    2,
+			Height:   10,
+			Tx:       "tx1",
+			N:        1,
+			Status:   DepositNotProcessed,
+		},
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a1",
+			Value:    5,
+			Height:   10,
+			Tx:       "tx2",
+			N:        1,
+			Status:   DepositNotProcessed,
+		},
+	}, dvs)
+
+	// Scanning the block again finds no new deposits
+	dvs, err = s.ScanBlock(block, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+}
+
+func TestLastScannedBlock(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	// No block scanned yet
+	lsb, err := s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Nil(t, lsb)
+
+	_, err = s.ScanBlock(&CommonBlock{
+		Height: 10,
+		Hash:   "hash10",
+	}, CoinTypeBTC)
+	require.NoError(t, err)
+
+	lsb, err = s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, &ScannedBlock{
+		Height: 10,
+		Hash:   "hash10",
+	}, lsb)
+
+	_, err = s.ScanBlock(&CommonBlock{
+		Height: 11,
+		Hash:   "hash11",
+	}, CoinTypeBTC)
+	require.NoError(t, err)
+
+	lsb, err = s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, int64(11), lsb.Height)
+	require.Equal(t, "hash11", lsb.Hash)
+
+	err = s.ResetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+
+	lsb, err = s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Nil(t, lsb)
+
+	_, err = s.GetLastScannedBlock("foo")
+	require.Equal(t, ErrUnsupportedCoinType, err)
+}
+
+func TestScanBlocks(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	err = s.AddScanAddress("a1", CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	var blocks []*CommonBlock
+	for i := int64(1); i <= 3; i++ {
+		blocks = append(blocks, &CommonBlock{
+			Height: i,
+			Hash:   fmt.Sprintf("hash%d", i),
+			RawTx: []CommonTx{
+				{
+					Txid: fmt.Sprintf("tx%d", i),
+					Vout: []CommonVout{
+						{Value: 100, Addresses: []string{"a1"}},
+						{Value: 200, N: 1, Addresses: []string{"b1"}},
+					},
+				},
+			},
+		})
+	}
+
+	// tx2 was scanned before
+	_, err = s.ScanBlock(blocks[1], CoinTypeBTC)
+	require.NoError(t, err)
+
+	dvs, err := s.ScanBlocks(blocks, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, dvs, 2)
+	require.Equal(t, "tx1:0", dvs[0].ID())
+	require.Equal(t, "tx3:0", dvs[1].ID())
+
+	udvs, err := s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 3)
+
+	lsb, err := s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, &ScannedBlock{
+		Height: 3,
+		Hash:   "hash3",
+	}, lsb)
+
+	// Every block is recorded, so that a chain reorganization can be rolled back
+	recent, err := s.GetRecentScannedBlocks(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, []ScannedBlock{
+		{Height: 1, Hash: "hash1"},
+		{Height: 2, Hash: "hash2"},
+		{Height: 3, Hash: "hash3"},
+	}, recent)
+
+	// Nothing is written if a block fails
+	_, err = s.ScanBlocks([]*CommonBlock{
+		{
+			Height: 4,
+			Hash:   "hash4",
+			RawTx: []CommonTx{
+				{
+					Txid: "tx4",
+					Vout: []CommonVout{
+						{Value: 100, Addresses: []string{"a1"}},
+					},
+				},
+			},
+		},
+	}, "foo")
+	require.Error(t, err)
+
+	lsb, err = s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), lsb.Height)
+}
+
+func TestRollbackScannedBlocks(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	err = s.AddScanAddress("a1", CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	for i := int64(1); i <= 5; i++ {
+		dvs, err := s.ScanBlock(&CommonBlock{
+			Height: i,
+			Hash:   fmt.Sprintf("hash%d", i),
+			RawTx: []CommonTx{
+				{
+					Txid: fmt.Sprintf("tx%d", i),
+					Vout: []CommonVout{
+						{
+							Value:     100,
+							Addresses: []string{"a1"},
+						},
+					},
+				},
+			},
+		}, CoinTypeBTC)
+		require.NoError(t, err)
+		require.Len(t, dvs, 1)
+	}
+
+	blocks, err := s.GetRecentScannedBlocks(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, blocks, 5)
+	require.Equal(t, int64(1), blocks[0].Height)
+	require.Equal(t, int64(5), blocks[4].Height)
+
+	err = s.SetDepositProcessed("tx4:0")
+	require.NoError(t, err)
+
+	forkBlock := ScannedBlock{
+		Height: 3,
+		Hash:   "hash3",
+	}
+	dvs, err := s.RollbackScannedBlocks(CoinTypeBTC, forkBlock)
+	require.NoError(t, err)
+	require.Len(t, dvs, 2)
+
+	sort.Slice(dvs, func(i, j int) bool {
+		return dvs[i].Height < dvs[j].Height
+	})
+	require.Equal(t, "tx4:0", dvs[0].ID())
+	require.Equal(t, "tx5:0", dvs[1].ID())
+	for _, dv := range dvs {
+		require.Equal(t, DepositInvalidated, dv.Status)
+	}
+
+	lsb, err := s.GetLastScannedBlock(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, &forkBlock, lsb)
+
+	blocks, err = s.GetRecentScannedBlocks(CoinTypeBTC)
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	require.Equal(t, forkBlock, blocks[2])
+
+	// Invalidated deposits are unprocessed, until the invalidation is processed
+	udvs, err := s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 5)
+
+	// An invalidated deposit is not accepted if it was still being processed
+	err = s.SetDepositProcessed("tx5:0")
+	require.NoError(t, err)
+
+	err = s.SetDepositInvalidationProcessed("tx4:0")
+	require.NoError(t, err)
+	err = s.SetDepositInvalidationProcessed("tx5:0")
+	require.NoError(t, err)
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		for _, id := range []string{"tx4:0", "tx5:0"} {
+			var dv Deposit
+			err := dbutil.GetBucketObject(tx, DepositBkt, id, &dv)
+			require.NoError(t, err)
+			require.Equal(t, DepositInvalidatedProcessed, dv.Status)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	udvs, err = s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 3)
+
+	// Rolling back again does not invalidate the deposits again
+	dvs, err = s.RollbackScannedBlocks(CoinTypeBTC, forkBlock)
+	require.NoError(t, err)
+	require.Len(t, dvs, 0)
+
+	// The orphaned transaction of tx5 is included again in the new chain,
+	// the deposit is added again to be processed
+	dvs, err = s.ScanBlock(&CommonBlock{
+		Height: 4,
+		Hash:   "hash4b",
+		RawTx: []CommonTx{
+			{
+				Txid: "tx5",
+				Vout: []CommonVout{
+					{
+						Value:     100,
+						Addresses: []string{"a1"},
+					},
+				},
+			},
+		},
+	}, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Equal(t, []Deposit{
+		{
+			CoinType: CoinTypeBTC,
+			Address:  "a1",
+			Value:    100,
+			Height:   4,
+			Tx:       "tx5",
+			N:        0,
+			Status:   DepositNotProcessed,
+		},
+	}, dvs)
+
+	udvs, err = s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 4)
+
+	// It is not added twice
+	dvs, err = s.ScanBlock(&CommonBlock{
+		Height: 5,
+		Hash:   "hash5b",
+		RawTx: []CommonTx{
+			{
+				Txid: "tx5",
+				Vout: []CommonVout{
+					{
+						Value:     100,
+						Addresses: []string{"a1"},
+					},
+				},
+			},
+		},
+	}, CoinTypeBTC)
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+
+	// A deposit that is included again while its invalidation is processed stays unprocessed
+	dvs, err = s.RollbackScannedBlocks(CoinTypeBTC, forkBlock)
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	_, err = s.ScanBlock(&CommonBlock{
+		Height: 4,
+		Hash:   "hash4c",
+		RawTx: []CommonTx{
+			{
+				Txid: "tx5",
+				Vout: []CommonVout{
+					{
+						Value:     100,
+						Addresses: []string{"a1"},
+					},
+				},
+			},
+		},
+	}, CoinTypeBTC)
+	require.NoError(t, err)
+	err = s.SetDepositInvalidationProcessed("tx5:0")
+	require.NoError(t, err)
+
+	udvs, err = s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 4)
+	for _, dv := range udvs {
+		require.Equal(t, DepositNotProcessed, dv.Status)
+	}
+}
+
+func TestScannedBlocksWindow(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeSKY)
+	require.NoError(t, err)
+
+	n := int64(scannedBlocksWindow + 10)
+	for i := int64(0); i < n; i++ {
+		_, err := s.ScanBlock(&CommonBlock{
+			Height: i,
+			Hash:   fmt.Sprintf("hash%d", i),
+		}, CoinTypeSKY)
+		require.NoError(t, err)
+	}
+
+	blocks, err := s.GetRecentScannedBlocks(CoinTypeSKY)
+	require.NoError(t, err)
+	require.Len(t, blocks, scannedBlocksWindow)
+	require.Equal(t, int64(10), blocks[0].Height)
+	require.Equal(t, n-1, blocks[len(blocks)-1].Height)
+}
+
+func TestSetDepositRejected(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+	err = s.AddSupportedCoin(CoinTypeBTC)
+	require.NoError(t, err)
+
+	err = s.AddScanAddress("a1", CoinTypeBTC, "")
+	require.NoError(t, err)
+
+	for i := int64(1); i <= 3; i++ {
+		dvs, err := s.ScanBlock(&CommonBlock{
+			Height: i,
+			Hash:   fmt.Sprintf("hash%d", i),
+			RawTx: []CommonTx{
+				{
+					Txid: fmt.Sprintf("tx%d", i),
+					Vout: []CommonVout{
+						{
+							Value:     100,
+							Addresses: []string{"a1"},
+						},
+					},
+				},
+			},
+		}, CoinTypeBTC)
+		require.NoError(t, err)
+		require.Len(t, dvs, 1)
+	}
+
+	dvs, err := s.GetRejectedDeposits()
+	require.NoError(t, err)
+	require.Empty(t, dvs)
+
+	err = s.SetDepositProcessed("tx1:0")
+	require.NoError(t, err)
+	err = s.SetDepositRejected("tx2:0", "Deposit has no bound skycoin address")
+	require.NoError(t, err)
+
+	err = s.SetDepositRejected("tx9:0", "")
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+
+	// A rejected deposit is final, it is not sent to the exchange again
+	dvs, err = s.GetRejectedDeposits()
+	require.NoError(t, err)
+	require.Len(t, dvs, 1)
+	require.Equal(t, "tx2:0", dvs[0].ID())
+	require.Equal(t, DepositRejected, dvs[0].Status)
+	require.Equal(t, "Deposit has no bound skycoin address", dvs[0].RejectReason)
+
+	udvs, err := s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 1)
+	require.Equal(t, "tx3:0", udvs[0].ID())
+
+	// An invalidated deposit is not rejected if it was still being processed
+	_, err = s.RollbackScannedBlocks(CoinTypeBTC, ScannedBlock{
+		Height: 2,
+		Hash:   "hash2",
+	})
+	require.NoError(t, err)
+	err = s.SetDepositRejected("tx3:0", "Deposit has no bound skycoin address")
+	require.NoError(t, err)
+
+	udvs, err = s.GetUnprocessedDeposits()
+	require.NoError(t, err)
+	require.Len(t, udvs, 1)
+	require.Equal(t, DepositInvalidated, udvs[0].Status)
+	require.Empty(t, udvs[0].RejectReason)
 }
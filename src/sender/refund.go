@@ -0,0 +1,84 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcutil"
+	"github.com/skycoin/skycoin/src/gui"
+
+	"github.com/kittycash/teller/src/util/btcaddr"
+)
+
+// SkyRefundSender sends SKY refunds from a wallet of a skycoin node
+type SkyRefundSender struct {
+	c      *gui.Client
+	wallet string
+}
+
+// NewSkyRefundSender creates a SkyRefundSender for the wallet with id wallet,
+// using the web interface of the skycoin node at nodeAddr
+func NewSkyRefundSender(nodeAddr, wallet string) *SkyRefundSender {
+	return &SkyRefundSender{
+		c:      gui.NewClient(fmt.Sprintf("http://%s", nodeAddr)),
+		wallet: wallet,
+	}
+}
+
+// SendRefund sends droplets to addr, and returns the txid
+func (s *SkyRefundSender) SendRefund(addr string, droplets int64) (string, error) {
+	if droplets <= 0 {
+		return "", errors.New("Refund amount must be positive")
+	}
+
+	rsp, err := s.c.Spend(s.wallet, addr, uint64(droplets))
+	if err != nil {
+		return "", err
+	}
+
+	if rsp.Error != "" {
+		return "", errors.New(rsp.Error)
+	}
+
+	if rsp.Transaction == nil {
+		return "", errors.New("Skycoin node returned no transaction")
+	}
+
+	return rsp.Transaction.Hash, nil
+}
+
+// BtcRefundSender sends BTC refunds from a btcwallet
+type BtcRefundSender struct {
+	c      *rpcclient.Client
+	params *chaincfg.Params
+}
+
+// NewBtcRefundSender creates a BtcRefundSender with a btcwallet RPC client,
+// sending to addresses of the bitcoin network of params
+func NewBtcRefundSender(c *rpcclient.Client, params *chaincfg.Params) *BtcRefundSender {
+	return &BtcRefundSender{
+		c:      c,
+		params: params,
+	}
+}
+
+// SendRefund sends satoshis to addr, and returns the txid
+func (s *BtcRefundSender) SendRefund(addr string, satoshis int64) (string, error) {
+	if satoshis <= 0 {
+		return "", errors.New("Refund amount must be positive")
+	}
+
+	a, err := btcaddr.Decode(addr, s.params)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := s.c.SendToAddress(a, btcutil.Amount(satoshis))
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
@@ -24,10 +24,10 @@ import (
 
 // StatusResponse http response for /api/status
 type StatusResponse struct {
-	Statuses []exchange.DepositStatus `json:"statuses,omitempty"`
+	Kitties []exchange.KittyStatus `json:"kitties"`
 }
 
-// StatusHandler returns the deposit status of specific skycoin address
+// StatusHandler returns the kitties reserved by specific skycoin address, with the status of their deposits
 // Method: GET
 // URI: /api/status
 // Args:
@@ -62,21 +62,25 @@ func StatusHandler(s *HTTPServer) http.HandlerFunc {
 
 		log.Info("Sending StatusRequest to teller")
 
-		depositStatuses, err := s.service.GetDepositStatuses(skyAddr)
+		kittyStatuses, err := s.service.GetKittyStatuses(skyAddr)
 		if err != nil {
-			log.WithError(err).Error("service.GetDepositStatuses failed")
+			log.WithError(err).Error("service.GetKittyStatuses failed")
 			errorResponse(ctx, w, http.StatusInternalServerError, errInternalServerError)
 			return
 		}
 
+		if kittyStatuses == nil {
+			kittyStatuses = []exchange.KittyStatus{}
+		}
+
 		log = log.WithFields(logrus.Fields{
-			"depositStatuses":    depositStatuses,
-			"depositStatusesLen": len(depositStatuses),
+			"kittyStatuses":    kittyStatuses,
+			"kittyStatusesLen": len(kittyStatuses),
 		})
-		log.Info("Got depositStatuses")
+		log.Info("Got kittyStatuses")
 
 		if err := httputil.JSONResponse(w, StatusResponse{
-			Statuses: depositStatuses,
+			Kitties: kittyStatuses,
 		}); err != nil {
 			log.WithError(err).Error(err)
 		}
@@ -87,6 +91,8 @@ func StatusHandler(s *HTTPServer) http.HandlerFunc {
 type ConfigResponse struct {
 	Enabled                  bool  `json:"enabled"`
 	BtcConfirmationsRequired int64 `json:"btc_confirmations_required"`
+	SkyConfirmationsRequired int64 `json:"sky_confirmations_required"`
+	EthConfirmationsRequired int64 `json:"eth_confirmations_required"`
 	MaxBoundAddresses        int   `json:"max_bound_addrs"`
 	MaxDecimals              int   `json:"max_decimals"`
 }
@@ -108,6 +114,8 @@ func ConfigHandler(s *HTTPServer) http.HandlerFunc {
 			MaxDecimals:              s.cfg.BoxExchanger.MaxDecimals,
 			MaxBoundAddresses:        s.cfg.Teller.MaxBoundAddresses,
 			BtcConfirmationsRequired: s.cfg.BtcScanner.ConfirmationsRequired,
+			SkyConfirmationsRequired: s.cfg.SkyScanner.ConfirmationsRequired,
+			EthConfirmationsRequired: s.cfg.EthScanner.ConfirmationsRequired,
 		}); err != nil {
 			log.WithError(err).Error()
 		}
@@ -188,6 +196,7 @@ type reservationRequest struct {
 	KittyID          uint64 `json:"kitty_id"`
 	CoinType         string `json:"coin_type"`
 	VerificationCode string `json:"verification_code"`
+	RefundAddress    string `json:"refund_address"`
 }
 
 // MakeReservationHandler handles kitty box reservations
@@ -195,7 +204,8 @@ type reservationRequest struct {
 // Accept: application/json
 // URI: /api/reservation/reserve
 // Args:
-//    {"user_address": "<user_address>", "kitty_id": "<kitty_id>", "coin_type": "<coin_type>", "verification_code": "<verification_code>"}
+//    {"user_address": "<user_address>", "kitty_id": "<kitty_id>", "coin_type": "<coin_type>", "verification_code": "<verification_code>", "refund_address": "<refund_address>"}
+//    refund_address is optional, overpayments and payments received after the reservation expired are refunded to it
 func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -253,6 +263,13 @@ func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
+		if reserveReq.RefundAddress != "" {
+			if err := exchange.ValidateRefundAddress(reserveReq.CoinType, reserveReq.RefundAddress, s.cfg.BtcParams()); err != nil {
+				errorResponse(ctx, w, http.StatusBadRequest, fmt.Errorf("invalid refund address: %v", err))
+				return
+			}
+		}
+
 		// Start a writable transaction.
 		tx, err := s.db.Begin(true)
 		if err != nil {
@@ -268,7 +285,7 @@ func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 
 		kittyStr := strconv.FormatUint(reserveReq.KittyID, 10)
 		log.Info("Calling service.BindAddress")
-		boundAddr, err := s.service.BindAddressTx(tx, kittyStr, reserveReq.CoinType)
+		boundAddr, err := s.service.BindAddressTx(tx, kittyStr, reserveReq.CoinType, reserveReq.RefundAddress)
 		if err != nil {
 			log.WithError(err).Error("service.BindAddress failed")
 			switch err {
@@ -286,12 +303,12 @@ func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 		}
 
 		log.Info("Calling agent.MakeReservation")
-		err = s.service.agentManager.MakeReservation(tx, boundAddr.Address, reserveReq.UserAddress,
+		reservation, err := s.service.agentManager.MakeReservation(tx, boundAddr.Address, reserveReq.UserAddress,
 			kittyStr, reserveReq.CoinType, reserveReq.VerificationCode)
 		if err != nil {
 			log.WithError(err).Error("s.agent.MakeReservation failed")
 			switch err {
-			case agent.ErrMaxReservationsExceeded, agent.ErrBoxAlreadyReserved, agent.ErrInvalidCoinType:
+			case agent.ErrMaxReservationsExceeded, agent.ErrBoxAlreadyReserved, agent.ErrInvalidCoinType, agent.ErrPriceNotSet, agent.ErrReservationNotFound:
 				errorResponse(ctx, w, http.StatusBadRequest, err)
 			default:
 				errorResponse(ctx, w, http.StatusInternalServerError, err)
@@ -299,21 +316,6 @@ func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		// get user from usermanager
-		u, err := s.service.agentManager.UserManager.GetUser(reserveReq.UserAddress)
-		if err != nil {
-			log.WithError(err).Error("UserManager.GetUser failed")
-			errorResponse(ctx, w, http.StatusBadRequest, err)
-			return
-		}
-		// get the reservation for the reservation map
-		reservation, err := s.service.agentManager.ReservationManager.GetReservationByKittyID(kittyStr)
-		if err != nil {
-			log.WithError(err).Error("ReservationManager.GetReservationByKittyID failed")
-			errorResponse(ctx, w, http.StatusBadRequest, err)
-			return
-		}
-
 		ikoKittyID, err := iko.KittyIDFromString(reservation.KittyID)
 		if err != nil {
 			log.WithError(err).Error("iko.KittyIDFromString failed")
@@ -340,17 +342,13 @@ func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 			return
 		}
 
-		// add reservation to user
-		err = s.service.agentManager.UserManager.AddReservation(u, reservation)
-		if err != nil {
-			log.WithError(err).Error("UserManager.AddReservation failed")
-			errorResponse(ctx, w, http.StatusBadRequest, err)
-			return
-		}
-
 		// commit the transaction
 		log.Info("commit reservation")
-		tx.Commit()
+		if err := tx.Commit(); err != nil {
+			log.WithError(err).Error("Commit reservation failed")
+			errorResponse(ctx, w, http.StatusInternalServerError, errInternalServerError)
+			return
+		}
 
 		log = log.WithField("boundAddr", boundAddr)
 		log.Infof("Bound sky and %s addresses", reserveReq.CoinType)
@@ -358,7 +356,7 @@ func MakeReservationHandler(s *HTTPServer) http.HandlerFunc {
 		if err := httputil.JSONResponse(w, ReserveResponse{
 			DepositAddress: boundAddr.Address,
 			CoinType:       boundAddr.CoinType,
-			Deadline:       time.Now().Add(time.Hour * 24).UnixNano(),
+			Deadline:       time.Unix(reservation.Expire, 0).UnixNano(),
 			KittyID:        reserveReq.KittyID,
 		}); err != nil {
 			errorResponse(ctx, w, http.StatusInternalServerError, err)
@@ -2,7 +2,6 @@ package teller
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
@@ -153,9 +152,8 @@ func (s *HTTPServer) Run() error {
 				Cache:      autocert.DirCache(tlsAutoCertCache),
 			}
 
-			s.httpsListener.TLSConfig = &tls.Config{
-				GetCertificate: certManager.GetCertificate,
-			}
+			// The config advertises acme.ALPNProto, so the tls-alpn-01 challenge can be used
+			s.httpsListener.TLSConfig = certManager.TLSConfig()
 
 			// These will be autogenerated by the autocert middleware
 			tlsCert = ""
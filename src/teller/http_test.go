@@ -33,7 +33,7 @@ func (e *fakeExchanger) BindAddress(kittyID, depositAddr, coinType string) (*exc
 	return ba.(*exchange.BoundAddress), args.Error(1)
 }
 
-func (e *fakeExchanger) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType string) (*exchange.BoundAddress, error) {
+func (e *fakeExchanger) BindAddressWithTx(tx *bolt.Tx, kittyID, depositAddr, coinType, refundAddr string) (*exchange.BoundAddress, error) {
 	args := e.Called(tx, kittyID, depositAddr, coinType)
 
 	ba := args.Get(0)
@@ -49,6 +49,17 @@ func (e *fakeExchanger) GetDepositStatuses(kittyID string) ([]exchange.DepositSt
 	return args.Get(0).([]exchange.DepositStatus), args.Error(1)
 }
 
+func (e *fakeExchanger) GetKittyStatusesOfOwner(ownerAddr string) ([]exchange.KittyStatus, error) {
+	args := e.Called(ownerAddr)
+
+	kss := args.Get(0)
+	if kss == nil {
+		return nil, args.Error(1)
+	}
+
+	return kss.([]exchange.KittyStatus), args.Error(1)
+}
+
 func (e *fakeExchanger) GetDepositStatusDetail(flt exchange.DepositFilter) ([]exchange.DepositStatusDetail, error) {
 	args := e.Called(flt)
 	return args.Get(0).([]exchange.DepositStatusDetail), args.Error(1)
@@ -188,3 +199,137 @@ func TestExchangeStatusHandler(t *testing.T) {
 	}
 
 }
+
+func TestStatusHandler(t *testing.T) {
+	skyAddr := "2Wbi4wvxC4fkTYMsS2f6HaFfW4pafDjXcQW"
+
+	kitties := []exchange.KittyStatus{
+		{
+			KittyID:        "1",
+			CoinType:       "BTC",
+			DepositAddress: "1FeDtFhARLxjKUPPkQqEBL78tisenc9znS",
+			Reserved:       true,
+			Expire:         1510000000,
+			AmountRequired: 100000,
+			AmountPaid:     100000,
+			Txid:           "sky-txid",
+			Deposits: []exchange.DepositStatus{
+				{
+					Seq:       1,
+					UpdatedAt: 1509000000,
+					Status:    "done",
+					CoinType:  "BTC",
+					Amount:    100000,
+					Txid:      "sky-txid",
+				},
+			},
+		},
+	}
+
+	tt := []struct {
+		name     string
+		method   string
+		url      string
+		status   int
+		err      string
+		kitties  []exchange.KittyStatus
+		getErr   error
+		expected []exchange.KittyStatus
+	}{
+		{
+			name:   "405",
+			method: http.MethodPost,
+			url:    "/api/status?skyaddr=" + skyAddr,
+			status: http.StatusMethodNotAllowed,
+			err:    "Invalid request method",
+		},
+
+		{
+			name:   "400 missing skyaddr",
+			method: http.MethodGet,
+			url:    "/api/status",
+			status: http.StatusBadRequest,
+			err:    "Missing skyaddr",
+		},
+
+		{
+			name:   "400 invalid skyaddr",
+			method: http.MethodGet,
+			url:    "/api/status?skyaddr=foo",
+			status: http.StatusBadRequest,
+			err:    "Invalid skycoin address: Invalid address length",
+		},
+
+		{
+			name:   "500 get kitty statuses failed",
+			method: http.MethodGet,
+			url:    "/api/status?skyaddr=" + skyAddr,
+			status: http.StatusInternalServerError,
+			err:    "Internal Server Error",
+			getErr: errors.New("get kitty statuses failed"),
+		},
+
+		{
+			name:     "200 no kitties",
+			method:   http.MethodGet,
+			url:      "/api/status?skyaddr=" + skyAddr,
+			status:   http.StatusOK,
+			expected: []exchange.KittyStatus{},
+		},
+
+		{
+			name:     "200",
+			method:   http.MethodGet,
+			url:      "/api/status?skyaddr=" + skyAddr,
+			status:   http.StatusOK,
+			kitties:  kitties,
+			expected: kitties,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &fakeExchanger{}
+
+			if tc.getErr != nil {
+				e.On("GetKittyStatusesOfOwner", skyAddr).Return(nil, tc.getErr)
+			} else if tc.kitties != nil {
+				e.On("GetKittyStatusesOfOwner", skyAddr).Return(tc.kitties, nil)
+			} else {
+				e.On("GetKittyStatusesOfOwner", skyAddr).Return(nil, nil)
+			}
+
+			req, err := http.NewRequest(tc.method, tc.url, nil)
+			require.NoError(t, err)
+
+			log, _ := testutil.NewLogger(t)
+
+			rr := httptest.NewRecorder()
+			httpServ := &HTTPServer{
+				log:       log,
+				exchanger: e,
+				service: &Service{
+					exchanger: e,
+				},
+			}
+			handler := httpServ.setupMux()
+
+			handler.ServeHTTP(rr, req)
+
+			status := rr.Code
+			require.Equal(t, tc.status, status, "wrong status code: got `%v` want `%v`", tc.name, status, tc.status)
+
+			if status != http.StatusOK {
+				require.Equal(t, tc.err, strings.TrimSpace(rr.Body.String()))
+				return
+			}
+
+			var msg StatusResponse
+			err = json.Unmarshal(rr.Body.Bytes(), &msg)
+			require.NoError(t, err)
+			require.Equal(t, StatusResponse{
+				Kitties: tc.expected,
+			}, msg)
+		})
+	}
+}
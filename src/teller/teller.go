@@ -102,9 +102,10 @@ func (s *Service) BindAddress(kittyID, coinType string) (*exchange.BoundAddress,
 	return s.exchanger.BindAddress(kittyID, depositAddr, coinType)
 }
 
-// BindAddress binds kittyID with a deposit address according to coinType with a db tx
+// BindAddressTx binds kittyID with a deposit address according to coinType with a db tx.
+// Deposits that can't pay for the kitty are refunded to refundAddr, if it is not empty.
 // return deposit address
-func (s *Service) BindAddressTx(tx *bolt.Tx, kittyID, coinType string) (*exchange.BoundAddress, error) {
+func (s *Service) BindAddressTx(tx *bolt.Tx, kittyID, coinType, refundAddr string) (*exchange.BoundAddress, error) {
 	if !s.cfg.BindEnabled {
 		return nil, ErrBindDisabled
 	}
@@ -119,10 +120,10 @@ func (s *Service) BindAddressTx(tx *bolt.Tx, kittyID, coinType string) (*exchang
 		return nil, err
 	}
 
-	return s.exchanger.BindAddressWithTx(tx, kittyID, depositAddr, coinType)
+	return s.exchanger.BindAddressWithTx(tx, kittyID, depositAddr, coinType, refundAddr)
 }
 
-// GetDepositStatuses returns deposit status of given skycoin address
-func (s *Service) GetDepositStatuses(skyAddr string) ([]exchange.DepositStatus, error) {
-	return s.exchanger.GetDepositStatuses(skyAddr)
+// GetKittyStatuses returns the payment progress of the kitties reserved by given skycoin address
+func (s *Service) GetKittyStatuses(skyAddr string) ([]exchange.KittyStatus, error) {
+	return s.exchanger.GetKittyStatusesOfOwner(skyAddr)
 }
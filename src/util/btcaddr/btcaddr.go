@@ -0,0 +1,200 @@
+// Package btcaddr provides bitcoin address helpers for the configured network,
+// including native segwit addresses
+package btcaddr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// MainNet is the bitcoin main network
+	MainNet = "mainnet"
+	// TestNet3 is the bitcoin test network
+	TestNet3 = "testnet3"
+	// RegTest is the bitcoin regression test network
+	RegTest = "regtest"
+	// SimNet is btcd's simulation test network
+	SimNet = "simnet"
+)
+
+const (
+	// TypeP2PKH is a legacy pay-to-pubkey-hash address
+	TypeP2PKH = "p2pkh"
+	// TypeP2WPKH is a native segwit pay-to-witness-pubkey-hash address
+	TypeP2WPKH = "p2wpkh"
+	// TypeP2SHP2WPKH is a P2WPKH address wrapped in a P2SH address
+	TypeP2SHP2WPKH = "p2sh-p2wpkh"
+)
+
+var (
+	// ErrUnsupportedAddressType is returned if an address is not P2PKH, P2SH, P2WPKH or P2WSH
+	ErrUnsupportedAddressType = errors.New("Unsupported bitcoin address type")
+	// ErrWrongNetwork is returned if an address is for another bitcoin network
+	ErrWrongNetwork = errors.New("Bitcoin address is for another network")
+)
+
+// Networks returns the supported network names
+func Networks() []string {
+	return []string{MainNet, TestNet3, RegTest, SimNet}
+}
+
+// Params returns the chain params of a network. "testnet" is accepted for TestNet3.
+func Params(network string) (*chaincfg.Params, error) {
+	switch network {
+	case MainNet:
+		return &chaincfg.MainNetParams, nil
+	case TestNet3, "testnet":
+		return &chaincfg.TestNet3Params, nil
+	case RegTest:
+		return &chaincfg.RegressionNetParams, nil
+	case SimNet:
+		return &chaincfg.SimNetParams, nil
+	default:
+		return nil, fmt.Errorf("Unknown bitcoin network %q, must be one of %s", network, strings.Join(Networks(), ", "))
+	}
+}
+
+// PubKeyAddress returns the address of type addrType for a compressed public key
+func PubKeyAddress(pubkey []byte, addrType string, params *chaincfg.Params) (btcutil.Address, error) {
+	pkHash := btcutil.Hash160(pubkey)
+
+	switch addrType {
+	case TypeP2PKH:
+		return btcutil.NewAddressPubKeyHash(pkHash, params)
+	case TypeP2WPKH:
+		return btcutil.NewAddressWitnessPubKeyHash(pkHash, params)
+	case TypeP2SHP2WPKH:
+		// The redeem script is the P2WPKH output script
+		redeemScript := append([]byte{op0, opData20}, pkHash...)
+		return btcutil.NewAddressScriptHash(redeemScript, params)
+	default:
+		return nil, fmt.Errorf("Unknown address type %q, must be one of %s, %s, %s", addrType, TypeP2PKH, TypeP2WPKH, TypeP2SHP2WPKH)
+	}
+}
+
+// Decode decodes a P2PKH, P2SH, P2WPKH or P2WSH address of the network of params
+func Decode(addr string, params *chaincfg.Params) (btcutil.Address, error) {
+	a, err := btcutil.DecodeAddress(addr, params)
+	if err != nil {
+		return nil, err
+	}
+
+	switch a.(type) {
+	case *btcutil.AddressPubKeyHash, *btcutil.AddressScriptHash,
+		*btcutil.AddressWitnessPubKeyHash, *btcutil.AddressWitnessScriptHash:
+	default:
+		return nil, ErrUnsupportedAddressType
+	}
+
+	if !a.IsForNet(params) {
+		return nil, ErrWrongNetwork
+	}
+
+	return a, nil
+}
+
+// Validate returns an error if addr is not a P2PKH, P2SH, P2WPKH or P2WSH address of the network of params
+func Validate(addr string, params *chaincfg.Params) error {
+	_, err := Decode(addr, params)
+	return err
+}
+
+const (
+	opDup         = 0x76
+	opHash160     = 0xa9
+	opEqual       = 0x87
+	opEqualVerify = 0x88
+	opCheckSig    = 0xac
+	opData20      = 0x14
+	opData32      = 0x20
+	op0           = 0x00
+)
+
+// PayToAddrScript returns the output script paying to a P2PKH, P2SH, P2WPKH or P2WSH address
+func PayToAddrScript(addr btcutil.Address) ([]byte, error) {
+	switch a := addr.(type) {
+	case *btcutil.AddressPubKeyHash:
+		script := []byte{opDup, opHash160, opData20}
+		script = append(script, a.ScriptAddress()...)
+		return append(script, opEqualVerify, opCheckSig), nil
+	case *btcutil.AddressScriptHash:
+		script := []byte{opHash160, opData20}
+		script = append(script, a.ScriptAddress()...)
+		return append(script, opEqual), nil
+	case *btcutil.AddressWitnessPubKeyHash:
+		return append([]byte{op0, opData20}, a.ScriptAddress()...), nil
+	case *btcutil.AddressWitnessScriptHash:
+		return append([]byte{op0, opData32}, a.ScriptAddress()...), nil
+	default:
+		return nil, ErrUnsupportedAddressType
+	}
+}
+
+// ScriptType returns the type of a standard output script, named as by btcd and bitcoind,
+// or "nonstandard" for other scripts
+func ScriptType(script []byte) string {
+	switch {
+	case isP2PKH(script):
+		return "pubkeyhash"
+	case isP2SH(script):
+		return "scripthash"
+	case isP2WPKH(script):
+		return "witness_v0_keyhash"
+	case isP2WSH(script):
+		return "witness_v0_scripthash"
+	default:
+		return "nonstandard"
+	}
+}
+
+// ScriptAddress returns the address of a P2PKH, P2SH, P2WPKH or P2WSH output script,
+// or an empty string for other scripts
+func ScriptAddress(script []byte, params *chaincfg.Params) (string, error) {
+	var addr btcutil.Address
+	var err error
+
+	switch {
+	// OP_DUP OP_HASH160 <20 bytes> OP_EQUALVERIFY OP_CHECKSIG
+	case isP2PKH(script):
+		addr, err = btcutil.NewAddressPubKeyHash(script[3:23], params)
+	// OP_HASH160 <20 bytes> OP_EQUAL
+	case isP2SH(script):
+		addr, err = btcutil.NewAddressScriptHashFromHash(script[2:22], params)
+	// OP_0 <20 bytes>
+	case isP2WPKH(script):
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(script[2:], params)
+	// OP_0 <32 bytes>
+	case isP2WSH(script):
+		addr, err = btcutil.NewAddressWitnessScriptHash(script[2:], params)
+	default:
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return addr.EncodeAddress(), nil
+}
+
+func isP2PKH(script []byte) bool {
+	return len(script) == 25 && script[0] == opDup && script[1] == opHash160 && script[2] == opData20 &&
+		script[23] == opEqualVerify && script[24] == opCheckSig
+}
+
+func isP2SH(script []byte) bool {
+	return len(script) == 23 && script[0] == opHash160 && script[1] == opData20 && script[22] == opEqual
+}
+
+func isP2WPKH(script []byte) bool {
+	return len(script) == 22 && script[0] == op0 && script[1] == opData20
+}
+
+func isP2WSH(script []byte) bool {
+	return len(script) == 34 && script[0] == op0 && script[1] == opData32
+}
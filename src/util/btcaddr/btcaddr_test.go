@@ -0,0 +1,155 @@
+package btcaddr
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParams(t *testing.T) {
+	for _, network := range Networks() {
+		params, err := Params(network)
+		require.NoError(t, err)
+		require.Equal(t, network, params.Name)
+	}
+
+	params, err := Params("testnet")
+	require.NoError(t, err)
+	require.Equal(t, &chaincfg.TestNet3Params, params)
+
+	_, err = Params("litecoin")
+	require.Error(t, err)
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		addr         string
+		params       *chaincfg.Params
+		scriptPubKey string
+		scriptType   string
+		err          error
+	}{
+		{
+			addr:         "1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYA",
+			params:       &chaincfg.MainNetParams,
+			scriptPubKey: "76a914e7ba1f3e360246c4e9acaa559ded09de2b0a869a88ac",
+			scriptType:   "pubkeyhash",
+		},
+		{
+			addr:         "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy",
+			params:       &chaincfg.MainNetParams,
+			scriptPubKey: "a914b472a266d0bd89c13706a4132ccfb16f7c3b9fcb87",
+			scriptType:   "scripthash",
+		},
+		{
+			addr:         "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+			params:       &chaincfg.MainNetParams,
+			scriptPubKey: "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+			scriptType:   "witness_v0_keyhash",
+		},
+		{
+			addr:         "tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7",
+			params:       &chaincfg.TestNet3Params,
+			scriptPubKey: "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262",
+			scriptType:   "witness_v0_scripthash",
+		},
+		{
+			addr:         "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn",
+			params:       &chaincfg.RegressionNetParams,
+			scriptPubKey: "76a914243f1394f44554f4ce3fd68649c19adc483ce92488ac",
+			scriptType:   "pubkeyhash",
+		},
+		{
+			addr:   "mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn",
+			params: &chaincfg.MainNetParams,
+			err:    ErrWrongNetwork,
+		},
+		{
+			addr:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			params: &chaincfg.MainNetParams,
+			err:    ErrWrongNetwork,
+		},
+		{
+			addr:   "bc1zw508d6qejxtdg4y5r3zarvaryvg6kdaj",
+			params: &chaincfg.MainNetParams,
+			err:    btcutil.UnsupportedWitnessVerError(2),
+		},
+		{
+			addr:   "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+			params: &chaincfg.MainNetParams,
+			err:    ErrUnsupportedAddressType,
+		},
+		{
+			addr:   "1N8G4JM8krsHLQZjC51R7ZgwDyihmgsQYB",
+			params: &chaincfg.MainNetParams,
+			err:    btcutil.ErrChecksumMismatch,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.addr, func(t *testing.T) {
+			a, err := Decode(tc.addr, tc.params)
+			if tc.err != nil {
+				require.Equal(t, tc.err, err)
+				require.Equal(t, tc.err, Validate(tc.addr, tc.params))
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, Validate(tc.addr, tc.params))
+			require.Equal(t, tc.addr, a.EncodeAddress())
+			require.True(t, a.IsForNet(tc.params))
+
+			script, err := PayToAddrScript(a)
+			require.NoError(t, err)
+			require.Equal(t, tc.scriptPubKey, hex.EncodeToString(script))
+			require.Equal(t, tc.scriptType, ScriptType(script))
+
+			addr, err := ScriptAddress(script, tc.params)
+			require.NoError(t, err)
+			require.Equal(t, tc.addr, addr)
+		})
+	}
+}
+
+func TestScriptAddressNonStandard(t *testing.T) {
+	script, err := hex.DecodeString("6a04aa21a9ed")
+	require.NoError(t, err)
+
+	addr, err := ScriptAddress(script, &chaincfg.MainNetParams)
+	require.NoError(t, err)
+	require.Empty(t, addr)
+	require.Equal(t, "nonstandard", ScriptType(script))
+}
+
+func TestPubKeyAddress(t *testing.T) {
+	// The public key of private key 1
+	pubkey, err := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	require.NoError(t, err)
+
+	cases := []struct {
+		addrType string
+		params   *chaincfg.Params
+		addr     string
+	}{
+		{TypeP2PKH, &chaincfg.MainNetParams, "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+		{TypeP2WPKH, &chaincfg.MainNetParams, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+		{TypeP2SHP2WPKH, &chaincfg.MainNetParams, "3JvL6Ymt8MVWiCNHC7oWU6nLeHNJKLZGLN"},
+		{TypeP2WPKH, &chaincfg.TestNet3Params, "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.addrType, func(t *testing.T) {
+			a, err := PubKeyAddress(pubkey, tc.addrType, tc.params)
+			require.NoError(t, err)
+			require.Equal(t, tc.addr, a.EncodeAddress())
+			require.NoError(t, Validate(a.EncodeAddress(), tc.params))
+		})
+	}
+
+	_, err = PubKeyAddress(pubkey, "p2tr", &chaincfg.MainNetParams)
+	require.Error(t, err)
+}
@@ -0,0 +1,85 @@
+// Package ethutil provides ethereum address helpers
+package ethutil
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	// ErrInvalidAddress is returned if an address is not a 20 byte hex string
+	ErrInvalidAddress = errors.New("Invalid ethereum address")
+	// ErrInvalidChecksum is returned if a mixed case address has an invalid EIP-55 checksum
+	ErrInvalidChecksum = errors.New("Invalid ethereum address checksum")
+)
+
+// addressLength is the length of an ethereum address in bytes
+const addressLength = 20
+
+// ChecksumAddress returns the EIP-55 mixed case checksum encoding of an address.
+// The address must be a 0x prefixed 20 byte hex string. It is not validated against
+// its own checksum, use ValidateAddress for that.
+func ChecksumAddress(addr string) (string, error) {
+	if !IsHexAddress(addr) {
+		return "", ErrInvalidAddress
+	}
+
+	lower := strings.ToLower(addr[2:])
+	hash := hex.EncodeToString(Keccak256([]byte(lower)))
+
+	checksummed := []byte(lower)
+	for i, c := range checksummed {
+		if c >= 'a' && c <= 'f' && hash[i] >= '8' {
+			checksummed[i] = c - 'a' + 'A'
+		}
+	}
+
+	return "0x" + string(checksummed), nil
+}
+
+// Keccak256 returns the legacy Keccak-256 hash of data, as used by Ethereum.
+// It differs from the standardized SHA3-256 in its padding.
+func Keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data) // nolint: errcheck
+	return h.Sum(nil)
+}
+
+// IsHexAddress returns true if addr is a 0x prefixed 20 byte hex string
+func IsHexAddress(addr string) bool {
+	if len(addr) != 2+2*addressLength {
+		return false
+	}
+
+	if addr[:2] != "0x" && addr[:2] != "0X" {
+		return false
+	}
+
+	_, err := hex.DecodeString(addr[2:])
+	return err == nil
+}
+
+// ValidateAddress returns an error if addr is not a valid ethereum address.
+// All lower case and all upper case addresses have no checksum,
+// mixed case addresses must have a valid EIP-55 checksum.
+func ValidateAddress(addr string) error {
+	checksummed, err := ChecksumAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	hexPart := addr[2:]
+	if hexPart == strings.ToLower(hexPart) || hexPart == strings.ToUpper(hexPart) {
+		return nil
+	}
+
+	if "0x"+hexPart != checksummed {
+		return fmt.Errorf("%v: expected %s", ErrInvalidChecksum, checksummed)
+	}
+
+	return nil
+}
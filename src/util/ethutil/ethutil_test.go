@@ -0,0 +1,94 @@
+package ethutil
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeccak256(t *testing.T) {
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{
+			"",
+			"c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470",
+		},
+		{
+			"abc",
+			"4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45",
+		},
+		{
+			"The quick brown fox jumps over the lazy dog",
+			"4d741b6f1eb29cb2a9b9911c82f56fa8d73b04959d3d9d222895df6c0b28aa15",
+		},
+	}
+
+	for _, tc := range cases {
+		h := Keccak256([]byte(tc.in))
+		require.Equal(t, tc.out, hex.EncodeToString(h))
+	}
+}
+
+func TestChecksumAddress(t *testing.T) {
+	// Test vectors from EIP-55
+	addrs := []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	}
+
+	for _, addr := range addrs {
+		t.Run(addr, func(t *testing.T) {
+			checksummed, err := ChecksumAddress(addr)
+			require.NoError(t, err)
+			require.Equal(t, addr, checksummed)
+
+			checksummed, err = ChecksumAddress("0x" + hex.EncodeToString(mustDecodeHex(t, addr[2:])))
+			require.NoError(t, err)
+			require.Equal(t, addr, checksummed)
+
+			require.NoError(t, ValidateAddress(addr))
+		})
+	}
+
+	_, err := ChecksumAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeA")
+	require.Equal(t, ErrInvalidAddress, err)
+}
+
+func TestValidateAddress(t *testing.T) {
+	cases := []struct {
+		name string
+		addr string
+		err  bool
+	}{
+		{"lower case", "0x77720eeb0be8b4060636e4f8e77b178ace343e11", false},
+		{"upper case", "0x77720EEB0BE8B4060636E4F8E77B178ACE343E11", false},
+		{"valid checksum", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", false},
+		{"invalid checksum", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD", true},
+		{"no prefix", "5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed00", true},
+		{"too short", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeA", true},
+		{"not hex", "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeg", true},
+		{"empty", "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateAddress(tc.addr)
+			if tc.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
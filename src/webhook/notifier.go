@@ -0,0 +1,197 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/config"
+)
+
+// Notifier sends the pending events of the outbox to the webhook url
+type Notifier struct {
+	log    logrus.FieldLogger
+	cfg    config.Webhook
+	store  *Store
+	client *http.Client
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewNotifier creates a Notifier
+func NewNotifier(log logrus.FieldLogger, cfg config.Webhook, store *Store) (*Notifier, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Notifier{
+		log:   log.WithField("prefix", "teller.webhook"),
+		cfg:   cfg,
+		store: store,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Run sends the pending events every SendPeriod
+func (n *Notifier) Run() error {
+	log := n.log
+	log.Info("Start webhook service...")
+	defer func() {
+		log.Info("Closed webhook service")
+		close(n.done)
+	}()
+
+	ticker := time.NewTicker(n.cfg.SendPeriod)
+	defer ticker.Stop()
+
+	for {
+		n.sendEvents()
+
+		select {
+		case <-n.quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops a previous call to Run
+func (n *Notifier) Shutdown() {
+	n.log.Info("Shutting down Notifier")
+	close(n.quit)
+	n.log.Info("Waiting for run to finish")
+	<-n.done
+	n.log.Info("Shutdown complete")
+}
+
+// sendEvents sends the pending events that are due, in the order they were emitted.
+// It stops at the first failure, so that a receiver that is down does not get later events first.
+func (n *Notifier) sendEvents() {
+	now := time.Now().UTC().Unix()
+	ds, err := n.store.GetPendingDeliveries()
+	if err != nil {
+		n.log.WithError(err).Error("GetPendingDeliveries failed")
+		return
+	}
+
+	for _, d := range ds {
+		select {
+		case <-n.quit:
+			return
+		default:
+		}
+
+		if d.NextAttempt > now {
+			return
+		}
+
+		log := n.log.WithFields(logrus.Fields{
+			"eventID":   d.Event.ID,
+			"eventType": d.Event.Type,
+		})
+
+		sendErr := n.send(d.Event)
+
+		d, err := n.store.UpdateDelivery(d.Event.ID, func(d Delivery) Delivery {
+			return n.recordAttempt(d, sendErr, time.Now().UTC())
+		})
+		if err != nil {
+			log.WithError(err).Error("UpdateDelivery failed")
+			return
+		}
+
+		if sendErr != nil {
+			log.WithError(sendErr).WithFields(logrus.Fields{
+				"attempts": d.Attempts,
+				"status":   d.Status,
+			}).Error("Send webhook failed")
+			return
+		}
+
+		log.Info("Webhook delivered")
+	}
+}
+
+// recordAttempt records the result of a delivery attempt. Failed deliveries are retried
+// with an exponential backoff, until MaxAttempts is reached.
+func (n *Notifier) recordAttempt(d Delivery, sendErr error, now time.Time) Delivery {
+	d.Attempts++
+
+	if sendErr == nil {
+		d.Status = DeliveryDelivered
+		d.DeliveredAt = now.Unix()
+		d.LastError = ""
+		return d
+	}
+
+	d.LastError = sendErr.Error()
+
+	if d.Attempts >= n.cfg.MaxAttempts {
+		d.Status = DeliveryFailed
+		return d
+	}
+
+	d.NextAttempt = now.Add(n.retryWait(d.Attempts)).Unix()
+	return d
+}
+
+// retryWait returns how long to wait after a number of failed attempts
+func (n *Notifier) retryWait(attempts int) time.Duration {
+	wait := n.cfg.RetryWait
+	for i := 1; i < attempts && wait < n.cfg.MaxRetryWait; i++ {
+		wait *= 2
+	}
+
+	if wait > n.cfg.MaxRetryWait {
+		return n.cfg.MaxRetryWait
+	}
+
+	return wait
+}
+
+// send posts an event to the webhook url. Any 2xx response is a successful delivery.
+// The signature covers the time of this attempt, not the time the event was created.
+func (n *Notifier) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(e.Type))
+	req.Header.Set(DeliveryHeader, e.ID)
+	timestamp := time.Now().UTC().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(n.cfg.Secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Read the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body) // nolint: errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook url responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+
+	"github.com/kittycash/teller/src/util/dbutil"
+)
+
+var (
+	// OutboxBkt maps an event ID to a Delivery.
+	// The IDs are zero padded sequence numbers, so the events are iterated in the order they were emitted.
+	OutboxBkt = []byte("webhook_outbox")
+
+	// PendingBkt indexes the IDs of the pending deliveries, so that the delivered and failed
+	// events of the outbox are not read again every time the pending events are sent
+	PendingBkt = []byte("webhook_pending")
+)
+
+// DeliveryStatus is the status of an event delivery
+type DeliveryStatus string
+
+const (
+	// DeliveryPending the event is waiting to be sent
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered the event was accepted by the webhook url
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed the event could not be delivered in the max number of attempts
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// ValidDeliveryStatus returns true if s is a delivery status
+func ValidDeliveryStatus(s DeliveryStatus) bool {
+	switch s {
+	case DeliveryPending, DeliveryDelivered, DeliveryFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Delivery records an event and its delivery attempts
+type Delivery struct {
+	Event       Event          `json:"event"`
+	Status      DeliveryStatus `json:"status"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt int64          `json:"next_attempt"`
+	LastError   string         `json:"last_error"`
+	DeliveredAt int64          `json:"delivered_at"`
+}
+
+// DeliveryFilter filters deliveries
+type DeliveryFilter func(d Delivery) bool
+
+// Store is the outbox of events
+type Store struct {
+	db  *bolt.DB
+	log logrus.FieldLogger
+}
+
+// NewStore creates a Store
+func NewStore(log logrus.FieldLogger, db *bolt.DB) (*Store, error) {
+	if db == nil {
+		return nil, errors.New("new webhook Store failed, db is nil")
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(OutboxBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(OutboxBkt, err)
+		}
+
+		if tx.Bucket(PendingBkt) != nil {
+			return nil
+		}
+
+		if _, err := tx.CreateBucket(PendingBkt); err != nil {
+			return dbutil.NewCreateBucketFailedErr(PendingBkt, err)
+		}
+
+		// Index the pending deliveries of an outbox created before the index
+		return dbutil.ForEach(tx, OutboxBkt, func(k, v []byte) error {
+			var d Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+
+			return putDeliveryTx(tx, d)
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		db:  db,
+		log: log.WithField("prefix", "webhook.Store"),
+	}, nil
+}
+
+// EmitTx saves an event in the outbox within a db transaction
+func (s *Store) EmitTx(tx *bolt.Tx, eventType EventType, data interface{}) error {
+	v, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encode event data failed: %v", err)
+	}
+
+	seq, err := dbutil.NextSequence(tx, OutboxBkt)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Unix()
+	d := Delivery{
+		Event: Event{
+			ID:        fmt.Sprintf("%020d", seq),
+			Type:      eventType,
+			CreatedAt: now,
+			Data:      v,
+		},
+		Status:      DeliveryPending,
+		NextAttempt: now,
+	}
+
+	return putDeliveryTx(tx, d)
+}
+
+// putDeliveryTx saves a delivery in the outbox, and adds it to or removes it from the pending index
+func putDeliveryTx(tx *bolt.Tx, d Delivery) error {
+	if err := dbutil.PutBucketValue(tx, OutboxBkt, d.Event.ID, d); err != nil {
+		return err
+	}
+
+	if d.Status == DeliveryPending {
+		return tx.Bucket(PendingBkt).Put([]byte(d.Event.ID), []byte{})
+	}
+
+	return tx.Bucket(PendingBkt).Delete([]byte(d.Event.ID))
+}
+
+// GetPendingDeliveries returns the pending deliveries, in the order the events were emitted.
+// Only the pending index is iterated, not the whole outbox.
+func (s *Store) GetPendingDeliveries() ([]Delivery, error) {
+	var ds []Delivery
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEach(tx, PendingBkt, func(k, v []byte) error {
+			var d Delivery
+			if err := dbutil.GetBucketObject(tx, OutboxBkt, string(k), &d); err != nil {
+				return err
+			}
+
+			ds = append(ds, d)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// GetDeliveries returns the deliveries that match the filter, in the order the events were emitted
+func (s *Store) GetDeliveries(flt DeliveryFilter) ([]Delivery, error) {
+	var ds []Delivery
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return dbutil.ForEach(tx, OutboxBkt, func(k, v []byte) error {
+			var d Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+
+			if flt(d) {
+				ds = append(ds, d)
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// UpdateDelivery updates the delivery of an event. The update func takes a Delivery
+// and returns a modified copy of it.
+func (s *Store) UpdateDelivery(id string, update func(Delivery) Delivery) (Delivery, error) {
+	var d Delivery
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := dbutil.GetBucketObject(tx, OutboxBkt, id, &d); err != nil {
+			return err
+		}
+
+		d = update(d)
+
+		return putDeliveryTx(tx, d)
+	}); err != nil {
+		return Delivery{}, err
+	}
+
+	return d, nil
+}
+
+// Replay sends an event again, whether it was delivered or failed
+func (s *Store) Replay(id string) (Delivery, error) {
+	return s.UpdateDelivery(id, func(d Delivery) Delivery {
+		d.Status = DeliveryPending
+		d.Attempts = 0
+		d.NextAttempt = time.Now().UTC().Unix()
+		d.LastError = ""
+		d.DeliveredAt = 0
+		return d
+	})
+}
@@ -0,0 +1,88 @@
+// Package webhook notifies an external service of reservation and deposit events.
+// Events are saved in an outbox bucket in the same db transaction as the change
+// they describe, and are then sent as signed HTTP POST requests until they are delivered.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// EventType is the type of an event
+type EventType string
+
+const (
+	// EventReservationCreated a kitty was reserved
+	EventReservationCreated EventType = "reservation.created"
+	// EventReservationExpired a reservation expired before it was paid, the kitty is available again
+	EventReservationExpired EventType = "reservation.expired"
+	// EventDepositSeen a deposit was received
+	EventDepositSeen EventType = "deposit.seen"
+	// EventDepositPartial a deposit paid part of the price of a kitty
+	EventDepositPartial EventType = "deposit.partial"
+	// EventDepositPaid a deposit completed the payment of a kitty
+	EventDepositPaid EventType = "deposit.paid"
+	// EventDepositRefund a deposit is refunded
+	EventDepositRefund EventType = "deposit.refund"
+	// EventDepositOrphaned a deposit was orphaned by a chain reorganization
+	EventDepositOrphaned EventType = "deposit.orphaned"
+	// EventKittySent the kitty of a paid reservation was sent to its owner
+	EventKittySent EventType = "kitty.sent"
+	// EventKittyConfirmed the transaction sending a kitty was confirmed
+	EventKittyConfirmed EventType = "kitty.confirmed"
+)
+
+const (
+	// SignatureHeader is the header with the signature of the request timestamp and body
+	SignatureHeader = "X-Teller-Signature"
+	// TimestampHeader is the header with the unix time the request was sent at. It is signed with the body,
+	// so that a receiver can reject a captured request that is replayed later.
+	TimestampHeader = "X-Teller-Timestamp"
+	// EventHeader is the header with the event type
+	EventHeader = "X-Teller-Event"
+	// DeliveryHeader is the header with the event ID, which can be used to ignore duplicate deliveries
+	DeliveryHeader = "X-Teller-Delivery"
+)
+
+// Event is the body of a webhook request
+type Event struct {
+	ID        string          `json:"id"`
+	Type      EventType       `json:"type"`
+	CreatedAt int64           `json:"created_at"`
+	Data      json.RawMessage `json:"data"` // the reservation or deposit info, depending on the event type
+}
+
+// Emitter records events to be sent
+type Emitter interface {
+	// EmitTx records an event within a db transaction, so that it is only sent if the tx is committed
+	EmitTx(tx *bolt.Tx, eventType EventType, data interface{}) error
+}
+
+type discard struct{}
+
+func (discard) EmitTx(tx *bolt.Tx, eventType EventType, data interface{}) error {
+	return nil
+}
+
+// Discard is an Emitter that drops all events, used when webhooks are disabled
+var Discard Emitter = discard{}
+
+// Sign returns the signature of a request, "sha256=" followed by the hex encoded HMAC-SHA256
+// of the timestamp in decimal, a "." and the body
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + ".")) // nolint: gas
+	mac.Write(body)                                           // nolint: gas
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature of a request timestamp and body, in constant time.
+// The receiver should also check that the timestamp is recent.
+func VerifySignature(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
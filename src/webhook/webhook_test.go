@@ -0,0 +1,303 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kittycash/teller/src/config"
+	"github.com/kittycash/teller/src/util/dbutil"
+	"github.com/kittycash/teller/src/util/testutil"
+)
+
+var errSend = errors.New("send failed")
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	db, shutdown := testutil.PrepareDB(t)
+
+	log, _ := testutil.NewLogger(t)
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+
+	return s, shutdown
+}
+
+func emit(t *testing.T, s *Store, eventType EventType, data interface{}) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.EmitTx(tx, eventType, data)
+	})
+	require.NoError(t, err)
+}
+
+func allDeliveries(t *testing.T, s *Store) []Delivery {
+	ds, err := s.GetDeliveries(func(Delivery) bool { return true })
+	require.NoError(t, err)
+	return ds
+}
+
+func pendingDeliveries(t *testing.T, s *Store) []Delivery {
+	ds, err := s.GetPendingDeliveries()
+	require.NoError(t, err)
+	return ds
+}
+
+type receiver struct {
+	sync.Mutex
+	secret string
+	fail   bool
+	events []Event
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	if rc.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Reject requests that are not recent, or not signed with the secret
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > 5*time.Minute ||
+		!VerifySignature(rc.secret, timestamp, body, r.Header.Get(SignatureHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get(EventHeader) != string(e.Type) || r.Header.Get(DeliveryHeader) != e.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rc.events = append(rc.events, e)
+}
+
+func (rc *receiver) setFail(fail bool) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.fail = fail
+}
+
+func newTestNotifier(t *testing.T, s *Store, url string) *Notifier {
+	log, _ := testutil.NewLogger(t)
+	n, err := NewNotifier(log, config.Webhook{
+		Enabled:      true,
+		URL:          url,
+		Secret:       "secret",
+		SendPeriod:   time.Second,
+		Timeout:      time.Second,
+		RetryWait:    time.Minute,
+		MaxRetryWait: time.Hour,
+		MaxAttempts:  3,
+	}, s)
+	require.NoError(t, err)
+	return n
+}
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"id":"00000000000000000001"}`)
+	sig := Sign("secret", 1520000000, body)
+	require.Equal(t, "sha256=", sig[:7])
+	require.Len(t, sig, 7+64)
+
+	require.True(t, VerifySignature("secret", 1520000000, body, sig))
+	require.False(t, VerifySignature("other", 1520000000, body, sig))
+	require.False(t, VerifySignature("secret", 1520000000, []byte(`{"id":"00000000000000000002"}`), sig))
+	require.False(t, VerifySignature("secret", 1520000000, body, ""))
+
+	// The timestamp is signed, so a replayed request can't be made fresh
+	require.False(t, VerifySignature("secret", 1520000001, body, sig))
+}
+
+func TestStoreEmit(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	emit(t, s, EventReservationCreated, map[string]string{"kitty_id": "1"})
+	emit(t, s, EventDepositSeen, map[string]string{"deposit_id": "t1:0"})
+
+	// events of a rolled back tx are dropped
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.EmitTx(tx, EventDepositPaid, nil); err != nil {
+			return err
+		}
+		return bolt.ErrTxNotWritable
+	})
+	require.Equal(t, bolt.ErrTxNotWritable, err)
+
+	ds := allDeliveries(t, s)
+	require.Len(t, ds, 2)
+	require.Equal(t, "00000000000000000001", ds[0].Event.ID)
+	require.Equal(t, EventReservationCreated, ds[0].Event.Type)
+	require.JSONEq(t, `{"kitty_id":"1"}`, string(ds[0].Event.Data))
+	require.Equal(t, DeliveryPending, ds[0].Status)
+	require.Equal(t, "00000000000000000002", ds[1].Event.ID)
+	require.Equal(t, EventDepositSeen, ds[1].Event.Type)
+	require.Equal(t, ds, pendingDeliveries(t, s))
+
+	_, err = s.Replay("00000000000000000003")
+	require.IsType(t, dbutil.ObjectNotExistErr{}, err)
+}
+
+func TestNotifierSendEvents(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	rc := &receiver{secret: "secret"}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	n := newTestNotifier(t, s, srv.URL)
+
+	emit(t, s, EventReservationCreated, map[string]string{"kitty_id": "1"})
+	emit(t, s, EventDepositSeen, map[string]string{"deposit_id": "t1:0"})
+
+	n.sendEvents()
+
+	require.Len(t, rc.events, 2)
+	require.Equal(t, EventReservationCreated, rc.events[0].Type)
+	require.Equal(t, EventDepositSeen, rc.events[1].Type)
+
+	for _, d := range allDeliveries(t, s) {
+		require.Equal(t, DeliveryDelivered, d.Status)
+		require.Equal(t, 1, d.Attempts)
+		require.NotZero(t, d.DeliveredAt)
+	}
+
+	// delivered events are not sent again
+	require.Empty(t, pendingDeliveries(t, s))
+	n.sendEvents()
+	require.Len(t, rc.events, 2)
+
+	// unless they are replayed
+	d, err := s.Replay("00000000000000000001")
+	require.NoError(t, err)
+	require.Equal(t, DeliveryPending, d.Status)
+	require.Equal(t, 0, d.Attempts)
+	require.Equal(t, []Delivery{d}, pendingDeliveries(t, s))
+
+	n.sendEvents()
+	require.Len(t, rc.events, 3)
+	require.Equal(t, "00000000000000000001", rc.events[2].ID)
+}
+
+func TestNotifierRetry(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	rc := &receiver{secret: "secret", fail: true}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	n := newTestNotifier(t, s, srv.URL)
+
+	emit(t, s, EventReservationCreated, map[string]string{"kitty_id": "1"})
+	emit(t, s, EventDepositSeen, map[string]string{"deposit_id": "t1:0"})
+
+	n.sendEvents()
+
+	// the batch stops at the first failure, so the events are received in order
+	ds := allDeliveries(t, s)
+	require.Equal(t, DeliveryPending, ds[0].Status)
+	require.Equal(t, 1, ds[0].Attempts)
+	require.Equal(t, "webhook url responded with status 500", ds[0].LastError)
+	require.True(t, ds[0].NextAttempt > time.Now().Unix())
+	require.Equal(t, 0, ds[1].Attempts)
+
+	// the failed event is not retried before its next attempt
+	rc.setFail(false)
+	n.sendEvents()
+	require.Empty(t, rc.events)
+
+	// the event fails after MaxAttempts
+	rc.setFail(true)
+	now := time.Now().UTC()
+	d := ds[0]
+	for i := 0; i < 2; i++ {
+		d = n.recordAttempt(d, errSend, now)
+	}
+	require.Equal(t, DeliveryFailed, d.Status)
+	require.Equal(t, 3, d.Attempts)
+
+	_, err := s.UpdateDelivery(d.Event.ID, func(Delivery) Delivery { return d })
+	require.NoError(t, err)
+
+	// failed events don't block the next events
+	rc.setFail(false)
+	n.sendEvents()
+	require.Len(t, rc.events, 1)
+	require.Equal(t, EventDepositSeen, rc.events[0].Type)
+
+	ds = allDeliveries(t, s)
+	require.Equal(t, DeliveryFailed, ds[0].Status)
+	require.Equal(t, DeliveryDelivered, ds[1].Status)
+	require.Empty(t, pendingDeliveries(t, s))
+}
+
+func TestStorePendingIndex(t *testing.T) {
+	db, shutdown := testutil.PrepareDB(t)
+	defer shutdown()
+
+	log, _ := testutil.NewLogger(t)
+	s, err := NewStore(log, db)
+	require.NoError(t, err)
+
+	emit(t, s, EventReservationCreated, map[string]string{"kitty_id": "1"})
+	emit(t, s, EventDepositSeen, map[string]string{"deposit_id": "t1:0"})
+	emit(t, s, EventDepositPaid, map[string]string{"deposit_id": "t1:0"})
+
+	_, err = s.UpdateDelivery("00000000000000000002", func(d Delivery) Delivery {
+		d.Status = DeliveryDelivered
+		return d
+	})
+	require.NoError(t, err)
+
+	// An outbox saved before the pending index existed is indexed when the store is created
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(PendingBkt)
+	})
+	require.NoError(t, err)
+
+	s, err = NewStore(log, db)
+	require.NoError(t, err)
+
+	ds := pendingDeliveries(t, s)
+	require.Len(t, ds, 2)
+	require.Equal(t, "00000000000000000001", ds[0].Event.ID)
+	require.Equal(t, "00000000000000000003", ds[1].Event.ID)
+}
+
+func TestNotifierRetryWait(t *testing.T) {
+	s, shutdown := newTestStore(t)
+	defer shutdown()
+
+	n := newTestNotifier(t, s, "http://127.0.0.1:1")
+
+	require.Equal(t, time.Minute, n.retryWait(1))
+	require.Equal(t, 2*time.Minute, n.retryWait(2))
+	require.Equal(t, 32*time.Minute, n.retryWait(6))
+	require.Equal(t, time.Hour, n.retryWait(7))
+	require.Equal(t, time.Hour, n.retryWait(100))
+}